@@ -8,6 +8,7 @@ import (
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util"
+	"io"
 	"net/url"
 	"os"
 	"strconv"
@@ -60,24 +61,21 @@ func run(_context *context.Context, identifierLike string, maxFiles int) {
 	if identifierLike != "" {
 		params.Set("identifier_like", identifierLike)
 	}
-	for {
-		resp := _context.PharosClient.GenericFileList(params)
-		if resp.Error != nil {
+	options := network.PagingOptions{Prefetch: true}
+	iterator := _context.PharosClient.GenericFileIterator(params, options)
+	for itemsAdded < maxFiles {
+		gf, err := iterator.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
 			fmt.Fprintln(os.Stderr,
-				"Error getting GenericFile list from Pharos: ",
-				resp.Error)
-			fmt.Fprintln(os.Stderr, resp.Request.URL)
-		}
-		for _, gf := range resp.GenericFiles() {
-			writeCSV(gf)
-			itemsAdded += 1
-		}
-		writer.Flush()
-		if resp.HasNextPage() == false || itemsAdded >= maxFiles {
+				"Error getting GenericFile list from Pharos: ", err)
 			break
 		}
-		params = resp.ParamsForNextPage()
+		writeCSV(gf)
+		itemsAdded += 1
 	}
+	writer.Flush()
 }
 
 func writeCSV(gf *models.GenericFile) {
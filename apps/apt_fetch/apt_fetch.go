@@ -30,6 +30,7 @@ func main() {
 
 	fetcher := workers.NewAPTFetcher(_context)
 	consumer.AddHandler(fetcher)
+	workers.StopOnSignal(_context, consumer)
 	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
 
 	// This reader blocks until we get an interrupt, so our program does not exit.
@@ -28,6 +28,7 @@ func main() {
 
 	deleter := workers.NewAPTFileDeleter(_context)
 	consumer.AddHandler(deleter)
+	workers.StopOnSignal(_context, consumer)
 	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
 
 	// This reader blocks until we get an interrupt, so our program does not exit.
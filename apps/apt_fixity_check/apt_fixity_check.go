@@ -29,6 +29,7 @@ func main() {
 
 	worker := workers.NewAPTFixityChecker(_context)
 	consumer.AddHandler(worker)
+	workers.StopOnSignal(_context, consumer)
 	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
 
 	// This reader blocks until we get an interrupt, so our program does not exit.
@@ -31,6 +31,7 @@ func main() {
 
 	restorer := workers.NewGlacierRestore(_context)
 	consumer.AddHandler(restorer)
+	workers.StopOnSignal(_context, consumer)
 	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
 
 	// This reader blocks until we get an interrupt, so our program does not exit.
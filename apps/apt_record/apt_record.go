@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/workers"
+	"github.com/nsqio/go-nsq"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // apt_record records IntellectualObjects, GenericFiles, PremisEvents
@@ -14,12 +19,15 @@ import (
 // in S3/Glacier by apt_store. This is the third and last step in the
 // ingest process.
 func main() {
-	pathToConfigFile := parseCommandLine()
+	pathToConfigFile, pathToCassette := parseCommandLine()
 	config, err := models.LoadConfigFile(pathToConfigFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, err.Error())
 		os.Exit(1)
 	}
+	if pathToCassette != "" {
+		os.Exit(replay(config, pathToCassette))
+	}
 	_context := context.NewContext(config)
 	_context.MessageLog.Info("Connecting to NSQLookupd at %s", _context.Config.NsqLookupd)
 	_context.MessageLog.Info("NSQDHttpAddress is %s", _context.Config.NsqdHttpAddress)
@@ -32,21 +40,76 @@ func main() {
 
 	recorder := workers.NewAPTRecorder(_context)
 	consumer.AddHandler(recorder)
+	workers.StopOnSignal(_context, consumer)
 	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
 
 	// This reader blocks until we get an interrupt, so our program does not exit.
 	<-consumer.StopChan
 }
 
-func parseCommandLine() (configFile string) {
-	var pathToConfigFile string
+// replay re-runs the WorkItem recorded in the cassette, answering
+// Pharos and S3 requests from the cassette instead of the network,
+// and returns the exit code.
+func replay(config *models.Config, pathToCassette string) int {
+	cassette, err := network.LoadCassette(pathToCassette)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	workItemId, err := strconv.Atoi(strings.TrimPrefix(cassette.Name, "workitem_"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cassette name %s does not include a WorkItem id\n", cassette.Name)
+		return 1
+	}
+	// Don't record the replay, and keep the validation
+	// database, so the item can be replayed again.
+	config.CassetteDirectory = ""
+	config.DeleteOnSuccess = false
+	config.RecordWorker.Workers = 1
+	_context := context.NewContext(config)
+	_context.ReplayCassette(cassette)
+	_context.MessageLog.Info("Replaying %d requests for WorkItem %d from cassette %s",
+		cassette.Len(), workItemId, pathToCassette)
+
+	recorder := workers.NewAPTRecorder(_context)
+	recorder.Done = make(chan *models.IngestState, 1)
+	var id nsq.MessageID
+	copy(id[:], fmt.Sprintf("replay%d", workItemId))
+	message := nsq.NewMessage(id, []byte(strconv.Itoa(workItemId)))
+	message.Delegate = replayDelegate{}
+	if err = recorder.HandleMessage(message); err != nil {
+		fmt.Fprintf(os.Stderr, "Replay of WorkItem %d failed: %v\n", workItemId, err)
+		return 1
+	}
+	ingestState := <-recorder.Done
+	result := ingestState.IngestManifest.RecordResult
+	fmt.Printf("Replayed WorkItem %d. %d of %d recorded requests were not replayed.\n",
+		workItemId, cassette.Unplayed(), cassette.Len())
+	if result.HasErrors() {
+		fmt.Printf("Record errors:\n%s\n", result.AllErrorsAsString())
+		return 1
+	}
+	return 0
+}
+
+// replayDelegate stands in for the NSQ connection that would
+// normally receive the message's Finish, Requeue and Touch calls.
+type replayDelegate struct{}
+
+func (replayDelegate) OnFinish(*nsq.Message)                       {}
+func (replayDelegate) OnRequeue(*nsq.Message, time.Duration, bool) {}
+func (replayDelegate) OnTouch(*nsq.Message)                        {}
+
+func parseCommandLine() (configFile, cassetteFile string) {
+	var pathToConfigFile, pathToCassette string
 	flag.StringVar(&pathToConfigFile, "config", "", "Path to APTrust config file")
+	flag.StringVar(&pathToCassette, "replay", "", "Path to a cassette to replay")
 	flag.Parse()
 	if pathToConfigFile == "" {
 		printUsage()
 		os.Exit(1)
 	}
-	return pathToConfigFile
+	return pathToConfigFile, pathToCassette
 }
 
 // Tell the user about the program.
@@ -54,9 +117,15 @@ func printUsage() {
 	message := `
 apt_record: Records objects, files, events and checksums in Pharos.
 
-Usage: apt_record -config=<absolute path to APTrust config file>
+Usage: apt_record -config=<absolute path to APTrust config file> [-replay=<path to cassette>]
 
 Param -config is required.
+
+Param -replay re-runs the WorkItem recorded in a cassette, answering
+Pharos and S3 requests from the cassette instead of sending them.
+Cassettes are recorded when CassetteDirectory is set in the config.
+The WorkItem's validation database must still be in the staging
+area. A replay does not delete it.
 `
 	fmt.Println(message)
 }
@@ -29,6 +29,7 @@ func main() {
 
 	restorer := workers.NewAPTRestorer(_context)
 	consumer.AddHandler(restorer)
+	workers.StopOnSignal(_context, consumer)
 	consumer.ConnectToNSQLookupd(_context.Config.NsqLookupd)
 
 	// This reader blocks until we get an interrupt, so our program does not exit.
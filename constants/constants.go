@@ -10,6 +10,10 @@ import (
 // the .tar suffix, you'll have a name like "my_bag.b04.of12"
 var MultipartSuffix = regexp.MustCompile("\\.b\\d+\\.of\\d+$")
 
+// SerializedBagSuffix matches the file extensions of the serialized
+// bags we can read: tar files, gzipped tar files and zip files.
+var SerializedBagSuffix = regexp.MustCompile("\\.(tar|tar\\.gz|tgz|zip)$")
+
 // APTrustFileNamePattern matches a valid APTrust file name, according to the spec at
 // https://sites.google.com/a/aptrust.org/member-wiki/basic-operations/bagging
 // This regex says a valid file name can be exactly one alpha-numeric character,
@@ -128,6 +132,9 @@ const (
 	StorageGlacierDeepOR = "Glacier-Deep-OR"
 )
 
+// StorageOptions lists the storage options we offer when the config
+// has no StorageOptions table. Workers get the storage options from
+// Config.StorageOptionNames, so adding one doesn't require a change here.
 var StorageOptions []string = []string{
 	StorageStandard,
 	StorageGlacierVA,
@@ -156,10 +163,21 @@ var GlacierDeepOptions []string = []string{
 
 const (
 	AlgMd5    = "md5"
+	AlgSha1   = "sha1"
 	AlgSha256 = "sha256"
+	AlgSha512 = "sha512"
 )
 
-var ChecksumAlgorithms = []string{AlgMd5, AlgSha256}
+var ChecksumAlgorithms = []string{AlgMd5, AlgSha1, AlgSha256, AlgSha512}
+
+// DigestLengths maps each supported checksum algorithm to the
+// length of its hex-encoded digest.
+var DigestLengths = map[string]int{
+	AlgMd5:    32,
+	AlgSha1:   40,
+	AlgSha256: 64,
+	AlgSha512: 128,
+}
 
 const (
 	IdTypeStorageURL = "url"
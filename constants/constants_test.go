@@ -16,6 +16,17 @@ func TestMultipartSuffix(t *testing.T) {
 	assert.False(t, pattern.MatchString("bag.bag02of04"), errShouldNotMatch)
 }
 
+func TestSerializedBagSuffix(t *testing.T) {
+	pattern := constants.SerializedBagSuffix
+	assert.True(t, pattern.MatchString("bag.tar"), errShouldMatch)
+	assert.True(t, pattern.MatchString("bag.tar.gz"), errShouldMatch)
+	assert.True(t, pattern.MatchString("bag.tgz"), errShouldMatch)
+	assert.True(t, pattern.MatchString("bag.zip"), errShouldMatch)
+	assert.False(t, pattern.MatchString("bag.gz"), errShouldNotMatch)
+	assert.False(t, pattern.MatchString("bag.tar.bz2"), errShouldNotMatch)
+	assert.False(t, pattern.MatchString("bag_tar"), errShouldNotMatch)
+}
+
 func TestAPTrustFileNamePattern(t *testing.T) {
 	pattern := constants.APTrustFileNamePattern
 	assert.True(t, pattern.MatchString("file_NAm3.is-valid"), errShouldMatch)
@@ -0,0 +1,85 @@
+package context
+
+import (
+	stdcontext "context"
+	"github.com/APTrust/exchange/network"
+	"path/filepath"
+)
+
+// Sets up the Pharos and S3 transports to record cassettes, if
+// Config.CassetteDirectory is set. The Pharos response cache is
+// turned off, because responses served from the cache never reach
+// the transport, so a replay would not have them.
+func (context *Context) initRecording() {
+	if context.Config.CassetteDirectory == "" {
+		return
+	}
+	if context.PharosClient.Cache() != nil {
+		context.MessageLog.Info("Turning off the Pharos cache while recording cassettes")
+		context.PharosClient.SetCache(nil)
+	}
+	context.PharosClient.SetRoundTripper(&network.RecordingTransport{
+		Transport: context.PharosClient.RoundTripper(),
+		Service:   "pharos",
+	})
+	network.SetS3RoundTripper(&network.RecordingTransport{Service: "s3"})
+	context.MessageLog.Info("Recording cassettes in %s", context.Config.CassetteDirectory)
+}
+
+// Recording returns true if workers should record cassettes.
+func (context *Context) Recording() bool {
+	return context.Config.CassetteDirectory != ""
+}
+
+// StartCassette returns a context that records the Pharos and S3
+// requests sent with it into a new cassette with the specified name.
+// The context is cancelled when the process shuts down. If recording
+// is off, StartCassette returns a context that doesn't record.
+// Call SaveCassette when the item is done.
+func (context *Context) StartCassette(name string) stdcontext.Context {
+	if !context.Recording() {
+		return context.shutdownContext()
+	}
+	return network.WithCassette(context.shutdownContext(), network.NewCassette(name))
+}
+
+// SaveCassette writes the cassette attached to ctx, if there is
+// one, to the CassetteDirectory. The file name includes the time
+// recording started, so each attempt at an item gets its own file.
+// It returns the path to the file, or an empty string if there was
+// nothing to save or the save failed. Failures are logged, but they
+// don't affect the item.
+func (context *Context) SaveCassette(ctx stdcontext.Context) string {
+	cassette := network.CassetteFrom(ctx)
+	if cassette == nil || !context.Recording() {
+		return ""
+	}
+	fileName := cassette.Name + "_" + cassette.RecordedAt.Format("20060102T150405") + ".json"
+	path := filepath.Join(context.Config.CassetteDirectory, fileName)
+	if err := cassette.Save(path); err != nil {
+		context.MessageLog.Warning("Cannot save cassette %s: %v", path, err)
+		return ""
+	}
+	context.MessageLog.Info("Saved %d requests to cassette %s", cassette.Len(), path)
+	return path
+}
+
+// ReplayCassette makes the PharosClient and new S3 sessions answer
+// requests from cassette, instead of sending them over the network.
+// This is for re-running a recorded WorkItem offline. There's no
+// way to undo it, so use it only in a process that does nothing else.
+func (context *Context) ReplayCassette(cassette *network.Cassette) {
+	context.PharosClient.SetCache(nil)
+	context.PharosClient.SetRoundTripper(&network.ReplayTransport{Cassette: cassette, Service: "pharos"})
+	network.SetS3RoundTripper(&network.ReplayTransport{Cassette: cassette, Service: "s3"})
+}
+
+// PharosClientFor returns a copy of the PharosClient that sends its
+// requests with ctx, so they are recorded into ctx's cassette. If ctx
+// is nil, it returns the PharosClient.
+func (context *Context) PharosClientFor(ctx stdcontext.Context) *network.PharosClient {
+	if ctx == nil {
+		return context.PharosClient
+	}
+	return context.PharosClient.WithContext(ctx)
+}
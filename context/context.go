@@ -1,6 +1,7 @@
 package context
 
 import (
+	stdcontext "context"
 	"fmt"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
@@ -10,6 +11,7 @@ import (
 	stdlog "log"
 	"os"
 	"sync/atomic"
+	"time"
 )
 
 /*
@@ -25,10 +27,15 @@ type Context struct {
 	NSQClient     *network.NSQClient
 	PharosClient  *network.PharosClient
 	VolumeClient  *network.VolumeClient
+	Institutions  *InstitutionRegistry
 	pathToLogFile string
 	pathToJsonLog string
 	succeeded     int64
 	failed        int64
+	storage       storageProviders
+
+	shutdown       stdcontext.Context
+	cancelShutdown stdcontext.CancelFunc
 }
 
 /*
@@ -47,28 +54,129 @@ func NewContext(config *models.Config) (context *Context) {
 		succeeded: int64(0),
 		failed:    int64(0),
 	}
+	context.shutdown, context.cancelShutdown = stdcontext.WithCancel(stdcontext.Background())
 	context.Config = config
 	context.MessageLog, context.pathToLogFile = logger.InitLogger(config)
 	context.JsonLog, context.pathToJsonLog = logger.InitJsonLogger(config)
 	context.VolumeClient = network.NewVolumeClient(context.Config.VolumeServicePort)
 	context.NSQClient = network.NewNSQClient(context.Config.NsqdHttpAddress)
 	context.initPharosClient()
+	context.initRecording()
+	context.initStorageProviders()
+	context.initInstitutionRegistry()
 	return context
 }
 
+// Sets up the institution registry. Workers call Institutions.Start
+// to load it, and pass it to the models that need to know who owns
+// a bucket.
+func (context *Context) initInstitutionRegistry() {
+	refresh := DefaultInstitutionRefresh
+	if context.Config.InstitutionRefresh != "" {
+		var err error
+		refresh, err = time.ParseDuration(context.Config.InstitutionRefresh)
+		if err != nil {
+			message := fmt.Sprintf("Exiting. Invalid InstitutionRefresh in config: %v", err)
+			fmt.Fprintln(os.Stderr, message)
+			context.MessageLog.Fatal(message)
+		}
+	}
+	context.Institutions = NewInstitutionRegistry(context, refresh)
+}
+
 // Initializes a reusable Pharos client.
 func (context *Context) initPharosClient() {
-	pharosClient, err := network.NewPharosClient(
-		context.Config.PharosURL,
-		context.Config.PharosAPIVersion,
+	auth, err := network.PharosAuthenticatorFromConfig(
+		context.Config.PharosAuth,
 		os.Getenv("PHAROS_API_USER"),
 		os.Getenv("PHAROS_API_KEY"))
+	if err != nil {
+		message := fmt.Sprintf("Exiting. Invalid Pharos auth settings in config: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		context.MessageLog.Fatal(message)
+	}
+	pharosClient, err := network.NewPharosClientWithAuth(
+		context.Config.PharosURL,
+		context.Config.PharosAPIVersion,
+		auth)
 	if err != nil {
 		message := fmt.Sprintf("Exiting. Cannot initialize Pharos Client: %v", err)
 		fmt.Fprintln(os.Stderr, message)
 		context.MessageLog.Fatal(message)
 	}
-	context.PharosClient = pharosClient
+	retryPolicy, err := network.RetryPolicyFromConfig(context.Config.PharosRetry)
+	if err != nil {
+		message := fmt.Sprintf("Exiting. Invalid Pharos retry settings in config: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		context.MessageLog.Fatal(message)
+	}
+	pharosClient.SetRetryPolicy(retryPolicy)
+	cache, err := network.PharosCacheFromConfig(context.Config.PharosCache)
+	if err != nil {
+		message := fmt.Sprintf("Exiting. Invalid Pharos cache settings in config: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		context.MessageLog.Fatal(message)
+	}
+	pharosClient.SetCache(cache)
+	if context.Config.PharosSchemaDirectory != "" {
+		schemas, err := network.LoadPharosSchemas(context.Config.PharosSchemaDirectory)
+		if err != nil {
+			message := fmt.Sprintf("Exiting. Cannot load Pharos schemas: %v", err)
+			fmt.Fprintln(os.Stderr, message)
+			context.MessageLog.Fatal(message)
+		}
+		pharosClient.SetSchemas(schemas)
+	}
+	// Pharos requests in progress stop when the process shuts down.
+	context.PharosClient = pharosClient.WithContext(context.shutdownContext())
+	if len(context.Config.PharosAPIVersions) > 0 {
+		version, err := context.PharosClient.NegotiateAPIVersion(context.Config.PharosAPIVersions...)
+		if err != nil {
+			context.MessageLog.Warning("%v. Using Pharos API %s.",
+				err, context.PharosClient.APIVersion())
+		} else {
+			context.MessageLog.Info("Using Pharos API %s", version)
+		}
+	}
+}
+
+// shutdownContext returns the context that Shutdown cancels.
+func (context *Context) shutdownContext() stdcontext.Context {
+	if context.shutdown == nil {
+		return stdcontext.Background()
+	}
+	return context.shutdown
+}
+
+// Shutdown cancels all network requests in progress that use
+// this Context's PharosClient or a context from NetworkContext.
+// Workers call this when the process is told to stop.
+func (context *Context) Shutdown() {
+	if context.cancelShutdown != nil {
+		context.cancelShutdown()
+	}
+}
+
+// ShuttingDown returns true if Shutdown has been called.
+func (context *Context) ShuttingDown() bool {
+	return context.shutdownContext().Err() != nil
+}
+
+// NetworkContext returns a context for the network requests a worker
+// makes while processing one item. The context is cancelled when the
+// process shuts down, or when the worker's MessageTimeout passes,
+// since NSQ will have given the item to another worker by then.
+// If workerConfig is nil, or its MessageTimeout is not a valid
+// duration, the context has no deadline. Call the cancel function
+// when the item is done, to release the context's resources.
+func (context *Context) NetworkContext(workerConfig *models.WorkerConfig) (stdcontext.Context, stdcontext.CancelFunc) {
+	if workerConfig != nil {
+		timeout, err := time.ParseDuration(workerConfig.MessageTimeout)
+		if err == nil && timeout > 0 {
+			return stdcontext.WithTimeout(context.shutdownContext(), timeout)
+		}
+	}
+	return stdcontext.WithCancel(context.shutdownContext())
 }
 
 // Returns the number of work items that succeeded.
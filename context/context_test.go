@@ -3,12 +3,17 @@ package context_test
 import (
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/network/pharostest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewContext(t *testing.T) {
@@ -63,3 +68,75 @@ func TestGetS3Client(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, client)
 }
+
+func TestNetworkContext(t *testing.T) {
+	configFile := filepath.Join("config", "test.json")
+	appConfig, err := models.LoadConfigFile(configFile)
+	require.Nil(t, err)
+	appConfig.LogToStderr = false
+	_context := context.NewContext(appConfig)
+
+	ctx, cancel := _context.NetworkContext(&models.WorkerConfig{MessageTimeout: "30m"})
+	deadline, hasDeadline := ctx.Deadline()
+	assert.True(t, hasDeadline)
+	assert.True(t, deadline.After(time.Now().Add(29*time.Minute)))
+	cancel()
+	assert.NotNil(t, ctx.Err())
+	assert.False(t, _context.ShuttingDown())
+
+	ctx, cancel = _context.NetworkContext(nil)
+	defer cancel()
+	_, hasDeadline = ctx.Deadline()
+	assert.False(t, hasDeadline)
+
+	_context.Shutdown()
+	assert.True(t, _context.ShuttingDown())
+	assert.NotNil(t, ctx.Err())
+	assert.NotNil(t, _context.PharosClient.Context().Err())
+}
+
+func TestCassettes(t *testing.T) {
+	fake := pharostest.NewFakePharos()
+	defer fake.Close()
+	defer network.SetS3RoundTripper(nil)
+	fake.AddInstitution(&models.Institution{Name: "Test University", Identifier: "test.edu"})
+	tempDir, err := ioutil.TempDir("", "context_cassette_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	appConfig, err := models.LoadConfigFile(filepath.Join("config", "test.json"))
+	require.Nil(t, err)
+	appConfig.LogToStderr = false
+	appConfig.PharosURL = fake.URL
+	appConfig.PharosAPIVersion = "v2"
+	appConfig.PharosCache = models.PharosCacheConfig{MaxEntries: 10, TTL: "1m"}
+	appConfig.CassetteDirectory = tempDir
+	_context := context.NewContext(appConfig)
+	assert.True(t, _context.Recording())
+	assert.Nil(t, _context.PharosClient.Cache())
+
+	ctx := _context.StartCassette("workitem_7")
+	require.Nil(t, _context.PharosClientFor(ctx).InstitutionGet("test.edu").Error)
+	require.Nil(t, _context.PharosClient.InstitutionGet("test.edu").Error)
+	assert.Equal(t, _context.PharosClient, _context.PharosClientFor(nil))
+	path := _context.SaveCassette(ctx)
+	require.NotEmpty(t, path)
+	assert.Equal(t, tempDir, filepath.Dir(path))
+	assert.True(t, strings.HasPrefix(filepath.Base(path), "workitem_7_"))
+
+	// With recording off, there's no cassette to save.
+	_context.Config.CassetteDirectory = ""
+	assert.Nil(t, network.CassetteFrom(_context.StartCassette("workitem_8")))
+	assert.Empty(t, _context.SaveCassette(ctx))
+
+	cassette, err := network.LoadCassette(path)
+	require.Nil(t, err)
+	assert.Equal(t, 1, cassette.Len())
+	fake.Close()
+
+	_context.ReplayCassette(cassette)
+	resp := _context.PharosClient.InstitutionGet("test.edu")
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "test.edu", resp.Institution().Identifier)
+	assert.Equal(t, 0, cassette.Unplayed())
+}
@@ -0,0 +1,217 @@
+package context
+
+import (
+	stdcontext "context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/util"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultInstitutionRefresh is how often an InstitutionRegistry
+// reloads institutions from Pharos when Config.InstitutionRefresh
+// is not set.
+const DefaultInstitutionRefresh = 15 * time.Minute
+
+// InstitutionRegistry holds the list of institutions from Pharos, and
+// maps bucket names to the institutions that own them. It reloads the
+// list periodically, so new institutions show up without restarting
+// the workers. It's safe for concurrent use.
+//
+// Until the registry has loaded institutions from Pharos, and for
+// buckets Pharos doesn't know about, OwnerOf and RestorationBucketFor
+// fall back to the bucket naming rules in util.
+type InstitutionRegistry struct {
+	context         *Context
+	refreshInterval time.Duration
+	startOnce       sync.Once
+
+	mutex         sync.RWMutex
+	byIdentifier  map[string]*models.Institution
+	ownerOfBucket map[string]string
+	loadedAt      time.Time
+}
+
+// NewInstitutionRegistry returns a registry that loads institutions
+// with the context's PharosClient, and reloads them every
+// refreshInterval after Start is called. A refreshInterval of zero
+// or less means never reload. The registry is empty until Load or
+// Start is called.
+func NewInstitutionRegistry(context *Context, refreshInterval time.Duration) *InstitutionRegistry {
+	return &InstitutionRegistry{
+		context:         context,
+		refreshInterval: refreshInterval,
+		byIdentifier:    make(map[string]*models.Institution),
+		ownerOfBucket:   make(map[string]string),
+	}
+}
+
+// Start loads institutions from Pharos, and then reloads them every
+// refresh interval until the context shuts down.
+// If Pharos can't be reached, Start logs a warning and the registry
+// falls back to the bucket naming rules until a reload succeeds.
+// Calling Start more than once has no effect, so every worker can
+// call it.
+func (registry *InstitutionRegistry) Start() {
+	registry.startOnce.Do(func() {
+		if err := registry.Load(); err != nil {
+			registry.context.MessageLog.Warning("Cannot load institutions from Pharos. "+
+				"Using bucket naming rules until Pharos responds: %v", err)
+		}
+		if registry.refreshInterval > 0 {
+			go registry.refresh()
+		}
+	})
+}
+
+// refresh reloads the institutions every refresh interval. It keeps
+// the old list if a reload fails.
+func (registry *InstitutionRegistry) refresh() {
+	ticker := time.NewTicker(registry.refreshInterval)
+	defer ticker.Stop()
+	done := registry.context.shutdownContext().Done()
+	for {
+		select {
+		case <-ticker.C:
+			if err := registry.Load(); err != nil {
+				registry.context.MessageLog.Warning("Cannot reload institutions from Pharos. "+
+					"Keeping the list loaded at %s: %v",
+					registry.LoadedAt().Format(time.RFC3339), err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Load replaces the registry's institutions with the current list
+// from Pharos. If it can't get the whole list, it returns an error
+// and leaves the registry unchanged.
+func (registry *InstitutionRegistry) Load() error {
+	return registry.LoadWithContext(nil)
+}
+
+// LoadWithContext is like Load, but it sends its Pharos requests with
+// ctx, so they are recorded into ctx's cassette. If ctx is nil, it
+// uses the context's PharosClient as it is.
+func (registry *InstitutionRegistry) LoadWithContext(ctx stdcontext.Context) error {
+	pharosClient := registry.context.PharosClientFor(ctx)
+	institutions := make([]*models.Institution, 0)
+	params := url.Values{}
+	params.Set("page", "1")
+	params.Set("per_page", "100")
+	for params != nil {
+		resp := pharosClient.InstitutionList(params)
+		if resp.Error != nil {
+			return resp.Error
+		}
+		institutions = append(institutions, resp.Institutions()...)
+		params = resp.ParamsForNextPage()
+	}
+	registry.set(institutions)
+	registry.context.MessageLog.Info("Loaded %d institutions and their bucket names", len(institutions))
+	return nil
+}
+
+func (registry *InstitutionRegistry) set(institutions []*models.Institution) {
+	byIdentifier := make(map[string]*models.Institution)
+	ownerOfBucket := make(map[string]string)
+	for _, inst := range institutions {
+		byIdentifier[inst.Identifier] = inst
+		if inst.ReceivingBucket != "" {
+			ownerOfBucket[inst.ReceivingBucket] = inst.Identifier
+		}
+		if inst.RestoreBucket != "" {
+			ownerOfBucket[inst.RestoreBucket] = inst.Identifier
+		}
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.byIdentifier = byIdentifier
+	registry.ownerOfBucket = ownerOfBucket
+	registry.loadedAt = time.Now()
+}
+
+// LoadedAt returns the time of the last successful load, or the
+// zero time if the registry has never loaded.
+func (registry *InstitutionRegistry) LoadedAt() time.Time {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return registry.loadedAt
+}
+
+// Institution returns the institution with the specified identifier,
+// or nil if the registry doesn't know it.
+func (registry *InstitutionRegistry) Institution(identifier string) *models.Institution {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return registry.byIdentifier[identifier]
+}
+
+// Institutions returns all of the institutions in the registry.
+func (registry *InstitutionRegistry) Institutions() []*models.Institution {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	institutions := make([]*models.Institution, 0, len(registry.byIdentifier))
+	for _, inst := range registry.byIdentifier {
+		institutions = append(institutions, inst)
+	}
+	return institutions
+}
+
+// OwnerOfBucket returns the identifier of the institution that owns
+// the specified receiving or restoration bucket, and true if the
+// registry knows the bucket.
+func (registry *InstitutionRegistry) OwnerOfBucket(bucketName string) (string, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	identifier, ok := registry.ownerOfBucket[bucketName]
+	return identifier, ok
+}
+
+// RestoreBucketFor returns the name of the specified institution's
+// restoration bucket, and true if the registry knows the institution.
+func (registry *InstitutionRegistry) RestoreBucketFor(identifier string) (string, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	inst := registry.byIdentifier[identifier]
+	if inst == nil || inst.RestoreBucket == "" {
+		return "", false
+	}
+	return inst.RestoreBucket, true
+}
+
+// OwnerOf returns the identifier of the institution that owns the
+// specified bucket, falling back to the bucket naming rules if the
+// registry doesn't know the bucket. This implements util.BucketOwners.
+func (registry *InstitutionRegistry) OwnerOf(bucketName string) string {
+	if identifier, ok := registry.OwnerOfBucket(bucketName); ok {
+		return identifier
+	}
+	registry.warnIfNotLoaded("owner of bucket " + bucketName)
+	return util.OwnerOf(bucketName)
+}
+
+// RestorationBucketFor returns the name of the specified institution's
+// restoration bucket. See util.RestorationBucketFor for a description
+// of restoreToTestBuckets.
+func (registry *InstitutionRegistry) RestorationBucketFor(identifier string, restoreToTestBuckets bool) string {
+	if !restoreToTestBuckets {
+		if bucket, ok := registry.RestoreBucketFor(identifier); ok {
+			return bucket
+		}
+		registry.warnIfNotLoaded("restoration bucket for " + identifier)
+	}
+	return util.RestorationBucketFor(identifier, restoreToTestBuckets)
+}
+
+// warnIfNotLoaded logs a warning if we're about to use the bucket
+// naming rules because we haven't been able to load institutions from
+// Pharos. Buckets that don't follow the rules will come out wrong.
+func (registry *InstitutionRegistry) warnIfNotLoaded(what string) {
+	if registry.LoadedAt().IsZero() {
+		registry.context.MessageLog.Warning("Institutions have not been loaded from Pharos. "+
+			"Using bucket naming rules to find the %s.", what)
+	}
+}
@@ -0,0 +1,128 @@
+package context_test
+
+import (
+	stdcontext "context"
+	"fmt"
+	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/network/pharostest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// contextWithFakePharos returns a context whose PharosClient talks
+// to a FakePharos that knows about a dozen institutions, so listing
+// them takes two pages.
+func contextWithFakePharos(t *testing.T) (*context.Context, *pharostest.FakePharos) {
+	appConfig, err := models.LoadConfigFile(filepath.Join("config", "test.json"))
+	require.Nil(t, err)
+	appConfig.LogToStderr = false
+	_context := context.NewContext(appConfig)
+
+	fake := pharostest.NewFakePharos()
+	for i := 0; i < 12; i++ {
+		fake.AddInstitution(&models.Institution{
+			Name:            fmt.Sprintf("College %d", i),
+			Identifier:      fmt.Sprintf("college%d.edu", i),
+			ReceivingBucket: fmt.Sprintf("incoming-%d", i),
+			RestoreBucket:   fmt.Sprintf("outgoing-%d", i),
+		})
+	}
+	_context.PharosClient, err = network.NewPharosClient(fake.URL, "v2", "user", "key")
+	require.Nil(t, err)
+	return _context, fake
+}
+
+func TestInstitutionRegistry(t *testing.T) {
+	_context, fake := contextWithFakePharos(t)
+	defer fake.Close()
+	registry := _context.Institutions
+	require.NotNil(t, registry)
+
+	// Before loading, we fall back to the naming rules.
+	assert.True(t, registry.LoadedAt().IsZero())
+	assert.Equal(t, "", registry.OwnerOf("incoming-11"))
+	assert.Equal(t, "unc.edu", registry.OwnerOf("aptrust.receiving.unc.edu"))
+	assert.Equal(t, "aptrust.restore.college3.edu", registry.RestorationBucketFor("college3.edu", false))
+
+	require.Nil(t, registry.Load())
+	assert.False(t, registry.LoadedAt().IsZero())
+	assert.Equal(t, 12, len(registry.Institutions()))
+	assert.Equal(t, "College 11", registry.Institution("college11.edu").Name)
+	assert.Equal(t, "college11.edu", registry.OwnerOf("incoming-11"))
+	assert.Equal(t, "college11.edu", registry.OwnerOf("outgoing-11"))
+	assert.Equal(t, "unc.edu", registry.OwnerOf("aptrust.receiving.unc.edu"))
+	assert.Equal(t, "outgoing-3", registry.RestorationBucketFor("college3.edu", false))
+	assert.Equal(t, "aptrust.restore.test.college3.edu", registry.RestorationBucketFor("college3.edu", true))
+
+	// Models get the same owners when we pass them the registry.
+	manifest := &models.IngestManifest{S3Bucket: "incoming-11", S3Key: "bag.tar"}
+	objIdentifier, err := manifest.ObjectIdentifier(registry)
+	require.Nil(t, err)
+	assert.Equal(t, "college11.edu/bag", objIdentifier)
+
+	// If Pharos goes away, we keep what we have.
+	fake.Close()
+	policy := network.DefaultRetryPolicy()
+	policy.MaxAttempts = 1
+	_context.PharosClient.SetRetryPolicy(policy)
+	assert.NotNil(t, registry.Load())
+	assert.Equal(t, "college11.edu", registry.OwnerOf("incoming-11"))
+}
+
+func TestInstitutionRegistry_LoadWithContext(t *testing.T) {
+	_context, fake := contextWithFakePharos(t)
+	defer fake.Close()
+	defer network.SetS3RoundTripper(nil)
+	_context.PharosClient.SetRoundTripper(&network.RecordingTransport{
+		Transport: _context.PharosClient.RoundTripper(),
+		Service:   "pharos",
+	})
+	cassette := network.NewCassette("workitem_1")
+	ctx := network.WithCassette(stdcontext.Background(), cassette)
+	err := _context.Institutions.LoadWithContext(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 1, cassette.Len())
+	fake.Close()
+
+	// A replay loads the institutions from the cassette.
+	replayContext := context.NewContext(_context.Config)
+	replayContext.PharosClient, err = network.NewPharosClient(fake.URL, "v2", "user", "key")
+	require.Nil(t, err)
+	replayContext.ReplayCassette(cassette)
+	require.Nil(t, replayContext.Institutions.Load())
+	assert.Equal(t, "college11.edu", replayContext.Institutions.OwnerOf("incoming-11"))
+	assert.Equal(t, 0, cassette.Unplayed())
+}
+
+func TestInstitutionRegistry_Refresh(t *testing.T) {
+	_context, fake := contextWithFakePharos(t)
+	defer fake.Close()
+	registry := context.NewInstitutionRegistry(_context, 20*time.Millisecond)
+	registry.Start()
+	registry.Start()
+	assert.Equal(t, 12, len(registry.Institutions()))
+
+	// New institutions show up without a restart.
+	fake.AddInstitution(&models.Institution{
+		Name:            "New College",
+		Identifier:      "new.edu",
+		ReceivingBucket: "incoming-new",
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for registry.Institution("new.edu") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "new.edu", registry.OwnerOf("incoming-new"))
+
+	// Shutdown stops the refresh.
+	_context.Shutdown()
+	time.Sleep(30 * time.Millisecond)
+	loadedAt := registry.LoadedAt()
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, loadedAt, registry.LoadedAt())
+}
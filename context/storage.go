@@ -0,0 +1,90 @@
+package context
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"os"
+	"sync"
+)
+
+// storageProviders caches StorageProviders by name and region.
+type storageProviders struct {
+	mutex     sync.Mutex
+	providers map[string]network.StorageProvider
+}
+
+// Checks the storage provider settings, so we find out about bad
+// endpoints, missing CA files and unknown provider names when the
+// worker starts, instead of when it first stores or restores a file.
+func (context *Context) initStorageProviders() {
+	for name, providerConfig := range context.Config.StorageProviders {
+		if _, err := network.StorageProviderFromConfig(name, providerConfig, ""); err != nil {
+			message := fmt.Sprintf("Exiting. Invalid storage provider settings in config: %v", err)
+			fmt.Fprintln(os.Stderr, message)
+			context.MessageLog.Fatal(message)
+		}
+	}
+	for _, err := range context.Config.ValidateStorageOptions() {
+		message := fmt.Sprintf("Exiting. Invalid storage option settings in config: %v", err)
+		fmt.Fprintln(os.Stderr, message)
+		context.MessageLog.Fatal(message)
+	}
+	for _, name := range context.Config.StorageOptionNames() {
+		option, _ := context.Config.StorageOption(name)
+		targets := append([]models.StorageTarget{option.StorageTarget}, option.ReplicationTargets...)
+		for _, target := range targets {
+			if _, ok := context.Config.StorageProviders[target.Provider]; !ok &&
+				target.Provider != "" && target.Provider != network.StorageTypeAWS {
+				message := fmt.Sprintf("Exiting. Storage option %s is stored in %s, "+
+					"which is not in StorageProviders", name, target.Provider)
+				fmt.Fprintln(os.Stderr, message)
+				context.MessageLog.Fatal(message)
+			}
+		}
+	}
+}
+
+// StorageProviderFor returns the provider that holds the bucket
+// described by target, set up for the target's region.
+func (context *Context) StorageProviderFor(target models.StorageTarget) (network.StorageProvider, error) {
+	name := target.Provider
+	if name == "" {
+		name = network.StorageTypeAWS
+	}
+	return context.StorageProvider(name, target.Region)
+}
+
+// StorageProvider returns the provider with the specified name from
+// Config.StorageProviders, set up for buckets in region. The name
+// "aws" means AWS, with credentials from the environment, unless
+// StorageProviders says otherwise.
+func (context *Context) StorageProvider(name, region string) (network.StorageProvider, error) {
+	context.storage.mutex.Lock()
+	defer context.storage.mutex.Unlock()
+	cacheKey := name + "/" + region
+	if provider := context.storage.providers[cacheKey]; provider != nil {
+		return provider, nil
+	}
+	var provider network.StorageProvider
+	providerConfig, ok := context.Config.StorageProviders[name]
+	if ok {
+		var err error
+		provider, err = network.StorageProviderFromConfig(name, providerConfig, region)
+		if err != nil {
+			return nil, err
+		}
+	} else if name == network.StorageTypeAWS {
+		provider = network.NewAWSStorage(name,
+			context.Config.GetAWSAccessKeyId(),
+			context.Config.GetAWSSecretAccessKey(),
+			region)
+	} else {
+		return nil, fmt.Errorf("Unknown storage provider %s", name)
+	}
+	if context.storage.providers == nil {
+		context.storage.providers = make(map[string]network.StorageProvider)
+	}
+	context.storage.providers[cacheKey] = provider
+	return provider, nil
+}
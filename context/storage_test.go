@@ -0,0 +1,83 @@
+package context_test
+
+import (
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStorageProviderFor(t *testing.T) {
+	fake := network.NewFakeS3()
+	defer fake.Close()
+	fake.CreateBucket("glacier-oh")
+
+	appConfig, err := models.LoadConfigFile(filepath.Join("config", "test.json"))
+	require.Nil(t, err)
+	appConfig.LogToStderr = false
+	os.Setenv("MINIO_KEY_ID", "minio-key")
+	os.Setenv("MINIO_SECRET", "minio-secret")
+	defer os.Unsetenv("MINIO_KEY_ID")
+	defer os.Unsetenv("MINIO_SECRET")
+	appConfig.StorageProviders = map[string]models.StorageProviderConfig{
+		"minio": {
+			Type:               "s3",
+			Endpoint:           fake.URL,
+			PathStyle:          true,
+			Region:             "us-east-1",
+			AccessKeyIdVar:     "MINIO_KEY_ID",
+			SecretAccessKeyVar: "MINIO_SECRET",
+		},
+	}
+	appConfig.StorageOptions = []models.StorageOptionConfig{
+		{
+			Name: constants.StorageStandard,
+			StorageTarget: models.StorageTarget{
+				Region: constants.AWSVirginia,
+				Bucket: "preservation",
+			},
+		},
+		{
+			Name: "Wasabi-OH",
+			StorageTarget: models.StorageTarget{
+				Provider: "minio",
+				Region:   constants.AWSOhio,
+				Bucket:   "glacier-oh",
+			},
+		},
+	}
+	_context := context.NewContext(appConfig)
+
+	option, err := appConfig.StorageOption(constants.StorageStandard)
+	require.Nil(t, err)
+	provider, err := _context.StorageProviderFor(option.StorageTarget)
+	require.Nil(t, err)
+	assert.IsType(t, &network.AWSStorage{}, provider)
+	assert.Equal(t, "aws", provider.Name())
+	assert.Equal(t, constants.AWSVirginia, provider.Region())
+
+	option, err = appConfig.StorageOption("Wasabi-OH")
+	require.Nil(t, err)
+	provider, err = _context.StorageProviderFor(option.StorageTarget)
+	require.Nil(t, err)
+	assert.Equal(t, "minio", provider.Name())
+	assert.Equal(t, "us-east-1", provider.Region())
+	same, err := _context.StorageProviderFor(option.StorageTarget)
+	require.Nil(t, err)
+	assert.True(t, provider == same)
+
+	upload := provider.Put("glacier-oh", "uuid", "text/plain")
+	upload.Send(strings.NewReader("data"))
+	require.Empty(t, upload.ErrorMessage)
+	assert.Equal(t, "data", string(fake.Object("glacier-oh", "uuid").Data))
+
+	_, err = _context.StorageProvider("wasabi", constants.AWSVirginia)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Unknown storage provider wasabi")
+}
@@ -67,7 +67,7 @@ func fetcherTestGoodBagResult(t *testing.T, bagName string, ingestManifest *mode
 		"ValidateResult.Retry should be true for %s", bagName)
 
 	// We should have a valid IntellectualObject and files.
-	objIdentifier, err := ingestManifest.ObjectIdentifier()
+	objIdentifier, err := ingestManifest.ObjectIdentifier(nil)
 	require.Nil(t, err)
 	db, err := storage.NewBoltDB(ingestManifest.DBPath)
 	require.Nil(t, err)
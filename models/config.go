@@ -76,6 +76,213 @@ type WorkerConfig struct {
 	// a write to the NSQ server to complete before timing out.
 	// The format is the same as for HeartbeatInterval.
 	WriteTimeout string
+
+	// DownloadConcurrency is the number of ranges of a file to fetch
+	// at once when downloading from preservation storage. Zero or one
+	// means fetch each file in a single stream. Multiple streams are
+	// much faster for very large files. See network.S3Download.
+	DownloadConcurrency int
+
+	// DownloadPartSize is the size in bytes of the ranges, when
+	// DownloadConcurrency is more than one. Zero means
+	// network.DefaultDownloadPartSize.
+	DownloadPartSize int64
+}
+
+// PharosRetryConfig describes how the Pharos client retries requests
+// that fail because of network errors or 5xx responses, and when it
+// stops calling Pharos altogether because Pharos appears to be down.
+// Zero values and empty strings mean use the defaults in
+// network.DefaultRetryPolicy. Durations use the same format as
+// WorkerConfig.HeartbeatInterval.
+type PharosRetryConfig struct {
+	// The maximum number of times to try a request, including
+	// the first try. Set to 1 to disable retries.
+	MaxAttempts int
+
+	// How long to wait before the first retry. The wait doubles
+	// after each failed retry, up to MaxBackoff.
+	InitialBackoff string
+
+	// The longest we'll wait between retries.
+	MaxBackoff string
+
+	// The number of consecutive failed requests that trip the
+	// circuit breaker. While the breaker is open, all Pharos
+	// requests from this process wait instead of hitting the
+	// server. Set to -1 to disable the circuit breaker.
+	CircuitBreakerThreshold int
+
+	// How long the circuit breaker stays open before we let
+	// a single request through to see if Pharos is back.
+	CircuitBreakerCooldown string
+
+	// How long a request will wait for an open circuit breaker
+	// to close before giving up and returning an error.
+	MaxCircuitWait string
+
+	// How long to wait for Pharos to respond to each attempt
+	// at a request. Empty means no timeout.
+	RequestTimeout string
+}
+
+// PharosAuthConfig describes how the Pharos client proves who it is.
+// The zero value means send PHAROS_API_USER and PHAROS_API_KEY from
+// the environment in request headers, as we always have.
+type PharosAuthConfig struct {
+	// Method is "header" to send the API user and key in request
+	// headers, or "token" to send a bearer token. Empty means "header".
+	Method string
+
+	// TokenFile is the path to a file containing the bearer token,
+	// for the "token" method. The client re-reads the file when it
+	// changes, so another process can rotate the token.
+	TokenFile string
+
+	// TokenURL is the URL of an endpoint that issues bearer tokens,
+	// for the "token" method when TokenFile is empty. The client sends
+	// PHAROS_API_USER and PHAROS_API_KEY, if set, in the same headers
+	// as the "header" method, and expects a JSON response with
+	// access_token and expires_in (seconds).
+	TokenURL string
+
+	// TokenRefresh is how often to get a new token from TokenURL
+	// when the endpoint does not say when its tokens expire. The
+	// format is the same as for WorkerConfig.HeartbeatInterval.
+	// Empty means five minutes.
+	TokenRefresh string
+
+	// ClientCertFile and ClientKeyFile are the paths to the PEM-encoded
+	// client certificate and private key for mutual TLS. Leave these
+	// empty if Pharos does not require client certificates. Client
+	// certificates work with either Method. The client reloads the
+	// certificate when the files change.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// CAFile is the path to a PEM file of certificate authorities
+	// to trust when checking the Pharos server's certificate, in
+	// addition to the system's. This is for mutual TLS only, so it
+	// requires ClientCertFile. Empty means use the system's only.
+	CAFile string
+}
+
+// PharosCacheConfig describes the Pharos client's response cache.
+// See network.PharosCache. The zero value turns caching off.
+type PharosCacheConfig struct {
+	// The maximum number of responses to cache. Zero turns
+	// caching off.
+	MaxEntries int
+
+	// How long to keep responses. The format is the same as for
+	// WorkerConfig.HeartbeatInterval. Empty means five minutes.
+	TTL string
+
+	// The types of records to cache, such as "Institution" or
+	// "GenericFile". Empty means Institution only.
+	Types []string
+}
+
+// StorageProviderConfig describes a service that holds preservation
+// copies. See network.StorageProviderFromConfig.
+type StorageProviderConfig struct {
+	// Type is "aws" for Amazon S3 and Glacier, or "s3" for any
+	// other service that implements the S3 API, such as Wasabi,
+	// MinIO or Ceph. Empty means "aws".
+	Type string
+
+	// Endpoint is the URL of the service, such as
+	// https://s3.wasabisys.com. It's required for type "s3".
+	Endpoint string
+
+	// Region, if set, is the region for all of this provider's
+	// buckets, overriding the region of the storage option.
+	// Many S3-compatible services have only one region.
+	Region string
+
+	// PathStyle puts bucket names in the URL path instead of the
+	// host name. MinIO and Ceph usually need this.
+	PathStyle bool
+
+	// CAFile is the path to a PEM file of certificate authorities
+	// to trust when checking the service's certificate, in addition
+	// to the system's. This is for on-premises services with their
+	// own CA. Empty means use the system's only.
+	CAFile string
+
+	// AccessKeyIdVar and SecretAccessKeyVar are the names of the
+	// environment variables that hold this provider's credentials.
+	// Empty means AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+	AccessKeyIdVar     string
+	SecretAccessKeyVar string
+
+	// NoMd5ETags means the ETags of this provider's objects are not
+	// md5 digests, so the storer can't use them to check that the
+	// provider has the data it sent. Set this for services that
+	// calculate ETags some other way, and for AWS buckets that
+	// encrypt objects with SSE-KMS by default.
+	NoMd5ETags bool
+}
+
+// StorageTarget is a bucket that holds copies of preserved files.
+type StorageTarget struct {
+	// Provider is the name of the service that holds the bucket:
+	// "aws", or the name of one of Config.StorageProviders.
+	// Empty means "aws".
+	Provider string
+
+	// Region is the region the bucket is in.
+	Region string
+
+	// Bucket is the name of the bucket.
+	Bucket string
+
+	// StorageClass is the storage class of the copies we upload,
+	// such as STANDARD, GLACIER or DEEP_ARCHIVE. Empty means the
+	// bucket's default, which may be changed by lifecycle rules.
+	StorageClass string
+
+	// RetrievalTier is the retrieval tier we ask for when we
+	// restore files from this bucket, such as Standard, Bulk or
+	// Expedited. Set this for buckets in Glacier or another cold
+	// storage tier. Empty means we can read files directly.
+	RetrievalTier string
+}
+
+// StorageOptionConfig describes one of the storage options depositors
+// choose with the Storage-Option tag in aptrust-info.txt. The storer
+// sends the primary copy of each file to the option's own bucket, and
+// a second copy to its replication target, if it has one. Restores,
+// fixity checks and deletions use the same buckets.
+type StorageOptionConfig struct {
+	// Name is the value of the Storage-Option tag, such
+	// as "Standard" or "Glacier-OH".
+	Name string
+
+	// StorageTarget is the bucket for the primary copy.
+	StorageTarget
+
+	// ReplicationTargets are the buckets for other copies.
+	// There may be at most one, since GenericFile records
+	// only one replication URL.
+	ReplicationTargets []StorageTarget
+}
+
+// GlacierTarget returns the bucket we restore from Glacier when we
+// need this storage option's files and they aren't in a bucket we
+// can read directly. That's the primary bucket, if it's in cold
+// storage, or else the first replication target that is. It returns
+// nil if no copy is in cold storage.
+func (option *StorageOptionConfig) GlacierTarget() *StorageTarget {
+	if option.RetrievalTier != "" {
+		return &option.StorageTarget
+	}
+	for i := range option.ReplicationTargets {
+		if option.ReplicationTargets[i].RetrievalTier != "" {
+			return &option.ReplicationTargets[i]
+		}
+	}
+	return nil
 }
 
 type Config struct {
@@ -116,6 +323,16 @@ type Config struct {
 	// load, this will save the server a lot of work.
 	BucketReaderCacheHours int
 
+	// CassetteDirectory, if set, turns on recording for workers that
+	// support it (currently apt_record). Those workers write every
+	// Pharos and S3 request they send for a WorkItem, with its
+	// response, to a cassette file named for the WorkItem in this
+	// directory. Cassettes can be replayed with apt_record -replay.
+	// Recording also turns off the Pharos response cache, so every
+	// request is recorded. This is for debugging. Leave it empty
+	// in production, except while chasing a specific failure.
+	CassetteDirectory string
+
 	// Should we delete the uploaded tar file from the receiving
 	// bucket after successfully processing this bag?
 	DeleteOnSuccess bool
@@ -171,6 +388,12 @@ type Config struct {
 	// Configuration options for apt_glacier_restore
 	GlacierRestoreWorker WorkerConfig
 
+	// InstitutionRefresh is how often workers reload the list of
+	// institutions, and their bucket names, from Pharos. The format
+	// is the same as for WorkerConfig.HeartbeatInterval. Empty means
+	// every 15 minutes.
+	InstitutionRefresh string
+
 	// LogDirectory is where we'll write our log files.
 	LogDirectory string
 
@@ -221,6 +444,31 @@ type Config struct {
 	// start with a v, like v1, v2.2, etc.
 	PharosAPIVersion string
 
+	// PharosAPIVersions, if set, lists the versions of the Pharos
+	// API the client may use, newest first. At startup, the client
+	// uses the newest one Pharos supports. If Pharos can't be reached,
+	// the client uses PharosAPIVersion.
+	PharosAPIVersions []string
+
+	// PharosAuth describes how the Pharos client authenticates.
+	// See PharosAuthConfig.
+	PharosAuth PharosAuthConfig
+
+	// PharosCache describes the Pharos client's response
+	// cache. See PharosCacheConfig.
+	PharosCache PharosCacheConfig
+
+	// PharosRetry describes how the Pharos client retries
+	// failed requests. See PharosRetryConfig.
+	PharosRetry PharosRetryConfig
+
+	// PharosSchemaDirectory is the directory containing the JSON
+	// schemas for each version of the Pharos API, usually
+	// config/pharos_schemas. If this is set, the Pharos client checks
+	// the records it sends and receives against the schemas. Relative
+	// paths are relative to EXCHANGE_HOME.
+	PharosSchemaDirectory string
+
 	// PharosURL is the URL of the Pharos server where
 	// we will be recording results and metadata. This should
 	// start with http:// or https://
@@ -270,6 +518,20 @@ type Config struct {
 	// items to test code changes.
 	SkipAlreadyProcessed bool
 
+	// StorageOptions lists the storage options depositors may
+	// choose, and where each one keeps its files. To add a storage
+	// option, add it here. If this is empty, the options are Standard
+	// and the Glacier and Glacier Deep Archive options in Virginia,
+	// Ohio and Oregon, with the buckets and regions in
+	// PreservationBucket, ReplicationBucket and the Glacier settings
+	// above.
+	StorageOptions []StorageOptionConfig
+
+	// StorageProviders describes the services, other than AWS,
+	// that can hold preservation copies, keyed by name. The names
+	// appear in the Provider settings of StorageOptions.
+	StorageProviders map[string]StorageProviderConfig
+
 	// Configuration options for apt_store
 	StoreWorker WorkerConfig
 
@@ -350,6 +612,12 @@ func (config *Config) EnsurePharosConfig() error {
 	if config.PharosURL == "" {
 		return fmt.Errorf("PharosUrl is missing from config file")
 	}
+	if config.PharosAuth.Method == "token" {
+		if config.PharosAuth.TokenFile == "" && config.PharosAuth.TokenURL == "" {
+			return fmt.Errorf("PharosAuth needs a TokenFile or TokenURL for the token method")
+		}
+		return nil
+	}
 	if os.Getenv("PHAROS_API_USER") == "" {
 		return fmt.Errorf("Environment variable PHAROS_API_USER is not set")
 	}
@@ -387,6 +655,16 @@ func (config *Config) ExpandFilePaths() {
 			config.BagValidationConfigFile = expanded
 		}
 	}
+	expanded, err = fileutil.ExpandTilde(config.CassetteDirectory)
+	if err == nil {
+		config.CassetteDirectory = expanded
+	}
+	if config.PharosSchemaDirectory != "" && !filepath.IsAbs(config.PharosSchemaDirectory) {
+		expanded, err = fileutil.RelativeToAbsPath(config.PharosSchemaDirectory)
+		if err == nil {
+			config.PharosSchemaDirectory = expanded
+		}
+	}
 }
 
 func (config *Config) createDirectories() error {
@@ -429,63 +707,161 @@ func (config *Config) createDirectories() error {
 	return nil
 }
 
-// TODO: Remove in favor of methods below that return maps.
+// StorageRegionAndBucketFor returns the region and bucket of the
+// primary copies of files with the specified storage option.
 func (config *Config) StorageRegionAndBucketFor(storageOption string) (region string, bucket string, err error) {
-	if storageOption == constants.StorageStandard {
-		region = config.APTrustS3Region
-		bucket = config.PreservationBucket
-	} else if storageOption == constants.StorageGlacierVA {
-		region = config.GlacierRegionVA
-		bucket = config.GlacierBucketVA
-	} else if storageOption == constants.StorageGlacierOH {
-		region = config.GlacierRegionOH
-		bucket = config.GlacierBucketOH
-	} else if storageOption == constants.StorageGlacierOR {
-		region = config.GlacierRegionOR
-		bucket = config.GlacierBucketOR
-	} else if storageOption == constants.StorageGlacierDeepVA {
-		region = config.GlacierRegionVA
-		bucket = config.GlacierDeepBucketVA
-	} else if storageOption == constants.StorageGlacierDeepOH {
-		region = config.GlacierRegionOH
-		bucket = config.GlacierDeepBucketOH
-	} else if storageOption == constants.StorageGlacierDeepOR {
-		region = config.GlacierRegionOR
-		bucket = config.GlacierDeepBucketOR
-	} else {
-		err = fmt.Errorf("Unknown Storage Option: %s", storageOption)
-	}
-	return region, bucket, err
+	option, err := config.StorageOption(storageOption)
+	if err != nil {
+		return "", "", err
+	}
+	return option.Region, option.Bucket, nil
+}
+
+// StorageOption returns the settings for the storage option with the
+// specified name. See StorageOptions.
+func (config *Config) StorageOption(name string) (*StorageOptionConfig, error) {
+	options := config.storageOptions()
+	for i := range options {
+		if options[i].Name == name {
+			return &options[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown Storage Option: %s", name)
+}
+
+// StorageTargetForBucket returns the primary or replication target
+// of any storage option whose bucket is the specified bucket. This
+// tells us how to reach copies stored at URLs in that bucket.
+func (config *Config) StorageTargetForBucket(bucket string) (*StorageTarget, error) {
+	options := config.storageOptions()
+	for i := range options {
+		if options[i].Bucket == bucket {
+			return &options[i].StorageTarget, nil
+		}
+		for j := range options[i].ReplicationTargets {
+			if options[i].ReplicationTargets[j].Bucket == bucket {
+				return &options[i].ReplicationTargets[j], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No storage option uses bucket %s", bucket)
+}
+
+// StorageOptionNames returns the names of all storage options,
+// which are the values allowed in the Storage-Option tag.
+func (config *Config) StorageOptionNames() []string {
+	options := config.storageOptions()
+	names := make([]string, len(options))
+	for i, option := range options {
+		names[i] = option.Name
+	}
+	return names
+}
+
+// ValidateStorageOptions returns a list of problems with the
+// StorageOptions settings. The list is empty if all is well.
+func (config *Config) ValidateStorageOptions() []error {
+	errors := make([]error, 0)
+	seen := make(map[string]bool)
+	for _, option := range config.storageOptions() {
+		if option.Name == "" {
+			errors = append(errors, fmt.Errorf("StorageOptions includes an option with no Name"))
+			continue
+		}
+		if seen[option.Name] {
+			errors = append(errors, fmt.Errorf("StorageOptions lists %s more than once", option.Name))
+		}
+		seen[option.Name] = true
+		if option.Bucket == "" {
+			errors = append(errors, fmt.Errorf("Storage option %s has no Bucket", option.Name))
+		}
+		if len(option.ReplicationTargets) > 1 {
+			errors = append(errors, fmt.Errorf("Storage option %s has %d ReplicationTargets, "+
+				"but only one is supported", option.Name, len(option.ReplicationTargets)))
+		}
+		for _, target := range option.ReplicationTargets {
+			if target.Bucket == "" {
+				errors = append(errors, fmt.Errorf("Storage option %s has a replication "+
+					"target with no Bucket", option.Name))
+			}
+		}
+	}
+	return errors
 }
 
+// storageOptions returns StorageOptions, or the options described
+// by the older Glacier settings if StorageOptions is empty.
+func (config *Config) storageOptions() []StorageOptionConfig {
+	if len(config.StorageOptions) > 0 {
+		return config.StorageOptions
+	}
+	glacier := func(name, region, bucket string) StorageOptionConfig {
+		return StorageOptionConfig{
+			Name: name,
+			StorageTarget: StorageTarget{
+				Region:        region,
+				Bucket:        bucket,
+				RetrievalTier: "Standard",
+			},
+		}
+	}
+	return []StorageOptionConfig{
+		{
+			Name: constants.StorageStandard,
+			StorageTarget: StorageTarget{
+				Region: config.APTrustS3Region,
+				Bucket: config.PreservationBucket,
+			},
+			ReplicationTargets: []StorageTarget{
+				{
+					Region:        config.APTrustGlacierRegion,
+					Bucket:        config.ReplicationBucket,
+					RetrievalTier: "Standard",
+				},
+			},
+		},
+		glacier(constants.StorageGlacierVA, config.GlacierRegionVA, config.GlacierBucketVA),
+		glacier(constants.StorageGlacierOH, config.GlacierRegionOH, config.GlacierBucketOH),
+		glacier(constants.StorageGlacierOR, config.GlacierRegionOR, config.GlacierBucketOR),
+		glacier(constants.StorageGlacierDeepVA, config.GlacierRegionVA, config.GlacierDeepBucketVA),
+		glacier(constants.StorageGlacierDeepOH, config.GlacierRegionOH, config.GlacierDeepBucketOH),
+		glacier(constants.StorageGlacierDeepOR, config.GlacierRegionOR, config.GlacierDeepBucketOR),
+	}
+}
+
+// ActiveAWSStorageRegions maps each storage option to
+// the region of its primary copies.
 func (config *Config) ActiveAWSStorageRegions() map[string]string {
-	return map[string]string{
-		constants.StorageStandard:      config.APTrustS3Region,
-		constants.StorageGlacierVA:     config.GlacierRegionVA,
-		constants.StorageGlacierOH:     config.GlacierRegionOH,
-		constants.StorageGlacierOR:     config.GlacierRegionOR,
-		constants.StorageGlacierDeepVA: config.GlacierRegionVA,
-		constants.StorageGlacierDeepOH: config.GlacierRegionOH,
-		constants.StorageGlacierDeepOR: config.GlacierRegionOR,
+	regions := make(map[string]string)
+	for _, option := range config.storageOptions() {
+		regions[option.Name] = option.Region
 	}
+	return regions
 }
 
+// AWSS3Buckets maps storage options whose primary copies
+// we can read directly to their buckets.
 func (config *Config) AWSS3Buckets() map[string]string {
-	return map[string]string{
-		constants.StorageStandard: config.PreservationBucket,
+	buckets := make(map[string]string)
+	for _, option := range config.storageOptions() {
+		if option.RetrievalTier == "" {
+			buckets[option.Name] = option.Bucket
+		}
 	}
+	return buckets
 }
 
+// AWSGlacierBuckets maps storage options to the buckets we
+// restore their files from Glacier. See GlacierTarget.
 func (config *Config) AWSGlacierBuckets() map[string]string {
-	return map[string]string{
-		constants.StorageStandard:      config.ReplicationBucket,
-		constants.StorageGlacierVA:     config.GlacierBucketVA,
-		constants.StorageGlacierOH:     config.GlacierBucketOH,
-		constants.StorageGlacierOR:     config.GlacierBucketOR,
-		constants.StorageGlacierDeepVA: config.GlacierDeepBucketVA,
-		constants.StorageGlacierDeepOH: config.GlacierDeepBucketOH,
-		constants.StorageGlacierDeepOR: config.GlacierDeepBucketOR,
+	buckets := make(map[string]string)
+	options := config.storageOptions()
+	for i := range options {
+		if target := options[i].GlacierTarget(); target != nil {
+			buckets[options[i].Name] = target.Bucket
+		}
 	}
+	return buckets
 }
 
 // TestsAreRunning returns true if we're running unit or integration
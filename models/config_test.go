@@ -71,6 +71,14 @@ func TestEnsurePharosConfig(t *testing.T) {
 	err = config.EnsurePharosConfig()
 	assert.Equal(t, "Environment variable PHAROS_API_KEY is not set", err.Error())
 
+	// The token method doesn't need the API key, but does need a token.
+	config.PharosAuth.Method = "token"
+	err = config.EnsurePharosConfig()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "TokenFile or TokenURL")
+	config.PharosAuth.TokenFile = "/var/run/pharos/token"
+	assert.Nil(t, config.EnsurePharosConfig())
+
 	os.Setenv("PHAROS_API_USER", apiUser)
 	os.Setenv("PHAROS_API_KEY", apiKey)
 }
@@ -206,3 +214,83 @@ func TestAWSGlacierBuckets(t *testing.T) {
 	assert.Equal(t, "aptrust.test.preservation.glacier-deep.oh", buckets[constants.StorageGlacierDeepOH])
 	assert.Equal(t, "aptrust.test.preservation.glacier-deep.or", buckets[constants.StorageGlacierDeepOR])
 }
+
+func TestStorageOption(t *testing.T) {
+	configFile := filepath.Join("config", "test.json")
+	config, err := models.LoadConfigFile(configFile)
+	require.Nil(t, err)
+
+	// Without a StorageOptions table, the options come
+	// from the Glacier settings.
+	assert.Equal(t, constants.StorageOptions, config.StorageOptionNames())
+	assert.Empty(t, config.ValidateStorageOptions())
+	option, err := config.StorageOption(constants.StorageStandard)
+	require.Nil(t, err)
+	assert.Equal(t, config.PreservationBucket, option.Bucket)
+	assert.Equal(t, "", option.RetrievalTier)
+	require.Equal(t, 1, len(option.ReplicationTargets))
+	assert.Equal(t, config.ReplicationBucket, option.ReplicationTargets[0].Bucket)
+	assert.Equal(t, &option.ReplicationTargets[0], option.GlacierTarget())
+	option, err = config.StorageOption(constants.StorageGlacierDeepOH)
+	require.Nil(t, err)
+	assert.Equal(t, config.GlacierDeepBucketOH, option.Bucket)
+	assert.Equal(t, "Standard", option.RetrievalTier)
+	assert.Equal(t, &option.StorageTarget, option.GlacierTarget())
+	_, err = config.StorageOption("Spongebob")
+	require.NotNil(t, err)
+
+	// A new storage option is one more entry in the table.
+	config.StorageOptions = []models.StorageOptionConfig{
+		{
+			Name: constants.StorageStandard,
+			StorageTarget: models.StorageTarget{
+				Region: "us-east-1",
+				Bucket: "preservation",
+			},
+		},
+		{
+			Name: "Wasabi-Deep",
+			StorageTarget: models.StorageTarget{
+				Provider:      "wasabi",
+				Region:        "eu-central-1",
+				Bucket:        "wasabi-deep",
+				StorageClass:  "DEEP_ARCHIVE",
+				RetrievalTier: "Bulk",
+			},
+		},
+	}
+	assert.Equal(t, []string{constants.StorageStandard, "Wasabi-Deep"}, config.StorageOptionNames())
+	region, bucket, err := config.StorageRegionAndBucketFor("Wasabi-Deep")
+	require.Nil(t, err)
+	assert.Equal(t, "eu-central-1", region)
+	assert.Equal(t, "wasabi-deep", bucket)
+	_, err = config.StorageOption(constants.StorageGlacierOH)
+	require.NotNil(t, err)
+	option, err = config.StorageOption(constants.StorageStandard)
+	require.Nil(t, err)
+	assert.Nil(t, option.GlacierTarget())
+	assert.Equal(t, map[string]string{"Wasabi-Deep": "wasabi-deep"}, config.AWSGlacierBuckets())
+	assert.Empty(t, config.ValidateStorageOptions())
+	target, err := config.StorageTargetForBucket("wasabi-deep")
+	require.Nil(t, err)
+	assert.Equal(t, "wasabi", target.Provider)
+	_, err = config.StorageTargetForBucket("no-such-bucket")
+	assert.NotNil(t, err)
+
+	config.StorageOptions = append(config.StorageOptions,
+		models.StorageOptionConfig{Name: "Wasabi-Deep"},
+		models.StorageOptionConfig{
+			Name:          "Two-Copies",
+			StorageTarget: models.StorageTarget{Bucket: "one"},
+			ReplicationTargets: []models.StorageTarget{
+				{Bucket: "two"},
+				{Bucket: ""},
+			},
+		})
+	errors := config.ValidateStorageOptions()
+	require.Equal(t, 4, len(errors))
+	assert.Equal(t, "StorageOptions lists Wasabi-Deep more than once", errors[0].Error())
+	assert.Equal(t, "Storage option Wasabi-Deep has no Bucket", errors[1].Error())
+	assert.Equal(t, "Storage option Two-Copies has 2 ReplicationTargets, but only one is supported", errors[2].Error())
+	assert.Equal(t, "Storage option Two-Copies has a replication target with no Bucket", errors[3].Error())
+}
@@ -3,7 +3,6 @@ package models
 import (
 	"fmt"
 	"github.com/nsqio/go-nsq"
-	"strings"
 )
 
 // FixityResult descibes the results of fetching a file from S3
@@ -44,14 +43,7 @@ func (result *FixityResult) BucketAndKey() (string, string, error) {
 	if result.GenericFile == nil {
 		return "", "", fmt.Errorf("FixityResult.GenericFile is nil")
 	}
-	parts := strings.Split(result.GenericFile.URI, "/")
-	length := len(parts)
-	if length < 4 {
-		return "", "", fmt.Errorf("GenericFile URI '%s' is invalid", result.GenericFile.URI)
-	}
-	bucket := parts[length-2]
-	key := parts[length-1]
-	return bucket, key, nil
+	return BucketAndKeyFromURL(result.GenericFile.URI)
 }
 
 // PharosSha256 returns the SHA256 checksum that Pharos has on record.
@@ -141,6 +141,40 @@ type GenericFile struct {
 	// matches what's in the manifest.
 	IngestSha256VerifiedAt time.Time `json:"ingest_sha_256_verified_at,omitempty"`
 
+	// The sha1 checksum for this file, as reported in the payload manifest.
+	// This will be empty unless the bag had a sha1 manifest that listed
+	// this file.
+	IngestManifestSha1 string `json:"ingest_manifest_sha1,omitempty"`
+
+	// The sha1 checksum we calculated when we read the actual file.
+	// This will be empty unless the bag validation config includes sha1
+	// in its FixityAlgorithms.
+	IngestSha1 string `json:"ingest_sha_1,omitempty"`
+
+	// Timestamp of when we calculated the sha1 checksum.
+	IngestSha1GeneratedAt time.Time `json:"ingest_sha_1_generated_at,omitempty"`
+
+	// Timestamp of when we verified that the sha1 checksum we calculated
+	// matches what's in the manifest.
+	IngestSha1VerifiedAt time.Time `json:"ingest_sha_1_verified_at,omitempty"`
+
+	// The sha512 checksum for this file, as reported in the payload manifest.
+	// This will be empty unless the bag had a sha512 manifest that listed
+	// this file.
+	IngestManifestSha512 string `json:"ingest_manifest_sha512,omitempty"`
+
+	// The sha512 checksum we calculated when we read the actual file.
+	// This will be empty unless the bag validation config includes sha512
+	// in its FixityAlgorithms.
+	IngestSha512 string `json:"ingest_sha_512,omitempty"`
+
+	// Timestamp of when we calculated the sha512 checksum.
+	IngestSha512GeneratedAt time.Time `json:"ingest_sha_512_generated_at,omitempty"`
+
+	// Timestamp of when we verified that the sha512 checksum we calculated
+	// matches what's in the manifest.
+	IngestSha512VerifiedAt time.Time `json:"ingest_sha_512_verified_at,omitempty"`
+
 	// The UUID assigned to this file. This will be its S3 key when we store it.
 	IngestUUID string `json:"ingest_uuid,omitempty"`
 
@@ -257,6 +291,14 @@ func (gf *GenericFile) Clone() *GenericFile {
 	newFile.IngestSha256 = gf.IngestSha256
 	newFile.IngestSha256GeneratedAt = gf.IngestSha256GeneratedAt
 	newFile.IngestSha256VerifiedAt = gf.IngestSha256VerifiedAt
+	newFile.IngestManifestSha1 = gf.IngestManifestSha1
+	newFile.IngestSha1 = gf.IngestSha1
+	newFile.IngestSha1GeneratedAt = gf.IngestSha1GeneratedAt
+	newFile.IngestSha1VerifiedAt = gf.IngestSha1VerifiedAt
+	newFile.IngestManifestSha512 = gf.IngestManifestSha512
+	newFile.IngestSha512 = gf.IngestSha512
+	newFile.IngestSha512GeneratedAt = gf.IngestSha512GeneratedAt
+	newFile.IngestSha512VerifiedAt = gf.IngestSha512VerifiedAt
 	newFile.IngestUUID = gf.IngestUUID
 	newFile.IngestUUIDGeneratedAt = gf.IngestUUIDGeneratedAt
 	newFile.IngestStorageURL = gf.IngestStorageURL
@@ -428,6 +470,39 @@ func (gf *GenericFile) PreservationStorageFileName() (string, error) {
 	return parts[len(parts)-1], nil
 }
 
+// ReplicationURLs returns the URLs of the file's replication copies,
+// from its replication events. These are where the copies went when
+// the file was ingested, which may not be where the storage options
+// in the current config would put them.
+func (gf *GenericFile) ReplicationURLs() []string {
+	urls := make([]string, 0)
+	seen := make(map[string]bool)
+	addURL := func(storageURL string) {
+		if !seen[storageURL] && (strings.HasPrefix(storageURL, "http://") ||
+			strings.HasPrefix(storageURL, "https://")) {
+			urls = append(urls, storageURL)
+			seen[storageURL] = true
+		}
+	}
+	addURL(gf.IngestReplicationURL)
+	for _, event := range gf.FindEventsByType(constants.EventReplication) {
+		addURL(event.OutcomeDetail)
+	}
+	return urls
+}
+
+// BucketAndKeyFromURL returns the bucket and key in a storage URL,
+// such as a GenericFile's URI or replication URL. These look like
+// https://s3.amazonaws.com/<bucket>/<key>.
+func BucketAndKeyFromURL(storageURL string) (string, string, error) {
+	parts := strings.Split(storageURL, "/")
+	length := len(parts)
+	if length < 4 || parts[length-2] == "" || parts[length-1] == "" {
+		return "", "", fmt.Errorf("Storage URL '%s' is invalid", storageURL)
+	}
+	return parts[length-2], parts[length-1], nil
+}
+
 // BuildIngestEvents creates all of the ingest events for
 // this GenericFile. See the notes for IntellectualObject.BuildIngestEvents,
 // as they all apply here. This call is idempotent, so
@@ -502,22 +577,54 @@ func (gf *GenericFile) buildIngestFixityCheck() error {
 
 // Builds an event (if it doesn't already exist) describing
 // when we calculated the sha256 checksum for this file, and
-// what the digest was.
+// what the digest was. If we also calculated sha1 or sha512
+// digests during validation, this builds events for those too.
 func (gf *GenericFile) buildDigestCalculationEvent() error {
-	events := gf.FindEventsByType(constants.EventDigestCalculation)
-	if len(events) == 0 {
-		event, err := NewEventGenericFileDigestCalculation(
-			gf.IngestSha256GeneratedAt, constants.AlgSha256, gf.IngestSha256)
+	err := gf.buildDigestCalculationEventFor(constants.AlgSha256,
+		gf.IngestSha256, gf.IngestSha256GeneratedAt)
+	if err != nil {
+		return err
+	}
+	if gf.IngestSha1 != "" {
+		err = gf.buildDigestCalculationEventFor(constants.AlgSha1,
+			gf.IngestSha1, gf.IngestSha1GeneratedAt)
 		if err != nil {
-			return fmt.Errorf("Error building replication event for %s: %v",
-				gf.Identifier, err)
+			return err
 		}
-		event.IntellectualObjectId = gf.IntellectualObjectId
-		event.IntellectualObjectIdentifier = gf.IntellectualObjectIdentifier
-		event.GenericFileId = gf.Id
-		event.GenericFileIdentifier = gf.Identifier
-		gf.PremisEvents = append(gf.PremisEvents, event)
 	}
+	if gf.IngestSha512 != "" {
+		err = gf.buildDigestCalculationEventFor(constants.AlgSha512,
+			gf.IngestSha512, gf.IngestSha512GeneratedAt)
+	}
+	return err
+}
+
+// Builds a digest calculation event for the specified algorithm,
+// unless this file already has one. Files ingested before we
+// supported sha1 and sha512 have a single digest calculation event,
+// so for backward compatibility, any existing event that isn't
+// explicitly for sha1 or sha512 counts as the sha256 event.
+func (gf *GenericFile) buildDigestCalculationEventFor(algorithm, digest string, generatedAt time.Time) error {
+	for _, existingEvent := range gf.FindEventsByType(constants.EventDigestCalculation) {
+		eventAlg := strings.SplitN(existingEvent.OutcomeDetail, ":", 2)[0]
+		if eventAlg == algorithm {
+			return nil
+		}
+		if algorithm == constants.AlgSha256 &&
+			eventAlg != constants.AlgSha1 && eventAlg != constants.AlgSha512 {
+			return nil
+		}
+	}
+	event, err := NewEventGenericFileDigestCalculation(generatedAt, algorithm, digest)
+	if err != nil {
+		return fmt.Errorf("Error building %s digest calculation event for %s: %v",
+			algorithm, gf.Identifier, err)
+	}
+	event.IntellectualObjectId = gf.IntellectualObjectId
+	event.IntellectualObjectIdentifier = gf.IntellectualObjectIdentifier
+	event.GenericFileId = gf.Id
+	event.GenericFileIdentifier = gf.Identifier
+	gf.PremisEvents = append(gf.PremisEvents, event)
 	return nil
 }
 
@@ -645,6 +752,43 @@ func (gf *GenericFile) BuildIngestChecksums() error {
 	if err != nil {
 		return err
 	}
+	if gf.IngestSha1 != "" {
+		err = gf.buildIngestChecksum(constants.AlgSha1, gf.IngestSha1, gf.IngestSha1GeneratedAt)
+		if err != nil {
+			return err
+		}
+	}
+	if gf.IngestSha512 != "" {
+		err = gf.buildIngestChecksum(constants.AlgSha512, gf.IngestSha512, gf.IngestSha512GeneratedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates the initial Checksum record for one of the optional
+// algorithms (sha1, sha512), if it does not already exist. We only
+// have these digests when the bag validation config asks for them.
+func (gf *GenericFile) buildIngestChecksum(algorithm, digest string, generatedAt time.Time) error {
+	checksum := gf.GetChecksumByAlgorithm(algorithm)
+	if checksum == nil {
+		if len(digest) != constants.DigestLengths[algorithm] {
+			return fmt.Errorf("Cannot create %s Checksum object: "+
+				"digest '%s' is invalid.", algorithm, digest)
+		}
+		if generatedAt.IsZero() {
+			return fmt.Errorf("Cannot create %s Checksum object: "+
+				"generation timestamp is missing.", algorithm)
+		}
+		checksum = &Checksum{
+			Algorithm:     algorithm,
+			DateTime:      generatedAt,
+			Digest:        digest,
+			GenericFileId: gf.Id,
+		}
+		gf.Checksums = append(gf.Checksums, checksum)
+	}
 	return nil
 }
 
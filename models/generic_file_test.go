@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -190,6 +191,33 @@ func TestPreservationStorageFileName(t *testing.T) {
 	assert.Equal(t, "a58a7c00-392f-11e4-916c-0800200c9a66", fileName)
 }
 
+func TestReplicationURLs(t *testing.T) {
+	gf := testutil.MakeGenericFile(0, 0, "test.edu/bag")
+	gf.IngestReplicationURL = "https://s3.amazonaws.com/replication/1234"
+	for _, detail := range []string{"https://s3.amazonaws.com/replication/1234",
+		"https://s3.amazonaws.com/old-replication/1234", "Not a URL"} {
+		event, err := models.NewEventGenericFileReplication(time.Now(), detail)
+		require.Nil(t, err)
+		gf.PremisEvents = append(gf.PremisEvents, event)
+	}
+	assert.Equal(t, []string{
+		"https://s3.amazonaws.com/replication/1234",
+		"https://s3.amazonaws.com/old-replication/1234",
+	}, gf.ReplicationURLs())
+	assert.Empty(t, models.NewGenericFile().ReplicationURLs())
+}
+
+func TestBucketAndKeyFromURL(t *testing.T) {
+	bucket, key, err := models.BucketAndKeyFromURL("https://s3.amazonaws.com/aptrust.test.preservation/a58a7c00")
+	require.Nil(t, err)
+	assert.Equal(t, "aptrust.test.preservation", bucket)
+	assert.Equal(t, "a58a7c00", key)
+	for _, storageURL := range []string{"", "http://example.com", "https://s3.amazonaws.com/bucket/"} {
+		_, _, err = models.BucketAndKeyFromURL(storageURL)
+		assert.NotNil(t, err, storageURL)
+	}
+}
+
 func TestFindEventsByType(t *testing.T) {
 	filename := filepath.Join("testdata", "json_objects", "intel_obj.json")
 	intelObj, err := testutil.LoadIntelObjFixture(filename)
@@ -492,6 +520,41 @@ func TestBuildIngestChecksums(t *testing.T) {
 	assert.Equal(t, 2, len(gf.Checksums))
 }
 
+func TestBuildIngestChecksumsAndEvents_Sha1AndSha512(t *testing.T) {
+	gf := testutil.MakeGenericFile(0, 0, "test.edu/test_bag/file.txt")
+	gf.IngestSha1 = "d82021489462a99ec18b7c5ca0a7c4ce14760238"
+	gf.IngestSha1GeneratedAt = testutil.TEST_TIMESTAMP
+	gf.IngestSha512 = strings.Repeat("0a", 64)
+	gf.IngestSha512GeneratedAt = testutil.TEST_TIMESTAMP
+
+	err := gf.BuildIngestChecksums()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(gf.Checksums))
+	sha1 := gf.GetChecksumByAlgorithm(constants.AlgSha1)
+	sha512 := gf.GetChecksumByAlgorithm(constants.AlgSha512)
+	require.NotNil(t, sha1)
+	require.NotNil(t, sha512)
+	assert.Equal(t, gf.IngestSha1, sha1.Digest)
+	assert.Equal(t, gf.IngestSha512, sha512.Digest)
+	assert.Equal(t, testutil.TEST_TIMESTAMP, sha512.DateTime)
+
+	err = gf.BuildIngestEvents()
+	assert.Nil(t, err)
+	digestEvents := gf.FindEventsByType(constants.EventDigestCalculation)
+	require.Equal(t, 3, len(digestEvents))
+	assert.True(t, strings.HasPrefix(digestEvents[0].OutcomeDetail, "sha256:"))
+	assert.Equal(t, "sha1:"+gf.IngestSha1, digestEvents[1].OutcomeDetail)
+	assert.Equal(t, "sha512:"+gf.IngestSha512, digestEvents[2].OutcomeDetail)
+
+	// Calling these again should not add anything new.
+	err = gf.BuildIngestChecksums()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(gf.Checksums))
+	err = gf.BuildIngestEvents()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(gf.FindEventsByType(constants.EventDigestCalculation)))
+}
+
 func TestPropagateIdsToChildren(t *testing.T) {
 	// Make a generic file with 6 events and 2 checksums
 	gf := testutil.MakeGenericFile(6, 2, "test.edu/test_bag/file.txt")
@@ -115,9 +115,10 @@ func (manifest *IngestManifest) BagHasBeenValidated() bool {
 // ObjectIdentifier returns the IntellectualObject.Identifier for
 // the object being ingested. If this is a new ingest, the identifier
 // will not yet exist in Pharos. If it's a re-ingest, the object
-// will exist.
-func (manifest *IngestManifest) ObjectIdentifier() (string, error) {
-	instIdentifier := util.OwnerOf(manifest.S3Bucket)
+// will exist. Param owners says who owns the bucket. If it's nil,
+// we use the bucket naming rules.
+func (manifest *IngestManifest) ObjectIdentifier(owners util.BucketOwners) (string, error) {
+	instIdentifier := ownerOf(owners, manifest.S3Bucket)
 	if instIdentifier == "" || instIdentifier == manifest.S3Bucket {
 		return "", fmt.Errorf("Can't determine insitution from invalid bucket '%s'", manifest.S3Bucket)
 	}
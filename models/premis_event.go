@@ -196,19 +196,14 @@ func NewEventGenericFileFixityCheck(checksumVerifiedAt time.Time, fixityAlg, dig
 	if !util.StringListContains(constants.ChecksumAlgorithms, fixityAlg) {
 		return nil, fmt.Errorf("Param fixityAlg '%s' is not valid.", fixityAlg)
 	}
-	if len(digest) != 32 && len(digest) != 64 {
-		return nil, fmt.Errorf("Param digest must have 32 or 64 characters. '%s' doesn't.",
-			digest)
+	if !validDigestLength(fixityAlg, digest) {
+		return nil, fmt.Errorf("Param digest must have %d characters for %s. '%s' doesn't.",
+			constants.DigestLengths[fixityAlg], fixityAlg, digest)
 	}
 	eventId := uuid.NewV4()
-	object := "Go language crypto/md5"
-	agent := "http://golang.org/pkg/crypto/md5/"
+	object, agent := digestObjectAndAgent(fixityAlg)
 	outcomeInformation := "Fixity matches"
 	outcome := string(constants.StatusSuccess)
-	if fixityAlg == constants.AlgSha256 {
-		object = "Go language crypto/sha256"
-		agent = "http://golang.org/pkg/crypto/sha256/"
-	}
 	if fixityMatched == false {
 		outcome = string(constants.StatusFailed)
 		outcomeInformation = "Fixity did not match"
@@ -226,7 +221,7 @@ func NewEventGenericFileFixityCheck(checksumVerifiedAt time.Time, fixityAlg, dig
 	}, nil
 }
 
-// We generated a sha256 checksum.
+// We generated a checksum (usually sha256, but possibly sha1 or sha512).
 func NewEventGenericFileDigestCalculation(checksumGeneratedAt time.Time, fixityAlg, digest string) (*PremisEvent, error) {
 	if checksumGeneratedAt.IsZero() {
 		return nil, fmt.Errorf("Param checksumVerifiedAt cannot be empty.")
@@ -234,17 +229,12 @@ func NewEventGenericFileDigestCalculation(checksumGeneratedAt time.Time, fixityA
 	if !util.StringListContains(constants.ChecksumAlgorithms, fixityAlg) {
 		return nil, fmt.Errorf("Param fixityAlg '%s' is not valid.", fixityAlg)
 	}
-	if len(digest) != 32 && len(digest) != 64 {
-		return nil, fmt.Errorf("Param digest must have 32 or 64 characters. '%s' doesn't.",
-			digest)
+	if !validDigestLength(fixityAlg, digest) {
+		return nil, fmt.Errorf("Param digest must have %d characters for %s. '%s' doesn't.",
+			constants.DigestLengths[fixityAlg], fixityAlg, digest)
 	}
 	eventId := uuid.NewV4()
-	object := "Go language crypto/md5"
-	agent := "http://golang.org/pkg/crypto/md5/"
-	if fixityAlg == constants.AlgSha256 {
-		object = "Go language crypto/sha256"
-		agent = "http://golang.org/pkg/crypto/sha256/"
-	}
+	object, agent := digestObjectAndAgent(fixityAlg)
 	return &PremisEvent{
 		Identifier:         eventId.String(),
 		EventType:          constants.EventDigestCalculation,
@@ -258,6 +248,20 @@ func NewEventGenericFileDigestCalculation(checksumGeneratedAt time.Time, fixityA
 	}, nil
 }
 
+// validDigestLength returns true if digest has the length of
+// a hex-encoded digest for algorithm fixityAlg.
+func validDigestLength(fixityAlg, digest string) bool {
+	length, ok := constants.DigestLengths[fixityAlg]
+	return ok && len(digest) == length
+}
+
+// digestObjectAndAgent returns the PREMIS object and agent describing
+// the Go library we use to calculate digests with fixityAlg.
+func digestObjectAndAgent(fixityAlg string) (object, agent string) {
+	return fmt.Sprintf("Go language crypto/%s", fixityAlg),
+		fmt.Sprintf("http://golang.org/pkg/crypto/%s/", fixityAlg)
+}
+
 // We assigned an identifier: either a generic file identifier
 // or a new storage URL. Note that when identifierType is
 // constants.IdTypeStorageURL, identifierGeneratedAt is the
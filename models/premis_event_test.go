@@ -15,7 +15,8 @@ import (
 
 const digest = "12345678901234567890123456789012"
 const md5_digest = "md5:12345678901234567890123456789012"
-const sha256_digest = "sha256:12345678901234567890123456789012"
+const digest256 = "1234567890123456789012345678901234567890123456789012345678901234"
+const sha256_digest = "sha256:1234567890123456789012345678901234567890123456789012345678901234"
 
 func TestEventTypeValid(t *testing.T) {
 	for _, eventType := range constants.EventTypes {
@@ -189,8 +190,14 @@ func TestNewEventGenericFileFixityCheck(t *testing.T) {
 	assert.Equal(t, "http://golang.org/pkg/crypto/md5/", event.Agent)
 	assert.Equal(t, "Fixity matches", event.OutcomeInformation)
 
-	event, err = models.NewEventGenericFileFixityCheck(testutil.TEST_TIMESTAMP, constants.AlgSha256,
+	// The digest must have the right length for its algorithm.
+	_, err = models.NewEventGenericFileFixityCheck(testutil.TEST_TIMESTAMP, constants.AlgSha256,
 		digest, false)
+	require.NotNil(t, err)
+	assert.Equal(t, "Param digest must have 64 characters for sha256. '"+digest+"' doesn't.", err.Error())
+
+	event, err = models.NewEventGenericFileFixityCheck(testutil.TEST_TIMESTAMP, constants.AlgSha256,
+		digest256, false)
 	if err != nil {
 		t.Errorf("Error creating PremisEvent: %v", err)
 		return
@@ -240,7 +247,10 @@ func TestNewEventGenericFileDigestCalculation(t *testing.T) {
 	assert.Equal(t, "http://golang.org/pkg/crypto/md5/", event.Agent)
 	assert.Equal(t, "Calculated fixity value", event.OutcomeInformation)
 
-	event, err = models.NewEventGenericFileDigestCalculation(testutil.TEST_TIMESTAMP, constants.AlgSha256, digest)
+	_, err = models.NewEventGenericFileDigestCalculation(testutil.TEST_TIMESTAMP, constants.AlgSha256, digest)
+	assert.NotNil(t, err)
+
+	event, err = models.NewEventGenericFileDigestCalculation(testutil.TEST_TIMESTAMP, constants.AlgSha256, digest256)
 	if err != nil {
 		t.Errorf("Error creating PremisEvent: %v", err)
 		return
@@ -413,3 +423,25 @@ func TestPremisEventClone(t *testing.T) {
 	assert.Equal(t, clone.CreatedAt, event.CreatedAt)
 	assert.Equal(t, clone.UpdatedAt, event.UpdatedAt)
 }
+
+func TestNewEventGenericFileDigestCalculationSha1AndSha512(t *testing.T) {
+	sha1Digest := "d82021489462a99ec18b7c5ca0a7c4ce14760238"
+	event, err := models.NewEventGenericFileDigestCalculation(testutil.TEST_TIMESTAMP,
+		constants.AlgSha1, sha1Digest)
+	require.Nil(t, err)
+	assert.Equal(t, "sha1:"+sha1Digest, event.OutcomeDetail)
+	assert.Equal(t, "Go language crypto/sha1", event.Object)
+	assert.Equal(t, "http://golang.org/pkg/crypto/sha1/", event.Agent)
+
+	sha512Digest := strings.Repeat("a1", 64)
+	event, err = models.NewEventGenericFileFixityCheck(testutil.TEST_TIMESTAMP,
+		constants.AlgSha512, sha512Digest, true)
+	require.Nil(t, err)
+	assert.Equal(t, "sha512:"+sha512Digest, event.OutcomeDetail)
+	assert.Equal(t, "Go language crypto/sha512", event.Object)
+	assert.Equal(t, "http://golang.org/pkg/crypto/sha512/", event.Agent)
+
+	_, err = models.NewEventGenericFileDigestCalculation(testutil.TEST_TIMESTAMP,
+		constants.AlgSha512, "1234")
+	assert.NotNil(t, err)
+}
@@ -62,9 +62,10 @@ func NewS3FileWithName(bucketName, keyName string) *S3File {
 // a slash and the tar file name, minus the .tar extension
 // and the ".bag1of12" multipart extension. So for BucketName
 // "aptrust.receiving.unc.edu" and Key.Key "nc_bag.b001.of030.tar",
-// this would return "unc.edu/nc_bag"
-func (s3File *S3File) ObjectName() (string, error) {
-	institution := util.OwnerOf(s3File.BucketName)
+// this would return "unc.edu/nc_bag". Param owners says who owns the
+// bucket. If it's nil, we use the bucket naming rules.
+func (s3File *S3File) ObjectName(owners util.BucketOwners) (string, error) {
+	institution := ownerOf(owners, s3File.BucketName)
 	cleanBagName := util.CleanBagName(s3File.Key.Key)
 	return fmt.Sprintf("%s/%s", institution, cleanBagName), nil
 }
@@ -72,8 +73,18 @@ func (s3File *S3File) ObjectName() (string, error) {
 // The name of the owning institution, followed by a slash, followed
 // by the name of the tar file. This differs from the ObjectName,
 // because it will have the .tar or bag.001.of030.tar suffix.
-func (s3File *S3File) BagName() string {
-	return fmt.Sprintf("%s/%s", util.OwnerOf(s3File.BucketName), s3File.Key.Key)
+// Param owners is as for ObjectName.
+func (s3File *S3File) BagName(owners util.BucketOwners) string {
+	return fmt.Sprintf("%s/%s", ownerOf(owners, s3File.BucketName), s3File.Key.Key)
+}
+
+// ownerOf returns the owner of bucketName according to owners,
+// or according to the bucket naming rules if owners is nil.
+func ownerOf(owners util.BucketOwners, bucketName string) string {
+	if owners == nil {
+		return util.OwnerOf(bucketName)
+	}
+	return owners.OwnerOf(bucketName)
 }
 
 // Returns true if we attempted to delete this file.
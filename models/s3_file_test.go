@@ -52,14 +52,14 @@ func testFile() *models.S3File {
 
 func TestS3BagName(t *testing.T) {
 	s3File := testFile()
-	assert.Equal(t, "uc.edu/cin.675812.tar", s3File.BagName())
+	assert.Equal(t, "uc.edu/cin.675812.tar", s3File.BagName(nil))
 }
 
 func TestObjectName(t *testing.T) {
 	s3File := testFile()
 
 	// Test with single-part bag
-	objname, err := s3File.ObjectName()
+	objname, err := s3File.ObjectName(nil)
 	if err != nil {
 		t.Error(err)
 		return
@@ -68,7 +68,7 @@ func TestObjectName(t *testing.T) {
 
 	// Test with multi-part bag
 	s3File.Key.Key = "cin.1234.b003.of191.tar"
-	objname, err = s3File.ObjectName()
+	objname, err = s3File.ObjectName(nil)
 	if err != nil {
 		t.Error(err)
 		return
@@ -76,6 +76,24 @@ func TestObjectName(t *testing.T) {
 	assert.Equal(t, "uc.edu/cin.1234", objname)
 }
 
+// bucketOwners is a util.BucketOwners for buckets that
+// don't follow the naming rules.
+type bucketOwners map[string]string
+
+func (owners bucketOwners) OwnerOf(bucketName string) string {
+	return owners[bucketName]
+}
+
+func TestObjectName_BucketOwners(t *testing.T) {
+	s3File := testFile()
+	s3File.BucketName = "incoming-uc"
+	owners := bucketOwners{"incoming-uc": "uc.edu"}
+	objname, err := s3File.ObjectName(owners)
+	assert.Nil(t, err)
+	assert.Equal(t, "uc.edu/cin.675812", objname)
+	assert.Equal(t, "uc.edu/cin.675812.tar", s3File.BagName(owners))
+}
+
 func TestKeyIsComplete(t *testing.T) {
 	s3file := models.NewS3FileWithName("buckey-dent", "file-in-a-cake.xml")
 	assert.False(t, s3file.KeyIsComplete())
@@ -0,0 +1,391 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultMaxRecordedBody is the largest request or response body a
+// RecordingTransport saves when its MaxBodySize is not set. Larger
+// bodies, like S3 downloads, are truncated, and can't be replayed.
+const DefaultMaxRecordedBody = 1024 * 1024
+
+// redactedHeaders are the headers we don't write to cassettes,
+// because they contain credentials.
+var redactedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Amz-Security-Token",
+	"X-Pharos-API-Key",
+}
+
+// Cassette is a recording of the HTTP requests a worker sent while
+// processing one WorkItem, and of the responses it got back. Use a
+// RecordingTransport to record a cassette, and a ReplayTransport to
+// play it back, so you can re-run the worker offline and see exactly
+// what it saw. A Cassette is safe for concurrent use.
+//
+// Cassettes contain whatever Pharos and S3 sent, including depositor
+// metadata, though credentials are redacted. Treat them accordingly.
+type Cassette struct {
+	// Name identifies what was recorded, usually the WorkItem.
+	Name string `json:"name"`
+	// RecordedAt is when recording started.
+	RecordedAt time.Time `json:"recorded_at"`
+	// Interactions are the requests and responses, in the
+	// order the requests were sent.
+	Interactions []*Interaction `json:"interactions"`
+
+	mutex  sync.Mutex
+	played []bool
+}
+
+// Interaction is one request and its response.
+type Interaction struct {
+	// Service is the name of the service the request went
+	// to, such as "pharos" or "s3".
+	Service string `json:"service"`
+
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	RequestBody   *Body       `json:"request_body,omitempty"`
+
+	// StatusCode is zero if the request failed without a response.
+	StatusCode     int         `json:"status_code,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   *Body       `json:"response_body,omitempty"`
+
+	// Error is the error the transport returned, if any.
+	Error string `json:"error,omitempty"`
+
+	// Duration is how long the request took.
+	Duration time.Duration `json:"duration"`
+}
+
+// Body is a recorded request or response body. Text bodies, like
+// JSON from Pharos, are stored as they are. Binary bodies are base64
+// encoded.
+type Body struct {
+	Data      string `json:"data"`
+	Base64    bool   `json:"base64,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	// Size is the size of the whole body, or -1 if the
+	// body was truncated and its size was unknown.
+	Size int64 `json:"size"`
+}
+
+// NewCassette returns an empty cassette.
+func NewCassette(name string) *Cassette {
+	return &Cassette{
+		Name:         name,
+		RecordedAt:   time.Now().UTC(),
+		Interactions: make([]*Interaction, 0),
+	}
+}
+
+// LoadCassette reads a cassette from a file written by Save.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read cassette: %v", err)
+	}
+	cassette := &Cassette{}
+	if err = json.Unmarshal(data, cassette); err != nil {
+		return nil, fmt.Errorf("Cannot parse cassette %s: %v", path, err)
+	}
+	return cassette, nil
+}
+
+// Save writes the cassette to path as JSON, creating the
+// directory if necessary.
+func (cassette *Cassette) Save(path string) error {
+	cassette.mutex.Lock()
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	cassette.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Add appends interaction to the cassette.
+func (cassette *Cassette) Add(interaction *Interaction) {
+	cassette.mutex.Lock()
+	defer cassette.mutex.Unlock()
+	cassette.Interactions = append(cassette.Interactions, interaction)
+}
+
+// Len returns the number of interactions in the cassette.
+func (cassette *Cassette) Len() int {
+	cassette.mutex.Lock()
+	defer cassette.mutex.Unlock()
+	return len(cassette.Interactions)
+}
+
+// Unplayed returns the number of interactions a ReplayTransport
+// has not played back yet. After a faithful replay, this is zero.
+func (cassette *Cassette) Unplayed() int {
+	cassette.mutex.Lock()
+	defer cassette.mutex.Unlock()
+	count := 0
+	for i := range cassette.Interactions {
+		if i >= len(cassette.played) || !cassette.played[i] {
+			count++
+		}
+	}
+	return count
+}
+
+// next returns the first interaction that hasn't been played yet
+// and matches service, method and url, and marks it played.
+func (cassette *Cassette) next(service, method, url string) *Interaction {
+	cassette.mutex.Lock()
+	defer cassette.mutex.Unlock()
+	if len(cassette.played) < len(cassette.Interactions) {
+		played := make([]bool, len(cassette.Interactions))
+		copy(played, cassette.played)
+		cassette.played = played
+	}
+	for i, interaction := range cassette.Interactions {
+		if !cassette.played[i] && interaction.Service == service &&
+			interaction.Method == method && interaction.URL == url {
+			cassette.played[i] = true
+			return interaction
+		}
+	}
+	return nil
+}
+
+type cassetteKey struct{}
+
+// WithCassette returns a copy of ctx that tells RecordingTransports
+// to record requests sent with it into cassette. If cassette is nil,
+// it returns ctx.
+func WithCassette(ctx context.Context, cassette *Cassette) context.Context {
+	if cassette == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cassetteKey{}, cassette)
+}
+
+// CassetteFrom returns the cassette attached to ctx by
+// WithCassette, or nil.
+func CassetteFrom(ctx context.Context) *Cassette {
+	if ctx == nil {
+		return nil
+	}
+	cassette, _ := ctx.Value(cassetteKey{}).(*Cassette)
+	return cassette
+}
+
+// RecordingTransport sends requests through Transport and records
+// them, with their responses, into the cassette attached to each
+// request's context. See WithCassette. Requests without a cassette
+// are sent without recording, so a process can record the requests
+// for one WorkItem while it works on others.
+type RecordingTransport struct {
+	// Transport sends the requests. If it's nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// Service is the name recorded in each Interaction.
+	Service string
+
+	// MaxBodySize is the largest body to record. Zero
+	// means DefaultMaxRecordedBody.
+	MaxBodySize int
+}
+
+// RoundTrip sends request and records the exchange.
+func (transport *RecordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	next := transport.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	cassette := CassetteFrom(request.Context())
+	if cassette == nil {
+		return next.RoundTrip(request)
+	}
+	interaction := &Interaction{
+		Service:       transport.Service,
+		Method:        request.Method,
+		URL:           requestURL(request),
+		RequestHeader: redact(request.Header),
+	}
+	if request.Body != nil && request.Body != http.NoBody {
+		body, rest, err := transport.capture(request.Body, request.ContentLength)
+		if err != nil {
+			return nil, err
+		}
+		interaction.RequestBody = body
+		request = request.Clone(request.Context())
+		request.Body = rest
+	}
+	started := time.Now()
+	response, err := next.RoundTrip(request)
+	if err == nil {
+		interaction.StatusCode = response.StatusCode
+		interaction.ResponseHeader = redact(response.Header)
+		interaction.ResponseBody, response.Body, err = transport.capture(response.Body, response.ContentLength)
+		if err != nil {
+			response = nil
+		}
+	}
+	interaction.Duration = time.Since(started)
+	if err != nil {
+		interaction.Error = err.Error()
+	}
+	cassette.Add(interaction)
+	return response, err
+}
+
+// capture records up to MaxBodySize bytes of body, and returns
+// the recording and a reader that returns the whole body, so
+// large bodies don't have to fit in memory.
+func (transport *RecordingTransport) capture(body io.ReadCloser, contentLength int64) (*Body, io.ReadCloser, error) {
+	maxSize := transport.MaxBodySize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxRecordedBody
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, int64(maxSize)+1))
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	recorded := &Body{Size: int64(len(data))}
+	rest := body
+	if len(data) > maxSize {
+		recorded.Size = contentLength
+		recorded.Truncated = true
+		rest = readCloser{io.MultiReader(bytes.NewReader(data), body), body}
+		data = data[:maxSize]
+	} else {
+		body.Close()
+		rest = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	if utf8.Valid(data) {
+		recorded.Data = string(data)
+	} else {
+		recorded.Data = base64.StdEncoding.EncodeToString(data)
+		recorded.Base64 = true
+	}
+	return recorded, rest, nil
+}
+
+// readCloser reads from one reader and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// requestURL returns the absolute URL of request. PharosClient
+// sets URL.Opaque to keep escaped slashes, which URL.String
+// doesn't handle the way we need.
+func requestURL(request *http.Request) string {
+	u := request.URL
+	if u.Opaque != "" && u.Host != "" && strings.HasPrefix(u.Opaque, "/") {
+		rawURL := u.Scheme + "://" + u.Host + u.Opaque
+		if u.RawQuery != "" {
+			rawURL += "?" + u.RawQuery
+		}
+		return rawURL
+	}
+	return u.String()
+}
+
+// redact returns a copy of header without credentials.
+func redact(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	header = header.Clone()
+	for _, name := range redactedHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, "REDACTED")
+		}
+	}
+	return header
+}
+
+// ReplayTransport answers requests from Cassette instead of sending
+// them. Each request gets the response recorded for the first
+// interaction with the same service, method and URL that hasn't been
+// played yet, so repeated requests, including retries, get their
+// responses in the order they were recorded. Requests the cassette
+// has no response for fail.
+type ReplayTransport struct {
+	Cassette *Cassette
+
+	// Service is the name of the service whose
+	// interactions this transport plays back.
+	Service string
+}
+
+// RoundTrip returns the recorded response to request.
+func (transport *ReplayTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Body != nil {
+		request.Body.Close()
+	}
+	if err := request.Context().Err(); err != nil {
+		return nil, err
+	}
+	url := requestURL(request)
+	interaction := transport.Cassette.next(transport.Service, request.Method, url)
+	if interaction == nil {
+		return nil, fmt.Errorf("Cassette %s has no %s response for %s %s",
+			transport.Cassette.Name, transport.Service, request.Method, url)
+	}
+	if interaction.StatusCode == 0 {
+		return nil, fmt.Errorf("%s (replayed)", interaction.Error)
+	}
+	data, err := interaction.ResponseBody.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot replay %s %s: %v", request.Method, url, err)
+	}
+	header := interaction.ResponseHeader.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.StatusCode, http.StatusText(interaction.StatusCode)),
+		StatusCode:    interaction.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       request,
+	}, nil
+}
+
+// bytes returns the body's original data.
+func (body *Body) bytes() ([]byte, error) {
+	if body == nil {
+		return []byte{}, nil
+	}
+	if body.Truncated {
+		return nil, fmt.Errorf("the body was too large to record")
+	}
+	if body.Base64 {
+		return base64.StdEncoding.DecodeString(body.Data)
+	}
+	return []byte(body.Data), nil
+}
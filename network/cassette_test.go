@@ -0,0 +1,195 @@
+package network_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/network"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassette_RecordAndReplayPharos(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	client.SetRoundTripper(&network.RecordingTransport{
+		Transport: client.RoundTripper(),
+		Service:   "pharos",
+	})
+	cassette := network.NewCassette("workitem_1")
+	recording := client.WithContext(network.WithCassette(context.Background(), cassette))
+
+	require.Nil(t, recording.IntellectualObjectGet(obj.Identifier, false, false).Error)
+	require.NotNil(t, recording.IntellectualObjectGet("test.edu/no-such-bag", false, false).Error)
+	obj.Title = "New Title"
+	require.Nil(t, recording.IntellectualObjectSave(obj).Error)
+	// Requests without a cassette aren't recorded.
+	require.Nil(t, client.InstitutionGet("test.edu").Error)
+	require.Equal(t, 3, cassette.Len())
+
+	first := cassette.Interactions[0]
+	assert.Equal(t, "pharos", first.Service)
+	assert.Equal(t, "GET", first.Method)
+	assert.Equal(t, fake.URL+"/api/v2/objects/test.edu%2Fbag1", first.URL)
+	assert.Equal(t, 200, first.StatusCode)
+	assert.Equal(t, "REDACTED", first.RequestHeader.Get("X-Pharos-API-Key"))
+	assert.Equal(t, "user", first.RequestHeader.Get("X-Pharos-API-User"))
+	assert.Contains(t, first.ResponseBody.Data, `"identifier":"test.edu/bag1"`)
+	assert.Equal(t, 404, cassette.Interactions[1].StatusCode)
+	assert.Contains(t, cassette.Interactions[2].RequestBody.Data, "New Title")
+
+	tempDir, err := ioutil.TempDir("", "cassette_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "cassettes", "workitem_1.json")
+	require.Nil(t, cassette.Save(path))
+	fake.Close()
+
+	loaded, err := network.LoadCassette(path)
+	require.Nil(t, err)
+	assert.Equal(t, "workitem_1", loaded.Name)
+	assert.Equal(t, 3, loaded.Unplayed())
+	client.SetRoundTripper(&network.ReplayTransport{Cassette: loaded, Service: "pharos"})
+
+	resp := client.IntellectualObjectGet(obj.Identifier, false, false)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, obj.Id, resp.IntellectualObject().Id)
+	resp = client.IntellectualObjectGet("test.edu/no-such-bag", false, false)
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, 404, resp.Response.StatusCode)
+	resp = client.IntellectualObjectSave(obj)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "New Title", resp.IntellectualObject().Title)
+	assert.Equal(t, 0, loaded.Unplayed())
+
+	// The request we didn't record, and the ones we've already
+	// played, have no responses.
+	instResp := client.InstitutionGet("test.edu")
+	require.NotNil(t, instResp.Error)
+	assert.Contains(t, instResp.Error.Error(), "Cassette workitem_1 has no pharos response for GET")
+	require.NotNil(t, client.IntellectualObjectGet(obj.Identifier, false, false).Error)
+
+	_, err = network.LoadCassette(filepath.Join(tempDir, "nope.json"))
+	assert.NotNil(t, err)
+}
+
+func TestCassette_ReplaysRetriesInOrder(t *testing.T) {
+	attempts := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"id": 1, "name": "College", "identifier": "college.edu"}`)
+	}))
+	defer testServer.Close()
+	client := fastRetryClient(t, testServer.URL)
+	client.SetRoundTripper(&network.RecordingTransport{Service: "pharos"})
+	cassette := network.NewCassette("retries")
+	resp := client.WithContext(network.WithCassette(context.Background(), cassette)).InstitutionGet("college.edu")
+	require.Nil(t, resp.Error)
+	require.Equal(t, 3, cassette.Len())
+	testServer.Close()
+
+	client = fastRetryClient(t, testServer.URL)
+	client.SetRoundTripper(&network.ReplayTransport{Cassette: cassette, Service: "pharos"})
+	// Clients for the same host share their stats.
+	retries := client.Stats().Retries
+	resp = client.InstitutionGet("college.edu")
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "college.edu", resp.Institution().Identifier)
+	assert.EqualValues(t, 2, client.Stats().Retries-retries)
+	assert.Equal(t, 0, cassette.Unplayed())
+}
+
+func TestRecordingTransport_Bodies(t *testing.T) {
+	binary := []byte{0xff, 0xfe, 0x00, 0x01}
+	large := strings.Repeat("x", 100)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			fmt.Fprint(w, large)
+		} else {
+			w.Write(binary)
+		}
+	}))
+	defer testServer.Close()
+	cassette := network.NewCassette("bodies")
+	httpClient := &http.Client{Transport: &network.RecordingTransport{Service: "test", MaxBodySize: 10}}
+	ctx := network.WithCassette(context.Background(), cassette)
+
+	request, err := http.NewRequestWithContext(ctx, "POST", testServer.URL+"/binary", strings.NewReader("request body"))
+	require.Nil(t, err)
+	response, err := httpClient.Do(request)
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	require.Nil(t, err)
+	assert.Equal(t, binary, data)
+
+	// The client gets the whole body, even though the
+	// cassette only has the first MaxBodySize bytes.
+	request, err = http.NewRequestWithContext(ctx, "GET", testServer.URL+"/large", nil)
+	require.Nil(t, err)
+	response, err = httpClient.Do(request)
+	require.Nil(t, err)
+	data, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	require.Nil(t, err)
+	assert.Equal(t, large, string(data))
+
+	require.Equal(t, 2, cassette.Len())
+	posted := cassette.Interactions[0]
+	assert.Equal(t, "request bo", posted.RequestBody.Data)
+	assert.True(t, posted.RequestBody.Truncated)
+	assert.True(t, posted.ResponseBody.Base64)
+	assert.EqualValues(t, 4, posted.ResponseBody.Size)
+	got := cassette.Interactions[1].ResponseBody
+	assert.True(t, got.Truncated)
+	assert.Equal(t, 10, len(got.Data))
+	assert.EqualValues(t, 100, got.Size)
+
+	replayClient := &http.Client{Transport: &network.ReplayTransport{Cassette: cassette, Service: "test"}}
+	response, err = replayClient.Post(testServer.URL+"/binary", "text/plain", strings.NewReader("request body"))
+	require.Nil(t, err)
+	data, _ = ioutil.ReadAll(response.Body)
+	assert.Equal(t, binary, data)
+	_, err = replayClient.Get(testServer.URL + "/large")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "too large to record")
+}
+
+func TestCassette_RecordAndReplayS3(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(network.S3HeadHandler))
+	defer testServer.Close()
+	defer network.SetS3RoundTripper(nil)
+
+	network.SetS3RoundTripper(&network.RecordingTransport{Service: "s3"})
+	cassette := network.NewCassette("s3")
+	client := network.NewS3Head("id", "secret", constants.AWSVirginia, "bucket")
+	client.SetSessionEndpoint(testServer.URL)
+	client.GetSession().Config.S3ForcePathStyle = aws.Bool(true)
+	client.HeadWithContext(network.WithCassette(context.Background(), cassette), "key")
+	require.Empty(t, client.ErrorMessage)
+	require.Equal(t, 1, cassette.Len())
+	assert.Equal(t, "HEAD", cassette.Interactions[0].Method)
+	assert.Equal(t, "REDACTED", cassette.Interactions[0].RequestHeader.Get("Authorization"))
+	testServer.Close()
+
+	network.SetS3RoundTripper(&network.ReplayTransport{Cassette: cassette, Service: "s3"})
+	client = network.NewS3Head("id", "secret", constants.AWSVirginia, "bucket")
+	client.SetSessionEndpoint(testServer.URL)
+	client.GetSession().Config.S3ForcePathStyle = aws.Bool(true)
+	client.HeadWithContext(context.Background(), "key")
+	require.Empty(t, client.ErrorMessage)
+	assert.Equal(t, `"fba9dede5f27731c9771645a39863328"`, *client.Response.ETag)
+	assert.Equal(t, 0, cassette.Unplayed())
+}
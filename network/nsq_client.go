@@ -2,6 +2,7 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/nsqio/nsq/nsqd"
@@ -44,14 +45,31 @@ func NewNSQClient(url string) *NSQClient {
 // For example, prepare_topic, fixity_topic, etc.
 // Param workItemId is the id of the WorkItem record in Pharos we want to queue.
 func (client *NSQClient) Enqueue(topic string, workItemId int) error {
+	return client.EnqueueWithContext(context.Background(), topic, workItemId)
+}
+
+// EnqueueWithContext is like Enqueue, but it gives up if ctx is
+// cancelled or its deadline passes before nsqd responds.
+func (client *NSQClient) EnqueueWithContext(ctx context.Context, topic string, workItemId int) error {
 	idAsString := strconv.Itoa(workItemId)
-	return client.EnqueueString(topic, idAsString)
+	return client.EnqueueStringWithContext(ctx, topic, idAsString)
 }
 
 // EnqueueString posts string data to the specified NSQ topic
 func (client *NSQClient) EnqueueString(topic string, data string) error {
+	return client.EnqueueStringWithContext(context.Background(), topic, data)
+}
+
+// EnqueueStringWithContext is like EnqueueString, but it gives up if
+// ctx is cancelled or its deadline passes before nsqd responds.
+func (client *NSQClient) EnqueueStringWithContext(ctx context.Context, topic string, data string) error {
 	url := fmt.Sprintf("%s/pub?topic=%s", client.URL, topic)
-	resp, err := http.Post(url, "text/html", bytes.NewBuffer([]byte(data)))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer([]byte(data)))
+	if err != nil {
+		return fmt.Errorf("Can't create request to queue data: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/html")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("Nsqd returned an error when queuing data: %v", err)
 	}
@@ -84,8 +102,18 @@ func (client *NSQClient) EnqueueString(topic string, data string) error {
 // returning stats for all topics right now. Also note that requests to
 // /stats/ (with trailing slash) produce a 404.
 func (client *NSQClient) GetStats() (*NSQStatsData, error) {
+	return client.GetStatsWithContext(context.Background())
+}
+
+// GetStatsWithContext is like GetStats, but it gives up if ctx is
+// cancelled or its deadline passes before nsqd responds.
+func (client *NSQClient) GetStatsWithContext(ctx context.Context) (*NSQStatsData, error) {
 	url := fmt.Sprintf("%s/stats?format=json", client.URL)
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
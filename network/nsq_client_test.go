@@ -1,6 +1,7 @@
 package network_test
 
 import (
+	"context"
 	"fmt"
 	"github.com/APTrust/exchange/network"
 	"github.com/stretchr/testify/assert"
@@ -33,6 +34,26 @@ func TestEnqueue(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestEnqueueWithContext(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(nsqEnqueueHandler))
+	defer testServer.Close()
+
+	client := network.NewNSQClient(testServer.URL)
+	nsqTester = t
+	nsqTopic = "test_topic3"
+	nsqId = 7702
+	err := client.EnqueueWithContext(context.Background(), nsqTopic, nsqId)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.EnqueueWithContext(ctx, nsqTopic, nsqId)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), context.Canceled.Error())
+	_, err = client.GetStatsWithContext(ctx)
+	assert.NotNil(t, err)
+}
+
 func TestNSQStatsData(t *testing.T) {
 	testServer := httptest.NewServer(http.HandlerFunc(nsqStatsHandler))
 	defer testServer.Close()
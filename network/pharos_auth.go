@@ -0,0 +1,442 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTokenRefresh is how often a TokenAuthenticator gets a new
+// token from its endpoint when the endpoint doesn't say when its
+// tokens expire.
+const DefaultTokenRefresh = 5 * time.Minute
+
+// tokenExpiryMargin is how long before a token expires that we
+// get a new one, so tokens don't expire while requests are in flight.
+const tokenExpiryMargin = 30 * time.Second
+
+// tokenFetchTimeout is how long we wait for the token endpoint.
+const tokenFetchTimeout = 30 * time.Second
+
+// PharosAuthenticator adds credentials to the requests a PharosClient
+// sends. See SetAuthenticator.
+type PharosAuthenticator interface {
+	// Authenticate adds credentials, such as headers, to request.
+	// PharosClient calls this for every request it sends, including
+	// retries.
+	Authenticate(request *http.Request) error
+
+	// ConfigureTransport makes any changes the authenticator needs to
+	// the client's transport, such as adding client certificates.
+	// PharosClient calls this once, from SetAuthenticator.
+	ConfigureTransport(transport *http.Transport) error
+}
+
+// CredentialInvalidator is implemented by authenticators whose
+// credentials can be revoked or expire before the authenticator
+// expects. When Pharos answers a request with 401 Unauthorized,
+// PharosClient calls InvalidateCredentials and, if it returns true,
+// sends the request once more with fresh credentials.
+type CredentialInvalidator interface {
+	// InvalidateCredentials drops any cached credentials and returns
+	// true if the next call to Authenticate will get new ones.
+	InvalidateCredentials() bool
+}
+
+// HeaderAuthenticator sends the API user and key in the
+// X-Pharos-API-User and X-Pharos-API-Key headers. This is the
+// authenticator NewPharosClient uses.
+type HeaderAuthenticator struct {
+	APIUser string
+	APIKey  string
+}
+
+// Authenticate adds the API user and key headers to request.
+func (auth *HeaderAuthenticator) Authenticate(request *http.Request) error {
+	request.Header.Set("X-Pharos-API-User", auth.APIUser)
+	request.Header.Set("X-Pharos-API-Key", auth.APIKey)
+	return nil
+}
+
+// ConfigureTransport does nothing. Headers don't need transport changes.
+func (auth *HeaderAuthenticator) ConfigureTransport(transport *http.Transport) error {
+	return nil
+}
+
+// TokenAuthenticator sends a short-lived bearer token in the
+// Authorization header. It reads the token from TokenFile, if that's
+// set, or else gets it from TokenURL. It caches the token, and gets a
+// new one when the file changes, when the token is about to expire, or
+// when Pharos rejects it.
+type TokenAuthenticator struct {
+	// TokenFile is the path to a file containing the token.
+	// Leading and trailing whitespace is ignored.
+	TokenFile string
+
+	// TokenURL is an endpoint that returns JSON containing
+	// access_token and, optionally, expires_in (seconds).
+	TokenURL string
+
+	// Credentials, if not nil, authenticates requests to TokenURL.
+	// Typically, this is a HeaderAuthenticator, so the process can
+	// trade its long-lived API key for a short-lived token.
+	Credentials PharosAuthenticator
+
+	// Refresh is how often to get a new token from TokenURL when
+	// the endpoint does not return expires_in. Zero means
+	// DefaultTokenRefresh.
+	Refresh time.Duration
+
+	mutex     sync.Mutex
+	token     string
+	expiresAt time.Time
+	fileMtime time.Time
+	client    *http.Client
+
+	// fetching is closed when the request to TokenURL that's
+	// in progress finishes. It's nil when there's no request.
+	fetching chan struct{}
+}
+
+// tokenResponse is the JSON a token endpoint returns.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Token       string `json:"token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Authenticate adds the Authorization header to request, getting
+// a new token first if necessary. Getting the token from TokenURL
+// stops if the request's context is cancelled.
+func (auth *TokenAuthenticator) Authenticate(request *http.Request) error {
+	token, err := auth.TokenWithContext(request.Context())
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// ConfigureTransport makes requests to TokenURL go through the
+// PharosClient's transport, so they use the same TLS settings as
+// requests to Pharos.
+func (auth *TokenAuthenticator) ConfigureTransport(transport *http.Transport) error {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	auth.client = &http.Client{Transport: transport, Timeout: tokenFetchTimeout}
+	return nil
+}
+
+// InvalidateCredentials drops the cached token, so the next request
+// gets a new one from TokenURL. It returns false for tokens read from
+// TokenFile, because reading the same file again won't help.
+func (auth *TokenAuthenticator) InvalidateCredentials() bool {
+	if auth.TokenFile != "" || auth.TokenURL == "" {
+		return false
+	}
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	auth.token = ""
+	return true
+}
+
+// Token returns the current token, reading or fetching a new one
+// if the cached token is missing, stale or about to expire.
+func (auth *TokenAuthenticator) Token() (string, error) {
+	return auth.TokenWithContext(context.Background())
+}
+
+// TokenWithContext is like Token, but stops waiting for TokenURL
+// when ctx is cancelled.
+func (auth *TokenAuthenticator) TokenWithContext(ctx context.Context) (string, error) {
+	if auth.TokenFile != "" {
+		auth.mutex.Lock()
+		defer auth.mutex.Unlock()
+		return auth.tokenFromFile()
+	}
+	if auth.TokenURL != "" {
+		return auth.tokenFromURL(ctx)
+	}
+	return "", fmt.Errorf("TokenAuthenticator needs a TokenFile or TokenURL")
+}
+
+func (auth *TokenAuthenticator) tokenFromFile() (string, error) {
+	fileInfo, err := os.Stat(auth.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read Pharos token file: %v", err)
+	}
+	if auth.token != "" && fileInfo.ModTime().Equal(auth.fileMtime) {
+		return auth.token, nil
+	}
+	data, err := ioutil.ReadFile(auth.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read Pharos token file: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("Pharos token file %s is empty", auth.TokenFile)
+	}
+	auth.token = token
+	auth.fileMtime = fileInfo.ModTime()
+	return auth.token, nil
+}
+
+// tokenFromURL returns the cached token or gets a new one from
+// TokenURL. The mutex is not held during the request, so a slow token
+// endpoint doesn't block callers that have a context to honor. Only one
+// request is made at a time. Other callers wait for it to finish and
+// then use its token, or try again themselves if it failed.
+func (auth *TokenAuthenticator) tokenFromURL(ctx context.Context) (string, error) {
+	auth.mutex.Lock()
+	for auth.token == "" || !time.Now().Before(auth.expiresAt) {
+		if auth.fetching == nil {
+			return auth.fetchToken(ctx)
+		}
+		fetching := auth.fetching
+		auth.mutex.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return "", fmt.Errorf("Cannot get Pharos token: %v", ctx.Err())
+		}
+		auth.mutex.Lock()
+	}
+	token := auth.token
+	auth.mutex.Unlock()
+	return token, nil
+}
+
+// fetchToken gets a new token from TokenURL and caches it. It must be
+// called with the mutex held, and returns with the mutex released.
+func (auth *TokenAuthenticator) fetchToken(ctx context.Context) (string, error) {
+	done := make(chan struct{})
+	auth.fetching = done
+	client := auth.client
+	auth.mutex.Unlock()
+	if client == nil {
+		client = &http.Client{Timeout: tokenFetchTimeout}
+	}
+	token, lifetime, err := auth.requestToken(ctx, client)
+	auth.mutex.Lock()
+	if err == nil {
+		auth.token = token
+		auth.expiresAt = time.Now().Add(lifetime)
+	}
+	auth.fetching = nil
+	auth.mutex.Unlock()
+	close(done)
+	return token, err
+}
+
+// requestToken asks TokenURL for a token and returns the token
+// and how long we can use it.
+func (auth *TokenAuthenticator) requestToken(ctx context.Context, client *http.Client) (string, time.Duration, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", auth.TokenURL, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	request.Header.Set("Accept", "application/json")
+	if auth.Credentials != nil {
+		if err = auth.Credentials.Authenticate(request); err != nil {
+			return "", 0, err
+		}
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", 0, fmt.Errorf("Cannot get Pharos token: %v", err)
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("Cannot read Pharos token response: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("Token endpoint returned status code %d. Body: %s",
+			response.StatusCode, string(data))
+	}
+	tokenResp := &tokenResponse{}
+	if err = json.Unmarshal(data, tokenResp); err != nil {
+		return "", 0, fmt.Errorf("Cannot parse Pharos token response: %v", err)
+	}
+	token := tokenResp.AccessToken
+	if token == "" {
+		token = tokenResp.Token
+	}
+	if token == "" {
+		return "", 0, fmt.Errorf("Token endpoint response has no access_token")
+	}
+	lifetime := auth.Refresh
+	if lifetime <= 0 {
+		lifetime = DefaultTokenRefresh
+	}
+	if tokenResp.ExpiresIn > 0 {
+		lifetime = time.Duration(tokenResp.ExpiresIn) * time.Second
+		if lifetime > 2*tokenExpiryMargin {
+			lifetime -= tokenExpiryMargin
+		}
+	}
+	return token, lifetime, nil
+}
+
+// ClientCertAuthenticator authenticates with a client certificate
+// (mutual TLS). Because Pharos may also want credentials in each
+// request, it passes Authenticate on to Credentials, if that's set.
+// The certificate is reloaded when CertFile changes, so it can be
+// rotated without restarting the process.
+type ClientCertAuthenticator struct {
+	// CertFile and KeyFile are the PEM-encoded client
+	// certificate and private key.
+	CertFile string
+	KeyFile  string
+
+	// CAFile, if not empty, is a PEM file of certificate authorities
+	// to trust, in addition to the system's, when checking the
+	// server's certificate.
+	CAFile string
+
+	// Credentials, if not nil, adds credentials to each request.
+	Credentials PharosAuthenticator
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	certMtime time.Time
+}
+
+// Authenticate passes request on to Credentials, if there are any.
+// The certificate itself is sent during the TLS handshake.
+func (auth *ClientCertAuthenticator) Authenticate(request *http.Request) error {
+	if auth.Credentials == nil {
+		return nil
+	}
+	return auth.Credentials.Authenticate(request)
+}
+
+// InvalidateCredentials passes the call on to Credentials, if they
+// can be invalidated. A rejected client certificate can't be fixed by
+// sending it again.
+func (auth *ClientCertAuthenticator) InvalidateCredentials() bool {
+	if invalidator, ok := auth.Credentials.(CredentialInvalidator); ok {
+		return invalidator.InvalidateCredentials()
+	}
+	return false
+}
+
+// ConfigureTransport sets up transport to send the client certificate
+// and to trust CAFile. It returns an error if the certificate, key or
+// CA file can't be loaded.
+func (auth *ClientCertAuthenticator) ConfigureTransport(transport *http.Transport) error {
+	if _, err := auth.certificate(); err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return auth.certificate()
+	}
+	if auth.CAFile != "" {
+		pool, err := loadCertPool(auth.CAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+	if auth.Credentials != nil {
+		return auth.Credentials.ConfigureTransport(transport)
+	}
+	return nil
+}
+
+// certificate returns the client certificate, loading it again
+// if the certificate file has changed.
+func (auth *ClientCertAuthenticator) certificate() (*tls.Certificate, error) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	fileInfo, err := os.Stat(auth.CertFile)
+	if err != nil {
+		if auth.cert != nil {
+			// Keep using the old certificate while
+			// a new one is being put in place.
+			return auth.cert, nil
+		}
+		return nil, fmt.Errorf("Cannot read client certificate: %v", err)
+	}
+	if auth.cert != nil && fileInfo.ModTime().Equal(auth.certMtime) {
+		return auth.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(auth.CertFile, auth.KeyFile)
+	if err != nil {
+		if auth.cert != nil {
+			return auth.cert, nil
+		}
+		return nil, fmt.Errorf("Cannot load client certificate: %v", err)
+	}
+	auth.cert = &cert
+	auth.certMtime = fileInfo.ModTime()
+	return auth.cert, nil
+}
+
+// PharosAuthenticatorFromConfig returns the authenticator that config
+// describes. Params apiUser and apiKey are the values of the
+// PHAROS_API_USER and PHAROS_API_KEY environment variables. The "header"
+// method sends these with every request. The "token" method sends them
+// only to the token endpoint. Like NewPharosClient, this won't let the
+// "header" method run without them, except in tests.
+func PharosAuthenticatorFromConfig(config models.PharosAuthConfig, apiUser, apiKey string) (PharosAuthenticator, error) {
+	var auth PharosAuthenticator
+	switch config.Method {
+	case "", "header":
+		testsAreRunning := flag.Lookup("test.v") != nil
+		if !testsAreRunning && (apiUser == "" || apiKey == "") {
+			return nil, fmt.Errorf("PharosAuth: env vars PHAROS_API_USER and PHAROS_API_KEY " +
+				"cannot be empty with the header method")
+		}
+		auth = &HeaderAuthenticator{APIUser: apiUser, APIKey: apiKey}
+	case "token":
+		if config.TokenFile == "" && config.TokenURL == "" {
+			return nil, fmt.Errorf("PharosAuth: the token method needs a TokenFile or TokenURL")
+		}
+		tokenAuth := &TokenAuthenticator{
+			TokenFile: config.TokenFile,
+			TokenURL:  config.TokenURL,
+		}
+		if apiUser != "" || apiKey != "" {
+			tokenAuth.Credentials = &HeaderAuthenticator{APIUser: apiUser, APIKey: apiKey}
+		}
+		if config.TokenRefresh != "" {
+			refresh, err := time.ParseDuration(config.TokenRefresh)
+			if err != nil {
+				return nil, fmt.Errorf("PharosAuth.TokenRefresh: %v", err)
+			}
+			tokenAuth.Refresh = refresh
+		}
+		auth = tokenAuth
+	default:
+		return nil, fmt.Errorf("PharosAuth: unknown method '%s'", config.Method)
+	}
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		if config.ClientCertFile == "" || config.ClientKeyFile == "" {
+			return nil, fmt.Errorf("PharosAuth: ClientCertFile and ClientKeyFile must be set together")
+		}
+		auth = &ClientCertAuthenticator{
+			CertFile:    config.ClientCertFile,
+			KeyFile:     config.ClientKeyFile,
+			CAFile:      config.CAFile,
+			Credentials: auth,
+		}
+	} else if config.CAFile != "" {
+		return nil, fmt.Errorf("PharosAuth: CAFile is only used with ClientCertFile")
+	}
+	return auth, nil
+}
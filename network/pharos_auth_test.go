@@ -0,0 +1,306 @@
+package network_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// authEchoServer returns the credentials it receives in place
+// of an institution name, so tests can see what the client sent.
+func authEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(authEchoHandler))
+}
+
+func authEchoHandler(w http.ResponseWriter, r *http.Request) {
+	credentials := r.Header.Get("Authorization")
+	if credentials == "" {
+		credentials = r.Header.Get("X-Pharos-API-User") + ":" + r.Header.Get("X-Pharos-API-Key")
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		credentials = "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id":1,"name":"%s","identifier":"college.edu"}`, credentials)
+}
+
+func credentialsSent(t *testing.T, client *network.PharosClient) string {
+	resp := client.InstitutionGet("college.edu")
+	require.Nil(t, resp.Error)
+	return resp.Institution().Name
+}
+
+func TestHeaderAuthenticator(t *testing.T) {
+	testServer := authEchoServer()
+	defer testServer.Close()
+	client := fastRetryClient(t, testServer.URL)
+	assert.IsType(t, &network.HeaderAuthenticator{}, client.Authenticator())
+	assert.Equal(t, "user:key", credentialsSent(t, client))
+}
+
+func TestTokenAuthenticator_File(t *testing.T) {
+	testServer := authEchoServer()
+	defer testServer.Close()
+	tempDir, err := ioutil.TempDir("", "pharos_auth_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	tokenFile := filepath.Join(tempDir, "token")
+	require.Nil(t, ioutil.WriteFile(tokenFile, []byte("first-token\n"), 0600))
+	client := fastRetryClient(t, testServer.URL)
+	require.Nil(t, client.SetAuthenticator(&network.TokenAuthenticator{TokenFile: tokenFile}))
+	assert.Equal(t, "Bearer first-token", credentialsSent(t, client))
+
+	// Rotate the token. The client should notice the file changed.
+	require.Nil(t, ioutil.WriteFile(tokenFile, []byte("second-token"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(tokenFile, later, later))
+	assert.Equal(t, "Bearer second-token", credentialsSent(t, client))
+
+	// Don't send requests without credentials.
+	require.Nil(t, os.Remove(tokenFile))
+	resp := client.InstitutionGet("college.edu")
+	require.NotNil(t, resp.Error)
+	assert.Contains(t, resp.Error.Error(), "Cannot read Pharos token file")
+}
+
+func TestTokenAuthenticator_URL(t *testing.T) {
+	var tokenRequests int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&tokenRequests, 1)
+		if r.Header.Get("X-Pharos-API-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, count)
+	}))
+	defer tokenServer.Close()
+	testServer := authEchoServer()
+	defer testServer.Close()
+
+	auth, err := network.PharosAuthenticatorFromConfig(models.PharosAuthConfig{
+		Method:   "token",
+		TokenURL: tokenServer.URL,
+	}, "user", "key")
+	require.Nil(t, err)
+	client := fastRetryClient(t, testServer.URL)
+	require.Nil(t, client.SetAuthenticator(auth))
+
+	// The token is cached until it's about to expire.
+	assert.Equal(t, "Bearer token-1", credentialsSent(t, client))
+	assert.Equal(t, "Bearer token-1", credentialsSent(t, client))
+	assert.EqualValues(t, 1, tokenRequests)
+
+	badAuth, err := network.PharosAuthenticatorFromConfig(models.PharosAuthConfig{
+		Method:   "token",
+		TokenURL: tokenServer.URL,
+	}, "user", "wrong key")
+	require.Nil(t, err)
+	require.Nil(t, client.SetAuthenticator(badAuth))
+	resp := client.InstitutionGet("college.edu")
+	require.NotNil(t, resp.Error)
+	assert.Contains(t, resp.Error.Error(), "Token endpoint returned status code 401")
+}
+
+func TestTokenAuthenticator_Revoked(t *testing.T) {
+	var tokenRequests int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&tokenRequests, 1)
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, count)
+	}))
+	defer tokenServer.Close()
+	// Pharos revoked the first token before it expired.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		authEchoHandler(w, r)
+	}))
+	defer testServer.Close()
+
+	client := fastRetryClient(t, testServer.URL)
+	require.Nil(t, client.SetAuthenticator(&network.TokenAuthenticator{TokenURL: tokenServer.URL}))
+	assert.Equal(t, "Bearer token-2", credentialsSent(t, client))
+	assert.EqualValues(t, 2, tokenRequests)
+}
+
+func TestTokenAuthenticator_SlowEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, `{"access_token":"slow-token"}`)
+	}))
+	defer tokenServer.Close()
+	defer close(release)
+	testServer := authEchoServer()
+	defer testServer.Close()
+	auth := &network.TokenAuthenticator{TokenURL: tokenServer.URL}
+	client := fastRetryClient(t, testServer.URL)
+	require.Nil(t, client.SetAuthenticator(auth))
+
+	// Neither the caller that's waiting for the token endpoint nor
+	// the one waiting for it to finish should outlive its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.WithContext(ctx).InstitutionGet("college.edu").Error
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, err := auth.TokenWithContext(ctx)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "context deadline exceeded")
+	select {
+	case err = <-errs:
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "context deadline exceeded")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request did not stop when its context expired")
+	}
+}
+
+func TestClientCertAuthenticator(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pharos_auth_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	certFile, keyFile, clientCAs := writeClientCert(t, tempDir, "apt_record")
+
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(authEchoHandler))
+	testServer.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	testServer.StartTLS()
+	defer testServer.Close()
+	caFile := filepath.Join(tempDir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", testServer.Certificate().Raw)
+
+	client := fastRetryClient(t, testServer.URL)
+	err = client.SetAuthenticator(&network.ClientCertAuthenticator{
+		CertFile: filepath.Join(tempDir, "missing.pem"),
+		KeyFile:  keyFile,
+	})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Cannot read client certificate")
+
+	auth, err := network.PharosAuthenticatorFromConfig(models.PharosAuthConfig{
+		ClientCertFile: certFile,
+		ClientKeyFile:  keyFile,
+		CAFile:         caFile,
+	}, "user", "key")
+	require.Nil(t, err)
+	require.Nil(t, client.SetAuthenticator(auth))
+	assert.Equal(t, "cert:apt_record", credentialsSent(t, client))
+}
+
+func TestPharosAuthenticatorFromConfig(t *testing.T) {
+	auth, err := network.PharosAuthenticatorFromConfig(models.PharosAuthConfig{}, "user", "key")
+	require.Nil(t, err)
+	assert.Equal(t, &network.HeaderAuthenticator{APIUser: "user", APIKey: "key"}, auth)
+
+	auth, err = network.PharosAuthenticatorFromConfig(models.PharosAuthConfig{
+		Method:       "token",
+		TokenFile:    "/tmp/token",
+		TokenRefresh: "90s",
+	}, "", "")
+	require.Nil(t, err)
+	tokenAuth, ok := auth.(*network.TokenAuthenticator)
+	require.True(t, ok)
+	assert.Equal(t, "/tmp/token", tokenAuth.TokenFile)
+	assert.Equal(t, 90*time.Second, tokenAuth.Refresh)
+	assert.Nil(t, tokenAuth.Credentials)
+
+	auth, err = network.PharosAuthenticatorFromConfig(models.PharosAuthConfig{
+		ClientCertFile: "client.pem",
+		ClientKeyFile:  "client.key",
+	}, "user", "key")
+	require.Nil(t, err)
+	certAuth, ok := auth.(*network.ClientCertAuthenticator)
+	require.True(t, ok)
+	assert.IsType(t, &network.HeaderAuthenticator{}, certAuth.Credentials)
+
+	badConfigs := map[string]models.PharosAuthConfig{
+		"unknown method":    {Method: "kerberos"},
+		"needs a TokenFile": {Method: "token"},
+		"TokenRefresh":      {Method: "token", TokenFile: "token", TokenRefresh: "often"},
+		"set together":      {ClientCertFile: "client.pem"},
+		"CAFile":            {CAFile: "ca.pem"},
+	}
+	for message, config := range badConfigs {
+		_, err = network.PharosAuthenticatorFromConfig(config, "user", "key")
+		require.NotNil(t, err, message)
+		assert.Contains(t, err.Error(), message)
+	}
+}
+
+// writeClientCert creates a CA and a client certificate signed by it,
+// and writes the client certificate and key to dir. It returns the
+// paths to those files and a pool containing the CA certificate.
+func writeClientCert(t *testing.T, dir, commonName string) (string, string, *x509.CertPool) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.Nil(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.Nil(t, err)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	require.Nil(t, err)
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	writePEM(t, certFile, "CERTIFICATE", clientDER)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return certFile, keyFile, pool
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.Nil(t, ioutil.WriteFile(path, data, 0600))
+}
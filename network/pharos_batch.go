@@ -0,0 +1,351 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"net/http"
+	"sync/atomic"
+)
+
+// The batch saves post to the events/create_batch and
+// checksums/create_batch endpoints. Those are not part of the Pharos
+// API this client was first written against, and older Pharos servers
+// don't have them. pharostest.FakePharos implements both. When a server
+// returns 404 for a batch endpoint, the client saves the records one at
+// a time with PremisEventSave and ChecksumSave instead, and keeps doing
+// that for the rest of the process, so workers run against either
+// version.
+
+// DefaultBatchSize is the number of records PremisEventSaveBatch and
+// ChecksumSaveBatch send to Pharos in each request, unless the client's
+// batch size has been changed with SetBatchSize.
+const DefaultBatchSize = 100
+
+// BatchItemError describes a record that a batch save did not save.
+type BatchItemError struct {
+	// Index is the record's position in the list passed to
+	// the batch save.
+	Index int
+
+	// Identifier describes the record in error messages. For events,
+	// this is the event identifier. For checksums, it's the GenericFile
+	// id and the algorithm.
+	Identifier string
+
+	// Err says why the record was not saved.
+	Err error
+}
+
+// Error returns a description of the failure, including the record's
+// identifier.
+func (itemErr *BatchItemError) Error() string {
+	return fmt.Sprintf("Record %d (%s) was not saved: %v",
+		itemErr.Index, itemErr.Identifier, itemErr.Err)
+}
+
+// PharosBatchResponse is the result of a batch save. A batch save sends
+// records to Pharos in chunks of the client's batch size, so it may make
+// many requests. Some chunks may succeed while others fail, so check
+// ItemErrors to see which records were not saved.
+type PharosBatchResponse struct {
+	// Responses contains the response to each request sent to Pharos,
+	// in the order the requests were sent. This is useful for logging.
+	Responses []*PharosResponse
+
+	// ItemErrors describes each record that was not saved.
+	ItemErrors []*BatchItemError
+
+	// Saved copies of the records passed to the batch save. Each
+	// slice has one entry for each record passed in, in the same
+	// order. Entries for records that were not saved are nil.
+	events    []*models.PremisEvent
+	checksums []*models.Checksum
+}
+
+// Error returns an error describing the records that were not saved,
+// or nil if all were saved.
+func (batchResp *PharosBatchResponse) Error() error {
+	if len(batchResp.ItemErrors) == 0 {
+		return nil
+	}
+	total := len(batchResp.events) + len(batchResp.checksums)
+	return fmt.Errorf("%d of %d records were not saved. First error: %v",
+		len(batchResp.ItemErrors), total, batchResp.ItemErrors[0])
+}
+
+// PremisEvents returns the saved copies of the events passed to
+// PremisEventSaveBatch. Entries for events that were not saved are nil.
+func (batchResp *PharosBatchResponse) PremisEvents() []*models.PremisEvent {
+	return batchResp.events
+}
+
+// Checksums returns the saved copies of the checksums passed to
+// ChecksumSaveBatch. Entries for checksums that were not saved are nil.
+func (batchResp *PharosBatchResponse) Checksums() []*models.Checksum {
+	return batchResp.checksums
+}
+
+func (batchResp *PharosBatchResponse) addItemError(index int, identifier string, err error) {
+	batchResp.ItemErrors = append(batchResp.ItemErrors, &BatchItemError{
+		Index:      index,
+		Identifier: identifier,
+		Err:        err,
+	})
+}
+
+// SetBatchSize sets the maximum number of records PremisEventSaveBatch
+// and ChecksumSaveBatch send to Pharos in one request. Values less than
+// one mean DefaultBatchSize.
+func (client *PharosClient) SetBatchSize(size int) {
+	client.batchSize = size
+}
+
+// batchEndpointsMissing returns true if Pharos has told us it has no
+// batch endpoints. Copies of the client made with WithContext share this.
+func (client *PharosClient) batchEndpointsMissing() bool {
+	return client.noBatch != nil && atomic.LoadInt32(client.noBatch) == 1
+}
+
+func (client *PharosClient) setBatchEndpointsMissing() {
+	if client.noBatch != nil {
+		atomic.StoreInt32(client.noBatch, 1)
+	}
+}
+
+// BatchSize returns the maximum number of records PremisEventSaveBatch
+// and ChecksumSaveBatch send to Pharos in one request.
+func (client *PharosClient) BatchSize() int {
+	if client.batchSize < 1 {
+		return DefaultBatchSize
+	}
+	return client.batchSize
+}
+
+// PremisEventSaveBatch creates new PremisEvents in Pharos. This is for
+// new events only, so each event should have an Id of zero. Events are
+// sent in chunks of BatchSize. Pharos saves each chunk in a transaction,
+// so if Pharos rejects a chunk, this resends the events in that chunk
+// one at a time, to find out which events were bad and to save the rest.
+//
+// The response's PremisEvents() are the saved copies of the events,
+// with ids and timestamps, in the same order as param events. Check
+// the response's ItemErrors for events that were not saved.
+func (client *PharosClient) PremisEventSaveBatch(events []*models.PremisEvent) *PharosBatchResponse {
+	batchResp := &PharosBatchResponse{
+		Responses:  make([]*PharosResponse, 0),
+		ItemErrors: make([]*BatchItemError, 0),
+		events:     make([]*models.PremisEvent, len(events)),
+	}
+	toSave := make([]int, 0, len(events))
+	for i, event := range events {
+		if event.Id != 0 {
+			batchResp.addItemError(i, event.Identifier, fmt.Errorf(
+				"Event has non-zero id %d. PremisEventSaveBatch "+
+					"is for creating new events only.", event.Id))
+			continue
+		}
+		toSave = append(toSave, i)
+	}
+	relativeUrl := fmt.Sprintf("/api/%s/events/create_batch", client.apiVersion)
+	client.saveInChunks(batchResp, toSave, PharosPremisEvent, relativeUrl,
+		func(i int) interface{} { return models.NewPremisEventForPharos(events[i]) },
+		func(i int) string { return events[i].Identifier },
+		func(i int) *PharosResponse {
+			resp := client.PremisEventSave(events[i])
+			if resp.Error == nil {
+				batchResp.events[i] = resp.PremisEvent()
+			}
+			return resp
+		},
+		func(resp *PharosResponse, chunk []int) map[int]bool {
+			byIdentifier := make(map[string]*models.PremisEvent)
+			for _, saved := range resp.PremisEvents() {
+				if saved != nil {
+					byIdentifier[saved.Identifier] = saved
+				}
+			}
+			found := make(map[int]bool)
+			for _, i := range chunk {
+				if saved := byIdentifier[events[i].Identifier]; saved != nil {
+					batchResp.events[i] = saved
+					found[i] = true
+				}
+			}
+			return found
+		})
+	return batchResp
+}
+
+// ChecksumSaveBatch creates new Checksums in Pharos. Each checksum must
+// have the Id of the GenericFile it belongs to, and an Id of zero.
+// Checksums are sent in chunks of BatchSize and, as with
+// PremisEventSaveBatch, the checksums in a chunk that Pharos rejects
+// are resent one at a time.
+//
+// Param gfIdentifiers holds the identifier of each checksum's
+// GenericFile, in the same order as checksums. ChecksumSave needs
+// these when Pharos has no batch endpoint.
+//
+// The response's Checksums() are the saved copies of the checksums,
+// in the same order as param checksums. Check the response's ItemErrors
+// for checksums that were not saved.
+func (client *PharosClient) ChecksumSaveBatch(checksums []*models.Checksum, gfIdentifiers []string) *PharosBatchResponse {
+	batchResp := &PharosBatchResponse{
+		Responses:  make([]*PharosResponse, 0),
+		ItemErrors: make([]*BatchItemError, 0),
+		checksums:  make([]*models.Checksum, len(checksums)),
+	}
+	describe := func(i int) string {
+		return fmt.Sprintf("GenericFile %d %s", checksums[i].GenericFileId, checksums[i].Algorithm)
+	}
+	// Pharos does not return anything that identifies a checksum
+	// other than its contents, so we match on those.
+	key := func(cs *models.Checksum) string {
+		return fmt.Sprintf("%d %s %s", cs.GenericFileId, cs.Algorithm, cs.Digest)
+	}
+	toSave := make([]int, 0, len(checksums))
+	for i, cs := range checksums {
+		if cs.Id != 0 {
+			batchResp.addItemError(i, describe(i), fmt.Errorf(
+				"Checksum has non-zero id %d. ChecksumSaveBatch "+
+					"is for creating new checksums only.", cs.Id))
+			continue
+		}
+		if cs.GenericFileId == 0 {
+			batchResp.addItemError(i, describe(i), fmt.Errorf(
+				"Checksum has no GenericFileId."))
+			continue
+		}
+		toSave = append(toSave, i)
+	}
+	relativeUrl := fmt.Sprintf("/api/%s/checksums/create_batch", client.apiVersion)
+	client.saveInChunks(batchResp, toSave, PharosChecksum, relativeUrl,
+		func(i int) interface{} { return models.NewChecksumForPharos(checksums[i]) },
+		describe,
+		func(i int) *PharosResponse {
+			if i >= len(gfIdentifiers) || gfIdentifiers[i] == "" {
+				resp := NewPharosResponse(PharosChecksum)
+				resp.Error = fmt.Errorf("Cannot save checksum without the identifier of its GenericFile.")
+				return resp
+			}
+			resp := client.ChecksumSave(checksums[i], gfIdentifiers[i])
+			if resp.Error == nil {
+				batchResp.checksums[i] = resp.Checksum()
+			}
+			return resp
+		},
+		func(resp *PharosResponse, chunk []int) map[int]bool {
+			byKey := make(map[string][]*models.Checksum)
+			for _, saved := range resp.Checksums() {
+				if saved != nil {
+					byKey[key(saved)] = append(byKey[key(saved)], saved)
+				}
+			}
+			found := make(map[int]bool)
+			for _, i := range chunk {
+				matches := byKey[key(checksums[i])]
+				if len(matches) > 0 {
+					batchResp.checksums[i] = matches[0]
+					byKey[key(checksums[i])] = matches[1:]
+					found[i] = true
+				}
+			}
+			return found
+		})
+	return batchResp
+}
+
+// saveInChunks does the work of the batch saves above. Param indexes
+// lists the positions of the records to save. Param serialize returns
+// the JSON structure for a record, and describe returns its identifier
+// for error messages. Param saveOne saves a single record without the
+// batch endpoint, and copies the saved record into batchResp. Param
+// match copies the saved records in a successful response into
+// batchResp and returns the indexes it found.
+func (client *PharosClient) saveInChunks(
+	batchResp *PharosBatchResponse,
+	indexes []int,
+	objType PharosObjectType,
+	relativeUrl string,
+	serialize func(int) interface{},
+	describe func(int) string,
+	saveOne func(int) *PharosResponse,
+	match func(*PharosResponse, []int) map[int]bool) {
+
+	absoluteUrl := client.BuildUrl(relativeUrl)
+	postChunk := func(chunk []int) *PharosResponse {
+		batch := make([]interface{}, len(chunk))
+		for j, i := range chunk {
+			batch[j] = serialize(i)
+		}
+		resp := NewPharosResponse(objType)
+		batchResp.Responses = append(batchResp.Responses, resp)
+		postData, err := json.Marshal(batch)
+		if err != nil {
+			resp.Error = fmt.Errorf("Error marshalling batch to JSON: %v", err)
+			return resp
+		}
+		client.DoRequest(resp, "POST", absoluteUrl, bytes.NewBuffer(postData))
+		if resp.Error == nil {
+			resp.UnmarshalJsonList()
+		}
+		if resp.Error == nil {
+			found := match(resp, chunk)
+			for _, i := range chunk {
+				if !found[i] {
+					batchResp.addItemError(i, describe(i), fmt.Errorf(
+						"Pharos did not return this record in its response to the batch save."))
+				}
+			}
+		}
+		return resp
+	}
+	saveEach := func(chunk []int) {
+		for _, i := range chunk {
+			resp := saveOne(i)
+			batchResp.Responses = append(batchResp.Responses, resp)
+			if resp.Error != nil {
+				batchResp.addItemError(i, describe(i), resp.Error)
+			}
+		}
+	}
+	batchSize := client.BatchSize()
+	for start := 0; start < len(indexes); start += batchSize {
+		end := start + batchSize
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+		chunk := indexes[start:end]
+		if client.batchEndpointsMissing() {
+			saveEach(chunk)
+			continue
+		}
+		resp := postChunk(chunk)
+		if resp.Error == nil {
+			continue
+		}
+		// An older Pharos without the batch endpoints returns 404.
+		// Save the records one at a time instead.
+		if resp.Response != nil && resp.Response.StatusCode == http.StatusNotFound {
+			client.setBatchEndpointsMissing()
+			saveEach(chunk)
+			continue
+		}
+		// If Pharos rejected the chunk, or the chunk didn't match its
+		// schema, one or more records in it are invalid, and Pharos
+		// rolled back or never saw the whole chunk. Send the records
+		// one at a time to find the bad ones and save the rest. If
+		// Pharos is down or the request never got there, don't bother.
+		rejected := len(chunk) > 1 && (isInvalidRequest(resp.Error) || (resp.Response != nil &&
+			resp.Response.StatusCode >= 400 && resp.Response.StatusCode < 500))
+		for _, i := range chunk {
+			if !rejected {
+				batchResp.addItemError(i, describe(i), resp.Error)
+			} else if singleResp := postChunk([]int{i}); singleResp.Error != nil {
+				batchResp.addItemError(i, describe(i), singleResp.Error)
+			}
+		}
+	}
+}
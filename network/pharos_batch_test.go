@@ -0,0 +1,242 @@
+package network_test
+
+import (
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/network/pharostest"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func makeUnsavedEvents(count int, obj *models.IntellectualObject) []*models.PremisEvent {
+	events := make([]*models.PremisEvent, count)
+	for i := range events {
+		events[i] = testutil.MakePremisEvent()
+		events[i].Id = 0
+		events[i].IntellectualObjectId = obj.Id
+		events[i].IntellectualObjectIdentifier = obj.Identifier
+	}
+	return events
+}
+
+func TestPremisEventSaveBatch(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	client.SetBatchSize(3)
+	assert.Equal(t, 3, client.BatchSize())
+
+	events := makeUnsavedEvents(7, obj)
+	resp := client.PremisEventSaveBatch(events)
+	require.Nil(t, resp.Error())
+	assert.Empty(t, resp.ItemErrors)
+	assert.Equal(t, 3, len(resp.Responses))
+	require.Equal(t, 7, len(resp.PremisEvents()))
+	for i, saved := range resp.PremisEvents() {
+		require.NotNil(t, saved)
+		assert.Equal(t, events[i].Identifier, saved.Identifier)
+		assert.NotEqual(t, 0, saved.Id)
+		assert.False(t, saved.CreatedAt.IsZero())
+	}
+
+	params := url.Values{}
+	params.Set("object_identifier", obj.Identifier)
+	listResp := client.PremisEventList(params)
+	require.Nil(t, listResp.Error)
+	assert.Equal(t, 7, listResp.Count)
+}
+
+func TestPremisEventSaveBatch_PartialFailure(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	client.SetBatchSize(5)
+
+	// Event 1 is already saved, and event 3 duplicates event 2,
+	// so Pharos rejects the chunk containing 2, 3, 4 and 5.
+	events := makeUnsavedEvents(6, obj)
+	events[1].Id = 1234
+	events[3].Identifier = events[2].Identifier
+	resp := client.PremisEventSaveBatch(events)
+	require.NotNil(t, resp.Error())
+	assert.Contains(t, resp.Error().Error(), "2 of 6 records were not saved")
+
+	require.Equal(t, 2, len(resp.ItemErrors))
+	failed := make(map[int]bool)
+	for _, itemErr := range resp.ItemErrors {
+		failed[itemErr.Index] = true
+		assert.Equal(t, events[itemErr.Index].Identifier, itemErr.Identifier)
+	}
+	assert.True(t, failed[1])
+	assert.True(t, failed[3])
+
+	for i, saved := range resp.PremisEvents() {
+		if failed[i] {
+			assert.Nil(t, saved)
+		} else {
+			require.NotNil(t, saved)
+			assert.NotEqual(t, 0, saved.Id)
+		}
+	}
+	// One chunk, then one request for each event in the rejected chunk.
+	assert.Equal(t, 6, len(resp.Responses))
+}
+
+func TestPremisEventSaveBatch_ServerDown(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	fake.Close()
+	policy := fastRetryPolicy()
+	policy.MaxAttempts = 1
+	policy.FailureThreshold = 0
+	client.SetRetryPolicy(policy)
+
+	// Don't send records one at a time when Pharos isn't there.
+	resp := client.PremisEventSaveBatch(makeUnsavedEvents(4, obj))
+	require.NotNil(t, resp.Error())
+	assert.Equal(t, 4, len(resp.ItemErrors))
+	assert.Equal(t, 1, len(resp.Responses))
+}
+
+// oldPharos serves the fake's API without the create_batch endpoints,
+// like Pharos versions that predate them. It counts the batch requests.
+func oldPharos(fake *pharostest.FakePharos, batchRequests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/create_batch/") || strings.HasSuffix(r.URL.Path, "/create_batch") {
+			*batchRequests++
+			http.NotFound(w, r)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+}
+
+func TestPremisEventSaveBatch_NoBatchEndpoint(t *testing.T) {
+	fake, _, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	batchRequests := 0
+	server := oldPharos(fake, &batchRequests)
+	defer server.Close()
+	client := fastRetryClient(t, server.URL)
+	client.SetBatchSize(3)
+
+	// The first chunk gets a 404, so the client saves the
+	// events one at a time.
+	events := makeUnsavedEvents(4, obj)
+	resp := client.PremisEventSaveBatch(events)
+	require.Nil(t, resp.Error())
+	assert.Empty(t, resp.ItemErrors)
+	assert.Equal(t, 1, batchRequests)
+	assert.Equal(t, 5, len(resp.Responses))
+	for i, saved := range resp.PremisEvents() {
+		require.NotNil(t, saved)
+		assert.Equal(t, events[i].Identifier, saved.Identifier)
+		assert.NotEqual(t, 0, saved.Id)
+	}
+
+	// Once the client knows the endpoint is missing,
+	// it doesn't ask again.
+	resp = client.PremisEventSaveBatch(makeUnsavedEvents(2, obj))
+	require.Nil(t, resp.Error())
+	assert.Equal(t, 1, batchRequests)
+	assert.Equal(t, 2, len(resp.Responses))
+
+	params := url.Values{}
+	params.Set("object_identifier", obj.Identifier)
+	listResp := client.PremisEventList(params)
+	require.Nil(t, listResp.Error)
+	assert.Equal(t, 6, listResp.Count)
+}
+
+func TestChecksumSaveBatch_NoBatchEndpoint(t *testing.T) {
+	fake, _, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	gf := testutil.MakeGenericFile(0, 0, obj.Identifier)
+	gf.IntellectualObjectId = obj.Id
+	gf, err := fake.AddGenericFile(gf)
+	require.Nil(t, err)
+	batchRequests := 0
+	server := oldPharos(fake, &batchRequests)
+	defer server.Close()
+	client := fastRetryClient(t, server.URL)
+
+	checksums := make([]*models.Checksum, 3)
+	gfIdentifiers := make([]string, 3)
+	for i := range checksums {
+		checksums[i] = testutil.MakeChecksum()
+		checksums[i].Id = 0
+		checksums[i].GenericFileId = gf.Id
+		checksums[i].Algorithm = constants.AlgSha256
+		gfIdentifiers[i] = gf.Identifier
+	}
+	// A single save needs the file identifier.
+	gfIdentifiers[2] = ""
+
+	resp := client.ChecksumSaveBatch(checksums, gfIdentifiers)
+	require.NotNil(t, resp.Error())
+	require.Equal(t, 1, len(resp.ItemErrors))
+	assert.Equal(t, 2, resp.ItemErrors[0].Index)
+	assert.Equal(t, 1, batchRequests)
+	for _, saved := range resp.Checksums()[:2] {
+		require.NotNil(t, saved)
+		assert.NotEqual(t, 0, saved.Id)
+	}
+	assert.Nil(t, resp.Checksums()[2])
+
+	params := url.Values{}
+	params.Set("generic_file_identifier", gf.Identifier)
+	listResp := client.ChecksumList(params)
+	require.Nil(t, listResp.Error)
+	assert.Equal(t, 2, listResp.Count)
+}
+
+func TestChecksumSaveBatch(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	gf := testutil.MakeGenericFile(0, 0, obj.Identifier)
+	gf.IntellectualObjectId = obj.Id
+	gf, err := fake.AddGenericFile(gf)
+	require.Nil(t, err)
+	client.SetBatchSize(2)
+
+	checksums := make([]*models.Checksum, 5)
+	for i := range checksums {
+		checksums[i] = testutil.MakeChecksum()
+		checksums[i].Id = 0
+		checksums[i].GenericFileId = gf.Id
+		checksums[i].Algorithm = constants.AlgSha256
+	}
+	checksums[4].GenericFileId = 0
+	gfIdentifiers := []string{gf.Identifier, gf.Identifier, gf.Identifier, gf.Identifier, gf.Identifier}
+
+	resp := client.ChecksumSaveBatch(checksums, gfIdentifiers)
+	require.NotNil(t, resp.Error())
+	require.Equal(t, 1, len(resp.ItemErrors))
+	assert.Equal(t, 4, resp.ItemErrors[0].Index)
+	assert.Equal(t, 2, len(resp.Responses))
+	for i, saved := range resp.Checksums()[:4] {
+		require.NotNil(t, saved)
+		assert.NotEqual(t, 0, saved.Id)
+		assert.Equal(t, checksums[i].Digest, saved.Digest)
+	}
+	assert.Nil(t, resp.Checksums()[4])
+
+	params := url.Values{}
+	params.Set("generic_file_identifier", gf.Identifier)
+	listResp := client.ChecksumList(params)
+	require.Nil(t, listResp.Error)
+	assert.Equal(t, 4, listResp.Count)
+}
+
+func TestBatchItemError(t *testing.T) {
+	itemErr := &network.BatchItemError{
+		Index:      3,
+		Identifier: "1234-5678",
+		Err:        assert.AnError,
+	}
+	assert.Equal(t, "Record 3 (1234-5678) was not saved: "+assert.AnError.Error(), itemErr.Error())
+}
@@ -0,0 +1,251 @@
+package network
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is how long a PharosCache keeps responses when
+// its TTL is not set.
+const DefaultCacheTTL = 5 * time.Minute
+
+// DefaultCacheTypes are the types of records a PharosCache caches
+// when its Types are not set. Institutions rarely change, and workers
+// look them up over and over. Objects and files are not cached by
+// default, because other workers change them while we're processing
+// a bag, and a stale object or file can lead us to record the wrong
+// thing. WorkItems are not cached, because the queue workers poll
+// for them and need fresh results.
+var DefaultCacheTypes = []PharosObjectType{
+	PharosInstitution,
+}
+
+// cacheDependents lists the types of cached responses that may contain
+// records of each type. Saving a record invalidates cached responses of
+// its own type and of the types listed here. For example, an object
+// fetched with its files includes the files, so saving a file
+// invalidates cached objects.
+var cacheDependents = map[PharosObjectType][]PharosObjectType{
+	PharosGenericFile:   {PharosIntellectualObject},
+	PharosChecksum:      {PharosGenericFile},
+	PharosPremisEvent:   {PharosGenericFile, PharosIntellectualObject},
+	PharosWorkItemState: {PharosWorkItem},
+}
+
+// PharosCache is a size-bounded LRU cache of successful GET responses
+// from Pharos, keyed by URL. Entries expire after the cache's TTL.
+// Any request other than a GET invalidates all cached responses of
+// the same type, and of the types that may contain records of that
+// type, since we can't tell from a URL which lists or parent records
+// a saved record appears in.
+//
+// The cache only knows about changes this process makes. Records
+// that other processes change stay stale for up to TTL, so only
+// cache records that change rarely or that this process owns.
+//
+// A PharosCache is safe for concurrent use, and may be shared by
+// many PharosClients. See PharosClient.SetCache.
+type PharosCache struct {
+	maxEntries int
+	ttl        time.Duration
+	types      map[PharosObjectType]bool
+
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   PharosCacheStats
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	url        string
+	objectType PharosObjectType
+	statusCode int
+	header     http.Header
+	data       []byte
+	expires    time.Time
+}
+
+// PharosCacheStats are counters describing how well a PharosCache
+// is working.
+type PharosCacheStats struct {
+	// Hits is the number of requests answered from the cache.
+	Hits int64
+	// Misses is the number of cacheable requests that went to Pharos.
+	Misses int64
+	// Evictions is the number of entries removed to make room
+	// for new ones.
+	Evictions int64
+	// Invalidations is the number of entries removed because
+	// of changes to records of the same type.
+	Invalidations int64
+	// Entries is the number of entries in the cache right now.
+	Entries int
+}
+
+// String returns the stats in a format suitable for logging.
+func (stats PharosCacheStats) String() string {
+	return fmt.Sprintf("hits=%d misses=%d evictions=%d invalidations=%d entries=%d",
+		stats.Hits, stats.Misses, stats.Evictions, stats.Invalidations, stats.Entries)
+}
+
+// NewPharosCache returns a cache that holds up to maxEntries responses
+// for up to ttl. A ttl of zero means DefaultCacheTTL. Param types lists
+// the types of records to cache. If it's empty, the cache holds
+// DefaultCacheTypes.
+func NewPharosCache(maxEntries int, ttl time.Duration, types ...PharosObjectType) *PharosCache {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	if len(types) == 0 {
+		types = DefaultCacheTypes
+	}
+	cache := &PharosCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		types:      make(map[PharosObjectType]bool),
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+	for _, objType := range types {
+		cache.types[objType] = true
+	}
+	return cache
+}
+
+// PharosCacheFromConfig returns the cache that config describes,
+// or nil if config.MaxEntries is zero, which means don't cache.
+func PharosCacheFromConfig(config models.PharosCacheConfig) (*PharosCache, error) {
+	if config.MaxEntries <= 0 {
+		return nil, nil
+	}
+	var ttl time.Duration
+	if config.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(config.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("PharosCache.TTL: %v", err)
+		}
+	}
+	types := make([]PharosObjectType, 0, len(config.Types))
+	for _, name := range config.Types {
+		objType := PharosObjectType(name)
+		switch objType {
+		case PharosIntellectualObject, PharosInstitution, PharosGenericFile,
+			PharosChecksum, PharosPremisEvent, PharosWorkItem, PharosWorkItemState:
+			types = append(types, objType)
+		default:
+			return nil, fmt.Errorf("PharosCache.Types: unknown type '%s'", name)
+		}
+	}
+	return NewPharosCache(config.MaxEntries, ttl, types...), nil
+}
+
+// Caches returns true if this cache holds responses of type objType.
+func (cache *PharosCache) Caches(objType PharosObjectType) bool {
+	return cache.types[objType]
+}
+
+// Stats returns this cache's counters.
+func (cache *PharosCache) Stats() PharosCacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	stats := cache.stats
+	stats.Entries = cache.lru.Len()
+	return stats
+}
+
+// Purge removes all entries from the cache.
+func (cache *PharosCache) Purge() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.lru.Init()
+	cache.entries = make(map[string]*list.Element)
+}
+
+// Invalidate removes all cached responses of type objType, and of the
+// types that may contain records of type objType.
+func (cache *PharosCache) Invalidate(objType PharosObjectType) {
+	stale := map[PharosObjectType]bool{objType: true}
+	for _, dependent := range cacheDependents[objType] {
+		stale[dependent] = true
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for element := cache.lru.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*cacheEntry)
+		if stale[entry.objectType] {
+			cache.remove(element)
+			cache.stats.Invalidations += 1
+		}
+		element = next
+	}
+}
+
+// get returns the unexpired entry for url, or nil.
+func (cache *PharosCache) get(url string) *cacheEntry {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element := cache.entries[url]
+	if element == nil {
+		cache.stats.Misses += 1
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.remove(element)
+		cache.stats.Misses += 1
+		return nil
+	}
+	cache.lru.MoveToFront(element)
+	cache.stats.Hits += 1
+	return entry
+}
+
+// put caches resp, which must be the successful response to a GET
+// for url, evicting the least recently used entries to make room.
+func (cache *PharosCache) put(url string, resp *PharosResponse) {
+	entry := &cacheEntry{
+		url:        url,
+		objectType: resp.objectType,
+		statusCode: resp.Response.StatusCode,
+		header:     resp.Response.Header.Clone(),
+		data:       resp.data,
+		expires:    time.Now().Add(cache.ttl),
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element := cache.entries[url]; element != nil {
+		cache.remove(element)
+	}
+	cache.entries[url] = cache.lru.PushFront(entry)
+	for cache.lru.Len() > cache.maxEntries {
+		cache.remove(cache.lru.Back())
+		cache.stats.Evictions += 1
+	}
+}
+
+// remove removes element. The caller must hold the mutex.
+func (cache *PharosCache) remove(element *list.Element) {
+	cache.lru.Remove(element)
+	delete(cache.entries, element.Value.(*cacheEntry).url)
+}
+
+// fill copies entry into resp, as if resp had come from Pharos.
+func (entry *cacheEntry) fill(resp *PharosResponse) {
+	resp.Response = &http.Response{
+		Status:     fmt.Sprintf("%d %s", entry.statusCode, http.StatusText(entry.statusCode)),
+		StatusCode: entry.statusCode,
+		Header:     entry.header.Clone(),
+		Body:       http.NoBody,
+		Request:    resp.Request,
+	}
+	resp.data = entry.data
+	resp.hasBeenRead = true
+	resp.Error = nil
+}
@@ -0,0 +1,149 @@
+package network_test
+
+import (
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestPharosCache_Get(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	client.SetCache(network.NewPharosCache(10, time.Minute, network.PharosIntellectualObject))
+
+	for i := 0; i < 3; i++ {
+		resp := client.IntellectualObjectGet(obj.Identifier, false, false)
+		require.Nil(t, resp.Error)
+		assert.Equal(t, obj.Id, resp.IntellectualObject().Id)
+		assert.Equal(t, 200, resp.Response.StatusCode)
+		require.NotNil(t, resp.Request)
+	}
+	assert.EqualValues(t, 1, client.Stats().Requests)
+	stats := client.Cache().Stats()
+	assert.EqualValues(t, 2, stats.Hits)
+	assert.EqualValues(t, 1, stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+
+	// Different URLs are different entries.
+	resp := client.IntellectualObjectGet(obj.Identifier, true, false)
+	require.Nil(t, resp.Error)
+	assert.EqualValues(t, 2, client.Stats().Requests)
+
+	// Errors aren't cached.
+	for i := 0; i < 2; i++ {
+		resp = client.IntellectualObjectGet("test.edu/no-such-bag", false, false)
+		require.NotNil(t, resp.Error)
+	}
+	assert.EqualValues(t, 4, client.Stats().Requests)
+	assert.Equal(t, 2, client.Cache().Stats().Entries)
+
+	// WorkItems aren't cached by default.
+	item := fake.AddWorkItem(testutil.MakeWorkItem())
+	client.WorkItemGet(item.Id)
+	client.WorkItemGet(item.Id)
+	assert.EqualValues(t, 6, client.Stats().Requests)
+
+	// Copies made with WithContext share the cache.
+	resp = client.WithContext(client.Context()).IntellectualObjectGet(obj.Identifier, false, false)
+	require.Nil(t, resp.Error)
+	assert.EqualValues(t, 6, client.Stats().Requests)
+}
+
+func TestPharosCache_Invalidate(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	client.SetCache(network.NewPharosCache(10, time.Minute, network.PharosInstitution,
+		network.PharosIntellectualObject, network.PharosGenericFile))
+
+	gf := testutil.MakeGenericFile(0, 0, obj.Identifier)
+	gf.IntellectualObjectId = obj.Id
+	gf, err := fake.AddGenericFile(gf)
+	require.Nil(t, err)
+	require.Nil(t, client.GenericFileGet(gf.Identifier, false).Error)
+	require.Nil(t, client.IntellectualObjectGet(obj.Identifier, true, false).Error)
+	require.Nil(t, client.InstitutionGet("test.edu").Error)
+	assert.Equal(t, 3, client.Cache().Stats().Entries)
+
+	// Saving a file invalidates cached files and objects,
+	// since objects may include their files.
+	gf.Size = 12345
+	resp := client.GenericFileSave(gf)
+	require.Nil(t, resp.Error)
+	stats := client.Cache().Stats()
+	assert.EqualValues(t, 2, stats.Invalidations)
+	assert.Equal(t, 1, stats.Entries)
+
+	resp = client.GenericFileGet(gf.Identifier, false)
+	require.Nil(t, resp.Error)
+	assert.EqualValues(t, 12345, resp.GenericFile().Size)
+
+	client.Cache().Purge()
+	assert.Equal(t, 0, client.Cache().Stats().Entries)
+}
+
+func TestPharosCache_DefaultTypes(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	client.SetCache(network.NewPharosCache(10, time.Minute))
+
+	// Only institutions are cached by default.
+	require.Nil(t, client.InstitutionGet("test.edu").Error)
+	require.Nil(t, client.InstitutionGet("test.edu").Error)
+	assert.EqualValues(t, 1, client.Stats().Requests)
+	require.Nil(t, client.IntellectualObjectGet(obj.Identifier, false, false).Error)
+	require.Nil(t, client.IntellectualObjectGet(obj.Identifier, false, false).Error)
+	assert.EqualValues(t, 3, client.Stats().Requests)
+	assert.True(t, client.Cache().Caches(network.PharosInstitution))
+	assert.False(t, client.Cache().Caches(network.PharosIntellectualObject))
+	assert.False(t, client.Cache().Caches(network.PharosGenericFile))
+}
+
+func TestPharosCache_ExpiryAndEviction(t *testing.T) {
+	fake, client, _ := fakePharosWithObject(t)
+	defer fake.Close()
+	fake.AddInstitution(&models.Institution{Name: "College", Identifier: "college.edu"})
+	fake.AddInstitution(&models.Institution{Name: "School", Identifier: "school.edu"})
+	client.SetCache(network.NewPharosCache(2, 50*time.Millisecond))
+
+	// The least recently used entry goes first.
+	client.InstitutionGet("test.edu")
+	client.InstitutionGet("college.edu")
+	client.InstitutionGet("test.edu")
+	client.InstitutionGet("school.edu")
+	assert.EqualValues(t, 1, client.Cache().Stats().Evictions)
+	client.InstitutionGet("test.edu")
+	assert.EqualValues(t, 3, client.Stats().Requests)
+	client.InstitutionGet("college.edu")
+	assert.EqualValues(t, 4, client.Stats().Requests)
+
+	time.Sleep(60 * time.Millisecond)
+	client.InstitutionGet("test.edu")
+	assert.EqualValues(t, 5, client.Stats().Requests)
+}
+
+func TestPharosCacheFromConfig(t *testing.T) {
+	cache, err := network.PharosCacheFromConfig(models.PharosCacheConfig{})
+	require.Nil(t, err)
+	assert.Nil(t, cache)
+
+	cache, err = network.PharosCacheFromConfig(models.PharosCacheConfig{
+		MaxEntries: 100,
+		TTL:        "30s",
+		Types:      []string{"WorkItem"},
+	})
+	require.Nil(t, err)
+	require.NotNil(t, cache)
+	assert.True(t, cache.Caches(network.PharosWorkItem))
+	assert.False(t, cache.Caches(network.PharosInstitution))
+
+	_, err = network.PharosCacheFromConfig(models.PharosCacheConfig{MaxEntries: 1, TTL: "later"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "PharosCache.TTL")
+	_, err = network.PharosCacheFromConfig(models.PharosCacheConfig{MaxEntries: 1, Types: []string{"Bag"}})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unknown type 'Bag'")
+}
@@ -2,15 +2,18 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/APTrust/exchange/models"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"strings"
+	"sync/atomic"
 )
 
 // PharosClient supports basic calls to the Pharos Admin REST API.
@@ -18,19 +21,35 @@ import (
 type PharosClient struct {
 	hostUrl    string
 	apiVersion string
-	apiUser    string
-	apiKey     string
 	httpClient *http.Client
 	transport  *http.Transport
+
+	authenticator PharosAuthenticator
+
+	retryPolicy *RetryPolicy
+	breaker     *circuitBreaker
+	batchSize   int
+	noBatch     *int32
+	cache       *PharosCache
+	schemas     *PharosSchemas
+	ctx         context.Context
 }
 
-// NewPharosClient creates a new pharos client. Param hostUrl should
-// come from the config.json file.
+// NewPharosClient creates a new pharos client that sends apiUser and
+// apiKey in the request headers. Param hostUrl should come from the
+// config.json file.
 func NewPharosClient(hostUrl, apiVersion, apiUser, apiKey string) (*PharosClient, error) {
 	testsAreRunning := flag.Lookup("test.v") != nil
 	if !testsAreRunning && (apiUser == "" || apiKey == "") {
 		panic("Env vars PHAROS_API_USER and PHAROS_API_KEY cannot be empty.")
 	}
+	return NewPharosClientWithAuth(hostUrl, apiVersion,
+		&HeaderAuthenticator{APIUser: apiUser, APIKey: apiKey})
+}
+
+// NewPharosClientWithAuth creates a new pharos client that uses
+// auth to authenticate its requests. See PharosAuthenticatorFromConfig.
+func NewPharosClientWithAuth(hostUrl, apiVersion string, auth PharosAuthenticator) (*PharosClient, error) {
 	// see security warning on nil PublicSuffixList here:
 	// http://gotour.golang.org/src/pkg/net/http/cookiejar/jar.go?s=1011:1492#L24
 	cookieJar, err := cookiejar.New(nil)
@@ -47,13 +66,169 @@ func NewPharosClient(hostUrl, apiVersion, apiUser, apiKey string) (*PharosClient
 		DisableKeepAlives: true,
 	}
 	httpClient := &http.Client{Jar: cookieJar, Transport: transport}
-	return &PharosClient{
-		hostUrl:    hostUrl,
-		apiVersion: apiVersion,
-		apiUser:    apiUser,
-		apiKey:     apiKey,
-		httpClient: httpClient,
-		transport:  transport}, nil
+	client := &PharosClient{
+		hostUrl:     hostUrl,
+		apiVersion:  apiVersion,
+		httpClient:  httpClient,
+		transport:   transport,
+		retryPolicy: DefaultRetryPolicy(),
+		breaker:     circuitBreakerFor(hostUrl),
+		batchSize:   DefaultBatchSize,
+		noBatch:     new(int32)}
+	if err = client.SetAuthenticator(auth); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// SetAuthenticator changes the way this client authenticates its
+// requests. It returns an error if auth can't set up the client's
+// transport, for example because a client certificate is missing.
+// Since copies made by WithContext share this client's transport,
+// set the authenticator before making copies.
+func (client *PharosClient) SetAuthenticator(auth PharosAuthenticator) error {
+	if auth == nil {
+		return fmt.Errorf("PharosAuthenticator cannot be nil")
+	}
+	if err := auth.ConfigureTransport(client.transport); err != nil {
+		return fmt.Errorf("Cannot configure Pharos authentication: %v", err)
+	}
+	client.authenticator = auth
+	return nil
+}
+
+// SetRoundTripper makes this client send its requests through
+// roundTripper, such as a RecordingTransport or ReplayTransport.
+// To record requests, wrap the client's current RoundTripper.
+// Copies made by WithContext share this setting.
+func (client *PharosClient) SetRoundTripper(roundTripper http.RoundTripper) {
+	client.httpClient.Transport = roundTripper
+}
+
+// RoundTripper returns the RoundTripper this client sends its requests
+// through. Unless SetRoundTripper has changed it, this is the client's
+// *http.Transport.
+func (client *PharosClient) RoundTripper() http.RoundTripper {
+	return client.httpClient.Transport
+}
+
+// Authenticator returns this client's PharosAuthenticator.
+func (client *PharosClient) Authenticator() PharosAuthenticator {
+	return client.authenticator
+}
+
+// WithContext returns a copy of this client that sends all of its
+// requests with ctx. When ctx is cancelled or its deadline passes,
+// requests in progress fail, and the client stops retrying and
+// waiting for the circuit breaker. The copy shares this client's
+// connections, settings and circuit breaker. If ctx is nil, the
+// copy uses context.Background().
+func (client *PharosClient) WithContext(ctx context.Context) *PharosClient {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	clientCopy := *client
+	clientCopy.ctx = ctx
+	return &clientCopy
+}
+
+// Context returns the context this client sends with its requests.
+// See WithContext.
+func (client *PharosClient) Context() context.Context {
+	if client.ctx == nil {
+		return context.Background()
+	}
+	return client.ctx
+}
+
+// SetCache makes this client answer GET requests from cache when it
+// can, and save successful GET responses in cache. Param cache may be
+// nil, which turns caching off. See PharosCache.
+func (client *PharosClient) SetCache(cache *PharosCache) {
+	client.cache = cache
+}
+
+// Cache returns this client's cache, which may be nil.
+func (client *PharosClient) Cache() *PharosCache {
+	return client.cache
+}
+
+// SetSchemas makes this client check request and response bodies
+// against schemas. Requests that don't match aren't sent, and responses
+// that don't match are reported, with a *SchemaError in resp.Error in
+// both cases. Param schemas may be nil, which turns checking off. The
+// client doesn't check bodies for API versions schemas doesn't support.
+func (client *PharosClient) SetSchemas(schemas *PharosSchemas) {
+	client.schemas = schemas
+}
+
+// Schemas returns this client's schemas, which may be nil.
+func (client *PharosClient) Schemas() *PharosSchemas {
+	return client.schemas
+}
+
+// APIVersion returns the version of the Pharos API this client uses.
+func (client *PharosClient) APIVersion() string {
+	return client.apiVersion
+}
+
+// NegotiateAPIVersion asks Pharos which of versions it supports, and
+// switches this client to the first one it does, so list versions
+// newest first. Pharos answers requests for versions it doesn't
+// support with 404. If the client has schemas, versions the schemas
+// don't describe are skipped, as are versions whose responses don't
+// match their schemas. This returns the version chosen, or an error if
+// Pharos supports none of versions or can't be reached.
+//
+// Copies of this client made by WithContext keep the version they had,
+// so negotiate before making copies.
+func (client *PharosClient) NegotiateAPIVersion(versions ...string) (string, error) {
+	params := url.Values{}
+	params.Set("page", "1")
+	params.Set("per_page", "1")
+	problems := make([]string, 0)
+	for _, version := range versions {
+		if client.schemas != nil && !client.schemas.Supports(version) {
+			problems = append(problems, fmt.Sprintf("%s: no schemas", version))
+			continue
+		}
+		probe := *client
+		probe.apiVersion = version
+		resp := probe.InstitutionList(params)
+		if resp.Error == nil {
+			client.apiVersion = version
+			return version, nil
+		}
+		if _, isSchemaError := resp.Error.(*SchemaError); isSchemaError {
+			problems = append(problems, fmt.Sprintf("%s: %v", version, resp.Error))
+			continue
+		}
+		if resp.Response != nil && resp.Response.StatusCode == http.StatusNotFound {
+			problems = append(problems, fmt.Sprintf("%s: not found", version))
+			continue
+		}
+		return "", fmt.Errorf("Cannot negotiate Pharos API version: %v", resp.Error)
+	}
+	return "", fmt.Errorf("Pharos does not support any of API versions %s (%s)",
+		strings.Join(versions, ", "), strings.Join(problems, "; "))
+}
+
+// SetRetryPolicy changes the way this client retries failed requests.
+// See RetryPolicy.
+func (client *PharosClient) SetRetryPolicy(policy *RetryPolicy) {
+	client.retryPolicy = policy
+}
+
+// RetryPolicy returns this client's RetryPolicy.
+func (client *PharosClient) RetryPolicy() *RetryPolicy {
+	return client.retryPolicy
+}
+
+// Stats returns counters describing all of the requests this process
+// has sent to this client's Pharos server, including requests from
+// other PharosClients.
+func (client *PharosClient) Stats() PharosClientStats {
+	return client.breaker.stats()
 }
 
 // InstitutionGet returns the institution with the specified identifier.
@@ -918,7 +1093,9 @@ func (client *PharosClient) BuildUrl(relativeUrl string) string {
 }
 
 // NewJsonRequest returns a new request with headers indicating
-// JSON request and response formats.
+// JSON request and response formats, and with the credentials from
+// the client's PharosAuthenticator. It returns an error if the
+// authenticator can't get credentials.
 //
 // Param method can be "GET", "POST", or "PUT". The Pharos service
 // currently only supports those three.
@@ -931,17 +1108,20 @@ func (client *PharosClient) BuildUrl(relativeUrl string) string {
 // constructed from bytes.NewBuffer([]byte) for POST and PUT.
 // For the PharosClient, we're typically sending JSON data in
 // the request body.
+//
+// The request uses the client's context. See WithContext.
 func (client *PharosClient) NewJsonRequest(method, absoluteUrl string, requestData io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, absoluteUrl, requestData)
+	req, err := http.NewRequestWithContext(client.Context(), method, absoluteUrl, requestData)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	req.Header.Add("X-Pharos-API-User", client.apiUser)
-	req.Header.Add("X-Pharos-API-Key", client.apiKey)
 	req.Header.Add("Connection", "Keep-Alive")
+	if err = client.authenticator.Authenticate(req); err != nil {
+		return nil, err
+	}
 
 	// Unfix the URL that golang net/url "fixes" for us.
 	// URLs that contain %2F (encoded slashes) MUST preserve
@@ -973,20 +1153,176 @@ func (client *PharosClient) NewJsonRequest(method, absoluteUrl string, requestDa
 //
 // For a description of the other params, see NewJsonRequest.
 //
+// Requests that fail because of network errors or 5xx responses are
+// retried according to the client's RetryPolicy. If Pharos appears to
+// be down, DoRequest waits for the circuit breaker to close before
+// sending anything.
+//
+// If Pharos answers 401 Unauthorized and the client's authenticator is
+// a CredentialInvalidator, the request is sent once more with new
+// credentials.
+//
+// If the client has a cache, GET requests for the types of records
+// the cache holds may be answered from the cache, and other requests
+// invalidate cached records of the same type. See SetCache.
+//
+// If the client has schemas, request bodies that don't match are not
+// sent, and successful responses that don't match are reported. Both
+// set resp.Error to a *SchemaError. See SetSchemas.
+//
 // If an error occurs, it will be recorded in resp.Error.
 func (client *PharosClient) DoRequest(resp *PharosResponse, method, absoluteUrl string, requestData io.Reader) {
+	cacheable := method == "GET" && client.cache != nil && client.cache.Caches(resp.objectType)
+	if cacheable && client.answerFromCache(resp, absoluteUrl) {
+		return
+	}
+	if method != "GET" && client.cache != nil {
+		defer client.cache.Invalidate(resp.objectType)
+	}
+	atomic.AddInt64(&client.breaker.requests, 1)
+
+	// Keep a copy of the request body, so we can resend it.
+	var body []byte
+	if requestData != nil {
+		body, resp.Error = ioutil.ReadAll(requestData)
+		if resp.Error == nil {
+			resp.Error = client.schemas.ValidateRequest(client.apiVersion, resp.objectType, body)
+		}
+		if resp.Error != nil {
+			// This is our bug, not a Pharos failure, so it
+			// doesn't count against Pharos in the stats.
+			return
+		}
+	}
+
+	ctx := client.Context()
+	policy := client.retryPolicy
+	reauthenticated := false
+	// If our request is testing whether Pharos is back, and we
+	// leave without an answer, let someone else test it.
+	probing := false
+	defer func() {
+		if probing {
+			client.breaker.abandonProbe()
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		var err error
+		probing, err = client.breaker.waitUntilClosed(ctx, policy)
+		if err != nil {
+			resp.Error = err
+			break
+		}
+		if !client.doRequestOnce(ctx, resp, method, absoluteUrl, body) {
+			// Couldn't build the request. Retrying won't help.
+			break
+		}
+		if ctx.Err() != nil {
+			// We gave up on the request. That says
+			// nothing about the health of Pharos.
+			break
+		}
+		probing = false
+		if isServerFailure(resp) {
+			client.breaker.recordFailure(policy)
+		} else {
+			client.breaker.recordSuccess()
+		}
+		if !reauthenticated && resp.Response != nil &&
+			resp.Response.StatusCode == http.StatusUnauthorized && client.invalidateCredentials() {
+			// Our token may have been revoked. Try once more with a new one.
+			reauthenticated = true
+			continue
+		}
+		if attempt >= policy.MaxAttempts || !shouldRetry(resp, method) {
+			break
+		}
+		atomic.AddInt64(&client.breaker.retries, 1)
+		if err := sleepContext(ctx, policy.Backoff(attempt)); err != nil {
+			break
+		}
+	}
+	if resp.Error == nil {
+		resp.Error = client.validateResponse(resp)
+	}
+	if resp.Error != nil {
+		atomic.AddInt64(&client.breaker.failures, 1)
+	} else if cacheable && resp.Response.StatusCode == http.StatusOK {
+		client.cache.put(absoluteUrl, resp)
+	}
+}
+
+// invalidateCredentials tells the client's authenticator that Pharos
+// rejected its credentials, and returns true if it will send new ones.
+func (client *PharosClient) invalidateCredentials() bool {
+	if invalidator, ok := client.authenticator.(CredentialInvalidator); ok {
+		return invalidator.InvalidateCredentials()
+	}
+	return false
+}
+
+// validateResponse checks the body of a successful response
+// against the client's schemas. See SetSchemas.
+func (client *PharosClient) validateResponse(resp *PharosResponse) error {
+	if client.schemas == nil || len(resp.data) == 0 {
+		return nil
+	}
+	if resp.Response.StatusCode != http.StatusOK && resp.Response.StatusCode != http.StatusCreated {
+		return nil
+	}
+	return client.schemas.ValidateResponse(client.apiVersion, resp.objectType, resp.data)
+}
+
+// answerFromCache fills in resp from the cache and returns true
+// if the cache has a response for absoluteUrl.
+func (client *PharosClient) answerFromCache(resp *PharosResponse, absoluteUrl string) bool {
+	entry := client.cache.get(absoluteUrl)
+	if entry == nil {
+		return false
+	}
+	// Callers log the request, so build one, even
+	// though we're not sending it.
+	request, err := client.NewJsonRequest("GET", absoluteUrl, nil)
+	if err != nil {
+		return false
+	}
+	resp.Request = request
+	entry.fill(resp)
+	return true
+}
+
+// doRequestOnce sends a single request and reads the response into
+// resp. It returns false if it couldn't build the request. If the
+// retry policy has a RequestTimeout, the request fails when that
+// runs out.
+func (client *PharosClient) doRequestOnce(ctx context.Context, resp *PharosResponse, method, absoluteUrl string, body []byte) bool {
+	resp.Response = nil
+	resp.data = nil
+	resp.hasBeenRead = false
+
 	// Build the request
+	var requestData io.Reader
+	if body != nil {
+		requestData = bytes.NewReader(body)
+	}
 	request, err := client.NewJsonRequest(method, absoluteUrl, requestData)
 	resp.Request = request
 	resp.Error = err
 	if resp.Error != nil {
-		return
+		return false
 	}
+	if client.retryPolicy.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.retryPolicy.RequestTimeout)
+		defer cancel()
+	}
+	request = request.WithContext(ctx)
 
 	// Issue the HTTP request
 	resp.Response, resp.Error = client.httpClient.Do(request)
 	if resp.Error != nil {
-		return
+		resp.Response = nil
+		return true
 	}
 
 	// Read the response data and close the response body.
@@ -1002,6 +1338,7 @@ func (client *PharosClient) DoRequest(resp *PharosResponse, method, absoluteUrl
 		resp.Error = fmt.Errorf("Server returned status code %d. Body: %s",
 			resp.Response.StatusCode, string(body))
 	}
+	return true
 }
 
 func escapeFileIdentifier(identifier string) string {
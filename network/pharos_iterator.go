@@ -0,0 +1,252 @@
+package network
+
+import (
+	"context"
+	"github.com/APTrust/exchange/models"
+	"io"
+	"net/url"
+)
+
+// PagingOptions control how the list iterators below fetch
+// pages of results from Pharos.
+type PagingOptions struct {
+	// Context, if not nil, stops the iteration when it's cancelled
+	// or times out. After that, Next returns the context's error,
+	// even if items from the current page remain. Cancelling the
+	// context also cancels page requests in progress.
+	Context context.Context
+
+	// Prefetch tells the iterator to request the next page of results
+	// in the background while the caller works through the current
+	// page. Don't use this if the caller changes records in a way
+	// that affects which records the query returns, because the next
+	// page will be fetched before those changes happen.
+	Prefetch bool
+
+	// OnPage, if not nil, is called with the response for each page
+	// of results, including responses with errors, before the iterator
+	// returns the first item from that page. This is useful for logging.
+	OnPage func(*PharosResponse)
+}
+
+// pageIterator follows the next-page links in Pharos list responses.
+// The typed iterators below wrap it.
+type pageIterator struct {
+	ctx      context.Context
+	fetch    func(url.Values) *PharosResponse
+	params   url.Values
+	prefetch bool
+	onPage   func(*PharosResponse)
+	pending  chan *PharosResponse
+	err      error
+}
+
+func newPageIterator(fetch func(url.Values) *PharosResponse, params url.Values, options PagingOptions) *pageIterator {
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// Copy params, so we don't change the caller's copy.
+	firstPage := url.Values{}
+	for key, values := range params {
+		firstPage[key] = append([]string{}, values...)
+	}
+	return &pageIterator{
+		ctx:      ctx,
+		fetch:    fetch,
+		params:   firstPage,
+		prefetch: options.Prefetch,
+		onPage:   options.OnPage,
+	}
+}
+
+// cancelled returns the context's error if the context is done.
+// After that, nextPage keeps returning the same error.
+func (iter *pageIterator) cancelled() error {
+	if iter.err == nil {
+		iter.err = iter.ctx.Err()
+	}
+	if iter.err == io.EOF {
+		return nil
+	}
+	return iter.err
+}
+
+// nextPage returns the next page of results. It returns io.EOF after
+// the last page. Once it returns an error, it keeps returning that error.
+func (iter *pageIterator) nextPage() (*PharosResponse, error) {
+	iter.cancelled()
+	if iter.err != nil {
+		return nil, iter.err
+	}
+	var resp *PharosResponse
+	if iter.pending != nil {
+		select {
+		case resp = <-iter.pending:
+			iter.pending = nil
+		case <-iter.ctx.Done():
+			iter.err = iter.ctx.Err()
+			return nil, iter.err
+		}
+	} else if iter.params != nil {
+		resp = iter.fetch(iter.params)
+	} else {
+		iter.err = io.EOF
+		return nil, iter.err
+	}
+	if iter.onPage != nil {
+		iter.onPage(resp)
+	}
+	if resp.Error != nil {
+		iter.err = resp.Error
+		return nil, iter.err
+	}
+	iter.params = resp.ParamsForNextPage()
+	if iter.prefetch && iter.params != nil {
+		// The channel is buffered, so this goroutine finishes
+		// even if the caller never asks for the next page.
+		iter.pending = make(chan *PharosResponse, 1)
+		go func(pending chan *PharosResponse, params url.Values) {
+			pending <- iter.fetch(params)
+		}(iter.pending, iter.params)
+		iter.params = nil
+	}
+	return resp, nil
+}
+
+// withPagingContext returns a client that sends its requests with
+// the options' Context, if there is one.
+func (client *PharosClient) withPagingContext(options PagingOptions) *PharosClient {
+	if options.Context == nil {
+		return client
+	}
+	return client.WithContext(options.Context)
+}
+
+// GenericFileIterator returns all of the GenericFiles matching
+// a query, one at a time, fetching pages from Pharos as needed.
+type GenericFileIterator struct {
+	pages *pageIterator
+	items []*models.GenericFile
+}
+
+// GenericFileIterator returns an iterator over all of the GenericFiles
+// matching params. See GenericFileList for a description of params.
+// Use the page and per_page params to choose the first page and the
+// page size.
+func (client *PharosClient) GenericFileIterator(params url.Values, options PagingOptions) *GenericFileIterator {
+	return &GenericFileIterator{pages: newPageIterator(client.withPagingContext(options).GenericFileList, params, options)}
+}
+
+// Next returns the next GenericFile. It returns io.EOF when there
+// are no more files, or the error that prevented it from getting
+// the next page of results.
+func (iter *GenericFileIterator) Next() (*models.GenericFile, error) {
+	if err := iter.pages.cancelled(); err != nil {
+		return nil, err
+	}
+	for len(iter.items) == 0 {
+		resp, err := iter.pages.nextPage()
+		if err != nil {
+			return nil, err
+		}
+		iter.items = resp.GenericFiles()
+	}
+	gf := iter.items[0]
+	iter.items = iter.items[1:]
+	return gf, nil
+}
+
+// IntellectualObjectIterator returns all of the IntellectualObjects
+// matching a query, one at a time, fetching pages from Pharos as needed.
+type IntellectualObjectIterator struct {
+	pages *pageIterator
+	items []*models.IntellectualObject
+}
+
+// IntellectualObjectIterator returns an iterator over all of the
+// IntellectualObjects matching params. See IntellectualObjectList
+// for a description of params.
+func (client *PharosClient) IntellectualObjectIterator(params url.Values, options PagingOptions) *IntellectualObjectIterator {
+	return &IntellectualObjectIterator{pages: newPageIterator(client.withPagingContext(options).IntellectualObjectList, params, options)}
+}
+
+// Next returns the next IntellectualObject, or io.EOF when there
+// are no more objects. See GenericFileIterator.Next.
+func (iter *IntellectualObjectIterator) Next() (*models.IntellectualObject, error) {
+	if err := iter.pages.cancelled(); err != nil {
+		return nil, err
+	}
+	for len(iter.items) == 0 {
+		resp, err := iter.pages.nextPage()
+		if err != nil {
+			return nil, err
+		}
+		iter.items = resp.IntellectualObjects()
+	}
+	obj := iter.items[0]
+	iter.items = iter.items[1:]
+	return obj, nil
+}
+
+// PremisEventIterator returns all of the PremisEvents matching
+// a query, one at a time, fetching pages from Pharos as needed.
+type PremisEventIterator struct {
+	pages *pageIterator
+	items []*models.PremisEvent
+}
+
+// PremisEventIterator returns an iterator over all of the PremisEvents
+// matching params. See PremisEventList for a description of params.
+func (client *PharosClient) PremisEventIterator(params url.Values, options PagingOptions) *PremisEventIterator {
+	return &PremisEventIterator{pages: newPageIterator(client.withPagingContext(options).PremisEventList, params, options)}
+}
+
+// Next returns the next PremisEvent, or io.EOF when there
+// are no more events. See GenericFileIterator.Next.
+func (iter *PremisEventIterator) Next() (*models.PremisEvent, error) {
+	if err := iter.pages.cancelled(); err != nil {
+		return nil, err
+	}
+	for len(iter.items) == 0 {
+		resp, err := iter.pages.nextPage()
+		if err != nil {
+			return nil, err
+		}
+		iter.items = resp.PremisEvents()
+	}
+	event := iter.items[0]
+	iter.items = iter.items[1:]
+	return event, nil
+}
+
+// WorkItemIterator returns all of the WorkItems matching
+// a query, one at a time, fetching pages from Pharos as needed.
+type WorkItemIterator struct {
+	pages *pageIterator
+	items []*models.WorkItem
+}
+
+// WorkItemIterator returns an iterator over all of the WorkItems
+// matching params. See WorkItemList for a description of params.
+func (client *PharosClient) WorkItemIterator(params url.Values, options PagingOptions) *WorkItemIterator {
+	return &WorkItemIterator{pages: newPageIterator(client.withPagingContext(options).WorkItemList, params, options)}
+}
+
+// Next returns the next WorkItem, or io.EOF when there
+// are no more items. See GenericFileIterator.Next.
+func (iter *WorkItemIterator) Next() (*models.WorkItem, error) {
+	if err := iter.pages.cancelled(); err != nil {
+		return nil, err
+	}
+	for len(iter.items) == 0 {
+		resp, err := iter.pages.nextPage()
+		if err != nil {
+			return nil, err
+		}
+		iter.items = resp.WorkItems()
+	}
+	item := iter.items[0]
+	iter.items = iter.items[1:]
+	return item, nil
+}
@@ -0,0 +1,192 @@
+package network_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pagingServer serves total items, two per page, with next links.
+// makeItem builds item number i, starting from 1. Requests for
+// page failPage return 404. The server records the pages requested.
+type pagingServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []string
+}
+
+func newPagingServer(total, failPage int, makeItem func(i int) interface{}) *pagingServer {
+	server := &pagingServer{requests: make([]string, 0)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		server.mutex.Lock()
+		server.requests = append(server.requests, r.URL.Query().Get("page"))
+		server.mutex.Unlock()
+		if page == failPage {
+			http.NotFound(w, r)
+			return
+		}
+		results := make([]interface{}, 0)
+		for i := (page-1)*2 + 1; i <= total && i <= page*2; i++ {
+			results = append(results, makeItem(i))
+		}
+		data := map[string]interface{}{"count": total, "results": results}
+		if page*2 < total {
+			data["next"] = fmt.Sprintf("%s%s?page=%d&per_page=2", server.URL, r.URL.Path, page+1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}))
+	return server
+}
+
+func (server *pagingServer) pagesRequested() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.requests...)
+}
+
+func makeGenericFileWithId(i int) interface{} {
+	return &models.GenericFile{Id: i, Identifier: fmt.Sprintf("test.edu/bag/data/%d.txt", i)}
+}
+
+func firstPageParams() url.Values {
+	params := url.Values{}
+	params.Set("page", "1")
+	params.Set("per_page", "2")
+	return params
+}
+
+func TestGenericFileIterator(t *testing.T) {
+	for _, prefetch := range []bool{false, true} {
+		server := newPagingServer(5, 0, makeGenericFileWithId)
+		client := fastRetryClient(t, server.URL)
+		params := firstPageParams()
+		pages := 0
+		options := network.PagingOptions{
+			Prefetch: prefetch,
+			OnPage:   func(resp *network.PharosResponse) { pages++ },
+		}
+		iterator := client.GenericFileIterator(params, options)
+		for i := 1; i <= 5; i++ {
+			gf, err := iterator.Next()
+			require.Nil(t, err)
+			assert.Equal(t, i, gf.Id)
+		}
+		_, err := iterator.Next()
+		assert.Equal(t, io.EOF, err)
+		_, err = iterator.Next()
+		assert.Equal(t, io.EOF, err)
+
+		assert.Equal(t, 3, pages)
+		assert.Equal(t, []string{"1", "2", "3"}, server.pagesRequested())
+		assert.Equal(t, "1", params.Get("page"), "Iterator should not change caller's params")
+		server.Close()
+	}
+}
+
+func TestGenericFileIterator_Prefetch(t *testing.T) {
+	server := newPagingServer(5, 0, makeGenericFileWithId)
+	defer server.Close()
+	client := fastRetryClient(t, server.URL)
+	iterator := client.GenericFileIterator(firstPageParams(), network.PagingOptions{Prefetch: true})
+	_, err := iterator.Next()
+	require.Nil(t, err)
+
+	// Page 2 should arrive while we're still working on page 1.
+	assert.Eventually(t, func() bool {
+		return len(server.pagesRequested()) == 2
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestGenericFileIterator_Error(t *testing.T) {
+	server := newPagingServer(5, 2, makeGenericFileWithId)
+	defer server.Close()
+	client := fastRetryClient(t, server.URL)
+	iterator := client.GenericFileIterator(firstPageParams(), network.PagingOptions{})
+	for i := 1; i <= 2; i++ {
+		gf, err := iterator.Next()
+		require.Nil(t, err)
+		assert.Equal(t, i, gf.Id)
+	}
+	_, err := iterator.Next()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "404")
+	_, err = iterator.Next()
+	assert.NotNil(t, err)
+	assert.NotEqual(t, io.EOF, err)
+}
+
+func TestGenericFileIterator_Cancel(t *testing.T) {
+	server := newPagingServer(5, 0, makeGenericFileWithId)
+	defer server.Close()
+	client := fastRetryClient(t, server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	iterator := client.GenericFileIterator(firstPageParams(), network.PagingOptions{Context: ctx})
+	_, err := iterator.Next()
+	require.Nil(t, err)
+	cancel()
+	_, err = iterator.Next()
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"1"}, server.pagesRequested())
+}
+
+func TestIntellectualObjectIterator(t *testing.T) {
+	server := newPagingServer(3, 0, func(i int) interface{} {
+		return &models.IntellectualObject{Id: i}
+	})
+	defer server.Close()
+	client := fastRetryClient(t, server.URL)
+	iterator := client.IntellectualObjectIterator(firstPageParams(), network.PagingOptions{Prefetch: true})
+	for i := 1; i <= 3; i++ {
+		obj, err := iterator.Next()
+		require.Nil(t, err)
+		assert.Equal(t, i, obj.Id)
+	}
+	_, err := iterator.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPremisEventIterator(t *testing.T) {
+	server := newPagingServer(3, 0, func(i int) interface{} {
+		return &models.PremisEvent{Id: i}
+	})
+	defer server.Close()
+	client := fastRetryClient(t, server.URL)
+	iterator := client.PremisEventIterator(firstPageParams(), network.PagingOptions{Prefetch: true})
+	for i := 1; i <= 3; i++ {
+		event, err := iterator.Next()
+		require.Nil(t, err)
+		assert.Equal(t, i, event.Id)
+	}
+	_, err := iterator.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWorkItemIterator(t *testing.T) {
+	server := newPagingServer(3, 0, func(i int) interface{} {
+		return &models.WorkItem{Id: i}
+	})
+	defer server.Close()
+	client := fastRetryClient(t, server.URL)
+	iterator := client.WorkItemIterator(firstPageParams(), network.PagingOptions{})
+	for i := 1; i <= 3; i++ {
+		item, err := iterator.Next()
+		require.Nil(t, err)
+		assert.Equal(t, i, item.Id)
+	}
+	_, err := iterator.Next()
+	assert.Equal(t, io.EOF, err)
+}
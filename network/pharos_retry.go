@@ -0,0 +1,354 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy describes how the PharosClient retries requests that
+// fail because of network errors, timeouts or 5xx responses, and how
+// its circuit breaker behaves when Pharos appears to be down.
+//
+// We retry GET, HEAD, PUT and DELETE requests, since sending those
+// twice does no harm. We retry POST requests only when we could not
+// connect to Pharos at all, because a POST that reached the server
+// may have created a record, even if the response was an error.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times to try a
+	// request, including the first try. 1 means no retries.
+	MaxAttempts int
+
+	// InitialBackoff is how long to wait before the first retry.
+	// The wait doubles after each failed retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the longest we'll wait between retries.
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction of each wait that is random, from
+	// 0.0 to 1.0. This keeps the workers from all retrying at the
+	// same moment when Pharos comes back.
+	Jitter float64
+
+	// FailureThreshold is the number of consecutive failed requests
+	// that opens the circuit breaker. Zero or less disables it.
+	FailureThreshold int
+
+	// CooldownPeriod is how long the circuit breaker stays open
+	// before we let one request through to see if Pharos is back.
+	CooldownPeriod time.Duration
+
+	// MaxCircuitWait is how long a request waits for an open circuit
+	// breaker to close. After that, the request fails with
+	// ErrCircuitOpen.
+	MaxCircuitWait time.Duration
+
+	// RequestTimeout is how long to wait for Pharos to respond to
+	// each attempt at a request. An attempt that times out counts
+	// as a failure, and may be retried. Zero means no timeout.
+	RequestTimeout time.Duration
+}
+
+// ErrCircuitOpen is the error a request returns when the circuit
+// breaker stays open longer than RetryPolicy.MaxCircuitWait.
+var ErrCircuitOpen = errors.New("Pharos appears to be down: circuit breaker is open")
+
+// DefaultRetryPolicy returns the retry policy new PharosClients use.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:      5,
+		InitialBackoff:   500 * time.Millisecond,
+		MaxBackoff:       30 * time.Second,
+		Jitter:           0.5,
+		FailureThreshold: 10,
+		CooldownPeriod:   30 * time.Second,
+		MaxCircuitWait:   5 * time.Minute,
+	}
+}
+
+// RetryPolicyFromConfig returns a RetryPolicy with the settings in
+// config. Settings that are missing from config get their values from
+// DefaultRetryPolicy.
+func RetryPolicyFromConfig(config models.PharosRetryConfig) (*RetryPolicy, error) {
+	policy := DefaultRetryPolicy()
+	if config.MaxAttempts > 0 {
+		policy.MaxAttempts = config.MaxAttempts
+	}
+	if config.CircuitBreakerThreshold != 0 {
+		policy.FailureThreshold = config.CircuitBreakerThreshold
+	}
+	durations := []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"InitialBackoff", config.InitialBackoff, &policy.InitialBackoff},
+		{"MaxBackoff", config.MaxBackoff, &policy.MaxBackoff},
+		{"CircuitBreakerCooldown", config.CircuitBreakerCooldown, &policy.CooldownPeriod},
+		{"MaxCircuitWait", config.MaxCircuitWait, &policy.MaxCircuitWait},
+		{"RequestTimeout", config.RequestTimeout, &policy.RequestTimeout},
+	}
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(duration.value)
+		if err != nil {
+			return nil, fmt.Errorf("PharosRetry.%s: %v", duration.name, err)
+		}
+		*duration.target = value
+	}
+	return policy, nil
+}
+
+// Backoff returns how long to wait after the specified
+// failed attempt, where the first attempt is 1.
+func (policy *RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 1; i < attempt && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	if policy.Jitter > 0 && backoff > 0 {
+		random := time.Duration(float64(backoff) * policy.Jitter * rand.Float64())
+		backoff = backoff - time.Duration(float64(backoff)*policy.Jitter) + random
+	}
+	return backoff
+}
+
+// PharosClientStats are counters describing the requests that all
+// of the PharosClients in this process have sent to one Pharos server.
+// They're useful for monitoring.
+type PharosClientStats struct {
+	// Requests is the number of calls to DoRequest.
+	Requests int64
+	// Retries is the number of times we resent a request.
+	Retries int64
+	// Failures is the number of requests that failed after
+	// all retries, including those rejected by the circuit breaker.
+	// Requests we didn't send because they didn't match the schema
+	// are not counted.
+	Failures int64
+	// CircuitOpened is the number of times the circuit breaker opened.
+	CircuitOpened int64
+	// CircuitRejected is the number of requests that gave up waiting
+	// for the circuit breaker to close.
+	CircuitRejected int64
+	// CircuitOpen is true if the circuit breaker is open right now.
+	CircuitOpen bool
+}
+
+// String returns the stats in a format suitable for logging.
+func (stats PharosClientStats) String() string {
+	return fmt.Sprintf("requests=%d retries=%d failures=%d circuit_opened=%d "+
+		"circuit_rejected=%d circuit_open=%t", stats.Requests, stats.Retries,
+		stats.Failures, stats.CircuitOpened, stats.CircuitRejected, stats.CircuitOpen)
+}
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker tracks the health of one Pharos server. All of the
+// PharosClients in a process that talk to the same server share one
+// circuitBreaker, so when Pharos goes down, every worker goroutine
+// stops calling it, not just the one that noticed.
+type circuitBreaker struct {
+	mutex               sync.Mutex
+	state               int
+	consecutiveFailures int
+	openUntil           time.Time
+
+	requests        int64
+	retries         int64
+	failures        int64
+	circuitOpened   int64
+	circuitRejected int64
+}
+
+var circuitBreakers = make(map[string]*circuitBreaker)
+var circuitBreakersMutex sync.Mutex
+
+// circuitBreakerFor returns the shared circuitBreaker for hostUrl.
+func circuitBreakerFor(hostUrl string) *circuitBreaker {
+	circuitBreakersMutex.Lock()
+	defer circuitBreakersMutex.Unlock()
+	breaker := circuitBreakers[hostUrl]
+	if breaker == nil {
+		breaker = &circuitBreaker{}
+		circuitBreakers[hostUrl] = breaker
+	}
+	return breaker
+}
+
+// wait returns how long the caller should wait before sending a
+// request. Zero means send it now. When the cooldown period is over,
+// exactly one caller gets to send a request to see if Pharos is back.
+// Everyone else waits to see how that turns out. The second return
+// value is true for that caller, which must call recordSuccess,
+// recordFailure or abandonProbe when it's done.
+func (breaker *circuitBreaker) wait(policy *RetryPolicy) (time.Duration, bool) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	now := time.Now()
+	switch breaker.state {
+	case circuitOpen:
+		if now.Before(breaker.openUntil) {
+			return breaker.openUntil.Sub(now), false
+		}
+		breaker.state = circuitHalfOpen
+		return 0, true
+	case circuitHalfOpen:
+		// Check back shortly. The request that's testing
+		// the server will close or reopen the circuit.
+		wait := policy.CooldownPeriod / 10
+		if wait <= 0 || wait > time.Second {
+			wait = time.Second
+		}
+		return wait, false
+	}
+	return 0, false
+}
+
+// waitUntilClosed blocks until the circuit breaker lets us send
+// a request, until the policy's MaxCircuitWait runs out, or until
+// ctx is done. It returns true if the caller's request is the one
+// testing whether Pharos is back. See wait.
+func (breaker *circuitBreaker) waitUntilClosed(ctx context.Context, policy *RetryPolicy) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if policy.FailureThreshold <= 0 {
+		return false, nil
+	}
+	deadline := time.Now().Add(policy.MaxCircuitWait)
+	for {
+		wait, probe := breaker.wait(policy)
+		if wait == 0 {
+			return probe, nil
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			atomic.AddInt64(&breaker.circuitRejected, 1)
+			return false, ErrCircuitOpen
+		}
+		if wait > remaining {
+			wait = remaining
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return false, err
+		}
+	}
+}
+
+// sleepContext sleeps for duration d, or until ctx is done. It returns
+// the context's error if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// recordSuccess records that Pharos answered a request.
+func (breaker *circuitBreaker) recordSuccess() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.consecutiveFailures = 0
+	breaker.state = circuitClosed
+}
+
+// recordFailure records that Pharos did not answer a request, or
+// answered with a 5xx status. This opens the circuit if there have
+// been too many failures in a row, or if the request was testing
+// whether Pharos had come back.
+func (breaker *circuitBreaker) recordFailure(policy *RetryPolicy) {
+	if policy.FailureThreshold <= 0 {
+		return
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.consecutiveFailures += 1
+	if breaker.state == circuitHalfOpen || breaker.consecutiveFailures >= policy.FailureThreshold {
+		if breaker.state != circuitOpen {
+			breaker.circuitOpened += 1
+		}
+		breaker.state = circuitOpen
+		breaker.openUntil = time.Now().Add(policy.CooldownPeriod)
+	}
+}
+
+// abandonProbe records that the request testing whether Pharos is back
+// ended without telling us, because we couldn't build or authenticate
+// it, or because the caller gave up. The circuit goes back to open,
+// with the cooldown already over, so the next caller sends a new test
+// request instead of everyone waiting on this one forever.
+func (breaker *circuitBreaker) abandonProbe() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.state == circuitHalfOpen {
+		breaker.state = circuitOpen
+	}
+}
+
+// stats returns a snapshot of the breaker's counters.
+func (breaker *circuitBreaker) stats() PharosClientStats {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return PharosClientStats{
+		Requests:        atomic.LoadInt64(&breaker.requests),
+		Retries:         atomic.LoadInt64(&breaker.retries),
+		Failures:        atomic.LoadInt64(&breaker.failures),
+		CircuitOpened:   breaker.circuitOpened,
+		CircuitRejected: atomic.LoadInt64(&breaker.circuitRejected),
+		CircuitOpen:     breaker.state != circuitClosed,
+	}
+}
+
+// isServerFailure returns true if the request never got a response
+// from Pharos, or if Pharos returned a 5xx status. Those are the
+// failures that count toward opening the circuit breaker.
+func isServerFailure(resp *PharosResponse) bool {
+	if resp.Response == nil {
+		return resp.Error != nil
+	}
+	return resp.Response.StatusCode >= 500
+}
+
+// shouldRetry returns true if the request in resp failed in a way
+// that makes it worth trying again.
+func shouldRetry(resp *PharosResponse, method string) bool {
+	if !isServerFailure(resp) {
+		return false
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	// Not idempotent. Retry only if the request never
+	// reached the server.
+	return resp.Response == nil && isDialError(resp.Error)
+}
+
+// isDialError returns true if err means we could not connect to
+// the server, so the server never saw the request.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,325 @@
+package network_test
+
+import (
+	"context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/network/pharostest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer returns 502 for the first failures requests, and a
+// valid institution after that. Param hits counts requests.
+func flakyServer(failures int, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(atomic.AddInt32(hits, 1)) <= failures {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1,"name":"College","identifier":"college.edu"}`))
+	}))
+}
+
+// fastRetryPolicy retries without making tests wait.
+func fastRetryPolicy() *network.RetryPolicy {
+	policy := network.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	policy.MaxBackoff = 5 * time.Millisecond
+	return policy
+}
+
+func fastRetryClient(t *testing.T, url string) *network.PharosClient {
+	client, err := network.NewPharosClient(url, "v2", "user", "key")
+	require.Nil(t, err)
+	client.SetRetryPolicy(fastRetryPolicy())
+	return client
+}
+
+// fakePharosWithObject returns a FakePharos containing an institution
+// and one object, and a client that talks to it.
+func fakePharosWithObject(t *testing.T) (*pharostest.FakePharos, *network.PharosClient, *models.IntellectualObject) {
+	fake := pharostest.NewFakePharos()
+	client, err := network.NewPharosClient(fake.URL, "v2", "user", "key")
+	require.Nil(t, err)
+	client.SetRetryPolicy(fastRetryPolicy())
+	fake.AddInstitution(&models.Institution{Name: "Test University", Identifier: "test.edu"})
+	obj, err := fake.AddIntellectualObject(&models.IntellectualObject{
+		Identifier: "test.edu/bag1",
+		BagName:    "bag1",
+		Access:     "institution",
+	})
+	require.Nil(t, err)
+	return fake, client, obj
+}
+
+func TestRetryPolicyFromConfig(t *testing.T) {
+	policy, err := network.RetryPolicyFromConfig(models.PharosRetryConfig{})
+	require.Nil(t, err)
+	assert.Equal(t, network.DefaultRetryPolicy(), policy)
+
+	policy, err = network.RetryPolicyFromConfig(models.PharosRetryConfig{
+		MaxAttempts:             3,
+		InitialBackoff:          "2s",
+		MaxBackoff:              "1m",
+		CircuitBreakerThreshold: -1,
+		CircuitBreakerCooldown:  "10s",
+		MaxCircuitWait:          "90s",
+		RequestTimeout:          "30s",
+	})
+	require.Nil(t, err)
+	assert.Equal(t, 3, policy.MaxAttempts)
+	assert.Equal(t, 2*time.Second, policy.InitialBackoff)
+	assert.Equal(t, time.Minute, policy.MaxBackoff)
+	assert.Equal(t, -1, policy.FailureThreshold)
+	assert.Equal(t, 10*time.Second, policy.CooldownPeriod)
+	assert.Equal(t, 90*time.Second, policy.MaxCircuitWait)
+	assert.Equal(t, 30*time.Second, policy.RequestTimeout)
+
+	_, err = network.RetryPolicyFromConfig(models.PharosRetryConfig{MaxBackoff: "soon"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "PharosRetry.MaxBackoff")
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := &network.RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+	assert.Equal(t, 100*time.Millisecond, policy.Backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.Backoff(2))
+	assert.Equal(t, 800*time.Millisecond, policy.Backoff(4))
+	assert.Equal(t, time.Second, policy.Backoff(5))
+	assert.Equal(t, time.Second, policy.Backoff(50))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		backoff := policy.Backoff(2)
+		assert.True(t, backoff >= 100*time.Millisecond && backoff <= 200*time.Millisecond, backoff)
+	}
+}
+
+func TestDoRequest_RetriesGet(t *testing.T) {
+	var hits int32
+	testServer := flakyServer(2, &hits)
+	defer testServer.Close()
+	client := fastRetryClient(t, testServer.URL)
+
+	resp := client.InstitutionGet("college.edu")
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "college.edu", resp.Institution().Identifier)
+	assert.EqualValues(t, 3, hits)
+
+	stats := client.Stats()
+	assert.EqualValues(t, 1, stats.Requests)
+	assert.EqualValues(t, 2, stats.Retries)
+	assert.EqualValues(t, 0, stats.Failures)
+	assert.False(t, stats.CircuitOpen)
+}
+
+func TestDoRequest_GivesUpAfterMaxAttempts(t *testing.T) {
+	var hits int32
+	testServer := flakyServer(100, &hits)
+	defer testServer.Close()
+	client := fastRetryClient(t, testServer.URL)
+
+	resp := client.InstitutionGet("college.edu")
+	require.NotNil(t, resp.Error)
+	assert.Contains(t, resp.Error.Error(), "Server returned status code 502")
+	assert.EqualValues(t, client.RetryPolicy().MaxAttempts, hits)
+	assert.EqualValues(t, 1, client.Stats().Failures)
+}
+
+func TestDoRequest_DoesNotRetry4xx(t *testing.T) {
+	var hits int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		http.NotFound(w, r)
+	}))
+	defer testServer.Close()
+	client := fastRetryClient(t, testServer.URL)
+
+	resp := client.InstitutionGet("college.edu")
+	require.NotNil(t, resp.Error)
+	assert.EqualValues(t, 1, hits)
+}
+
+func TestDoRequest_DoesNotRetryPostAfterResponse(t *testing.T) {
+	var hits int32
+	testServer := flakyServer(1, &hits)
+	defer testServer.Close()
+	client := fastRetryClient(t, testServer.URL)
+
+	// The server may have created the WorkItem, even though
+	// it returned an error, so don't send it again.
+	resp := client.WorkItemSave(&models.WorkItem{Name: "bag.tar"})
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, "POST", resp.Request.Method)
+	assert.EqualValues(t, 1, hits)
+}
+
+func TestDoRequest_RetriesPostWhenServerUnreachable(t *testing.T) {
+	testServer := httptest.NewServer(http.NotFoundHandler())
+	testServer.Close()
+	client := fastRetryClient(t, testServer.URL)
+
+	resp := client.WorkItemSave(&models.WorkItem{Name: "bag.tar"})
+	require.NotNil(t, resp.Error)
+	assert.EqualValues(t, client.RetryPolicy().MaxAttempts-1, client.Stats().Retries)
+}
+
+func TestDoRequest_CircuitBreaker(t *testing.T) {
+	var hits int32
+	testServer := flakyServer(3, &hits)
+	defer testServer.Close()
+
+	policy := fastRetryPolicy()
+	policy.MaxAttempts = 1
+	policy.FailureThreshold = 3
+	policy.CooldownPeriod = 100 * time.Millisecond
+	policy.MaxCircuitWait = 0
+	client := fastRetryClient(t, testServer.URL)
+	client.SetRetryPolicy(policy)
+
+	for i := 0; i < 3; i++ {
+		resp := client.InstitutionGet("college.edu")
+		require.NotNil(t, resp.Error)
+	}
+	assert.True(t, client.Stats().CircuitOpen)
+	assert.EqualValues(t, 1, client.Stats().CircuitOpened)
+
+	// All clients in the process that talk to the same server
+	// share the breaker, and none of them should hit the server.
+	otherClient := fastRetryClient(t, testServer.URL)
+	otherClient.SetRetryPolicy(policy)
+	resp := otherClient.InstitutionGet("college.edu")
+	assert.Equal(t, network.ErrCircuitOpen, resp.Error)
+	assert.EqualValues(t, 3, hits)
+	assert.EqualValues(t, 1, client.Stats().CircuitRejected)
+
+	// A request that waits out the cooldown gets through.
+	policy.MaxCircuitWait = time.Second
+	resp = client.InstitutionGet("college.edu")
+	require.Nil(t, resp.Error)
+	assert.EqualValues(t, 4, hits)
+
+	stats := client.Stats()
+	assert.False(t, stats.CircuitOpen)
+	assert.EqualValues(t, 5, stats.Requests)
+	assert.EqualValues(t, 4, stats.Failures)
+}
+
+// failingAuthenticator can't get credentials for any request.
+type failingAuthenticator struct{}
+
+func (auth failingAuthenticator) Authenticate(request *http.Request) error {
+	return assert.AnError
+}
+
+func (auth failingAuthenticator) ConfigureTransport(transport *http.Transport) error {
+	return nil
+}
+
+func TestDoRequest_CircuitBreakerProbeFails(t *testing.T) {
+	var hits int32
+	testServer := flakyServer(3, &hits)
+	defer testServer.Close()
+
+	policy := fastRetryPolicy()
+	policy.MaxAttempts = 1
+	policy.FailureThreshold = 3
+	policy.CooldownPeriod = 20 * time.Millisecond
+	policy.MaxCircuitWait = 0
+	client := fastRetryClient(t, testServer.URL)
+	client.SetRetryPolicy(policy)
+	for i := 0; i < 3; i++ {
+		resp := client.InstitutionGet("college.edu")
+		require.NotNil(t, resp.Error)
+	}
+	require.True(t, client.Stats().CircuitOpen)
+	time.Sleep(2 * policy.CooldownPeriod)
+
+	// The first request after the cooldown tests whether Pharos
+	// is back, but it never gets sent.
+	badClient, err := network.NewPharosClientWithAuth(testServer.URL, "v2", failingAuthenticator{})
+	require.Nil(t, err)
+	badClient.SetRetryPolicy(policy)
+	resp := badClient.InstitutionGet("college.edu")
+	require.NotNil(t, resp.Error)
+	assert.EqualValues(t, 3, hits)
+
+	// The next request tests Pharos instead of waiting for an
+	// answer that will never come.
+	policy.MaxCircuitWait = time.Second
+	resp = client.InstitutionGet("college.edu")
+	require.Nil(t, resp.Error)
+	assert.EqualValues(t, 4, hits)
+	assert.False(t, client.Stats().CircuitOpen)
+	assert.EqualValues(t, 0, client.Stats().CircuitRejected)
+}
+
+// slowServer holds each request until the client gives up on it.
+// Param hits counts requests.
+func slowServer(hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		<-r.Context().Done()
+	}))
+}
+
+func TestDoRequest_RequestTimeout(t *testing.T) {
+	var hits int32
+	testServer := slowServer(&hits)
+	defer testServer.Close()
+
+	policy := fastRetryPolicy()
+	policy.MaxAttempts = 2
+	policy.RequestTimeout = 20 * time.Millisecond
+	client := fastRetryClient(t, testServer.URL)
+	client.SetRetryPolicy(policy)
+
+	// A request that times out is retried, like any other network error.
+	resp := client.InstitutionGet("college.edu")
+	require.NotNil(t, resp.Error)
+	assert.EqualValues(t, 2, hits)
+	assert.EqualValues(t, 1, client.Stats().Retries)
+}
+
+func TestDoRequest_Cancelled(t *testing.T) {
+	var hits int32
+	testServer := slowServer(&hits)
+	defer testServer.Close()
+
+	policy := fastRetryPolicy()
+	policy.FailureThreshold = 1
+	client := fastRetryClient(t, testServer.URL)
+	client.SetRetryPolicy(policy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	resp := client.WithContext(ctx).InstitutionGet("college.edu")
+	require.NotNil(t, resp.Error)
+	assert.EqualValues(t, 1, hits)
+
+	// Cancelling is not the server's fault, so there are no retries,
+	// and the circuit stays closed.
+	stats := client.Stats()
+	assert.EqualValues(t, 0, stats.Retries)
+	assert.False(t, stats.CircuitOpen)
+
+	// The original client has no context, and is not affected.
+	assert.Equal(t, context.Background(), client.Context())
+	assert.Equal(t, ctx, client.WithContext(ctx).Context())
+	assert.Equal(t, context.Background(), client.WithContext(nil).Context())
+
+	// A client with a cancelled context doesn't send anything.
+	resp = client.WithContext(ctx).InstitutionGet("college.edu")
+	assert.Equal(t, context.Canceled, resp.Error)
+	assert.EqualValues(t, 1, hits)
+}
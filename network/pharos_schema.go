@@ -0,0 +1,442 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaError means a request or response body doesn't match the
+// schema for its record type and API version. For a request, that
+// means we built a record Pharos would reject, and the request was not
+// sent. For a response, it usually means Pharos has changed the shape
+// of its records, and the schemas in config/pharos_schemas need
+// updating.
+type SchemaError struct {
+	// APIVersion is the version of the Pharos API whose
+	// schema the body didn't match.
+	APIVersion string
+	// ObjectType is the type of record in the body.
+	ObjectType PharosObjectType
+	// Direction is "request" or "response".
+	Direction string
+	// Problems describes each part of the body that doesn't
+	// match, starting with its path, like "generic_file.size".
+	Problems []string
+}
+
+// Error returns a description of all of the problems.
+func (err *SchemaError) Error() string {
+	return fmt.Sprintf("Pharos %s %s %s does not match schema: %s",
+		err.APIVersion, err.ObjectType, err.Direction, strings.Join(err.Problems, "; "))
+}
+
+// isInvalidRequest returns true if err says a request body
+// didn't match its schema.
+func isInvalidRequest(err error) bool {
+	schemaErr, ok := err.(*SchemaError)
+	return ok && schemaErr.Direction == "request"
+}
+
+// PharosSchemas holds the JSON schemas that describe the records each
+// version of the Pharos API sends and accepts. See LoadPharosSchemas
+// and PharosClient.SetSchemas.
+//
+// The schemas use a subset of JSON Schema: type (a name or list of
+// names, including "integer" and "null"), properties, required,
+// additionalProperties (true or false), items, enum (strings only),
+// format ("date-time" only), minimum, minLength, and $ref. A $ref
+// must point to another record's schema in the same file, like
+// "#/types/Checksum/request".
+type PharosSchemas struct {
+	versions map[string]*schemaBundle
+}
+
+// schemaBundle is the contents of one schema file.
+type schemaBundle struct {
+	Version     string                              `json:"version"`
+	Description string                              `json:"description"`
+	Types       map[PharosObjectType]*recordSchemas `json:"types"`
+}
+
+// recordSchemas are the schemas for one type of record. RequestWrapper
+// is the name of the key that wraps a single record in a request body,
+// like "generic_file". Batch requests send unwrapped records in a list.
+type recordSchemas struct {
+	RequestWrapper string      `json:"requestWrapper"`
+	Request        *jsonSchema `json:"request"`
+	Response       *jsonSchema `json:"response"`
+}
+
+// jsonSchema is the part of a JSON Schema we understand.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []string               `json:"enum"`
+	Format               string                 `json:"format"`
+	Minimum              *float64               `json:"minimum"`
+	MinLength            *int                   `json:"minLength"`
+	Ref                  string                 `json:"$ref"`
+}
+
+// schemaTypes is the value of a schema's type keyword, which
+// may be a single name or a list of names.
+type schemaTypes []string
+
+func (types *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*types = schemaTypes{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*types = schemaTypes(names)
+	return nil
+}
+
+// LoadPharosSchemas loads every .json file in dir. Each file holds
+// the schemas for one version of the Pharos API. The repo's schemas
+// are in config/pharos_schemas.
+func LoadPharosSchemas(dir string) (*PharosSchemas, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No Pharos schema files in %s", dir)
+	}
+	schemas := &PharosSchemas{versions: make(map[string]*schemaBundle)}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read Pharos schema file: %v", err)
+		}
+		bundle := &schemaBundle{}
+		if err = json.Unmarshal(data, bundle); err != nil {
+			return nil, fmt.Errorf("Cannot parse Pharos schema file %s: %v", file, err)
+		}
+		if bundle.Version == "" {
+			return nil, fmt.Errorf("Pharos schema file %s has no version", file)
+		}
+		if _, exists := schemas.versions[bundle.Version]; exists {
+			return nil, fmt.Errorf("More than one Pharos schema file for version %s", bundle.Version)
+		}
+		if err = bundle.checkRefs(); err != nil {
+			return nil, fmt.Errorf("Pharos schema file %s: %v", file, err)
+		}
+		schemas.versions[bundle.Version] = bundle
+	}
+	return schemas, nil
+}
+
+// Versions returns the API versions these schemas describe, sorted.
+func (schemas *PharosSchemas) Versions() []string {
+	versions := make([]string, 0, len(schemas.versions))
+	for version := range schemas.versions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Supports returns true if these schemas describe version
+// of the Pharos API.
+func (schemas *PharosSchemas) Supports(version string) bool {
+	return schemas.versions[version] != nil
+}
+
+// ValidateRequest checks body, which we're about to send to the
+// specified version of the Pharos API, against the request schema
+// for objType. The body may be a single record, wrapped or not, or a
+// list of records. It returns a *SchemaError if the body doesn't
+// match, and nil if it matches or if there's no schema to check.
+func (schemas *PharosSchemas) ValidateRequest(version string, objType PharosObjectType, body []byte) error {
+	bundle, record := schemas.recordSchemas(version, objType)
+	if record == nil || record.Request == nil {
+		return nil
+	}
+	v := &validator{bundle: bundle, direction: "request"}
+	value, err := decodeJson(body)
+	if err != nil {
+		v.problem("", "body is not valid JSON: %v", err)
+	} else if list, isList := value.([]interface{}); isList {
+		v.validateList(list, "", record.Request)
+	} else if wrapped, isObject := value.(map[string]interface{}); isObject && record.RequestWrapper != "" {
+		inner, hasWrapper := wrapped[record.RequestWrapper]
+		if !hasWrapper || len(wrapped) > 1 {
+			v.problem("", "body must be a list or an object with the single key %s", record.RequestWrapper)
+		} else {
+			v.validate(inner, record.RequestWrapper, record.Request)
+		}
+	} else {
+		v.validate(value, "", record.Request)
+	}
+	return v.err(version, objType)
+}
+
+// ValidateResponse checks body, which came from the specified version
+// of the Pharos API, against the response schema for objType. The body
+// may be a single record, a list of records, or a page of results. It
+// returns a *SchemaError if the body doesn't match, and nil if it
+// matches or if there's no schema to check.
+func (schemas *PharosSchemas) ValidateResponse(version string, objType PharosObjectType, body []byte) error {
+	bundle, record := schemas.recordSchemas(version, objType)
+	if record == nil || record.Response == nil {
+		return nil
+	}
+	v := &validator{bundle: bundle, direction: "response"}
+	value, err := decodeJson(body)
+	if err != nil {
+		v.problem("", "body is not valid JSON: %v", err)
+	} else if list, isList := value.([]interface{}); isList {
+		v.validateList(list, "", record.Response)
+	} else if page, isPage := value.(map[string]interface{}); isPage && isResultsPage(page) {
+		if results, ok := page["results"].([]interface{}); ok {
+			v.validateList(results, "results", record.Response)
+		} else if page["results"] != nil {
+			v.problem("results", "expected array, got %s", jsonTypeOf(page["results"]))
+		}
+	} else {
+		v.validate(value, "", record.Response)
+	}
+	return v.err(version, objType)
+}
+
+func (schemas *PharosSchemas) recordSchemas(version string, objType PharosObjectType) (*schemaBundle, *recordSchemas) {
+	if schemas == nil {
+		return nil, nil
+	}
+	bundle := schemas.versions[version]
+	if bundle == nil {
+		return nil, nil
+	}
+	return bundle, bundle.Types[objType]
+}
+
+// isResultsPage returns true if value looks like a page of list
+// results, which has count, next, previous and results.
+func isResultsPage(value map[string]interface{}) bool {
+	_, hasCount := value["count"]
+	_, hasResults := value["results"]
+	return hasCount && hasResults
+}
+
+// resolve returns the schema ref points to, or nil.
+func (bundle *schemaBundle) resolve(ref string) *jsonSchema {
+	parts := strings.Split(strings.TrimPrefix(ref, "#/types/"), "/")
+	if !strings.HasPrefix(ref, "#/types/") || len(parts) != 2 {
+		return nil
+	}
+	record := bundle.Types[PharosObjectType(parts[0])]
+	if record == nil {
+		return nil
+	}
+	switch parts[1] {
+	case "request":
+		return record.Request
+	case "response":
+		return record.Response
+	}
+	return nil
+}
+
+// checkRefs returns an error if any $ref in the bundle
+// doesn't point to a schema.
+func (bundle *schemaBundle) checkRefs() error {
+	var check func(schema *jsonSchema) error
+	check = func(schema *jsonSchema) error {
+		if schema == nil {
+			return nil
+		}
+		if schema.Ref != "" && bundle.resolve(schema.Ref) == nil {
+			return fmt.Errorf("$ref %s does not point to a schema", schema.Ref)
+		}
+		for _, property := range schema.Properties {
+			if err := check(property); err != nil {
+				return err
+			}
+		}
+		return check(schema.Items)
+	}
+	for _, record := range bundle.Types {
+		if err := check(record.Request); err != nil {
+			return err
+		}
+		if err := check(record.Response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validator collects the problems it finds in one body.
+type validator struct {
+	bundle    *schemaBundle
+	direction string
+	problems  []string
+}
+
+func (v *validator) problem(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "body"
+	}
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) err(version string, objType PharosObjectType) error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &SchemaError{
+		APIVersion: version,
+		ObjectType: objType,
+		Direction:  v.direction,
+		Problems:   v.problems,
+	}
+}
+
+func (v *validator) validateList(list []interface{}, path string, schema *jsonSchema) {
+	for i, item := range list {
+		v.validate(item, fmt.Sprintf("%s[%d]", path, i), schema)
+	}
+}
+
+func (v *validator) validate(value interface{}, path string, schema *jsonSchema) {
+	if schema.Ref != "" {
+		schema = v.bundle.resolve(schema.Ref)
+	}
+	valueType := jsonTypeOf(value)
+	if len(schema.Type) > 0 && !schema.allows(valueType) {
+		v.problem(path, "expected %s, got %s", strings.Join(schema.Type, " or "), valueType)
+		return
+	}
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(typedValue, path, schema)
+	case []interface{}:
+		if schema.Items != nil {
+			v.validateList(typedValue, path, schema.Items)
+		}
+	case string:
+		v.validateString(typedValue, path, schema)
+	case json.Number:
+		if schema.Minimum != nil {
+			number, _ := typedValue.Float64()
+			if number < *schema.Minimum {
+				v.problem(path, "%s is less than the minimum, %v", typedValue, *schema.Minimum)
+			}
+		}
+	}
+}
+
+func (v *validator) validateObject(value map[string]interface{}, path string, schema *jsonSchema) {
+	for _, name := range schema.Required {
+		if _, ok := value[name]; !ok {
+			v.problem(joinPath(path, name), "is required")
+		}
+	}
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propertySchema := schema.Properties[name]
+		if propertySchema != nil {
+			v.validate(value[name], joinPath(path, name), propertySchema)
+		} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+			v.problem(joinPath(path, name), "is not in the schema")
+		}
+	}
+}
+
+func (v *validator) validateString(value, path string, schema *jsonSchema) {
+	if schema.MinLength != nil && len([]rune(value)) < *schema.MinLength {
+		if *schema.MinLength == 1 {
+			v.problem(path, "cannot be empty")
+		} else {
+			v.problem(path, "must be at least %d characters", *schema.MinLength)
+		}
+	}
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			if value == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.problem(path, "'%s' is not one of %s", value, strings.Join(schema.Enum, ", "))
+		}
+	}
+	if schema.Format == "date-time" {
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			v.problem(path, "'%s' is not an RFC 3339 date-time", value)
+		}
+	}
+}
+
+// allows returns true if the schema's type keyword
+// allows a value of type valueType.
+func (schema *jsonSchema) allows(valueType string) bool {
+	for _, allowed := range schema.Type {
+		if allowed == valueType || (allowed == "number" && valueType == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeOf returns the JSON Schema type name of value, which
+// must have been decoded by decodeJson.
+func jsonTypeOf(value interface{}) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if _, err := typedValue.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// decodeJson decodes data, keeping numbers as json.Number
+// so we can tell integers from other numbers.
+func decodeJson(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,268 @@
+package network_test
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadPharosSchemas(t *testing.T) *network.PharosSchemas {
+	dir, err := fileutil.RelativeToAbsPath("config/pharos_schemas")
+	require.Nil(t, err)
+	schemas, err := network.LoadPharosSchemas(dir)
+	require.Nil(t, err)
+	return schemas
+}
+
+func schemaProblems(t *testing.T, err error) []string {
+	require.NotNil(t, err)
+	schemaErr, ok := err.(*network.SchemaError)
+	require.True(t, ok, "Expected a SchemaError, got %v", err)
+	return schemaErr.Problems
+}
+
+func TestLoadPharosSchemas(t *testing.T) {
+	schemas := loadPharosSchemas(t)
+	assert.Equal(t, []string{"v2"}, schemas.Versions())
+	assert.True(t, schemas.Supports("v2"))
+	assert.False(t, schemas.Supports("v1"))
+
+	tempDir, err := ioutil.TempDir("", "pharos_schema_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	_, err = network.LoadPharosSchemas(tempDir)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "No Pharos schema files")
+
+	badRef := `{"version": "v9", "types": {"GenericFile": {"response": {"$ref": "#/types/Nope/response"}}}}`
+	require.Nil(t, ioutil.WriteFile(filepath.Join(tempDir, "v9.json"), []byte(badRef), 0644))
+	_, err = network.LoadPharosSchemas(tempDir)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "does not point to a schema")
+}
+
+func TestPharosSchemas_ValidateRequest(t *testing.T) {
+	schemas := loadPharosSchemas(t)
+	obj := testutil.MakeIntellectualObject(0, 0, 0, 0)
+	data, err := obj.SerializeForPharos()
+	require.Nil(t, err)
+	assert.Nil(t, schemas.ValidateRequest("v2", network.PharosIntellectualObject, data))
+
+	// Storage options come from the config, so the schema
+	// accepts any name.
+	obj.StorageOption = "Wasabi-OR"
+	data, err = obj.SerializeForPharos()
+	require.Nil(t, err)
+	assert.Nil(t, schemas.ValidateRequest("v2", network.PharosIntellectualObject, data))
+
+	// No schemas for this version means nothing to check.
+	assert.Nil(t, schemas.ValidateRequest("v1", network.PharosIntellectualObject, []byte("{}")))
+
+	obj.Title = ""
+	obj.Access = "public"
+	obj.InstitutionId = 0
+	data, err = obj.SerializeForPharos()
+	require.Nil(t, err)
+	problems := schemaProblems(t, schemas.ValidateRequest("v2", network.PharosIntellectualObject, data))
+	assert.Equal(t, []string{
+		"intellectual_object.access: 'public' is not one of consortia, institution, restricted",
+		"intellectual_object.institution_id: 0 is less than the minimum, 1",
+		"intellectual_object.title: cannot be empty",
+	}, problems)
+
+	problems = schemaProblems(t, schemas.ValidateRequest("v2", network.PharosIntellectualObject,
+		[]byte(`{"identifier": "test.edu/bag"}`)))
+	assert.Equal(t, []string{"body: body must be a list or an object with the single key intellectual_object"}, problems)
+
+	// Batches are lists of unwrapped records, and nested
+	// records are checked against their own schemas.
+	gf := testutil.MakeGenericFile(1, 1, "")
+	gf.Checksums[0].Algorithm = "crc32"
+	data = []byte(fmt.Sprintf(`[{"identifier": "%s", "size": 1.5, "color": "blue"}]`, gf.Identifier))
+	problems = schemaProblems(t, schemas.ValidateRequest("v2", network.PharosGenericFile, data))
+	assert.Contains(t, problems, "[0].intellectual_object_id: is required")
+	assert.Contains(t, problems, "[0].size: expected integer, got number")
+	assert.Contains(t, problems, "[0].color: is not in the schema")
+	data, err = gf.SerializeForPharos()
+	require.Nil(t, err)
+	problems = schemaProblems(t, schemas.ValidateRequest("v2", network.PharosGenericFile, data))
+	assert.Equal(t, []string{
+		"generic_file.checksums_attributes[0].algorithm: 'crc32' is not one of md5, sha1, sha256, sha512",
+	}, problems)
+
+	problems = schemaProblems(t, schemas.ValidateRequest("v2", network.PharosWorkItem, []byte("not json")))
+	assert.Contains(t, problems[0], "body: body is not valid JSON")
+}
+
+func TestPharosSchemas_ValidateResponse(t *testing.T) {
+	schemas := loadPharosSchemas(t)
+	page := `{"count": 2, "next": null, "previous": null, "results": [
+		{"id": 1, "identifier": "test.edu", "name": null, "receiving_bucket": "aptrust.receiving.test.edu", "new_field": 7},
+		{"id": "2", "name": "College"}]}`
+	problems := schemaProblems(t, schemas.ValidateResponse("v2", network.PharosInstitution, []byte(page)))
+	assert.Equal(t, []string{
+		"results[1].identifier: is required",
+		"results[1].id: expected integer, got string",
+	}, problems)
+
+	obj := `{"id": 5, "identifier": "test.edu/bag", "created_at": "2016-11-08T19:07:55.000Z",
+		"generic_files": [{"id": 6, "identifier": "test.edu/bag/data/file.txt",
+		"checksums": [{"id": 7, "generic_file_id": 6, "algorithm": "md5", "digest": "1234", "datetime": "yesterday"}]}]}`
+	problems = schemaProblems(t, schemas.ValidateResponse("v2", network.PharosIntellectualObject, []byte(obj)))
+	assert.Equal(t, []string{
+		"generic_files[0].checksums[0].datetime: 'yesterday' is not an RFC 3339 date-time",
+	}, problems)
+}
+
+func TestPharosClient_RequestSchemaError(t *testing.T) {
+	fake, client, _ := fakePharosWithObject(t)
+	defer fake.Close()
+	client.SetSchemas(loadPharosSchemas(t))
+	assert.NotNil(t, client.Schemas())
+
+	obj := testutil.MakeIntellectualObject(0, 0, 0, 0)
+	obj.Id = 0
+	obj.Access = "public"
+	resp := client.IntellectualObjectSave(obj)
+	problems := schemaProblems(t, resp.Error)
+	assert.Equal(t, 1, len(problems))
+	assert.Contains(t, resp.Error.Error(), "Pharos v2 IntellectualObject request does not match schema")
+	assert.Nil(t, resp.Response)
+
+	// That's our bug, so it doesn't count against Pharos.
+	assert.EqualValues(t, 0, client.Stats().Failures)
+	assert.False(t, client.Stats().CircuitOpen)
+
+	// A batch with an invalid record is split up, so the
+	// valid records are still saved.
+	objResp := client.IntellectualObjectGet("test.edu/bag1", false, false)
+	require.Nil(t, objResp.Error)
+	events := makeUnsavedEvents(3, objResp.IntellectualObject())
+	events[1].EventType = ""
+	batchResp := client.PremisEventSaveBatch(events)
+	require.Equal(t, 1, len(batchResp.ItemErrors))
+	assert.Equal(t, 1, batchResp.ItemErrors[0].Index)
+	schemaProblems(t, batchResp.ItemErrors[0].Err)
+	assert.NotNil(t, batchResp.PremisEvents()[0])
+	assert.NotNil(t, batchResp.PremisEvents()[2])
+}
+
+func TestPharosClient_ResponseSchemaError(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": 1, "name": "College", "ident": "college.edu"}`)
+	}))
+	defer testServer.Close()
+	client := fastRetryClient(t, testServer.URL)
+	client.SetSchemas(loadPharosSchemas(t))
+
+	resp := client.InstitutionGet("college.edu")
+	problems := schemaProblems(t, resp.Error)
+	assert.Equal(t, []string{"identifier: is required"}, problems)
+	assert.Contains(t, resp.Error.Error(), "Pharos v2 Institution response does not match schema")
+	assert.Equal(t, 200, resp.Response.StatusCode)
+}
+
+func TestPharosClient_SchemasMatchFakePharos(t *testing.T) {
+	fake, client, _ := fakePharosWithObject(t)
+	defer fake.Close()
+	client.SetSchemas(loadPharosSchemas(t))
+	inst := client.InstitutionGet("test.edu")
+	require.Nil(t, inst.Error)
+
+	obj := testutil.MakeIntellectualObject(0, 0, 0, 0)
+	obj.Id = 0
+	obj.Institution = "test.edu"
+	obj.InstitutionId = inst.Institution().Id
+	obj.Identifier = "test.edu/" + obj.BagName
+	objResp := client.IntellectualObjectSave(obj)
+	require.Nil(t, objResp.Error)
+	obj = objResp.IntellectualObject()
+
+	gf := testutil.MakeGenericFile(2, 2, obj.Identifier)
+	gf.Id = 0
+	gf.IntellectualObjectId = obj.Id
+	for _, cs := range gf.Checksums {
+		cs.Id = 0
+		cs.GenericFileId = 0
+	}
+	for _, event := range gf.PremisEvents {
+		event.Id = 0
+	}
+	gfResp := client.GenericFileSave(gf)
+	require.Nil(t, gfResp.Error)
+
+	item := testutil.MakeWorkItem()
+	item.Id = 0
+	item.InstitutionId = obj.InstitutionId
+	itemResp := client.WorkItemSave(item)
+	require.Nil(t, itemResp.Error)
+
+	state := testutil.MakeWorkItemState()
+	state.Id = 0
+	state.WorkItemId = itemResp.WorkItem().Id
+	require.Nil(t, client.WorkItemStateSave(state).Error)
+
+	params := url.Values{}
+	params.Set("intellectual_object_identifier", obj.Identifier)
+	require.Nil(t, client.IntellectualObjectGet(obj.Identifier, true, true).Error)
+	require.Nil(t, client.GenericFileList(params).Error)
+	require.Nil(t, client.InstitutionList(nil).Error)
+}
+
+func TestNegotiateAPIVersion(t *testing.T) {
+	fake, client, _ := fakePharosWithObject(t)
+	defer fake.Close()
+	fake.APIVersion = "v3"
+
+	version, err := client.NegotiateAPIVersion("v4", "v3", "v2")
+	require.Nil(t, err)
+	assert.Equal(t, "v3", version)
+	assert.Equal(t, "v3", client.APIVersion())
+	require.Nil(t, client.InstitutionGet("test.edu").Error)
+
+	// With schemas, the client won't use versions it can't check.
+	client.SetSchemas(loadPharosSchemas(t))
+	fake.APIVersion = "v4"
+	_, err = client.NegotiateAPIVersion("v4", "v1")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Pharos does not support any of API versions v4, v1")
+	assert.Contains(t, err.Error(), "v4: no schemas")
+	assert.Contains(t, err.Error(), "v1: no schemas")
+	assert.Equal(t, "v3", client.APIVersion())
+
+	// We don't ship a v3 schema yet.
+	fake.APIVersion = "v3"
+	_, err = client.NegotiateAPIVersion("v3")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "v3: no schemas")
+
+	fake.APIVersion = "v2"
+	version, err = client.NegotiateAPIVersion("v3", "v2")
+	require.Nil(t, err)
+	assert.Equal(t, "v2", version)
+
+	fake.Close()
+	_, err = client.NegotiateAPIVersion("v3", "v2")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Cannot negotiate Pharos API version")
+}
+
+func TestPharosSchemaConfig(t *testing.T) {
+	config := &models.Config{PharosSchemaDirectory: "config/pharos_schemas"}
+	config.ExpandFilePaths()
+	assert.True(t, filepath.IsAbs(config.PharosSchemaDirectory))
+	_, err := network.LoadPharosSchemas(config.PharosSchemaDirectory)
+	assert.Nil(t, err)
+}
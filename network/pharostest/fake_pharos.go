@@ -0,0 +1,1257 @@
+package pharostest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakePharosPerPage is the page size FakePharos uses for list
+// requests that don't include a per_page param.
+const FakePharosPerPage = 10
+
+// FakePharos is an in-process stand-in for the Pharos REST API. It
+// implements the endpoints PharosClient uses, storing records in
+// memory, so tests can exercise code that talks to Pharos without a
+// Rails server, Postgres or a network.
+//
+// FakePharos supports the filters our workers use, not every filter
+// Pharos supports. Unknown params are ignored. List responses have
+// the same count, next, previous and results keys as Pharos, and
+// results are in order of id unless the request sorts by date.
+//
+// Seed data with the Add methods. For example:
+//
+//	fake := pharostest.NewFakePharos()
+//	defer fake.Close()
+//	fake.AddInstitution(&models.Institution{Identifier: "test.edu"})
+//	client, _ := network.NewPharosClient(fake.URL, "v2", "user", "key")
+type FakePharos struct {
+	*httptest.Server
+
+	// APIVersion is the version in the URLs the fake responds
+	// to, as in /api/v2/objects.
+	APIVersion string
+
+	mutex          sync.Mutex
+	lastId         map[string]int
+	institutions   []*models.Institution
+	objects        []*models.IntellectualObject
+	files          []*models.GenericFile
+	checksums      []*models.Checksum
+	events         []*models.PremisEvent
+	workItems      []*models.WorkItem
+	workItemStates []*models.WorkItemState
+}
+
+// fakePharosError is an error with an HTTP status code.
+type fakePharosError struct {
+	status  int
+	message string
+}
+
+func (err *fakePharosError) Error() string {
+	return err.message
+}
+
+func notFound(format string, a ...interface{}) *fakePharosError {
+	return &fakePharosError{http.StatusNotFound, fmt.Sprintf(format, a...)}
+}
+
+func unprocessable(format string, a ...interface{}) *fakePharosError {
+	return &fakePharosError{http.StatusUnprocessableEntity, fmt.Sprintf(format, a...)}
+}
+
+// NewFakePharos starts a FakePharos with no data. Call Close
+// when you're done with it.
+func NewFakePharos() *FakePharos {
+	fake := &FakePharos{
+		APIVersion:     "v2",
+		lastId:         make(map[string]int),
+		institutions:   make([]*models.Institution, 0),
+		objects:        make([]*models.IntellectualObject, 0),
+		files:          make([]*models.GenericFile, 0),
+		checksums:      make([]*models.Checksum, 0),
+		events:         make([]*models.PremisEvent, 0),
+		workItems:      make([]*models.WorkItem, 0),
+		workItemStates: make([]*models.WorkItemState, 0),
+	}
+	fake.Server = httptest.NewServer(fake)
+	return fake
+}
+
+// -------------------------------------------------------------------------
+// Seed data
+// -------------------------------------------------------------------------
+
+// AddInstitution adds an institution and returns the saved copy.
+func (fake *FakePharos) AddInstitution(institution *models.Institution) *models.Institution {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	saved := *institution
+	saved.Id = fake.newId("institution")
+	fake.institutions = append(fake.institutions, &saved)
+	return &saved
+}
+
+// AddIntellectualObject adds an object and returns the saved copy.
+// The object's institution must already exist. Files and events
+// attached to obj are not saved. Use AddGenericFile and
+// AddPremisEvent for those.
+func (fake *FakePharos) AddIntellectualObject(obj *models.IntellectualObject) (*models.IntellectualObject, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.createObject(obj)
+}
+
+// AddGenericFile adds a GenericFile, along with its checksums and
+// events, and returns the saved copy. The file's IntellectualObject
+// must already exist.
+func (fake *FakePharos) AddGenericFile(gf *models.GenericFile) (*models.GenericFile, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.createFile(gf)
+}
+
+// AddPremisEvent adds a PremisEvent and returns the saved copy.
+func (fake *FakePharos) AddPremisEvent(event *models.PremisEvent) (*models.PremisEvent, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.createEvent(event)
+}
+
+// AddWorkItem adds a WorkItem and returns the saved copy.
+func (fake *FakePharos) AddWorkItem(item *models.WorkItem) *models.WorkItem {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.createWorkItem(item)
+}
+
+// -------------------------------------------------------------------------
+// Routing
+// -------------------------------------------------------------------------
+
+// ServeHTTP routes requests to the handlers below, based on the
+// same URLs PharosClient builds.
+func (fake *FakePharos) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := fmt.Sprintf("/api/%s/", fake.APIVersion)
+	rawPath := r.URL.EscapedPath()
+	if !strings.HasPrefix(rawPath, prefix) {
+		fake.writeError(w, notFound("No route for %s", rawPath))
+		return
+	}
+	// Split on slashes before unescaping, because identifiers
+	// in the URL contain escaped slashes. PharosClient escapes
+	// identifiers with url.QueryEscape, so a plus is a space.
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(strings.Trim(strings.TrimPrefix(rawPath, prefix), "/"), "/") {
+		unescaped, err := url.QueryUnescape(segment)
+		if err != nil {
+			fake.writeError(w, notFound("Bad URL segment %s", segment))
+			return
+		}
+		if unescaped != "" {
+			segments = append(segments, unescaped)
+		}
+	}
+	if len(segments) == 0 {
+		fake.writeError(w, notFound("No route for %s", rawPath))
+		return
+	}
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	var data interface{}
+	var err *fakePharosError
+	switch segments[0] {
+	case "institutions":
+		data, err = fake.routeInstitutions(r, segments[1:])
+	case "objects":
+		data, err = fake.routeObjects(r, segments[1:])
+	case "files":
+		data, err = fake.routeFiles(r, segments[1:])
+	case "checksums":
+		data, err = fake.routeChecksums(r, segments[1:])
+	case "events":
+		data, err = fake.routeEvents(r, segments[1:])
+	case "items":
+		data, err = fake.routeWorkItems(r, segments[1:])
+	case "item_state":
+		data, err = fake.routeWorkItemStates(r, segments[1:])
+	case "notifications":
+		data, err = fake.routeNotifications(r, segments[1:])
+	default:
+		err = notFound("No route for %s", rawPath)
+	}
+	if err != nil {
+		fake.writeError(w, err)
+		return
+	}
+	if data == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	jsonData, jsonErr := json.Marshal(data)
+	if jsonErr != nil {
+		fake.writeError(w, &fakePharosError{http.StatusInternalServerError, jsonErr.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(jsonData)
+}
+
+func (fake *FakePharos) writeError(w http.ResponseWriter, err *fakePharosError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.status)
+	jsonData, _ := json.Marshal(map[string]string{"error": err.message})
+	w.Write(jsonData)
+}
+
+func methodNotAllowed(r *http.Request) *fakePharosError {
+	return &fakePharosError{http.StatusMethodNotAllowed,
+		fmt.Sprintf("%s not allowed for %s", r.Method, r.URL.EscapedPath())}
+}
+
+// decodeBody decodes the JSON request body into v. If key is not
+// empty, the record is inside the top-level object under that key,
+// as in {"generic_file": {...}}.
+func decodeBody(r *http.Request, key string, v interface{}) *fakePharosError {
+	if key == "" {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			return unprocessable("Invalid JSON: %v", err)
+		}
+		return nil
+	}
+	wrapper := make(map[string]json.RawMessage)
+	if err := json.NewDecoder(r.Body).Decode(&wrapper); err != nil {
+		return unprocessable("Invalid JSON: %v", err)
+	}
+	if _, ok := wrapper[key]; !ok {
+		return unprocessable("Request body is missing %s", key)
+	}
+	if err := json.Unmarshal(wrapper[key], v); err != nil {
+		return unprocessable("Invalid JSON: %v", err)
+	}
+	return nil
+}
+
+func (fake *FakePharos) newId(recordType string) int {
+	fake.lastId[recordType] += 1
+	return fake.lastId[recordType]
+}
+
+// transaction runs fn, which creates records. If fn returns an error,
+// transaction removes any records fn created, so batch creates save
+// all of their records or none, as they do in Pharos.
+func (fake *FakePharos) transaction(fn func() *fakePharosError) *fakePharosError {
+	fileCount := len(fake.files)
+	checksumCount := len(fake.checksums)
+	eventCount := len(fake.events)
+	err := fn()
+	if err != nil {
+		fake.files = fake.files[:fileCount]
+		fake.checksums = fake.checksums[:checksumCount]
+		fake.events = fake.events[:eventCount]
+	}
+	return err
+}
+
+// -------------------------------------------------------------------------
+// Pagination
+// -------------------------------------------------------------------------
+
+// fakePharosList is the structure of a Pharos list response.
+type fakePharosList struct {
+	Count    int           `json:"count"`
+	Next     *string       `json:"next"`
+	Previous *string       `json:"previous"`
+	Results  []interface{} `json:"results"`
+}
+
+// paginate returns one page of results, with links to the next and
+// previous pages, based on the page and per_page params.
+func (fake *FakePharos) paginate(r *http.Request, results []interface{}) *fakePharosList {
+	params := r.URL.Query()
+	page, err := strconv.Atoi(params.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(params.Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = FakePharosPerPage
+	}
+	list := &fakePharosList{Count: len(results), Results: make([]interface{}, 0)}
+	start := (page - 1) * perPage
+	if start < len(results) {
+		end := start + perPage
+		if end > len(results) {
+			end = len(results)
+		}
+		list.Results = results[start:end]
+	}
+	pageUrl := func(pageNumber int) *string {
+		params.Set("page", strconv.Itoa(pageNumber))
+		params.Set("per_page", strconv.Itoa(perPage))
+		link := fmt.Sprintf("%s%s?%s", fake.URL, r.URL.EscapedPath(), params.Encode())
+		return &link
+	}
+	if start+perPage < len(results) {
+		list.Next = pageUrl(page + 1)
+	}
+	if page > 1 {
+		list.Previous = pageUrl(page - 1)
+	}
+	return list
+}
+
+// timeParam parses a datetime param in RFC3339 or yyyy-mm-dd format.
+// It returns ok = false if the param is missing or invalid.
+func timeParam(params url.Values, name string) (value time.Time, ok bool) {
+	str := params.Get(name)
+	if str == "" {
+		return value, false
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if value, err := time.Parse(layout, str); err == nil {
+			return value, true
+		}
+	}
+	return value, false
+}
+
+// matches returns true if params has no value for name, or if
+// the value equals actual.
+func matches(params url.Values, name, actual string) bool {
+	expected := params.Get(name)
+	return expected == "" || expected == actual
+}
+
+// -------------------------------------------------------------------------
+// Institutions
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) routeInstitutions(r *http.Request, segments []string) (interface{}, *fakePharosError) {
+	if r.Method != http.MethodGet {
+		return nil, methodNotAllowed(r)
+	}
+	if len(segments) == 0 {
+		results := make([]interface{}, len(fake.institutions))
+		for i, institution := range fake.institutions {
+			results[i] = institution
+		}
+		return fake.paginate(r, results), nil
+	}
+	institution := fake.findInstitution(segments[0])
+	if institution == nil {
+		return nil, notFound("Institution %s not found", segments[0])
+	}
+	return institution, nil
+}
+
+func (fake *FakePharos) findInstitution(identifier string) *models.Institution {
+	for _, institution := range fake.institutions {
+		if institution.Identifier == identifier {
+			return institution
+		}
+	}
+	return nil
+}
+
+// -------------------------------------------------------------------------
+// IntellectualObjects
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) routeObjects(r *http.Request, segments []string) (interface{}, *fakePharosError) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		return fake.listObjects(r, "")
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		// Object identifiers have slashes. Institution identifiers don't.
+		if !strings.Contains(segments[0], "/") {
+			return fake.listObjects(r, segments[0])
+		}
+		return fake.getObject(r, segments[0])
+	case len(segments) == 1 && r.Method == http.MethodPost:
+		return fake.postObject(r, segments[0])
+	case len(segments) == 1 && r.Method == http.MethodPut:
+		return fake.putObject(r, segments[0])
+	case len(segments) == 2 && segments[1] == "restore" && r.Method == http.MethodPut:
+		return fake.requestObjectRestore(segments[0])
+	case len(segments) == 2 && segments[1] == "delete" && r.Method == http.MethodDelete:
+		return fake.requestObjectDelete(segments[0])
+	case len(segments) == 2 && segments[1] == "finish_delete" && r.Method == http.MethodGet:
+		return fake.finishObjectDelete(segments[0])
+	}
+	return nil, methodNotAllowed(r)
+}
+
+func (fake *FakePharos) findObject(identifier string) *models.IntellectualObject {
+	for _, obj := range fake.objects {
+		if obj.Identifier == identifier {
+			return obj
+		}
+	}
+	return nil
+}
+
+func (fake *FakePharos) findObjectById(id int) *models.IntellectualObject {
+	for _, obj := range fake.objects {
+		if obj.Id == id {
+			return obj
+		}
+	}
+	return nil
+}
+
+// listObjects returns objects belonging to institution, or to all
+// institutions if institution is empty. Like Pharos, it returns
+// only active objects unless the state param says otherwise.
+func (fake *FakePharos) listObjects(r *http.Request, institution string) (interface{}, *fakePharosError) {
+	params := r.URL.Query()
+	state := params.Get("state")
+	if state == "" {
+		state = "A"
+	}
+	updatedSince, filterUpdated := timeParam(params, "updated_since")
+	results := make([]interface{}, 0)
+	for _, obj := range fake.objects {
+		if (institution != "" && obj.Institution != institution) ||
+			obj.State != state ||
+			!matches(params, "storage_option", obj.StorageOption) ||
+			!matches(params, "name_exact", obj.BagName) ||
+			!strings.Contains(obj.Identifier, params.Get("name_contains")) ||
+			(filterUpdated && obj.UpdatedAt.Before(updatedSince)) {
+			continue
+		}
+		results = append(results, obj)
+	}
+	return fake.paginate(r, results), nil
+}
+
+// getObject returns the object, with files and events
+// if the query string asks for them.
+func (fake *FakePharos) getObject(r *http.Request, identifier string) (interface{}, *fakePharosError) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		return nil, notFound("IntellectualObject %s not found", identifier)
+	}
+	params := r.URL.Query()
+	includeAll := params.Get("include_all_relations") == "true"
+	copy := *obj
+	if includeAll || params.Get("include_files") == "true" {
+		copy.GenericFiles = make([]*models.GenericFile, 0)
+		for _, gf := range fake.files {
+			if gf.IntellectualObjectId == obj.Id {
+				copy.GenericFiles = append(copy.GenericFiles, fake.fileWithRelations(gf))
+			}
+		}
+	}
+	if includeAll || params.Get("include_events") == "true" {
+		copy.PremisEvents = make([]*models.PremisEvent, 0)
+		for _, event := range fake.events {
+			if event.IntellectualObjectId == obj.Id && event.GenericFileId == 0 {
+				copy.PremisEvents = append(copy.PremisEvents, event)
+			}
+		}
+	}
+	return &copy, nil
+}
+
+func (fake *FakePharos) postObject(r *http.Request, institution string) (interface{}, *fakePharosError) {
+	pharosObj := &models.IntellectualObjectForPharos{}
+	if err := decodeBody(r, "intellectual_object", pharosObj); err != nil {
+		return nil, err
+	}
+	obj := intellectualObjectFromPharos(pharosObj)
+	obj.Institution = institution
+	return fake.createObject(obj)
+}
+
+func (fake *FakePharos) createObject(obj *models.IntellectualObject) (*models.IntellectualObject, *fakePharosError) {
+	if obj.Identifier == "" {
+		return nil, unprocessable("IntellectualObject identifier is required")
+	}
+	if fake.findObject(obj.Identifier) != nil {
+		return nil, unprocessable("IntellectualObject %s already exists", obj.Identifier)
+	}
+	if obj.Institution == "" {
+		obj.Institution = strings.Split(obj.Identifier, "/")[0]
+	}
+	institution := fake.findInstitution(obj.Institution)
+	if institution == nil {
+		return nil, unprocessable("Institution %s does not exist", obj.Institution)
+	}
+	saved := *obj
+	saved.Id = fake.newId("object")
+	saved.InstitutionId = institution.Id
+	saved.GenericFiles = nil
+	saved.PremisEvents = nil
+	if saved.State == "" {
+		saved.State = "A"
+	}
+	saved.CreatedAt = time.Now().UTC()
+	saved.UpdatedAt = saved.CreatedAt
+	fake.objects = append(fake.objects, &saved)
+	return &saved, nil
+}
+
+func (fake *FakePharos) putObject(r *http.Request, identifier string) (interface{}, *fakePharosError) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		return nil, notFound("IntellectualObject %s not found", identifier)
+	}
+	pharosObj := &models.IntellectualObjectForPharos{}
+	if err := decodeBody(r, "intellectual_object", pharosObj); err != nil {
+		return nil, err
+	}
+	updated := intellectualObjectFromPharos(pharosObj)
+	updated.Id = obj.Id
+	updated.Identifier = obj.Identifier
+	updated.Institution = obj.Institution
+	updated.InstitutionId = obj.InstitutionId
+	updated.CreatedAt = obj.CreatedAt
+	updated.UpdatedAt = time.Now().UTC()
+	if updated.State == "" {
+		updated.State = obj.State
+	}
+	*obj = *updated
+	return obj, nil
+}
+
+func intellectualObjectFromPharos(pharosObj *models.IntellectualObjectForPharos) *models.IntellectualObject {
+	return &models.IntellectualObject{
+		Identifier:             pharosObj.Identifier,
+		BagName:                pharosObj.BagName,
+		BagGroupIdentifier:     pharosObj.BagGroupIdentifier,
+		InstitutionId:          pharosObj.InstitutionId,
+		Title:                  pharosObj.Title,
+		Description:            pharosObj.Description,
+		AltIdentifier:          pharosObj.AltIdentifier,
+		Access:                 pharosObj.Access,
+		DPNUUID:                pharosObj.DPNUUID,
+		ETag:                   pharosObj.ETag,
+		State:                  pharosObj.State,
+		StorageOption:          pharosObj.StorageOption,
+		SourceOrganization:     pharosObj.SourceOrganization,
+		BagItProfileIdentifier: pharosObj.BagItProfileIdentifier,
+	}
+}
+
+func (fake *FakePharos) requestObjectRestore(identifier string) (interface{}, *fakePharosError) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		return nil, notFound("IntellectualObject %s not found", identifier)
+	}
+	return fake.createWorkItem(&models.WorkItem{
+		ObjectIdentifier: obj.Identifier,
+		Name:             obj.BagName + ".tar",
+		InstitutionId:    obj.InstitutionId,
+		Action:           constants.ActionRestore,
+		Stage:            constants.StageRequested,
+		Status:           constants.StatusPending,
+		Note:             "Restore requested",
+		Retry:            true,
+	}), nil
+}
+
+// requestObjectDelete creates a delete WorkItem for each of
+// the object's active files, as Pharos does.
+func (fake *FakePharos) requestObjectDelete(identifier string) (interface{}, *fakePharosError) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		return nil, notFound("IntellectualObject %s not found", identifier)
+	}
+	for _, gf := range fake.files {
+		if gf.IntellectualObjectId == obj.Id && gf.State == "A" {
+			fake.createWorkItem(&models.WorkItem{
+				ObjectIdentifier:      obj.Identifier,
+				GenericFileIdentifier: gf.Identifier,
+				Name:                  obj.BagName + ".tar",
+				InstitutionId:         obj.InstitutionId,
+				Action:                constants.ActionDelete,
+				Stage:                 constants.StageRequested,
+				Status:                constants.StatusPending,
+				Note:                  "Delete requested",
+				Retry:                 true,
+			})
+		}
+	}
+	return nil, nil
+}
+
+func (fake *FakePharos) finishObjectDelete(identifier string) (interface{}, *fakePharosError) {
+	obj := fake.findObject(identifier)
+	if obj == nil {
+		return nil, notFound("IntellectualObject %s not found", identifier)
+	}
+	obj.State = "D"
+	obj.UpdatedAt = time.Now().UTC()
+	return nil, nil
+}
+
+// -------------------------------------------------------------------------
+// GenericFiles
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) routeFiles(r *http.Request, segments []string) (interface{}, *fakePharosError) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		return fake.listFiles(r)
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		return fake.postFile(r)
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		return fake.getFile(r, segments[0])
+	case len(segments) == 1 && r.Method == http.MethodPut:
+		return fake.putFile(r, segments[0])
+	case len(segments) == 2 && segments[0] == "restore" && r.Method == http.MethodPut:
+		return fake.requestFileRestore(segments[1])
+	case len(segments) == 2 && segments[0] == "finish_delete" && r.Method == http.MethodGet:
+		return fake.finishFileDelete(segments[1])
+	case len(segments) == 2 && segments[1] == "create_batch" && r.Method == http.MethodPost:
+		return fake.postFileBatch(r, segments[0])
+	}
+	return nil, methodNotAllowed(r)
+}
+
+func (fake *FakePharos) findFile(identifier string) *models.GenericFile {
+	for _, gf := range fake.files {
+		if gf.Identifier == identifier {
+			return gf
+		}
+	}
+	return nil
+}
+
+// fileWithRelations returns a copy of gf with its checksums and events.
+func (fake *FakePharos) fileWithRelations(gf *models.GenericFile) *models.GenericFile {
+	copy := *gf
+	copy.Checksums = make([]*models.Checksum, 0)
+	for _, cs := range fake.checksums {
+		if cs.GenericFileId == gf.Id {
+			copy.Checksums = append(copy.Checksums, cs)
+		}
+	}
+	copy.PremisEvents = make([]*models.PremisEvent, 0)
+	for _, event := range fake.events {
+		if event.GenericFileId == gf.Id {
+			copy.PremisEvents = append(copy.PremisEvents, event)
+		}
+	}
+	return &copy
+}
+
+func (fake *FakePharos) listFiles(r *http.Request) (interface{}, *fakePharosError) {
+	params := r.URL.Query()
+	notCheckedSince, filterFixity := timeParam(params, "not_checked_since")
+	includeRelations := params.Get("include_relations") == "true" ||
+		params.Get("include_checksums") == "true"
+	results := make([]interface{}, 0)
+	for _, gf := range fake.files {
+		institution := strings.Split(gf.Identifier, "/")[0]
+		if !matches(params, "intellectual_object_identifier", gf.IntellectualObjectIdentifier) ||
+			!matches(params, "institution_identifier", institution) ||
+			!matches(params, "state", gf.State) ||
+			!matches(params, "storage_option", gf.StorageOption) ||
+			!strings.Contains(gf.Identifier, params.Get("identifier_like")) ||
+			(filterFixity && !gf.LastFixityCheck.Before(notCheckedSince)) {
+			continue
+		}
+		if includeRelations {
+			results = append(results, fake.fileWithRelations(gf))
+		} else {
+			results = append(results, gf)
+		}
+	}
+	if params.Get("sort") == "last_fixity_check" {
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].(*models.GenericFile).LastFixityCheck.Before(
+				results[j].(*models.GenericFile).LastFixityCheck)
+		})
+	}
+	return fake.paginate(r, results), nil
+}
+
+func (fake *FakePharos) getFile(r *http.Request, identifier string) (interface{}, *fakePharosError) {
+	gf := fake.findFile(identifier)
+	if gf == nil {
+		return nil, notFound("GenericFile %s not found", identifier)
+	}
+	if r.URL.Query().Get("include_relations") == "true" {
+		return fake.fileWithRelations(gf), nil
+	}
+	return gf, nil
+}
+
+func (fake *FakePharos) postFile(r *http.Request) (interface{}, *fakePharosError) {
+	pharosFile := &models.GenericFileForPharos{}
+	if err := decodeBody(r, "generic_file", pharosFile); err != nil {
+		return nil, err
+	}
+	return fake.createFile(genericFileFromPharos(pharosFile))
+}
+
+// postFileBatch creates all of the files in the batch, or none of
+// them, and returns the new records with their checksums and events.
+func (fake *FakePharos) postFileBatch(r *http.Request, objId string) (interface{}, *fakePharosError) {
+	batch := make([]*models.GenericFileForPharos, 0)
+	if err := decodeBody(r, "", &batch); err != nil {
+		return nil, err
+	}
+	for _, pharosFile := range batch {
+		if strconv.Itoa(pharosFile.IntellectualObjectId) != objId {
+			return nil, unprocessable("GenericFile %s does not belong to object %s",
+				pharosFile.Identifier, objId)
+		}
+		if fake.findFile(pharosFile.Identifier) != nil {
+			return nil, unprocessable("GenericFile %s already exists", pharosFile.Identifier)
+		}
+	}
+	results := make([]interface{}, 0)
+	err := fake.transaction(func() *fakePharosError {
+		for _, pharosFile := range batch {
+			gf, err := fake.createFile(genericFileFromPharos(pharosFile))
+			if err != nil {
+				return err
+			}
+			results = append(results, fake.fileWithRelations(gf))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fakePharosList{Count: len(results), Results: results}, nil
+}
+
+func (fake *FakePharos) createFile(gf *models.GenericFile) (*models.GenericFile, *fakePharosError) {
+	if gf.Identifier == "" {
+		return nil, unprocessable("GenericFile identifier is required")
+	}
+	if fake.findFile(gf.Identifier) != nil {
+		return nil, unprocessable("GenericFile %s already exists", gf.Identifier)
+	}
+	obj := fake.findObjectById(gf.IntellectualObjectId)
+	if obj == nil && gf.IntellectualObjectIdentifier != "" {
+		obj = fake.findObject(gf.IntellectualObjectIdentifier)
+	}
+	if obj == nil {
+		return nil, unprocessable("IntellectualObject %d for GenericFile %s does not exist",
+			gf.IntellectualObjectId, gf.Identifier)
+	}
+	saved := *gf
+	saved.Id = fake.newId("file")
+	saved.IntellectualObjectId = obj.Id
+	saved.IntellectualObjectIdentifier = obj.Identifier
+	if saved.State == "" {
+		saved.State = "A"
+	}
+	saved.CreatedAt = time.Now().UTC()
+	saved.UpdatedAt = saved.CreatedAt
+	saved.Checksums = nil
+	saved.PremisEvents = nil
+	fake.files = append(fake.files, &saved)
+	for _, cs := range gf.Checksums {
+		checksum := *cs
+		checksum.GenericFileId = saved.Id
+		fake.createChecksum(&checksum)
+	}
+	for _, event := range gf.PremisEvents {
+		fileEvent := *event
+		fileEvent.GenericFileId = saved.Id
+		fileEvent.GenericFileIdentifier = saved.Identifier
+		fileEvent.IntellectualObjectId = obj.Id
+		fileEvent.IntellectualObjectIdentifier = obj.Identifier
+		if _, err := fake.createEvent(&fileEvent); err != nil {
+			return nil, err
+		}
+	}
+	return &saved, nil
+}
+
+func (fake *FakePharos) putFile(r *http.Request, identifier string) (interface{}, *fakePharosError) {
+	gf := fake.findFile(identifier)
+	if gf == nil {
+		return nil, notFound("GenericFile %s not found", identifier)
+	}
+	pharosFile := &models.GenericFileForPharos{}
+	if err := decodeBody(r, "generic_file", pharosFile); err != nil {
+		return nil, err
+	}
+	gf.FileFormat = pharosFile.FileFormat
+	gf.URI = pharosFile.URI
+	gf.Size = pharosFile.Size
+	if pharosFile.StorageOption != "" {
+		gf.StorageOption = pharosFile.StorageOption
+	}
+	gf.UpdatedAt = time.Now().UTC()
+	// Like Rails nested attributes, records that already
+	// have an id are not created again.
+	for _, cs := range pharosFile.Checksums {
+		if cs.Id == 0 {
+			fake.createChecksum(checksumFromPharos(cs, gf.Id))
+		}
+	}
+	for _, pharosEvent := range pharosFile.PremisEvents {
+		if pharosEvent.Id != 0 {
+			continue
+		}
+		event := premisEventFromPharos(pharosEvent)
+		event.GenericFileId = gf.Id
+		event.GenericFileIdentifier = gf.Identifier
+		event.IntellectualObjectId = gf.IntellectualObjectId
+		event.IntellectualObjectIdentifier = gf.IntellectualObjectIdentifier
+		if _, err := fake.createEvent(event); err != nil {
+			return nil, err
+		}
+	}
+	return gf, nil
+}
+
+func genericFileFromPharos(pharosFile *models.GenericFileForPharos) *models.GenericFile {
+	gf := &models.GenericFile{
+		Identifier:           pharosFile.Identifier,
+		IntellectualObjectId: pharosFile.IntellectualObjectId,
+		FileFormat:           pharosFile.FileFormat,
+		URI:                  pharosFile.URI,
+		Size:                 pharosFile.Size,
+		StorageOption:        pharosFile.StorageOption,
+		Checksums:            make([]*models.Checksum, 0),
+		PremisEvents:         make([]*models.PremisEvent, 0),
+	}
+	for _, cs := range pharosFile.Checksums {
+		gf.Checksums = append(gf.Checksums, checksumFromPharos(cs, 0))
+	}
+	for _, event := range pharosFile.PremisEvents {
+		gf.PremisEvents = append(gf.PremisEvents, premisEventFromPharos(event))
+	}
+	return gf
+}
+
+func (fake *FakePharos) requestFileRestore(identifier string) (interface{}, *fakePharosError) {
+	gf := fake.findFile(identifier)
+	if gf == nil {
+		return nil, notFound("GenericFile %s not found", identifier)
+	}
+	obj := fake.findObjectById(gf.IntellectualObjectId)
+	return fake.createWorkItem(&models.WorkItem{
+		ObjectIdentifier:      gf.IntellectualObjectIdentifier,
+		GenericFileIdentifier: gf.Identifier,
+		Name:                  obj.BagName + ".tar",
+		InstitutionId:         obj.InstitutionId,
+		Action:                constants.ActionRestore,
+		Stage:                 constants.StageRequested,
+		Status:                constants.StatusPending,
+		Note:                  "Restore requested",
+		Retry:                 true,
+	}), nil
+}
+
+func (fake *FakePharos) finishFileDelete(identifier string) (interface{}, *fakePharosError) {
+	gf := fake.findFile(identifier)
+	if gf == nil {
+		return nil, notFound("GenericFile %s not found", identifier)
+	}
+	gf.State = "D"
+	gf.UpdatedAt = time.Now().UTC()
+	return nil, nil
+}
+
+// -------------------------------------------------------------------------
+// Checksums
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) routeChecksums(r *http.Request, segments []string) (interface{}, *fakePharosError) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		return fake.listChecksums(r)
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		id, _ := strconv.Atoi(segments[0])
+		for _, cs := range fake.checksums {
+			if cs.Id == id {
+				return cs, nil
+			}
+		}
+		return nil, notFound("Checksum %s not found", segments[0])
+	case len(segments) == 1 && segments[0] == "create_batch" && r.Method == http.MethodPost:
+		return fake.postChecksumBatch(r)
+	case len(segments) == 1 && r.Method == http.MethodPost:
+		gf := fake.findFile(segments[0])
+		if gf == nil {
+			return nil, notFound("GenericFile %s not found", segments[0])
+		}
+		pharosChecksum := &models.ChecksumForPharos{}
+		if err := decodeBody(r, "checksum", pharosChecksum); err != nil {
+			return nil, err
+		}
+		return fake.createChecksum(checksumFromPharos(pharosChecksum, gf.Id)), nil
+	}
+	return nil, methodNotAllowed(r)
+}
+
+func (fake *FakePharos) listChecksums(r *http.Request) (interface{}, *fakePharosError) {
+	params := r.URL.Query()
+	gfId := 0
+	if identifier := params.Get("generic_file_identifier"); identifier != "" {
+		gf := fake.findFile(identifier)
+		if gf == nil {
+			return fake.paginate(r, make([]interface{}, 0)), nil
+		}
+		gfId = gf.Id
+	}
+	results := make([]interface{}, 0)
+	for _, cs := range fake.checksums {
+		if (gfId != 0 && cs.GenericFileId != gfId) ||
+			!matches(params, "algorithm", cs.Algorithm) {
+			continue
+		}
+		results = append(results, cs)
+	}
+	if strings.HasPrefix(params.Get("sort"), "datetime") {
+		descending := strings.HasSuffix(strings.ToUpper(params.Get("sort")), " DESC")
+		sort.SliceStable(results, func(i, j int) bool {
+			a, b := results[i].(*models.Checksum).DateTime, results[j].(*models.Checksum).DateTime
+			if descending {
+				return a.After(b)
+			}
+			return a.Before(b)
+		})
+	}
+	return fake.paginate(r, results), nil
+}
+
+// postChecksumBatch creates all of the checksums in the batch,
+// or none of them.
+func (fake *FakePharos) postChecksumBatch(r *http.Request) (interface{}, *fakePharosError) {
+	batch := make([]*models.ChecksumForPharos, 0)
+	if err := decodeBody(r, "", &batch); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, 0)
+	err := fake.transaction(func() *fakePharosError {
+		for _, pharosChecksum := range batch {
+			if pharosChecksum.Algorithm == "" || pharosChecksum.Digest == "" {
+				return unprocessable("Checksum algorithm and digest are required")
+			}
+			found := false
+			for _, gf := range fake.files {
+				found = found || gf.Id == pharosChecksum.GenericFileId
+			}
+			if !found {
+				return unprocessable("GenericFile %d does not exist", pharosChecksum.GenericFileId)
+			}
+			results = append(results, fake.createChecksum(
+				checksumFromPharos(pharosChecksum, pharosChecksum.GenericFileId)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fakePharosList{Count: len(results), Results: results}, nil
+}
+
+func (fake *FakePharos) createChecksum(cs *models.Checksum) *models.Checksum {
+	saved := *cs
+	saved.Id = fake.newId("checksum")
+	saved.CreatedAt = time.Now().UTC()
+	saved.UpdatedAt = saved.CreatedAt
+	fake.checksums = append(fake.checksums, &saved)
+	return &saved
+}
+
+func checksumFromPharos(pharosChecksum *models.ChecksumForPharos, gfId int) *models.Checksum {
+	return &models.Checksum{
+		GenericFileId: gfId,
+		Algorithm:     pharosChecksum.Algorithm,
+		DateTime:      pharosChecksum.DateTime,
+		Digest:        pharosChecksum.Digest,
+	}
+}
+
+// -------------------------------------------------------------------------
+// PremisEvents
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) routeEvents(r *http.Request, segments []string) (interface{}, *fakePharosError) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		return fake.listEvents(r)
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		pharosEvent := &models.PremisEventForPharos{}
+		if err := decodeBody(r, "", pharosEvent); err != nil {
+			return nil, err
+		}
+		return fake.createEvent(premisEventFromPharos(pharosEvent))
+	case len(segments) == 1 && segments[0] == "create_batch" && r.Method == http.MethodPost:
+		return fake.postEventBatch(r)
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		for _, event := range fake.events {
+			if event.Identifier == segments[0] {
+				return event, nil
+			}
+		}
+		return nil, notFound("PremisEvent %s not found", segments[0])
+	}
+	// Pharos does not support updating events.
+	return nil, methodNotAllowed(r)
+}
+
+// postEventBatch creates all of the events in the batch, or none of them.
+func (fake *FakePharos) postEventBatch(r *http.Request) (interface{}, *fakePharosError) {
+	batch := make([]*models.PremisEventForPharos, 0)
+	if err := decodeBody(r, "", &batch); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, 0)
+	err := fake.transaction(func() *fakePharosError {
+		for _, pharosEvent := range batch {
+			event, err := fake.createEvent(premisEventFromPharos(pharosEvent))
+			if err != nil {
+				return err
+			}
+			results = append(results, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fakePharosList{Count: len(results), Results: results}, nil
+}
+
+// listEvents returns events matching the params. The object_identifier
+// filter matches events for the object and for its files.
+func (fake *FakePharos) listEvents(r *http.Request) (interface{}, *fakePharosError) {
+	params := r.URL.Query()
+	createdSince, filterCreated := timeParam(params, "created_since")
+	results := make([]interface{}, 0)
+	for _, event := range fake.events {
+		if !matches(params, "object_identifier", event.IntellectualObjectIdentifier) ||
+			!matches(params, "file_identifier", event.GenericFileIdentifier) ||
+			!matches(params, "event_type", event.EventType) ||
+			(filterCreated && event.DateTime.Before(createdSince)) {
+			continue
+		}
+		results = append(results, event)
+	}
+	return fake.paginate(r, results), nil
+}
+
+func (fake *FakePharos) createEvent(event *models.PremisEvent) (*models.PremisEvent, *fakePharosError) {
+	if event.Identifier == "" {
+		return nil, unprocessable("PremisEvent identifier is required")
+	}
+	for _, existing := range fake.events {
+		if existing.Identifier == event.Identifier {
+			return nil, unprocessable("PremisEvent %s already exists", event.Identifier)
+		}
+	}
+	saved := *event
+	if saved.IntellectualObjectId == 0 && saved.IntellectualObjectIdentifier != "" {
+		if obj := fake.findObject(saved.IntellectualObjectIdentifier); obj != nil {
+			saved.IntellectualObjectId = obj.Id
+		}
+	}
+	if saved.GenericFileId == 0 && saved.GenericFileIdentifier != "" {
+		if gf := fake.findFile(saved.GenericFileIdentifier); gf != nil {
+			saved.GenericFileId = gf.Id
+		}
+	}
+	saved.Id = fake.newId("event")
+	saved.CreatedAt = time.Now().UTC()
+	saved.UpdatedAt = saved.CreatedAt
+	fake.events = append(fake.events, &saved)
+	return &saved, nil
+}
+
+func premisEventFromPharos(pharosEvent *models.PremisEventForPharos) *models.PremisEvent {
+	return &models.PremisEvent{
+		Identifier:                   pharosEvent.Identifier,
+		EventType:                    pharosEvent.EventType,
+		DateTime:                     pharosEvent.DateTime,
+		Detail:                       pharosEvent.Detail,
+		Outcome:                      pharosEvent.Outcome,
+		OutcomeDetail:                pharosEvent.OutcomeDetail,
+		Object:                       pharosEvent.Object,
+		Agent:                        pharosEvent.Agent,
+		OutcomeInformation:           pharosEvent.OutcomeInformation,
+		IntellectualObjectId:         pharosEvent.IntellectualObjectId,
+		IntellectualObjectIdentifier: pharosEvent.IntellectualObjectIdentifier,
+		GenericFileId:                pharosEvent.GenericFileId,
+		GenericFileIdentifier:        pharosEvent.GenericFileIdentifier,
+	}
+}
+
+// -------------------------------------------------------------------------
+// WorkItems
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) routeWorkItems(r *http.Request, segments []string) (interface{}, *fakePharosError) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		return fake.listWorkItems(r)
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		item := &models.WorkItem{}
+		if err := decodeBody(r, "", item); err != nil {
+			return nil, err
+		}
+		return fake.createWorkItem(item), nil
+	case len(segments) == 1 && (r.Method == http.MethodGet || r.Method == http.MethodPut):
+		id, _ := strconv.Atoi(segments[0])
+		item := fake.findWorkItem(id)
+		if item == nil {
+			return nil, notFound("WorkItem %s not found", segments[0])
+		}
+		if r.Method == http.MethodGet {
+			return item, nil
+		}
+		updated := &models.WorkItem{}
+		if err := decodeBody(r, "", updated); err != nil {
+			return nil, err
+		}
+		updated.Id = item.Id
+		updated.WorkItemStateId = item.WorkItemStateId
+		updated.CreatedAt = item.CreatedAt
+		updated.UpdatedAt = time.Now().UTC()
+		*item = *updated
+		return item, nil
+	}
+	return nil, methodNotAllowed(r)
+}
+
+func (fake *FakePharos) findWorkItem(id int) *models.WorkItem {
+	for _, item := range fake.workItems {
+		if item.Id == id {
+			return item
+		}
+	}
+	return nil
+}
+
+func (fake *FakePharos) listWorkItems(r *http.Request) (interface{}, *fakePharosError) {
+	params := r.URL.Query()
+	action := params.Get("item_action")
+	if action == "" {
+		action = params.Get("action")
+	}
+	createdAfter, filterCreated := timeParam(params, "created_after")
+	updatedAfter, filterUpdated := timeParam(params, "updated_after")
+	bagDate, filterBagDate := timeParam(params, "bag_date")
+	results := make([]interface{}, 0)
+	for _, item := range fake.workItems {
+		if (action != "" && item.Action != action) ||
+			!matches(params, "name", item.Name) ||
+			!matches(params, "etag", item.ETag) ||
+			!matches(params, "status", item.Status) ||
+			!matches(params, "stage", item.Stage) ||
+			!matches(params, "object_identifier", item.ObjectIdentifier) ||
+			!matches(params, "file_identifier", item.GenericFileIdentifier) ||
+			!matches(params, "generic_file_identifier", item.GenericFileIdentifier) ||
+			!matches(params, "institution_id", strconv.Itoa(item.InstitutionId)) ||
+			!matches(params, "retry", strconv.FormatBool(item.Retry)) ||
+			!matches(params, "queued", strconv.FormatBool(item.QueuedAt != nil)) ||
+			!matches(params, "node_empty", strconv.FormatBool(item.Node == "")) ||
+			!strings.Contains(item.Name, params.Get("name_contains")) ||
+			(filterBagDate && !item.BagDate.Equal(bagDate)) ||
+			(filterCreated && !item.CreatedAt.After(createdAfter)) ||
+			(filterUpdated && !item.UpdatedAt.After(updatedAfter)) {
+			continue
+		}
+		results = append(results, item)
+	}
+	if params.Get("sort") == "date" {
+		// Newest first, as in Pharos.
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].(*models.WorkItem).Date.After(results[j].(*models.WorkItem).Date)
+		})
+	}
+	return fake.paginate(r, results), nil
+}
+
+func (fake *FakePharos) createWorkItem(item *models.WorkItem) *models.WorkItem {
+	saved := *item
+	saved.Id = fake.newId("work_item")
+	saved.CreatedAt = time.Now().UTC()
+	saved.UpdatedAt = saved.CreatedAt
+	if saved.Date.IsZero() {
+		saved.Date = saved.CreatedAt
+	}
+	fake.workItems = append(fake.workItems, &saved)
+	return &saved
+}
+
+// -------------------------------------------------------------------------
+// WorkItemStates
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) routeWorkItemStates(r *http.Request, segments []string) (interface{}, *fakePharosError) {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		pharosState := &models.WorkItemStateForPharos{}
+		if err := decodeBody(r, "", pharosState); err != nil {
+			return nil, err
+		}
+		item := fake.findWorkItem(pharosState.WorkItemId)
+		if item == nil {
+			return nil, unprocessable("WorkItem %d does not exist", pharosState.WorkItemId)
+		}
+		state := &models.WorkItemState{
+			Id:         fake.newId("work_item_state"),
+			WorkItemId: pharosState.WorkItemId,
+			Action:     pharosState.Action,
+			State:      pharosState.State,
+			CreatedAt:  time.Now().UTC(),
+		}
+		state.UpdatedAt = state.CreatedAt
+		fake.workItemStates = append(fake.workItemStates, state)
+		stateId := state.Id
+		item.WorkItemStateId = &stateId
+		return state, nil
+	case len(segments) == 1 && (r.Method == http.MethodGet || r.Method == http.MethodPut):
+		id, _ := strconv.Atoi(segments[0])
+		for _, state := range fake.workItemStates {
+			if state.Id != id {
+				continue
+			}
+			if r.Method == http.MethodPut {
+				pharosState := &models.WorkItemStateForPharos{}
+				if err := decodeBody(r, "", pharosState); err != nil {
+					return nil, err
+				}
+				state.Action = pharosState.Action
+				state.State = pharosState.State
+				state.UpdatedAt = time.Now().UTC()
+			}
+			return state, nil
+		}
+		return nil, notFound("WorkItemState %s not found", segments[0])
+	}
+	return nil, methodNotAllowed(r)
+}
+
+// -------------------------------------------------------------------------
+// Notifications
+// -------------------------------------------------------------------------
+
+func (fake *FakePharos) routeNotifications(r *http.Request, segments []string) (interface{}, *fakePharosError) {
+	if len(segments) == 2 && segments[0] == "spot_test_restoration" && r.Method == http.MethodGet {
+		id, _ := strconv.Atoi(segments[1])
+		item := fake.findWorkItem(id)
+		if item == nil {
+			return nil, notFound("WorkItem %s not found", segments[1])
+		}
+		return item, nil
+	}
+	return nil, methodNotAllowed(r)
+}
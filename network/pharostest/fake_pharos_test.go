@@ -0,0 +1,317 @@
+package pharostest_test
+
+import (
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/network/pharostest"
+	"github.com/APTrust/exchange/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/url"
+	"testing"
+)
+
+// fakePharosWithObject returns a FakePharos containing an institution
+// and one object, and a client that talks to it.
+func fakePharosWithObject(t *testing.T) (*pharostest.FakePharos, *network.PharosClient, *models.IntellectualObject) {
+	fake := pharostest.NewFakePharos()
+	client, err := network.NewPharosClient(fake.URL, "v2", "user", "key")
+	require.Nil(t, err)
+	fake.AddInstitution(&models.Institution{Name: "Test University", Identifier: "test.edu"})
+	obj, err := fake.AddIntellectualObject(&models.IntellectualObject{
+		Identifier: "test.edu/bag1",
+		BagName:    "bag1",
+		Access:     "institution",
+	})
+	require.Nil(t, err)
+	return fake, client, obj
+}
+
+func TestFakePharos_IntellectualObjects(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+
+	resp := client.InstitutionGet("test.edu")
+	require.Nil(t, resp.Error)
+	assert.Equal(t, obj.InstitutionId, resp.Institution().Id)
+
+	newObj := testutil.MakeIntellectualObject(0, 0, 0, 0)
+	newObj.Id = 0
+	newObj.Identifier = "test.edu/bag2"
+	newObj.Institution = "test.edu"
+	resp = client.IntellectualObjectSave(newObj)
+	require.Nil(t, resp.Error)
+	saved := resp.IntellectualObject()
+	assert.NotEqual(t, 0, saved.Id)
+	assert.Equal(t, obj.InstitutionId, saved.InstitutionId)
+	assert.Equal(t, newObj.Title, saved.Title)
+	assert.False(t, saved.CreatedAt.IsZero())
+
+	saved.Title = "New Title"
+	resp = client.IntellectualObjectSave(saved)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "New Title", resp.IntellectualObject().Title)
+
+	resp = client.IntellectualObjectGet("test.edu/bag2", false, false)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, saved.Id, resp.IntellectualObject().Id)
+
+	resp = client.IntellectualObjectGet("test.edu/no-such-bag", false, false)
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, 404, resp.Response.StatusCode)
+
+	resp = client.IntellectualObjectSave(newObj)
+	require.NotNil(t, resp.Error)
+	assert.Equal(t, 422, resp.Response.StatusCode)
+
+	params := url.Values{}
+	params.Set("institution", "test.edu")
+	resp = client.IntellectualObjectList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 2, resp.Count)
+}
+
+func TestFakePharos_GenericFiles(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+
+	gf := testutil.MakeGenericFile(2, 2, obj.Identifier)
+	gf.Id = 0
+	gf.IntellectualObjectId = obj.Id
+	resp := client.GenericFileSave(gf)
+	require.Nil(t, resp.Error)
+	saved := resp.GenericFile()
+	assert.NotEqual(t, 0, saved.Id)
+	assert.Equal(t, obj.Identifier, saved.IntellectualObjectIdentifier)
+
+	resp = client.GenericFileGet(gf.Identifier, true)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 2, len(resp.GenericFile().Checksums))
+	assert.Equal(t, 2, len(resp.GenericFile().PremisEvents))
+
+	// Updating a file with its existing checksums and
+	// events should not duplicate them.
+	withRelations := resp.GenericFile()
+	withRelations.Size = 99
+	resp = client.GenericFileSave(withRelations)
+	require.Nil(t, resp.Error)
+	resp = client.GenericFileGet(gf.Identifier, true)
+	require.Nil(t, resp.Error)
+	assert.EqualValues(t, 99, resp.GenericFile().Size)
+	assert.Equal(t, 2, len(resp.GenericFile().Checksums))
+	assert.Equal(t, 2, len(resp.GenericFile().PremisEvents))
+
+	batch := make([]*models.GenericFile, 3)
+	for i := range batch {
+		batch[i] = testutil.MakeGenericFile(1, 1, obj.Identifier)
+		batch[i].Id = 0
+		batch[i].IntellectualObjectId = obj.Id
+	}
+	resp = client.GenericFileSaveBatch(batch)
+	require.Nil(t, resp.Error)
+	require.Equal(t, 3, len(resp.GenericFiles()))
+	for _, savedFile := range resp.GenericFiles() {
+		assert.NotEqual(t, 0, savedFile.Id)
+		assert.Equal(t, 1, len(savedFile.Checksums))
+	}
+
+	// Batches are all or nothing.
+	batch = append(batch, testutil.MakeGenericFile(0, 0, obj.Identifier))
+	batch[3].Id = 0
+	batch[3].IntellectualObjectId = obj.Id
+	resp = client.GenericFileSaveBatch(batch[2:])
+	require.NotNil(t, resp.Error)
+	resp = client.GenericFileGet(batch[3].Identifier, false)
+	assert.NotNil(t, resp.Error)
+
+	resp = client.IntellectualObjectGet(obj.Identifier, true, true)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 4, len(resp.IntellectualObject().GenericFiles))
+	assert.Equal(t, 0, len(resp.IntellectualObject().PremisEvents))
+}
+
+func TestFakePharos_ChecksumsAndEvents(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	gf := testutil.MakeGenericFile(0, 0, obj.Identifier)
+	gf.IntellectualObjectId = obj.Id
+	gf, err := fake.AddGenericFile(gf)
+	require.Nil(t, err)
+
+	cs := testutil.MakeChecksum()
+	cs.Algorithm = constants.AlgSha256
+	resp := client.ChecksumSave(cs, gf.Identifier)
+	require.Nil(t, resp.Error)
+	savedChecksum := resp.Checksum()
+	assert.Equal(t, gf.Id, savedChecksum.GenericFileId)
+	assert.Equal(t, cs.Digest, savedChecksum.Digest)
+
+	resp = client.ChecksumGet(savedChecksum.Id)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, cs.Digest, resp.Checksum().Digest)
+
+	params := url.Values{}
+	params.Set("generic_file_identifier", gf.Identifier)
+	params.Set("algorithm", constants.AlgSha256)
+	resp = client.ChecksumList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 1, resp.Count)
+
+	event := testutil.MakePremisEvent()
+	event.Id = 0
+	event.IntellectualObjectIdentifier = obj.Identifier
+	event.GenericFileIdentifier = gf.Identifier
+	resp = client.PremisEventSave(event)
+	require.Nil(t, resp.Error)
+	savedEvent := resp.PremisEvent()
+	assert.Equal(t, gf.Id, savedEvent.GenericFileId)
+	assert.Equal(t, obj.Id, savedEvent.IntellectualObjectId)
+
+	resp = client.PremisEventGet(event.Identifier)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, savedEvent.Id, resp.PremisEvent().Id)
+
+	params = url.Values{}
+	params.Set("object_identifier", obj.Identifier)
+	resp = client.PremisEventList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 1, resp.Count)
+}
+
+func TestFakePharos_WorkItems(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+
+	item := testutil.MakeWorkItem()
+	item.Id = 0
+	item.ObjectIdentifier = obj.Identifier
+	item.Action = constants.ActionIngest
+	resp := client.WorkItemSave(item)
+	require.Nil(t, resp.Error)
+	saved := resp.WorkItem()
+	assert.NotEqual(t, 0, saved.Id)
+
+	saved.Stage = constants.StageRecord
+	resp = client.WorkItemSave(saved)
+	require.Nil(t, resp.Error)
+	resp = client.WorkItemGet(saved.Id)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, constants.StageRecord, resp.WorkItem().Stage)
+
+	state := &models.WorkItemState{
+		WorkItemId: saved.Id,
+		Action:     constants.ActionIngest,
+		State:      `{"key":"value"}`,
+	}
+	resp = client.WorkItemStateSave(state)
+	require.Nil(t, resp.Error)
+	savedState := resp.WorkItemState()
+	assert.NotEqual(t, 0, savedState.Id)
+	resp = client.WorkItemGet(saved.Id)
+	require.Nil(t, resp.Error)
+	require.NotNil(t, resp.WorkItem().WorkItemStateId)
+	assert.Equal(t, savedState.Id, *resp.WorkItem().WorkItemStateId)
+
+	savedState.State = `{"key":"new value"}`
+	resp = client.WorkItemStateSave(savedState)
+	require.Nil(t, resp.Error)
+	resp = client.WorkItemStateGet(savedState.Id)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, `{"key":"new value"}`, resp.WorkItemState().State)
+
+	params := url.Values{}
+	params.Set("item_action", constants.ActionIngest)
+	params.Set("object_identifier", obj.Identifier)
+	resp = client.WorkItemList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 1, resp.Count)
+	params.Set("item_action", constants.ActionRestore)
+	resp = client.WorkItemList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 0, resp.Count)
+
+	resp = client.FinishRestorationSpotTest(saved.Id)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, saved.Id, resp.WorkItem().Id)
+}
+
+func TestFakePharos_RestoreAndDelete(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	for i := 0; i < 2; i++ {
+		gf := testutil.MakeGenericFile(0, 0, obj.Identifier)
+		gf.IntellectualObjectId = obj.Id
+		_, err := fake.AddGenericFile(gf)
+		require.Nil(t, err)
+	}
+
+	resp := client.IntellectualObjectRequestRestore(obj.Identifier)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, constants.ActionRestore, resp.WorkItem().Action)
+	assert.Equal(t, obj.Identifier, resp.WorkItem().ObjectIdentifier)
+
+	resp = client.IntellectualObjectRequestDelete(obj.Identifier)
+	require.Nil(t, resp.Error)
+	params := url.Values{}
+	params.Set("item_action", constants.ActionDelete)
+	resp = client.WorkItemList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 2, resp.Count)
+
+	for _, item := range resp.WorkItems() {
+		fileResp := client.GenericFileFinishDelete(item.GenericFileIdentifier)
+		require.Nil(t, fileResp.Error)
+	}
+	resp = client.IntellectualObjectFinishDelete(obj.Identifier)
+	require.Nil(t, resp.Error)
+	resp = client.IntellectualObjectGet(obj.Identifier, true, false)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, "D", resp.IntellectualObject().State)
+	for _, gf := range resp.IntellectualObject().GenericFiles {
+		assert.Equal(t, "D", gf.State)
+	}
+}
+
+func TestFakePharos_Pagination(t *testing.T) {
+	fake, client, obj := fakePharosWithObject(t)
+	defer fake.Close()
+	for i := 0; i < 25; i++ {
+		gf := testutil.MakeGenericFile(0, 0, obj.Identifier)
+		gf.IntellectualObjectId = obj.Id
+		_, err := fake.AddGenericFile(gf)
+		require.Nil(t, err)
+	}
+
+	params := url.Values{}
+	params.Set("intellectual_object_identifier", obj.Identifier)
+	resp := client.GenericFileList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 25, resp.Count)
+	assert.Equal(t, pharostest.FakePharosPerPage, len(resp.GenericFiles()))
+	assert.Nil(t, resp.Previous)
+	require.NotNil(t, resp.Next)
+	assert.Equal(t, "2", resp.ParamsForNextPage().Get("page"))
+
+	params.Set("page", "3")
+	resp = client.GenericFileList(params)
+	require.Nil(t, resp.Error)
+	assert.Equal(t, 5, len(resp.GenericFiles()))
+	assert.Nil(t, resp.Next)
+	require.NotNil(t, resp.Previous)
+
+	params.Set("page", "1")
+	params.Set("per_page", "4")
+	iter := client.GenericFileIterator(params, network.PagingOptions{Prefetch: true})
+	ids := make(map[int]bool)
+	for {
+		gf, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		ids[gf.Id] = true
+	}
+	assert.Equal(t, 25, len(ids))
+}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -62,8 +63,15 @@ func (client *S3Copy) GetSession() *session.Session {
 	return client.session
 }
 
-// Fetch the file from S3.
+// Copy copies the source object to the destination, and waits
+// until the copy exists.
 func (client *S3Copy) Copy() {
+	client.CopyWithContext(context.Background())
+}
+
+// CopyWithContext is like Copy, but it gives up if ctx is cancelled
+// or its deadline passes before the copy completes.
+func (client *S3Copy) CopyWithContext(ctx context.Context) {
 	client.Response = nil
 	_session := client.GetSession()
 	if _session == nil {
@@ -79,7 +87,7 @@ func (client *S3Copy) Copy() {
 		Key:        aws.String(client.DestinationKey),
 	}
 	var err error
-	client.Response, err = service.CopyObject(copyObjectInput)
+	client.Response, err = service.CopyObjectWithContext(ctx, copyObjectInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 		return
@@ -88,7 +96,7 @@ func (client *S3Copy) Copy() {
 		Bucket: aws.String(client.DestinationBucket),
 		Key:    aws.String(client.DestinationKey),
 	}
-	err = service.WaitUntilObjectExists(headObjectInput)
+	err = service.WaitUntilObjectExistsWithContext(ctx, headObjectInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 	}
@@ -1,13 +1,10 @@
 package network
 
 import (
-	"crypto/md5"
-	"crypto/sha256"
-	"fmt"
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -26,6 +23,25 @@ type S3Download struct {
 	BytesCopied     int64
 	ErrorMessage    string
 
+	// Concurrency is the number of ranges of the file to fetch at
+	// once. If it's more than one, files larger than PartSize are
+	// fetched in ranges over several connections, which is much
+	// faster for very large files. The checksums are still
+	// calculated in the same pass. Zero or one means fetch the
+	// whole file in a single stream.
+	Concurrency int
+
+	// PartSize is the size of the ranges, when Concurrency is more
+	// than one. Zero means DefaultDownloadPartSize. A download needs
+	// up to 2 x Concurrency x PartSize bytes of memory.
+	PartSize int64
+
+	// MaxBytes, if more than zero, is the most we'll read from S3.
+	// Anything after that is left unread, and BytesCopied tells the
+	// caller whether the file was cut short. Downloads with MaxBytes
+	// use a single stream, regardless of Concurrency.
+	MaxBytes int64
+
 	// The response from S3 for the attempted download.
 	// Don't try to read Response.Body, because if this
 	// object is non-nil, the response will already have
@@ -81,6 +97,12 @@ func (client *S3Download) GetSession() *session.Session {
 
 // Fetch the file from S3.
 func (client *S3Download) Fetch() {
+	client.FetchWithContext(context.Background())
+}
+
+// FetchWithContext fetches the file from S3, giving up if ctx is
+// cancelled or its deadline passes before the download completes.
+func (client *S3Download) FetchWithContext(ctx context.Context) {
 	_session := client.GetSession()
 	if _session == nil {
 		return
@@ -100,8 +122,12 @@ func (client *S3Download) Fetch() {
 	// requeue the whole job.
 	var err error = nil
 	for i := 0; i < 5; i++ {
-		err = client.tryDownload(service, params)
-		if err == nil {
+		if client.Concurrency > 1 && client.MaxBytes <= 0 {
+			err = client.tryRangedDownload(ctx, service, params)
+		} else {
+			err = client.tryDownload(ctx, service, params)
+		}
+		if err == nil || ctx.Err() != nil {
 			break
 		}
 	}
@@ -119,9 +145,10 @@ func (client *S3Download) Fetch() {
 // faster downloads, but requires a WrterAt interface, which the
 // hashing algorithms don't provide. When we're working with
 // multi-gigabyte files, we really don't want to have to read them
-// again to produce the checksums.
-func (client *S3Download) tryDownload(service *s3.S3, params *s3.GetObjectInput) error {
-	resp, err := service.GetObject(params)
+// again to produce the checksums. See tryRangedDownload for how
+// we get multiple streams and one-pass checksums.
+func (client *S3Download) tryDownload(ctx context.Context, service *s3.S3, params *s3.GetObjectInput) error {
+	resp, err := service.GetObjectWithContext(ctx, params)
 	if err != nil {
 		return err
 	}
@@ -148,26 +175,21 @@ func (client *S3Download) tryDownload(service *s3.S3, params *s3.GetObjectInput)
 	// Create a writer to write the contents to the file,
 	// and optionally to pass the bitstream through the
 	// md5 and sha256 algorithms while we're at it.
-	var multiWriter io.Writer
-	var md5Hash hash.Hash
-	var sha256Hash hash.Hash
-	if client.CalculateMd5 {
-		md5Hash = md5.New()
-		writers = append(writers, md5Hash)
-	}
-	if client.CalculateSha256 {
-		sha256Hash = sha256.New()
-		writers = append(writers, sha256Hash)
+	md5Hash, sha256Hash, hashWriter := client.newHashes()
+	writers = append(writers, hashWriter)
+	multiWriter := io.MultiWriter(writers...)
+	var body io.Reader = resp.Body
+	if client.MaxBytes > 0 {
+		body = io.LimitReader(resp.Body, client.MaxBytes)
 	}
-	multiWriter = io.MultiWriter(writers...)
 
 	// Copy the file, with several tries. On larger files,
 	// we often get a "connection reset by peer" error.
 	// Better to retry a few times now than throw this
 	// back into the work queue.
 	for attemptNumber := 0; attemptNumber < 5; attemptNumber++ {
-		client.BytesCopied, err = io.Copy(multiWriter, resp.Body)
-		if err == nil {
+		client.BytesCopied, err = io.Copy(multiWriter, body)
+		if err == nil || ctx.Err() != nil {
 			break
 		}
 	}
@@ -176,12 +198,7 @@ func (client *S3Download) tryDownload(service *s3.S3, params *s3.GetObjectInput)
 	}
 
 	// Set the checksums, if needed...
-	if client.CalculateMd5 {
-		client.Md5Digest = fmt.Sprintf("%x", md5Hash.Sum(nil))
-	}
-	if client.CalculateSha256 {
-		client.Sha256Digest = fmt.Sprintf("%x", sha256Hash.Sum(nil))
-	}
+	client.setDigests(md5Hash, sha256Hash)
 
 	// No errors.
 	return nil
@@ -0,0 +1,275 @@
+package network
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultDownloadPartSize is the size of the ranges a concurrent
+// S3Download fetches when its PartSize is not set.
+const DefaultDownloadPartSize = int64(16 * 1024 * 1024)
+
+// downloadedPart is one range of a ranged download.
+type downloadedPart struct {
+	index int64
+	data  []byte
+}
+
+// tryRangedDownload fetches the file in ranges of PartSize bytes,
+// Concurrency ranges at a time. Each range is written to its place
+// in the file as soon as it arrives, but the checksums need the
+// bytes in order, so this goroutine hashes the ranges in order as
+// they become available. To limit memory use, we fetch at most
+// 2 x Concurrency ranges ahead of the hashing.
+//
+// Files no larger than one range are fetched with tryDownload.
+func (client *S3Download) tryRangedDownload(ctx context.Context, service *s3.S3, params *s3.GetObjectInput) error {
+	partSize := client.PartSize
+	if partSize <= 0 {
+		partSize = DefaultDownloadPartSize
+	}
+	head, err := service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: params.Bucket,
+		Key:    params.Key,
+	})
+	if err != nil {
+		return err
+	}
+	size := aws.Int64Value(head.ContentLength)
+	if size <= partSize {
+		return client.tryDownload(ctx, service, params)
+	}
+	client.Response = getObjectOutputFromHead(head)
+
+	output, err := client.openOutput()
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	md5Hash, sha256Hash, hashWriter := client.newHashes()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	window := 2 * client.Concurrency
+	numParts := (size + partSize - 1) / partSize
+	tokens := make(chan struct{}, window)
+	buffers := make(chan []byte, window)
+	indexes := make(chan int64)
+	parts := make(chan downloadedPart, window)
+
+	// Hand out the ranges in order, no more than
+	// window ranges ahead of the hashing.
+	go func() {
+		defer close(indexes)
+		for i := int64(0); i < numParts; i++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < client.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				var buf []byte
+				select {
+				case buf = <-buffers:
+				default:
+					buf = make([]byte, partSize)
+				}
+				start := i * partSize
+				end := start + partSize
+				if end > size {
+					end = size
+				}
+				data, err := client.fetchRange(ctx, service, params, head.ETag, start, end, buf)
+				if err == nil {
+					_, err = output.WriteAt(data, start)
+				}
+				if err != nil {
+					fail(err)
+					return
+				}
+				parts <- downloadedPart{index: i, data: data}
+			}
+		}()
+	}
+
+	// Hash the ranges in order.
+	pending := make(map[int64][]byte)
+	client.BytesCopied = 0
+	for next := int64(0); next < numParts; {
+		select {
+		case part := <-parts:
+			pending[part.index] = part.data
+		case <-ctx.Done():
+			wg.Wait()
+			if firstErr != nil {
+				return firstErr
+			}
+			return ctx.Err()
+		}
+		for data, ok := pending[next]; ok; data, ok = pending[next] {
+			hashWriter.Write(data)
+			client.BytesCopied += int64(len(data))
+			delete(pending, next)
+			buffers <- data[:cap(data)]
+			<-tokens
+			next++
+		}
+	}
+	wg.Wait()
+	if err := output.Close(); err != nil {
+		return err
+	}
+	client.setDigests(md5Hash, sha256Hash)
+	return nil
+}
+
+// fetchRange returns bytes start through end-1 of the file, read
+// into buf. If the file's ETag no longer matches etag, the file
+// changed since we started, and there's no point in retrying.
+func (client *S3Download) fetchRange(ctx context.Context, service *s3.S3, params *s3.GetObjectInput, etag *string, start, end int64, buf []byte) ([]byte, error) {
+	input := *params
+	input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1))
+	input.IfMatch = etag
+	data := buf[:end-start]
+	var err error
+	for attemptNumber := 0; attemptNumber < 5; attemptNumber++ {
+		var resp *s3.GetObjectOutput
+		resp, err = service.GetObjectWithContext(ctx, &input)
+		if err == nil {
+			_, err = io.ReadFull(resp.Body, data)
+			resp.Body.Close()
+			if err == nil {
+				return data, nil
+			}
+		}
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "PreconditionFailed" {
+			return nil, fmt.Errorf("%s changed while we were downloading it", aws.StringValue(params.Key))
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// downloadOutput is where a ranged download writes its ranges.
+type downloadOutput interface {
+	io.WriterAt
+	io.Closer
+}
+
+// discardOutput is a downloadOutput that throws the data away,
+// for fixity checks that download to /dev/null.
+type discardOutput struct{}
+
+func (discardOutput) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+func (discardOutput) Close() error                             { return nil }
+
+// fileOutput is a downloadOutput that may be closed more than once.
+type fileOutput struct {
+	*os.File
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (output *fileOutput) Close() error {
+	output.closeOnce.Do(func() {
+		output.closeErr = output.File.Close()
+	})
+	return output.closeErr
+}
+
+// openOutput creates the download directory and the file at LocalPath.
+func (client *S3Download) openOutput() (downloadOutput, error) {
+	if client.LocalPath == os.DevNull {
+		return discardOutput{}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(client.LocalPath), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(client.LocalPath)
+	if err != nil {
+		return nil, err
+	}
+	return &fileOutput{File: file}, nil
+}
+
+// newHashes returns the hashes the client should calculate, and
+// a writer that writes to all of them.
+func (client *S3Download) newHashes() (md5Hash, sha256Hash hash.Hash, writer io.Writer) {
+	writers := make([]io.Writer, 0)
+	if client.CalculateMd5 {
+		md5Hash = md5.New()
+		writers = append(writers, md5Hash)
+	}
+	if client.CalculateSha256 {
+		sha256Hash = sha256.New()
+		writers = append(writers, sha256Hash)
+	}
+	if len(writers) == 0 {
+		return nil, nil, ioutil.Discard
+	}
+	return md5Hash, sha256Hash, io.MultiWriter(writers...)
+}
+
+// setDigests sets Md5Digest and Sha256Digest from the hashes.
+func (client *S3Download) setDigests(md5Hash, sha256Hash hash.Hash) {
+	if md5Hash != nil {
+		client.Md5Digest = fmt.Sprintf("%x", md5Hash.Sum(nil))
+	}
+	if sha256Hash != nil {
+		client.Sha256Digest = fmt.Sprintf("%x", sha256Hash.Sum(nil))
+	}
+}
+
+// getObjectOutputFromHead describes the whole file in the form of a
+// GetObject response, so S3Download.Response means the same thing
+// whether or not the file was downloaded in ranges.
+func getObjectOutputFromHead(head *s3.HeadObjectOutput) *s3.GetObjectOutput {
+	return &s3.GetObjectOutput{
+		AcceptRanges:         head.AcceptRanges,
+		ContentLength:        head.ContentLength,
+		ContentType:          head.ContentType,
+		ETag:                 head.ETag,
+		LastModified:         head.LastModified,
+		Metadata:             head.Metadata,
+		PartsCount:           head.PartsCount,
+		Restore:              head.Restore,
+		ServerSideEncryption: head.ServerSideEncryption,
+		StorageClass:         head.StorageClass,
+		VersionId:            head.VersionId,
+	}
+}
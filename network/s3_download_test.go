@@ -1,13 +1,23 @@
 package network_test
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -119,3 +129,109 @@ func TestFetchWithChecksums(t *testing.T) {
 	assert.Equal(t, testFileMd5, download.Md5Digest)
 	assert.Equal(t, testFileSha256, download.Sha256Digest)
 }
+
+func TestFetchInRanges(t *testing.T) {
+	fake, provider := fakeS3Storage(t)
+	defer fake.Close()
+	data := make([]byte, 1000*1000+17)
+	rand.New(rand.NewSource(23)).Read(data)
+	fake.PutObject("preservation", "big", data)
+	fake.PutObject("preservation", "small", data[:100])
+
+	tmpDir, err := ioutil.TempDir("", "s3_download_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	localPath := filepath.Join(tmpDir, "dir", "big")
+	download := provider.Get("preservation", "big", localPath, true, true)
+	download.Concurrency = 4
+	download.PartSize = 64 * 1024
+	download.Fetch()
+	require.Empty(t, download.ErrorMessage)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum(data)), download.Md5Digest)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(data)), download.Sha256Digest)
+	assert.Equal(t, int64(len(data)), download.BytesCopied)
+	require.NotNil(t, download.Response)
+	assert.Equal(t, int64(len(data)), *download.Response.ContentLength)
+	assert.Equal(t, fake.Object("preservation", "big").ETag, *download.Response.ETag)
+	fileData, err := ioutil.ReadFile(localPath)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(data, fileData))
+
+	// Fixity checks download to /dev/null.
+	download = provider.Get("preservation", "big", os.DevNull, false, true)
+	download.Concurrency = 3
+	download.PartSize = 100 * 1000
+	download.Fetch()
+	require.Empty(t, download.ErrorMessage)
+	assert.Empty(t, download.Md5Digest)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(data)), download.Sha256Digest)
+
+	// Files that fit in one range come in one stream.
+	download = provider.Get("preservation", "small", os.DevNull, true, false)
+	download.Concurrency = 4
+	download.Fetch()
+	require.Empty(t, download.ErrorMessage)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum(data[:100])), download.Md5Digest)
+	assert.Equal(t, int64(100), download.BytesCopied)
+}
+
+func TestFetchMaxBytes(t *testing.T) {
+	fake, provider := fakeS3Storage(t)
+	defer fake.Close()
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(5)).Read(data)
+	fake.PutObject("preservation", "file", data)
+
+	tmpDir, err := ioutil.TempDir("", "s3_download_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	localPath := filepath.Join(tmpDir, "file")
+
+	// We stop reading at MaxBytes, even if we asked for ranges.
+	download := provider.Get("preservation", "file", localPath, false, false)
+	download.MaxBytes = 101
+	download.Concurrency = 4
+	download.PartSize = 100
+	download.Fetch()
+	require.Empty(t, download.ErrorMessage)
+	assert.Equal(t, int64(101), download.BytesCopied)
+	fileData, err := ioutil.ReadFile(localPath)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(data[:101], fileData))
+
+	download = provider.Get("preservation", "file", localPath, false, false)
+	download.MaxBytes = 1001
+	download.Fetch()
+	require.Empty(t, download.ErrorMessage)
+	assert.Equal(t, int64(1000), download.BytesCopied)
+}
+
+func TestFetchInRanges_FileChanged(t *testing.T) {
+	fake := network.NewFakeS3()
+	defer fake.Close()
+	data := make([]byte, 500*1000)
+	fake.PutObject("preservation", "big", data)
+	var versions int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Replace the file whenever someone asks for its second range.
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=100000-") {
+			version := atomic.AddInt32(&versions, 1)
+			fake.PutObject("preservation", "big", append(data, byte(version)))
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	provider, err := network.NewS3CompatibleStorage("minio", "key", "secret",
+		"us-east-1", server.URL, true, "")
+	require.Nil(t, err)
+
+	download := provider.Get("preservation", "big", os.DevNull, true, true)
+	download.Concurrency = 1
+	download.Fetch()
+	require.Empty(t, download.ErrorMessage)
+
+	download.Concurrency = 2
+	download.PartSize = 100 * 1000
+	download.Fetch()
+	assert.Contains(t, download.ErrorMessage, "big changed while we were downloading it")
+}
@@ -0,0 +1,611 @@
+package network
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeS3 is an in-process stand-in for an S3-compatible storage
+// service, like a tiny MinIO. It implements the requests our S3
+// clients send: put, get (including ranges), head, delete, list,
+// restore and multipart uploads, storing objects in memory. It only
+// understands path-style URLs, so use it with an S3CompatibleStorage
+// whose pathStyle is true. It does not check credentials or
+// signatures.
+//
+//	fake := network.NewFakeS3()
+//	defer fake.Close()
+//	fake.CreateBucket("preservation")
+//	provider, _ := network.NewS3CompatibleStorage("minio", "key", "secret",
+//	    "us-east-1", fake.URL, true, "")
+type FakeS3 struct {
+	*httptest.Server
+
+	mutex   sync.Mutex
+	buckets map[string]map[string]*FakeS3Object
+	uploads map[string]*fakeS3Upload
+	nextId  int
+}
+
+// fakeS3Upload is a multipart upload in progress.
+type fakeS3Upload struct {
+	bucket      string
+	key         string
+	contentType string
+	metadata    map[string]string
+	parts       map[int]*FakeS3Object
+}
+
+// FakeS3Object is an object stored in a FakeS3.
+type FakeS3Object struct {
+	Data         []byte
+	ContentType  string
+	Metadata     map[string]string
+	ETag         string
+	LastModified time.Time
+
+	// RestoreRequested is true if someone asked
+	// for this object to be restored.
+	RestoreRequested bool
+}
+
+// NewFakeS3 starts a FakeS3 with no buckets. Call Close when
+// you're done with it.
+func NewFakeS3() *FakeS3 {
+	fake := &FakeS3{
+		buckets: make(map[string]map[string]*FakeS3Object),
+		uploads: make(map[string]*fakeS3Upload),
+	}
+	fake.Server = httptest.NewServer(fake)
+	return fake
+}
+
+// CreateBucket adds an empty bucket, if it doesn't already exist.
+func (fake *FakeS3) CreateBucket(bucket string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if fake.buckets[bucket] == nil {
+		fake.buckets[bucket] = make(map[string]*FakeS3Object)
+	}
+}
+
+// PutObject stores data in bucket, creating the bucket if necessary.
+func (fake *FakeS3) PutObject(bucket, key string, data []byte) *FakeS3Object {
+	fake.CreateBucket(bucket)
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	obj := newFakeS3Object(data)
+	fake.buckets[bucket][key] = obj
+	return obj
+}
+
+// Object returns the object with the specified key, or nil.
+func (fake *FakeS3) Object(bucket, key string) *FakeS3Object {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.buckets[bucket][key]
+}
+
+// Uploads returns the number of multipart uploads that
+// have been started but not completed or aborted.
+func (fake *FakeS3) Uploads() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return len(fake.uploads)
+}
+
+// Keys returns the keys in bucket, in order.
+func (fake *FakeS3) Keys(bucket string) []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.sortedKeys(bucket, "")
+}
+
+func newFakeS3Object(data []byte) *FakeS3Object {
+	return &FakeS3Object{
+		Data:         data,
+		Metadata:     make(map[string]string),
+		ETag:         fmt.Sprintf("\"%x\"", md5.Sum(data)),
+		LastModified: time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+func (fake *FakeS3) sortedKeys(bucket, prefix string) []string {
+	keys := make([]string, 0)
+	for key := range fake.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ServeHTTP handles requests to the fake.
+func (fake *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket := path
+	key := ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket = path[:i]
+		key = path[i+1:]
+	}
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	objects := fake.buckets[bucket]
+	if objects == nil {
+		fakeS3Error(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == "GET":
+		fake.list(w, bucket, query.Get("prefix"), query.Get("marker"), query.Get("max-keys"))
+	case key == "" && r.Method == "POST" && hasParam(query, "delete"):
+		fake.deleteObjects(w, r, objects)
+	case key == "":
+		fakeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "FakeS3 does not support this bucket request")
+	case r.Method == "POST" && hasParam(query, "uploads"):
+		fake.createMultipartUpload(w, r, bucket, key)
+	case hasParam(query, "uploadId"):
+		fake.multipartRequest(w, r, objects, bucket, key)
+	case r.Method == "PUT":
+		fake.put(w, r, objects, key)
+	case r.Method == "POST" && hasParam(query, "restore"):
+		fake.restore(w, r, objects[key])
+	case r.Method == "GET" || r.Method == "HEAD":
+		fake.get(w, r, objects[key])
+	case r.Method == "DELETE":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "FakeS3 does not support this object request")
+	}
+}
+
+func hasParam(query map[string][]string, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+func (fake *FakeS3) put(w http.ResponseWriter, r *http.Request, objects map[string]*FakeS3Object, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fakeS3Error(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !checkFakeS3Digests(w, r, data) {
+		return
+	}
+	obj := newFakeS3Object(data)
+	obj.ContentType = r.Header.Get("Content-Type")
+	obj.Metadata = fakeS3Metadata(r.Header)
+	objects[key] = obj
+	w.Header().Set("ETag", obj.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// checkFakeS3Digests checks data against the Content-MD5 and
+// X-Amz-Content-Sha256 headers, as S3 does, and sends an error
+// if either one doesn't match.
+func checkFakeS3Digests(w http.ResponseWriter, r *http.Request, data []byte) bool {
+	if contentMd5 := r.Header.Get("Content-MD5"); contentMd5 != "" {
+		digest := md5.Sum(data)
+		if contentMd5 != base64.StdEncoding.EncodeToString(digest[:]) {
+			fakeS3Error(w, r, http.StatusBadRequest, "BadDigest",
+				"The Content-MD5 you specified did not match what we received.")
+			return false
+		}
+	}
+	contentSha256 := r.Header.Get("X-Amz-Content-Sha256")
+	if contentSha256 != "" && contentSha256 != "UNSIGNED-PAYLOAD" {
+		if contentSha256 != fmt.Sprintf("%x", sha256.Sum256(data)) {
+			fakeS3Error(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch",
+				"The provided 'x-amz-content-sha256' header does not match what was computed.")
+			return false
+		}
+	}
+	return true
+}
+
+// fakeS3Metadata returns the x-amz-meta-* headers, without the prefix.
+func fakeS3Metadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for name := range header {
+		lcName := strings.ToLower(name)
+		if strings.HasPrefix(lcName, "x-amz-meta-") {
+			metadata[strings.TrimPrefix(lcName, "x-amz-meta-")] = header.Get(name)
+		}
+	}
+	return metadata
+}
+
+func (fake *FakeS3) get(w http.ResponseWriter, r *http.Request, obj *FakeS3Object) {
+	if obj == nil {
+		fakeS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != obj.ETag {
+		fakeS3Error(w, r, http.StatusPreconditionFailed, "PreconditionFailed",
+			"At least one of the pre-conditions you specified did not hold")
+		return
+	}
+	data := obj.Data
+	status := http.StatusOK
+	header := w.Header()
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		start, end, ok := parseFakeS3Range(rangeHeader, len(obj.Data))
+		if !ok {
+			fakeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange",
+				"The requested range is not satisfiable")
+			return
+		}
+		data = obj.Data[start:end]
+		status = http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(obj.Data)))
+	}
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("ETag", obj.ETag)
+	header.Set("Last-Modified", obj.LastModified.Format(http.TimeFormat))
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	if obj.ContentType != "" {
+		header.Set("Content-Type", obj.ContentType)
+	}
+	for name, value := range obj.Metadata {
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+	if obj.RestoreRequested {
+		header.Set("X-Amz-Restore", `ongoing-request="false"`)
+	}
+	w.WriteHeader(status)
+	if r.Method == "GET" {
+		w.Write(data)
+	}
+}
+
+// parseFakeS3Range parses a Range header of the form "bytes=first-last"
+// or "bytes=first-", and returns the start and end of the slice of a
+// size-byte object it asks for.
+func parseFakeS3Range(rangeHeader string, size int) (start, end int, ok bool) {
+	spec := strings.TrimPrefix(rangeHeader, "bytes=")
+	dash := strings.Index(spec, "-")
+	if spec == rangeHeader || dash < 0 {
+		return 0, 0, false
+	}
+	start, err := strconv.Atoi(spec[:dash])
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size
+	if spec[dash+1:] != "" {
+		last, err := strconv.Atoi(spec[dash+1:])
+		if err != nil || last < start {
+			return 0, 0, false
+		}
+		if last+1 < size {
+			end = last + 1
+		}
+	}
+	return start, end, true
+}
+
+func (fake *FakeS3) restore(w http.ResponseWriter, r *http.Request, obj *FakeS3Object) {
+	if obj == nil {
+		fakeS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if obj.RestoreRequested {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	obj.RestoreRequested = true
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name              `xml:"ListBucketResult"`
+	Name        string                `xml:"Name"`
+	Prefix      string                `xml:"Prefix"`
+	Marker      string                `xml:"Marker"`
+	NextMarker  string                `xml:"NextMarker,omitempty"`
+	MaxKeys     int                   `xml:"MaxKeys"`
+	IsTruncated bool                  `xml:"IsTruncated"`
+	Contents    []fakeS3ListedContent `xml:"Contents"`
+}
+
+type fakeS3ListedContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+func (fake *FakeS3) list(w http.ResponseWriter, bucket, prefix, marker, maxKeysParam string) {
+	maxKeys := 1000
+	if n, err := strconv.Atoi(maxKeysParam); err == nil && n >= 0 {
+		maxKeys = n
+	}
+	result := fakeS3ListResult{
+		Name:     bucket,
+		Prefix:   prefix,
+		Marker:   marker,
+		MaxKeys:  maxKeys,
+		Contents: make([]fakeS3ListedContent, 0),
+	}
+	for _, key := range fake.sortedKeys(bucket, prefix) {
+		if key <= marker {
+			continue
+		}
+		if len(result.Contents) == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		obj := fake.buckets[bucket][key]
+		result.Contents = append(result.Contents, fakeS3ListedContent{
+			Key:          key,
+			LastModified: obj.LastModified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         obj.ETag,
+			Size:         len(obj.Data),
+			StorageClass: "STANDARD",
+		})
+	}
+	if result.IsTruncated && len(result.Contents) > 0 {
+		result.NextMarker = result.Contents[len(result.Contents)-1].Key
+	}
+	writeFakeS3XML(w, http.StatusOK, result)
+}
+
+type fakeS3DeleteRequest struct {
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type fakeS3DeleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []struct {
+		Key string `xml:"Key"`
+	} `xml:"Deleted"`
+}
+
+func (fake *FakeS3) deleteObjects(w http.ResponseWriter, r *http.Request, objects map[string]*FakeS3Object) {
+	request := fakeS3DeleteRequest{}
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = xml.Unmarshal(data, &request)
+	}
+	if err != nil {
+		fakeS3Error(w, r, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	result := fakeS3DeleteResult{}
+	for _, obj := range request.Objects {
+		delete(objects, obj.Key)
+		result.Deleted = append(result.Deleted, struct {
+			Key string `xml:"Key"`
+		}{obj.Key})
+	}
+	writeFakeS3XML(w, http.StatusOK, result)
+}
+
+type fakeS3ErrorBody struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// fakeS3Error sends an S3 error response. Responses to HEAD
+// requests have no body, so the client sees only the status.
+func fakeS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if r.Method == "HEAD" {
+		w.WriteHeader(status)
+		return
+	}
+	writeFakeS3XML(w, status, fakeS3ErrorBody{Code: code, Message: message})
+}
+
+func writeFakeS3XML(w http.ResponseWriter, status int, body interface{}) {
+	data, err := xml.Marshal(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+type fakeS3InitiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type fakeS3ListPartsResult struct {
+	XMLName              xml.Name           `xml:"ListPartsResult"`
+	Bucket               string             `xml:"Bucket"`
+	Key                  string             `xml:"Key"`
+	UploadId             string             `xml:"UploadId"`
+	PartNumberMarker     int                `xml:"PartNumberMarker"`
+	NextPartNumberMarker int                `xml:"NextPartNumberMarker"`
+	MaxParts             int                `xml:"MaxParts"`
+	IsTruncated          bool               `xml:"IsTruncated"`
+	Parts                []fakeS3ListedPart `xml:"Part"`
+}
+
+type fakeS3ListedPart struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+}
+
+type fakeS3CompleteRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type fakeS3CompleteResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (fake *FakeS3) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	fake.nextId++
+	uploadId := fmt.Sprintf("upload-%d", fake.nextId)
+	fake.uploads[uploadId] = &fakeS3Upload{
+		bucket:      bucket,
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		metadata:    fakeS3Metadata(r.Header),
+		parts:       make(map[int]*FakeS3Object),
+	}
+	writeFakeS3XML(w, http.StatusOK, fakeS3InitiateResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: uploadId,
+	})
+}
+
+// multipartRequest handles requests about the multipart upload
+// in the uploadId parameter: upload part, list parts, complete
+// and abort.
+func (fake *FakeS3) multipartRequest(w http.ResponseWriter, r *http.Request, objects map[string]*FakeS3Object, bucket, key string) {
+	query := r.URL.Query()
+	uploadId := query.Get("uploadId")
+	upload := fake.uploads[uploadId]
+	if upload == nil || upload.bucket != bucket || upload.key != key {
+		fakeS3Error(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		partNumber, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || partNumber < 1 || partNumber > 10000 {
+			fakeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Part number must be between 1 and 10000")
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			fakeS3Error(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if !checkFakeS3Digests(w, r, data) {
+			return
+		}
+		part := newFakeS3Object(data)
+		upload.parts[partNumber] = part
+		w.Header().Set("ETag", part.ETag)
+		w.WriteHeader(http.StatusOK)
+	case "GET":
+		fake.listParts(w, upload, bucket, key, uploadId, query.Get("part-number-marker"), query.Get("max-parts"))
+	case "POST":
+		fake.completeMultipartUpload(w, r, objects, upload, uploadId)
+	case "DELETE":
+		delete(fake.uploads, uploadId)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "FakeS3 does not support this upload request")
+	}
+}
+
+func (fake *FakeS3) listParts(w http.ResponseWriter, upload *fakeS3Upload, bucket, key, uploadId, markerParam, maxPartsParam string) {
+	marker, _ := strconv.Atoi(markerParam)
+	maxParts := 1000
+	if n, err := strconv.Atoi(maxPartsParam); err == nil && n > 0 {
+		maxParts = n
+	}
+	numbers := make([]int, 0)
+	for number := range upload.parts {
+		if number > marker {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+	result := fakeS3ListPartsResult{
+		Bucket:           bucket,
+		Key:              key,
+		UploadId:         uploadId,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+		Parts:            make([]fakeS3ListedPart, 0),
+	}
+	if len(numbers) > maxParts {
+		numbers = numbers[:maxParts]
+		result.IsTruncated = true
+	}
+	for _, number := range numbers {
+		part := upload.parts[number]
+		result.Parts = append(result.Parts, fakeS3ListedPart{
+			PartNumber:   number,
+			LastModified: part.LastModified.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         part.ETag,
+			Size:         len(part.Data),
+		})
+		result.NextPartNumberMarker = number
+	}
+	writeFakeS3XML(w, http.StatusOK, result)
+}
+
+// completeMultipartUpload joins the parts listed in the request into
+// an object. Like S3, the object's ETag is the md5 of the parts' md5
+// digests, followed by the number of parts.
+func (fake *FakeS3) completeMultipartUpload(w http.ResponseWriter, r *http.Request, objects map[string]*FakeS3Object, upload *fakeS3Upload, uploadId string) {
+	request := fakeS3CompleteRequest{}
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = xml.Unmarshal(data, &request)
+	}
+	if err != nil || len(request.Parts) == 0 {
+		fakeS3Error(w, r, http.StatusBadRequest, "MalformedXML", fmt.Sprintf("Bad part list: %v", err))
+		return
+	}
+	joined := make([]byte, 0)
+	digests := make([]byte, 0)
+	for i, requested := range request.Parts {
+		part := upload.parts[requested.PartNumber]
+		if part == nil || part.ETag != requested.ETag {
+			fakeS3Error(w, r, http.StatusBadRequest, "InvalidPart",
+				fmt.Sprintf("Part %d was not uploaded or its ETag does not match", requested.PartNumber))
+			return
+		}
+		if i > 0 && requested.PartNumber <= request.Parts[i-1].PartNumber {
+			fakeS3Error(w, r, http.StatusBadRequest, "InvalidPartOrder", "The parts must be in ascending order")
+			return
+		}
+		joined = append(joined, part.Data...)
+		digest := md5.Sum(part.Data)
+		digests = append(digests, digest[:]...)
+	}
+	obj := newFakeS3Object(joined)
+	obj.ETag = fmt.Sprintf("\"%x-%d\"", md5.Sum(digests), len(request.Parts))
+	obj.ContentType = upload.contentType
+	obj.Metadata = upload.metadata
+	objects[upload.key] = obj
+	delete(fake.uploads, uploadId)
+	writeFakeS3XML(w, http.StatusOK, fakeS3CompleteResult{
+		Location: fmt.Sprintf("http://%s/%s/%s", r.Host, upload.bucket, upload.key),
+		Bucket:   upload.bucket,
+		Key:      upload.key,
+		ETag:     obj.ETag,
+	})
+}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/util"
 	"github.com/aws/aws-sdk-go/aws"
@@ -78,6 +79,12 @@ func (client *S3Head) SetSessionEndpoint(url string) {
 // The most relevant items for us in the HeadObjectOutput struct are
 // ContentLength, ContentType, LastModified, Metadata, and VersionId.
 func (client *S3Head) Head(key string) {
+	client.HeadWithContext(context.Background(), key)
+}
+
+// HeadWithContext is like Head, but it gives up if ctx is cancelled
+// or its deadline passes before S3 responds.
+func (client *S3Head) HeadWithContext(ctx context.Context, key string) {
 	client.Response = nil
 	client.ErrorMessage = ""
 	_session := client.GetSession()
@@ -98,6 +105,7 @@ func (client *S3Head) Head(key string) {
 	}
 	client.input = params
 	request, response := service.HeadObjectRequest(params)
+	request.SetContext(ctx)
 	err := request.Send()
 	if err != nil {
 		client.ErrorMessage = err.Error()
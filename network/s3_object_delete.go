@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -73,6 +74,12 @@ func (client *S3ObjectDelete) GetSession() *session.Session {
 // get an error, and those keys will be shown as deleted in
 // s3ObjectDelete.Response.Deleted. That's AWS' design decision.
 func (client *S3ObjectDelete) DeleteList() {
+	client.DeleteListWithContext(context.Background())
+}
+
+// DeleteListWithContext is like DeleteList, but it gives up if ctx is
+// cancelled or its deadline passes before S3 responds.
+func (client *S3ObjectDelete) DeleteListWithContext(ctx context.Context) {
 	_session := client.GetSession()
 	if _session == nil {
 		return
@@ -80,7 +87,7 @@ func (client *S3ObjectDelete) DeleteList() {
 	var err error = nil
 	service := s3.New(_session)
 
-	client.Response, err = service.DeleteObjects(client.DeleteObjectsInput)
+	client.Response, err = service.DeleteObjectsWithContext(ctx, client.DeleteObjectsInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 	}
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -58,6 +59,12 @@ func (client *S3ObjectList) GetSession() *session.Session {
 // you got the complete list. If not, keep calling
 // GetList until IsTruncated == false.
 func (client *S3ObjectList) GetList(prefix string) {
+	client.GetListWithContext(context.Background(), prefix)
+}
+
+// GetListWithContext is like GetList, but it gives up if ctx is
+// cancelled or its deadline passes before S3 responds.
+func (client *S3ObjectList) GetListWithContext(ctx context.Context, prefix string) {
 	_session := client.GetSession()
 	if _session == nil {
 		return
@@ -80,7 +87,7 @@ func (client *S3ObjectList) GetList(prefix string) {
 	if prefix != "" {
 		client.ListObjectsInput.Prefix = &prefix
 	}
-	client.Response, err = service.ListObjects(client.ListObjectsInput)
+	client.Response, err = service.ListObjectsWithContext(ctx, client.ListObjectsInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 	}
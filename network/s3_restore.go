@@ -1,6 +1,7 @@
 package network
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -103,6 +104,12 @@ func (client *S3Restore) getTestSession() {
 
 // Restore the archived file from Glacier to S3.
 func (client *S3Restore) Restore() {
+	client.RestoreWithContext(context.Background())
+}
+
+// RestoreWithContext is like Restore, but it gives up if ctx is
+// cancelled or its deadline passes before S3 responds.
+func (client *S3Restore) RestoreWithContext(ctx context.Context) {
 	client.Response = nil
 	client.ErrorMessage = ""
 	client.RestoreAlreadyInProgress = false
@@ -124,7 +131,7 @@ func (client *S3Restore) Restore() {
 			},
 		},
 	}
-	resp, err := service.RestoreObject(params)
+	resp, err := service.RestoreObjectWithContext(ctx, params)
 	client.Response = resp
 	client.checkError(err)
 }
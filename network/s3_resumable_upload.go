@@ -0,0 +1,356 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+	"sort"
+	"sync"
+)
+
+// MetadataStore holds bookkeeping data that must survive a restart of
+// the process. storage.BoltDB implements this, so the state of the
+// uploads for a bag can live in the bag's .valdb file.
+type MetadataStore interface {
+	SaveMetadata(key string, value interface{}) error
+	GetMetadata(key string, value interface{}) (bool, error)
+	DeleteMetadata(key string) error
+}
+
+// MultipartUploadState is what we need to know to resume a multipart
+// upload. See S3Upload.SendResumableWithContext.
+type MultipartUploadState struct {
+	Bucket   string
+	Key      string
+	UploadId string
+	FileSize int64
+	PartSize int64
+
+	// ETags are the ETags of the parts S3 has, by part number.
+	ETags map[int64]string
+}
+
+// resumableUploadConcurrency is the number of parts to send at once.
+// As in SendWithSizeWithContext, we keep this low because several
+// storers usually run at the same time.
+const resumableUploadConcurrency = 2
+
+// SendResumableWithContext uploads fileSize bytes from reader in
+// parts, like SendWithSizeWithContext, except that an upload that
+// fails, or is cut off when the process stops, can be resumed. It
+// saves the multipart upload ID and the ETag of each part in store,
+// under stateKey, as it goes. A later call with the same store and
+// stateKey asks S3 which parts it already has, and sends only the
+// rest. The state is deleted when the upload is complete.
+//
+// As in SendWithSizeWithContext, we read each part into memory once,
+// adding it to the digests of the file as we go. Parts S3 already has
+// are read too, but they're sent again only if their ETags don't match
+// the data. Each part goes up with its md5 digest in the Content-MD5
+// header. Once we've read the whole file, we check its digests against
+// ExpectedMd5 and ExpectedSha256, and we complete the upload only if
+// they match. If they don't, the parts stay in S3, so the next attempt
+// sends only the parts that differ. When S3 completes the upload, we
+// check the ETag it reports.
+//
+// Unlike s3manager, this doesn't abort multipart uploads that fail,
+// since the point is to resume them. Buckets should have a lifecycle
+// rule that cleans up incomplete multipart uploads after a few days.
+func (client *S3Upload) SendResumableWithContext(ctx context.Context, reader io.ReaderAt, fileSize int64, store MetadataStore, stateKey string) {
+	if fileSize <= 0 {
+		client.SendWithSizeWithContext(ctx, io.NewSectionReader(reader, 0, fileSize), fileSize)
+		return
+	}
+	_session := client.GetSession()
+	if _session == nil {
+		return
+	}
+	service := s3.New(_session)
+
+	// Same part size as SendWithSizeWithContext.
+	partSize := client.partSize
+	if partSize <= 0 {
+		partSize = (fileSize + int64(1000000)) / int64(10000)
+		if partSize < BIG_CHUNK_SIZE {
+			partSize = BIG_CHUNK_SIZE
+		}
+	}
+	state, err := client.resumableState(ctx, service, fileSize, partSize, store, stateKey)
+	if err != nil {
+		client.ErrorMessage = err.Error()
+		return
+	}
+	verifier := client.newUploadVerifier(fileSize, partSize)
+	if err = client.sendParts(ctx, service, reader, verifier, state, store, stateKey); err != nil {
+		client.ErrorMessage = err.Error()
+		return
+	}
+	if err = verifier.finish(); err != nil {
+		client.ErrorMessage = err.Error()
+		return
+	}
+	partNumbers := make([]int64, 0, len(state.ETags))
+	for partNumber := range state.ETags {
+		partNumbers = append(partNumbers, partNumber)
+	}
+	sort.Slice(partNumbers, func(i, j int) bool { return partNumbers[i] < partNumbers[j] })
+	parts := make([]*s3.CompletedPart, len(partNumbers))
+	for i, partNumber := range partNumbers {
+		parts[i] = &s3.CompletedPart{
+			ETag:       aws.String(state.ETags[partNumber]),
+			PartNumber: aws.Int64(partNumber),
+		}
+	}
+	complete, err := service.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          client.UploadInput.Bucket,
+		Key:             client.UploadInput.Key,
+		UploadId:        aws.String(state.UploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		client.ErrorMessage = err.Error()
+		return
+	}
+	if err = store.DeleteMetadata(stateKey); err != nil {
+		client.ErrorMessage = fmt.Sprintf("Upload is complete, but can't delete its state: %v", err)
+	}
+	if client.md5ETags && aws.StringValue(complete.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms {
+		client.ETag = verifier.etag(true)
+		if !SameETag(aws.StringValue(complete.ETag), client.ETag) {
+			client.ErrorMessage = fmt.Sprintf("S3 reports ETag %s for %s, expected %s",
+				aws.StringValue(complete.ETag), state.Key, client.ETag)
+			return
+		}
+	}
+
+	// Report the same location s3manager does.
+	getReq, _ := service.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: client.UploadInput.Bucket,
+		Key:    client.UploadInput.Key,
+	})
+	getReq.Config.Credentials = credentials.AnonymousCredentials
+	getReq.SetContext(ctx)
+	location, _, _ := getReq.PresignRequest(1)
+	client.Response = &s3manager.UploadOutput{
+		Location:  location,
+		VersionID: complete.VersionId,
+		UploadID:  state.UploadId,
+	}
+}
+
+// resumableState returns the state of the upload saved in store, with
+// the ETags of the parts S3 has, or the state of a new multipart upload
+// if there's nothing to resume.
+func (client *S3Upload) resumableState(ctx context.Context, service *s3.S3, fileSize, partSize int64, store MetadataStore, stateKey string) (*MultipartUploadState, error) {
+	bucket := aws.StringValue(client.UploadInput.Bucket)
+	key := aws.StringValue(client.UploadInput.Key)
+	state := &MultipartUploadState{}
+	found, err := store.GetMetadata(stateKey, state)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read state of upload %s: %v", stateKey, err)
+	}
+	if found && state.Bucket == bucket && state.Key == key &&
+		state.FileSize == fileSize && state.PartSize == partSize {
+		err = client.listUploadedParts(ctx, service, state)
+		if err == nil {
+			return state, nil
+		}
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != s3.ErrCodeNoSuchUpload {
+			return nil, err
+		}
+	} else if found {
+		// The file, its destination or the part size changed,
+		// so the old upload is no use. This is best effort.
+		service.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(state.Bucket),
+			Key:      aws.String(state.Key),
+			UploadId: aws.String(state.UploadId),
+		})
+	}
+
+	input := client.UploadInput
+	created, err := service.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		ContentType:          input.ContentType,
+		Metadata:             input.Metadata,
+		ServerSideEncryption: input.ServerSideEncryption,
+		StorageClass:         input.StorageClass,
+	})
+	if err != nil {
+		return nil, err
+	}
+	state = &MultipartUploadState{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: aws.StringValue(created.UploadId),
+		FileSize: fileSize,
+		PartSize: partSize,
+		ETags:    make(map[int64]string),
+	}
+	if err = store.SaveMetadata(stateKey, state); err != nil {
+		return nil, fmt.Errorf("Can't save state of upload %s: %v", stateKey, err)
+	}
+	return state, nil
+}
+
+// listUploadedParts replaces state.ETags with the ETags of the parts
+// S3 has. Parts that are the wrong size, or whose ETags don't match
+// the ones we saved, will be sent again. So will parts we have no
+// ETag for, since we may have died while sending them, and we can't
+// tell what S3 got.
+func (client *S3Upload) listUploadedParts(ctx context.Context, service *s3.S3, state *MultipartUploadState) error {
+	saved := state.ETags
+	state.ETags = make(map[int64]string)
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadId),
+	}
+	return service.ListPartsPagesWithContext(ctx, input, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			partNumber := aws.Int64Value(part.PartNumber)
+			etag := aws.StringValue(part.ETag)
+			_, size := state.partRange(partNumber)
+			if aws.Int64Value(part.Size) != size {
+				continue
+			}
+			if savedETag := saved[partNumber]; savedETag == "" || !SameETag(savedETag, etag) {
+				continue
+			}
+			state.ETags[partNumber] = etag
+		}
+		return true
+	})
+}
+
+// partRange returns the offset and size of the specified part.
+func (state *MultipartUploadState) partRange(partNumber int64) (offset, size int64) {
+	offset = (partNumber - 1) * state.PartSize
+	size = state.PartSize
+	if offset+size > state.FileSize {
+		size = state.FileSize - offset
+	}
+	return offset, size
+}
+
+// resumablePart is a part of a file, read into memory, on its way
+// to S3.
+type resumablePart struct {
+	number int64
+	data   []byte
+	md5    []byte
+}
+
+// sendParts reads the file one part at a time, passing each part
+// through verifier, and sends the parts that aren't in state.ETags,
+// or whose ETags don't match the data, saving the state after each
+// one. When a part fails, we stop starting new parts, but let the
+// ones in progress finish, so there's less to send next time.
+//
+// We keep at most resumableUploadConcurrency + 1 parts in memory.
+func (client *S3Upload) sendParts(ctx context.Context, service *s3.S3, reader io.ReaderAt, verifier *uploadVerifier, state *MultipartUploadState, store MetadataStore, stateKey string) error {
+	stop := make(chan struct{})
+	var mutex sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			close(stop)
+		}
+	}
+	buffers := make(chan []byte, resumableUploadConcurrency+1)
+	for i := 0; i < cap(buffers); i++ {
+		buffers <- nil
+	}
+
+	numParts := (state.FileSize + state.PartSize - 1) / state.PartSize
+	parts := make(chan *resumablePart)
+	go func() {
+		defer close(parts)
+		for partNumber := int64(1); partNumber <= numParts; partNumber++ {
+			var buffer []byte
+			select {
+			case buffer = <-buffers:
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+			offset, size := state.partRange(partNumber)
+			if int64(cap(buffer)) < size {
+				buffer = make([]byte, state.PartSize)
+			}
+			data := buffer[:size]
+			if n, err := reader.ReadAt(data, offset); int64(n) != size {
+				fail(fmt.Errorf("Error reading part %d of %d: %v", partNumber, numParts, err))
+				return
+			}
+			part := &resumablePart{
+				number: partNumber,
+				data:   data,
+				md5:    verifier.writePart(data),
+			}
+			mutex.Lock()
+			etag, uploaded := state.ETags[partNumber]
+			mutex.Unlock()
+			if uploaded && SameETag(etag, hex.EncodeToString(part.md5)) {
+				buffers <- buffer
+				continue
+			}
+			select {
+			case parts <- part:
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < resumableUploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				output, err := service.UploadPartWithContext(ctx, &s3.UploadPartInput{
+					Bucket:        aws.String(state.Bucket),
+					Key:           aws.String(state.Key),
+					UploadId:      aws.String(state.UploadId),
+					PartNumber:    aws.Int64(part.number),
+					ContentLength: aws.Int64(int64(len(part.data))),
+					ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(part.md5)),
+					Body:          bytes.NewReader(part.data),
+				})
+				buffers <- part.data
+				if err != nil {
+					fail(fmt.Errorf("Error sending part %d of %d: %v", part.number, numParts, err))
+					continue
+				}
+				mutex.Lock()
+				state.ETags[part.number] = aws.StringValue(output.ETag)
+				err = store.SaveMetadata(stateKey, state)
+				mutex.Unlock()
+				if err != nil {
+					fail(fmt.Errorf("Can't save state of upload %s: %v", stateKey, err))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
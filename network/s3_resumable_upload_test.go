@@ -0,0 +1,253 @@
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/util/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// flakyS3 is a FakeS3 that fails uploads of part 2 while failPartTwo
+// is true. It counts the uploads of each part.
+type flakyS3 struct {
+	*network.FakeS3
+	server      *httptest.Server
+	mutex       sync.Mutex
+	partsSent   map[string]int
+	failPartTwo bool
+}
+
+func newFlakyS3(t *testing.T) (*flakyS3, network.StorageProvider) {
+	flaky := &flakyS3{
+		FakeS3:      network.NewFakeS3(),
+		partsSent:   make(map[string]int),
+		failPartTwo: true,
+	}
+	flaky.CreateBucket("preservation")
+	flaky.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		partNumber := r.URL.Query().Get("partNumber")
+		if r.Method == "PUT" && partNumber != "" {
+			flaky.mutex.Lock()
+			flaky.partsSent[partNumber]++
+			fail := flaky.failPartTwo && partNumber == "2"
+			flaky.mutex.Unlock()
+			if fail {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		flaky.FakeS3.ServeHTTP(w, r)
+	}))
+	provider, err := network.NewS3CompatibleStorage("minio", "key", "secret",
+		"us-east-1", flaky.server.URL, true, "")
+	require.Nil(t, err)
+	return flaky, provider
+}
+
+func (flaky *flakyS3) sent(partNumber string) int {
+	flaky.mutex.Lock()
+	defer flaky.mutex.Unlock()
+	return flaky.partsSent[partNumber]
+}
+
+func (flaky *flakyS3) stopFailing() {
+	flaky.mutex.Lock()
+	defer flaky.mutex.Unlock()
+	flaky.failPartTwo = false
+}
+
+func (flaky *flakyS3) Close() {
+	flaky.server.Close()
+	flaky.FakeS3.Close()
+}
+
+func TestSendResumable(t *testing.T) {
+	fake, provider := newFlakyS3(t)
+	defer fake.Close()
+
+	tmpDir, err := ioutil.TempDir("", "s3_resumable_upload_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dbPath := filepath.Join(tmpDir, "bag.valdb")
+	data := make([]byte, 2*network.S3_MIN_CHUNK_SIZE+1234)
+	rand.New(rand.NewSource(24)).Read(data)
+	reader := bytes.NewReader(data)
+	ctx := context.Background()
+
+	db, err := storage.NewBoltDB(dbPath)
+	require.Nil(t, err)
+	upload := provider.Put("preservation", "big", "application/octet-stream")
+	upload.AddMetadata("institution", "test.edu")
+	upload.SetPartSize(network.S3_MIN_CHUNK_SIZE)
+	upload.SendResumableWithContext(ctx, reader, int64(len(data)), db, "upload:big")
+	assert.Contains(t, upload.ErrorMessage, "Error sending part 2 of 3")
+	assert.Nil(t, fake.Object("preservation", "big"))
+	assert.Equal(t, 1, fake.Uploads())
+	state := &network.MultipartUploadState{}
+	found, err := db.GetMetadata("upload:big", state)
+	require.Nil(t, err)
+	require.True(t, found)
+	assert.Equal(t, "big", state.Key)
+	assert.Equal(t, network.S3_MIN_CHUNK_SIZE, state.PartSize)
+	assert.NotEmpty(t, state.ETags[1])
+	assert.Empty(t, state.ETags[2])
+	db.Close()
+
+	// Pretend the worker restarted.
+	fake.stopFailing()
+	partOneSent := fake.sent("1")
+	db, err = storage.NewBoltDB(dbPath)
+	require.Nil(t, err)
+	defer db.Close()
+	upload = provider.Put("preservation", "big", "application/octet-stream")
+	upload.SetPartSize(network.S3_MIN_CHUNK_SIZE)
+	upload.ExpectedMd5 = fmt.Sprintf("%x", md5.Sum(data))
+	upload.ExpectedSha256 = fmt.Sprintf("%x", sha256.Sum256(data))
+	upload.SendResumableWithContext(ctx, reader, int64(len(data)), db, "upload:big")
+	require.Empty(t, upload.ErrorMessage)
+	assert.Equal(t, upload.ExpectedMd5, upload.Md5Digest)
+	assert.Equal(t, upload.ExpectedSha256, upload.Sha256Digest)
+	assert.Equal(t, partOneSent, fake.sent("1"), "Part 1 should not be sent again")
+	assert.Equal(t, 1, fake.sent("3"))
+	assert.Equal(t, fake.server.URL+"/preservation/big", upload.Response.Location)
+	assert.Equal(t, state.UploadId, upload.Response.UploadID)
+
+	obj := fake.Object("preservation", "big")
+	require.NotNil(t, obj)
+	assert.True(t, bytes.Equal(data, obj.Data))
+	assert.Equal(t, "application/octet-stream", obj.ContentType)
+	assert.Equal(t, "test.edu", obj.Metadata["institution"])
+	assert.Equal(t, 0, fake.Uploads())
+	assert.True(t, network.SameETag(obj.ETag, upload.ETag))
+	assert.True(t, strings.HasSuffix(upload.ETag, "-3"))
+	found, err = db.GetMetadata("upload:big", state)
+	require.Nil(t, err)
+	assert.False(t, found)
+}
+
+func TestSendResumable_UploadGone(t *testing.T) {
+	fake, provider := fakeS3Storage(t)
+	defer fake.Close()
+	tmpDir, err := ioutil.TempDir("", "s3_resumable_upload_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	db, err := storage.NewBoltDB(filepath.Join(tmpDir, "bag.valdb"))
+	require.Nil(t, err)
+	defer db.Close()
+	data := []byte("Not much data")
+
+	// S3 cleaned up this upload, so we have to start over.
+	require.Nil(t, db.SaveMetadata("upload:small", &network.MultipartUploadState{
+		Bucket:   "preservation",
+		Key:      "small",
+		UploadId: "upload-1234",
+		FileSize: int64(len(data)),
+		PartSize: network.S3_MIN_CHUNK_SIZE,
+		ETags:    map[int64]string{1: "\"abc\""},
+	}))
+	upload := provider.Put("preservation", "small", "text/plain")
+	upload.SetPartSize(network.S3_MIN_CHUNK_SIZE)
+	upload.SendResumableWithContext(context.Background(), bytes.NewReader(data),
+		int64(len(data)), db, "upload:small")
+	require.Empty(t, upload.ErrorMessage)
+	obj := fake.Object("preservation", "small")
+	require.NotNil(t, obj)
+	assert.Equal(t, data, obj.Data)
+	assert.Equal(t, 0, fake.Uploads())
+}
+
+func TestSendResumable_UnsavedPart(t *testing.T) {
+	fake, provider := newFlakyS3(t)
+	defer fake.Close()
+	tmpDir, err := ioutil.TempDir("", "s3_resumable_upload_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	db, err := storage.NewBoltDB(filepath.Join(tmpDir, "bag.valdb"))
+	require.Nil(t, err)
+	defer db.Close()
+	data := make([]byte, network.S3_MIN_CHUNK_SIZE+1)
+	rand.New(rand.NewSource(26)).Read(data)
+	ctx := context.Background()
+
+	upload := provider.Put("preservation", "big", "")
+	upload.SetPartSize(network.S3_MIN_CHUNK_SIZE)
+	upload.SendResumableWithContext(ctx, bytes.NewReader(data), int64(len(data)), db, "upload:big")
+	assert.Contains(t, upload.ErrorMessage, "Error sending part 2 of 2")
+	assert.Equal(t, 1, fake.sent("1"))
+
+	// Pretend we died after S3 got part 1, but before we saved its
+	// ETag. We can't trust that part, so we send it again.
+	state := &network.MultipartUploadState{}
+	found, err := db.GetMetadata("upload:big", state)
+	require.Nil(t, err)
+	require.True(t, found)
+	delete(state.ETags, 1)
+	require.Nil(t, db.SaveMetadata("upload:big", state))
+	fake.stopFailing()
+	upload = provider.Put("preservation", "big", "")
+	upload.SetPartSize(network.S3_MIN_CHUNK_SIZE)
+	upload.SendResumableWithContext(ctx, bytes.NewReader(data), int64(len(data)), db, "upload:big")
+	require.Empty(t, upload.ErrorMessage)
+	assert.Equal(t, 2, fake.sent("1"))
+	obj := fake.Object("preservation", "big")
+	require.NotNil(t, obj)
+	assert.True(t, bytes.Equal(data, obj.Data))
+}
+
+func TestSendResumable_BadData(t *testing.T) {
+	fake, provider := newFlakyS3(t)
+	defer fake.Close()
+	fake.stopFailing()
+	tmpDir, err := ioutil.TempDir("", "s3_resumable_upload_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	db, err := storage.NewBoltDB(filepath.Join(tmpDir, "bag.valdb"))
+	require.Nil(t, err)
+	defer db.Close()
+	data := make([]byte, network.S3_MIN_CHUNK_SIZE+1)
+	rand.New(rand.NewSource(25)).Read(data)
+	bad := make([]byte, len(data))
+	copy(bad, data)
+	bad[0]++
+	ctx := context.Background()
+
+	// We find out the data is bad only after we've read all of
+	// it, but we don't complete the upload.
+	upload := provider.Put("preservation", "big", "")
+	upload.SetPartSize(network.S3_MIN_CHUNK_SIZE)
+	upload.ExpectedSha256 = fmt.Sprintf("%x", sha256.Sum256(data))
+	upload.SendResumableWithContext(ctx, bytes.NewReader(bad), int64(len(bad)), db, "upload:big")
+	assert.Contains(t, upload.ErrorMessage, "Data read for big has sha256")
+	assert.Nil(t, fake.Object("preservation", "big"))
+	assert.Equal(t, 1, fake.Uploads())
+	assert.Equal(t, 1, fake.sent("1"))
+	assert.Equal(t, 1, fake.sent("2"))
+
+	// When we resume with the right data, only part 1,
+	// which was bad, is sent again.
+	upload = provider.Put("preservation", "big", "")
+	upload.SetPartSize(network.S3_MIN_CHUNK_SIZE)
+	upload.ExpectedSha256 = fmt.Sprintf("%x", sha256.Sum256(data))
+	upload.SendResumableWithContext(ctx, bytes.NewReader(data), int64(len(data)), db, "upload:big")
+	require.Empty(t, upload.ErrorMessage)
+	assert.Equal(t, 2, fake.sent("1"))
+	assert.Equal(t, 1, fake.sent("2"))
+	obj := fake.Object("preservation", "big")
+	require.NotNil(t, obj)
+	assert.True(t, bytes.Equal(data, obj.Data))
+	assert.True(t, network.SameETag(obj.ETag, upload.ETag))
+}
@@ -5,18 +5,49 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"net/http"
+	"sync"
 )
 
+var s3RoundTripper struct {
+	sync.RWMutex
+	roundTripper http.RoundTripper
+}
+
+// SetS3RoundTripper makes S3 sessions created after this call send
+// their requests through roundTripper, such as a RecordingTransport
+// or ReplayTransport. Pass nil to go back to the AWS default.
+func SetS3RoundTripper(roundTripper http.RoundTripper) {
+	s3RoundTripper.Lock()
+	defer s3RoundTripper.Unlock()
+	s3RoundTripper.roundTripper = roundTripper
+}
+
+// s3HTTPClient returns a client that sends requests through the
+// transport set with SetS3RoundTripper, or nil if none is set.
+func s3HTTPClient() *http.Client {
+	s3RoundTripper.RLock()
+	defer s3RoundTripper.RUnlock()
+	if s3RoundTripper.roundTripper == nil {
+		return nil
+	}
+	return &http.Client{Transport: s3RoundTripper.roundTripper}
+}
+
 // Returns an S3 session for this objectList.
 func GetS3Session(awsRegion, accessKeyId, secretAccessKey string) (*session.Session, error) {
 	creds := credentials.NewEnvCredentials()
 	if accessKeyId != "" && secretAccessKey != "" {
 		creds = credentials.NewStaticCredentials(accessKeyId, secretAccessKey, "")
 	}
-	_session := session.New(&aws.Config{
+	awsConfig := &aws.Config{
 		Region:      aws.String(awsRegion),
 		Credentials: creds,
-	})
+	}
+	if httpClient := s3HTTPClient(); httpClient != nil {
+		awsConfig.HTTPClient = httpClient
+	}
+	_session := session.New(awsConfig)
 	if _session == nil {
 		return nil, fmt.Errorf("AWS Session returned nil")
 	}
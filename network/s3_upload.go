@@ -1,9 +1,12 @@
 package network
 
 import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"io"
+	"strings"
 )
 
 // Typical usage:
@@ -27,15 +30,43 @@ import (
 // urlOfNewItem := upload.Response.Location
 //
 type S3Upload struct {
-	AWSRegion       string
-	ErrorMessage    string
-	UploadInput     *s3manager.UploadInput
-	Response        *s3manager.UploadOutput
+	AWSRegion    string
+	ErrorMessage string
+	UploadInput  *s3manager.UploadInput
+	Response     *s3manager.UploadOutput
+
+	// ExpectedMd5 and ExpectedSha256 are the hex digests the data
+	// should have, usually the ones we calculated at ingest. If
+	// they're set, SendWithSize and SendResumable fail when the data
+	// they read doesn't match, before S3 creates the object.
+	//
+	// S3 checks these itself only for files small enough to go up
+	// in one request. For files uploaded in parts, S3 checks the md5
+	// of each part, and we check the ETag of the object, but nothing
+	// on the S3 side checks the sha256 of the whole object. That
+	// check happens only here, on the data we read.
+	ExpectedMd5    string
+	ExpectedSha256 string
+
+	// Md5Digest and Sha256Digest are the hex digests of the data
+	// SendWithSize or SendResumable sent.
+	Md5Digest    string
+	Sha256Digest string
+
+	// ETag is the ETag S3 should give the object, based on the data
+	// SendWithSize or SendResumable sent. Compare it with the ETag S3
+	// reports, using SameETag, to be sure S3 has what we sent. ETag
+	// is empty if we can't know it, because the provider's ETags are
+	// not md5 digests (see models.StorageProviderConfig.NoMd5ETags),
+	// or because S3 encrypted the object with SSE-KMS.
+	ETag string
+
 	session         *session.Session
 	accessKeyId     string
 	secretAccessKey string
 	partSize        int64
 	concurrency     int
+	md5ETags        bool
 }
 
 // S3_MIN_CHUNK_SIZE is the minimum chunk size that aws-go-sdk
@@ -77,6 +108,7 @@ func NewS3Upload(accessKeyId, secretAccessKey, region, bucket, key, contentType
 		UploadInput:     uploadInput,
 		accessKeyId:     accessKeyId,
 		secretAccessKey: secretAccessKey,
+		md5ETags:        true,
 	}
 }
 
@@ -117,6 +149,13 @@ func (client *S3Upload) AddMetadata(key, value string) {
 // crash due to lack of memory. (Esp. when we're dealing with 1TB files.)
 // See apt_storer for an example.
 func (client *S3Upload) Send(reader io.Reader) {
+	client.SendWithContext(context.Background(), reader)
+}
+
+// SendWithContext is like Send, but it gives up if ctx is cancelled
+// or its deadline passes before the upload completes. The uploader
+// aborts multipart uploads that don't complete.
+func (client *S3Upload) SendWithContext(ctx context.Context, reader io.Reader) {
 	_session := client.GetSession()
 	if _session == nil {
 		return
@@ -124,7 +163,7 @@ func (client *S3Upload) Send(reader io.Reader) {
 	uploader := s3manager.NewUploader(_session)
 	client.UploadInput.Body = reader
 	var err error
-	client.Response, err = uploader.Upload(client.UploadInput)
+	client.Response, err = uploader.UploadWithContext(ctx, client.UploadInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
 	}
@@ -143,6 +182,22 @@ func (client *S3Upload) Send(reader io.Reader) {
 // PT #148913619
 // https://www.pivotaltracker.com/story/show/148913619
 func (client *S3Upload) SendWithSize(reader io.Reader, fileSize int64) {
+	client.SendWithSizeWithContext(context.Background(), reader, fileSize)
+}
+
+// SendWithSizeWithContext is like SendWithSize, but it gives up if ctx
+// is cancelled or its deadline passes before the upload completes.
+//
+// The upload fails if we don't read fileSize bytes from reader, or if
+// ExpectedMd5 or ExpectedSha256 is set and the data doesn't match.
+// When the file fits in one part, we also send ExpectedMd5 and
+// ExpectedSha256 in the Content-MD5 and X-Amz-Content-Sha256 headers,
+// so S3 rejects the object if the data it gets doesn't match. Larger
+// files go up in parts, and the SDK sends those headers for each
+// part, with the digests of the data it read. S3 can't check the
+// sha256 of the whole object in that case. We check it locally, and
+// fail before the upload is completed if it's wrong.
+func (client *S3Upload) SendWithSizeWithContext(ctx context.Context, reader io.Reader, fileSize int64) {
 	chunkSize := (fileSize + int64(1000000)) / int64(10000)
 	if chunkSize < BIG_CHUNK_SIZE {
 		chunkSize = BIG_CHUNK_SIZE
@@ -169,18 +224,55 @@ func (client *S3Upload) SendWithSize(reader io.Reader, fileSize int64) {
 	uploader.PartSize = chunkSize
 	uploader.Concurrency = 2
 
-	client.UploadInput.Body = reader
+	if fileSize < chunkSize {
+		if err := client.setDigestHeaders(uploader); err != nil {
+			client.ErrorMessage = err.Error()
+			return
+		}
+	}
+	verifier := client.newUploadVerifier(fileSize, chunkSize)
+	client.UploadInput.Body = &verifyingReader{reader: reader, verifier: verifier}
 	var err error
-	client.Response, err = uploader.Upload(client.UploadInput)
+	client.Response, err = uploader.UploadWithContext(ctx, client.UploadInput)
 	if err != nil {
 		client.ErrorMessage = err.Error()
+		return
+	}
+	if client.md5ETags {
+		client.ETag = verifier.etag(client.Response.UploadID != "")
+	}
+}
+
+// setDigestHeaders tells S3 to check the ExpectedMd5 and ExpectedSha256
+// of a single-part upload.
+func (client *S3Upload) setDigestHeaders(uploader *s3manager.Uploader) error {
+	if client.ExpectedMd5 != "" {
+		contentMd5, err := hexToBase64(client.ExpectedMd5)
+		if err != nil {
+			return err
+		}
+		client.UploadInput.ContentMD5 = &contentMd5
 	}
+	if client.ExpectedSha256 != "" {
+		uploader.RequestOptions = append(uploader.RequestOptions,
+			request.WithSetRequestHeaders(map[string]string{
+				"X-Amz-Content-Sha256": strings.ToLower(client.ExpectedSha256),
+			}))
+	}
+	return nil
 }
 
 func (client *S3Upload) PartSize() int64 {
 	return client.partSize
 }
 
+// SetPartSize sets the size of the parts SendResumableWithContext
+// sends. Zero, the default, means choose a size based on the size
+// of the file.
+func (client *S3Upload) SetPartSize(partSize int64) {
+	client.partSize = partSize
+}
+
 func (client *S3Upload) Concurrency() int {
 	return client.concurrency
 }
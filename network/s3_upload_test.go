@@ -1,13 +1,22 @@
 package network_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -92,3 +101,54 @@ func TestS3UploadGoodFile(t *testing.T) {
 	upload.Send(file)
 	assert.Equal(t, "", upload.ErrorMessage)
 }
+
+func TestSendWithSizeVerifiesData(t *testing.T) {
+	fake := network.NewFakeS3()
+	defer fake.Close()
+	fake.CreateBucket("preservation")
+	var mutex sync.Mutex
+	headers := make(http.Header)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			mutex.Lock()
+			headers = r.Header.Clone()
+			mutex.Unlock()
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	provider, err := network.NewS3CompatibleStorage("minio", "key", "secret",
+		"us-east-1", server.URL, true, "")
+	require.Nil(t, err)
+	ctx := context.Background()
+	data := []byte("Preservation copy")
+	md5Digest := md5.Sum(data)
+	sha256Digest := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	upload := provider.Put("preservation", "good", "text/plain")
+	upload.ExpectedMd5 = fmt.Sprintf("%x", md5Digest)
+	upload.ExpectedSha256 = sha256Digest
+	upload.SendWithSizeWithContext(ctx, bytes.NewReader(data), int64(len(data)))
+	require.Empty(t, upload.ErrorMessage)
+	assert.Equal(t, upload.ExpectedMd5, upload.Md5Digest)
+	assert.Equal(t, sha256Digest, upload.Sha256Digest)
+	assert.Equal(t, upload.ExpectedMd5, upload.ETag)
+	obj := fake.Object("preservation", "good")
+	require.NotNil(t, obj)
+	assert.True(t, network.SameETag(obj.ETag, upload.ETag))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(md5Digest[:]), headers.Get("Content-MD5"))
+	assert.Equal(t, sha256Digest, headers.Get("X-Amz-Content-Sha256"))
+
+	// This is what happened with the EFS bug.
+	upload = provider.Put("preservation", "empty", "text/plain")
+	upload.ExpectedMd5 = fmt.Sprintf("%x", md5Digest)
+	upload.SendWithSizeWithContext(ctx, bytes.NewReader(nil), int64(len(data)))
+	assert.Contains(t, upload.ErrorMessage, "Read 0 bytes for empty, expected 17")
+	assert.Nil(t, fake.Object("preservation", "empty"))
+
+	upload = provider.Put("preservation", "bad", "text/plain")
+	upload.ExpectedSha256 = sha256Digest
+	upload.SendWithSizeWithContext(ctx, strings.NewReader("Preservation cop!"), int64(len(data)))
+	assert.Contains(t, upload.ErrorMessage, "Data read for bad has sha256")
+	assert.Nil(t, fake.Object("preservation", "bad"))
+}
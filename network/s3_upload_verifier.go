@@ -0,0 +1,167 @@
+package network
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"hash"
+	"io"
+	"strings"
+)
+
+// uploadVerifier calculates the digests of the data an S3Upload sends,
+// and checks them against the upload's ExpectedMd5, ExpectedSha256 and
+// size. It also calculates the ETag S3 should give the object. For a
+// multipart upload, that's the md5 of the md5 digests of the parts,
+// followed by a dash and the number of parts, so we keep the md5 of
+// each part.
+type uploadVerifier struct {
+	client     *S3Upload
+	size       int64
+	partSize   int64
+	bytesRead  int64
+	md5Hash    hash.Hash
+	sha256Hash hash.Hash
+	partHash   hash.Hash
+	partBytes  int64
+	partMd5s   [][]byte
+	finished   bool
+	err        error
+}
+
+// newUploadVerifier returns a verifier for size bytes, sent in parts
+// of partSize bytes. If size is less than zero, the verifier doesn't
+// check the size.
+func (client *S3Upload) newUploadVerifier(size, partSize int64) *uploadVerifier {
+	return &uploadVerifier{
+		client:     client,
+		size:       size,
+		partSize:   partSize,
+		md5Hash:    md5.New(),
+		sha256Hash: sha256.New(),
+		partHash:   md5.New(),
+		partMd5s:   make([][]byte, 0),
+	}
+}
+
+// Write adds p to the digests.
+func (verifier *uploadVerifier) Write(p []byte) (int, error) {
+	n := len(p)
+	verifier.bytesRead += int64(n)
+	verifier.md5Hash.Write(p)
+	verifier.sha256Hash.Write(p)
+	for len(p) > 0 {
+		chunk := int64(len(p))
+		if remaining := verifier.partSize - verifier.partBytes; chunk > remaining {
+			chunk = remaining
+		}
+		verifier.partHash.Write(p[:chunk])
+		verifier.partBytes += chunk
+		p = p[chunk:]
+		if verifier.partBytes == verifier.partSize {
+			verifier.endPart()
+		}
+	}
+	return n, nil
+}
+
+func (verifier *uploadVerifier) endPart() {
+	verifier.partMd5s = append(verifier.partMd5s, verifier.partHash.Sum(nil))
+	verifier.partHash.Reset()
+	verifier.partBytes = 0
+}
+
+// finish sets the client's Md5Digest and Sha256Digest, and returns
+// an error if the data we read is not the data we expected.
+func (verifier *uploadVerifier) finish() error {
+	if verifier.finished {
+		return verifier.err
+	}
+	verifier.finished = true
+	if verifier.partBytes > 0 {
+		verifier.endPart()
+	}
+	client := verifier.client
+	client.Md5Digest = hex.EncodeToString(verifier.md5Hash.Sum(nil))
+	client.Sha256Digest = hex.EncodeToString(verifier.sha256Hash.Sum(nil))
+	key := aws.StringValue(client.UploadInput.Key)
+	if verifier.size >= 0 && verifier.bytesRead != verifier.size {
+		verifier.err = fmt.Errorf("Read %d bytes for %s, expected %d",
+			verifier.bytesRead, key, verifier.size)
+	} else if client.ExpectedMd5 != "" && !strings.EqualFold(client.ExpectedMd5, client.Md5Digest) {
+		verifier.err = fmt.Errorf("Data read for %s has md5 %s, expected %s",
+			key, client.Md5Digest, client.ExpectedMd5)
+	} else if client.ExpectedSha256 != "" && !strings.EqualFold(client.ExpectedSha256, client.Sha256Digest) {
+		verifier.err = fmt.Errorf("Data read for %s has sha256 %s, expected %s",
+			key, client.Sha256Digest, client.ExpectedSha256)
+	}
+	return verifier.err
+}
+
+// etag returns the ETag S3 should give the object, which depends
+// on whether it was uploaded in parts. Call this after finish.
+func (verifier *uploadVerifier) etag(multipart bool) string {
+	if multipart {
+		return multipartETag(verifier.partMd5s)
+	}
+	return verifier.client.Md5Digest
+}
+
+// writePart adds the data of one whole part to the digests, and
+// returns the md5 digest of the part.
+func (verifier *uploadVerifier) writePart(data []byte) []byte {
+	verifier.Write(data)
+	if verifier.partBytes > 0 {
+		verifier.endPart()
+	}
+	return verifier.partMd5s[len(verifier.partMd5s)-1]
+}
+
+// multipartETag returns the ETag S3 gives an object uploaded in
+// parts with the specified md5 digests.
+func multipartETag(partMd5s [][]byte) string {
+	digests := md5.New()
+	for _, partMd5 := range partMd5s {
+		digests.Write(partMd5)
+	}
+	return fmt.Sprintf("%x-%d", digests.Sum(nil), len(partMd5s))
+}
+
+// SameETag returns true if the ETags are the same, ignoring the
+// quotes S3 puts around them.
+func SameETag(etag1, etag2 string) bool {
+	return strings.Trim(etag1, "\"") == strings.Trim(etag2, "\"")
+}
+
+// verifyingReader passes the data it reads through an uploadVerifier.
+// When it reaches the end, it returns the verifier's error, if there
+// is one, instead of io.EOF, so the uploader fails before it finishes
+// the upload, and S3 never gets an object with bad data.
+type verifyingReader struct {
+	reader   io.Reader
+	verifier *uploadVerifier
+}
+
+func (reader *verifyingReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.verifier.Write(p[:n])
+	if err == io.EOF {
+		if verifyErr := reader.verifier.finish(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+// hexToBase64 converts a hex digest, like ExpectedMd5, to base64
+// for the Content-MD5 header.
+func hexToBase64(digest string) (string, error) {
+	data, err := hex.DecodeString(digest)
+	if err != nil {
+		return "", fmt.Errorf("Bad digest '%s': %v", digest, err)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
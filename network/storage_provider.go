@@ -0,0 +1,330 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// StorageTypeAWS is the StorageProviderConfig.Type for
+	// Amazon S3 and Glacier.
+	StorageTypeAWS = "aws"
+
+	// StorageTypeS3 is the StorageProviderConfig.Type for other
+	// services that implement the S3 API.
+	StorageTypeS3 = "s3"
+)
+
+// StorageProvider is a service that holds preservation copies, such
+// as AWS, Wasabi, MinIO or Ceph. Each method returns a client for one
+// kind of request, set up to talk to the provider in the provider's
+// region. Use the clients as you would the ones from NewS3Upload,
+// NewS3Download and friends. For example:
+//
+//	upload := provider.Put(bucket, gf.IngestUUID, gf.FileFormat)
+//	upload.AddMetadata("institution", "test.edu")
+//	upload.SendWithContext(ctx, reader)
+//	if upload.ErrorMessage != "" {
+//	    ... whatever ...
+//	}
+type StorageProvider interface {
+	// Name returns the provider's name, from the config.
+	Name() string
+
+	// Region returns the region the provider's clients use.
+	Region() string
+
+	// Put returns a client that uploads key to bucket.
+	Put(bucket, key, contentType string) *S3Upload
+
+	// Get returns a client that downloads key from bucket to
+	// localPath. See NewS3Download.
+	Get(bucket, key, localPath string, calculateMd5, calculateSha256 bool) *S3Download
+
+	// Head returns a client that gets the metadata of objects
+	// in bucket.
+	Head(bucket string) *S3Head
+
+	// Delete returns a client that deletes keys from bucket.
+	Delete(bucket string, keys []string) *S3ObjectDelete
+
+	// List returns a client that lists the objects in bucket,
+	// maxKeys at a time.
+	List(bucket string, maxKeys int64) *S3ObjectList
+
+	// Restore returns a client that asks for an object in
+	// Glacier or another cold storage tier to be restored.
+	// See NewS3Restore.
+	Restore(bucket, key, tier string, days int64) *S3Restore
+}
+
+// AWSStorage is a StorageProvider for Amazon S3 and Glacier.
+type AWSStorage struct {
+	name            string
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+	noMd5ETags      bool
+}
+
+// NewAWSStorage returns a StorageProvider for the specified AWS
+// region. If accessKeyId and secretAccessKey are empty, the clients
+// get their credentials from the environment.
+func NewAWSStorage(name, accessKeyId, secretAccessKey, region string) *AWSStorage {
+	return &AWSStorage{
+		name:            name,
+		region:          region,
+		accessKeyId:     accessKeyId,
+		secretAccessKey: secretAccessKey,
+	}
+}
+
+// Name returns the provider's name.
+func (storage *AWSStorage) Name() string {
+	return storage.name
+}
+
+// Region returns the AWS region the provider's clients use.
+func (storage *AWSStorage) Region() string {
+	return storage.region
+}
+
+// Put returns a client that uploads key to bucket.
+func (storage *AWSStorage) Put(bucket, key, contentType string) *S3Upload {
+	client := NewS3Upload(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, key, contentType)
+	client.md5ETags = !storage.noMd5ETags
+	return client
+}
+
+// Get returns a client that downloads key from bucket.
+func (storage *AWSStorage) Get(bucket, key, localPath string, calculateMd5, calculateSha256 bool) *S3Download {
+	return NewS3Download(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, key, localPath, calculateMd5, calculateSha256)
+}
+
+// Head returns a client that gets the metadata of objects in bucket.
+func (storage *AWSStorage) Head(bucket string) *S3Head {
+	return NewS3Head(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket)
+}
+
+// Delete returns a client that deletes keys from bucket.
+func (storage *AWSStorage) Delete(bucket string, keys []string) *S3ObjectDelete {
+	return NewS3ObjectDelete(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, keys)
+}
+
+// List returns a client that lists the objects in bucket.
+func (storage *AWSStorage) List(bucket string, maxKeys int64) *S3ObjectList {
+	return NewS3ObjectList(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, maxKeys)
+}
+
+// Restore returns a client that restores key from Glacier.
+func (storage *AWSStorage) Restore(bucket, key, tier string, days int64) *S3Restore {
+	return NewS3Restore(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, key, tier, days)
+}
+
+// S3CompatibleStorage is a StorageProvider for services other than
+// AWS that implement the S3 API, such as Wasabi, MinIO and Ceph.
+// Most of these don't support Restore, since they have no cold
+// storage tier.
+type S3CompatibleStorage struct {
+	name            string
+	region          string
+	endpoint        string
+	pathStyle       bool
+	accessKeyId     string
+	secretAccessKey string
+	httpClient      *http.Client
+	noMd5ETags      bool
+}
+
+// NewS3CompatibleStorage returns a StorageProvider that sends requests
+// to endpoint, which is a URL like https://s3.wasabisys.com. If
+// pathStyle is true, bucket names go in the URL path instead of the
+// host name. If caFile is not empty, it's a PEM file of certificate
+// authorities to trust in addition to the system's. If accessKeyId
+// and secretAccessKey are empty, the clients get their credentials
+// from the environment.
+func NewS3CompatibleStorage(name, accessKeyId, secretAccessKey, region, endpoint string, pathStyle bool, caFile string) (*S3CompatibleStorage, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("Storage provider %s has no endpoint", name)
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("Storage provider %s endpoint '%s' must start with http:// or https://",
+			name, endpoint)
+	}
+	storage := &S3CompatibleStorage{
+		name:            name,
+		region:          region,
+		endpoint:        strings.TrimSuffix(endpoint, "/"),
+		pathStyle:       pathStyle,
+		accessKeyId:     accessKeyId,
+		secretAccessKey: secretAccessKey,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Storage provider %s: %v", name, err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		storage.httpClient = &http.Client{Transport: transport}
+	}
+	return storage, nil
+}
+
+// Name returns the provider's name.
+func (storage *S3CompatibleStorage) Name() string {
+	return storage.name
+}
+
+// Region returns the region the provider's clients use.
+func (storage *S3CompatibleStorage) Region() string {
+	return storage.region
+}
+
+// Endpoint returns the URL of the service.
+func (storage *S3CompatibleStorage) Endpoint() string {
+	return storage.endpoint
+}
+
+// GetSession returns a new session for talking to the service.
+// A transport set with SetS3RoundTripper takes the place of the
+// provider's own, including any CA file.
+func (storage *S3CompatibleStorage) GetSession() *session.Session {
+	creds := credentials.NewEnvCredentials()
+	if storage.accessKeyId != "" && storage.secretAccessKey != "" {
+		creds = credentials.NewStaticCredentials(storage.accessKeyId, storage.secretAccessKey, "")
+	}
+	awsConfig := &aws.Config{
+		Region:           aws.String(storage.region),
+		Endpoint:         aws.String(storage.endpoint),
+		S3ForcePathStyle: aws.Bool(storage.pathStyle),
+		Credentials:      creds,
+	}
+	if storage.httpClient != nil {
+		awsConfig.HTTPClient = storage.httpClient
+	}
+	if httpClient := s3HTTPClient(); httpClient != nil {
+		awsConfig.HTTPClient = httpClient
+	}
+	return session.New(awsConfig)
+}
+
+// Put returns a client that uploads key to bucket.
+func (storage *S3CompatibleStorage) Put(bucket, key, contentType string) *S3Upload {
+	client := NewS3Upload(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, key, contentType)
+	client.session = storage.GetSession()
+	client.md5ETags = !storage.noMd5ETags
+	return client
+}
+
+// Get returns a client that downloads key from bucket.
+func (storage *S3CompatibleStorage) Get(bucket, key, localPath string, calculateMd5, calculateSha256 bool) *S3Download {
+	client := NewS3Download(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, key, localPath, calculateMd5, calculateSha256)
+	client.session = storage.GetSession()
+	return client
+}
+
+// Head returns a client that gets the metadata of objects in bucket.
+func (storage *S3CompatibleStorage) Head(bucket string) *S3Head {
+	client := NewS3Head(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket)
+	client.session = storage.GetSession()
+	return client
+}
+
+// Delete returns a client that deletes keys from bucket.
+func (storage *S3CompatibleStorage) Delete(bucket string, keys []string) *S3ObjectDelete {
+	client := NewS3ObjectDelete(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, keys)
+	client.session = storage.GetSession()
+	return client
+}
+
+// List returns a client that lists the objects in bucket.
+func (storage *S3CompatibleStorage) List(bucket string, maxKeys int64) *S3ObjectList {
+	client := NewS3ObjectList(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, maxKeys)
+	client.session = storage.GetSession()
+	return client
+}
+
+// Restore returns a client that asks the service to restore key
+// from cold storage, for services that support it.
+func (storage *S3CompatibleStorage) Restore(bucket, key, tier string, days int64) *S3Restore {
+	client := NewS3Restore(storage.accessKeyId, storage.secretAccessKey,
+		storage.region, bucket, key, tier, days)
+	client.session = storage.GetSession()
+	return client
+}
+
+// StorageProviderFromConfig returns the StorageProvider described by
+// config, for buckets in region. If config.Region is set, it overrides
+// region. Credentials come from the environment variables named in
+// config.
+func StorageProviderFromConfig(name string, config models.StorageProviderConfig, region string) (StorageProvider, error) {
+	keyIdVar := config.AccessKeyIdVar
+	if keyIdVar == "" {
+		keyIdVar = "AWS_ACCESS_KEY_ID"
+	}
+	secretVar := config.SecretAccessKeyVar
+	if secretVar == "" {
+		secretVar = "AWS_SECRET_ACCESS_KEY"
+	}
+	if config.Region != "" {
+		region = config.Region
+	}
+	switch config.Type {
+	case "", StorageTypeAWS:
+		if config.Endpoint != "" || config.PathStyle || config.CAFile != "" {
+			return nil, fmt.Errorf("Storage provider %s: Endpoint, PathStyle and CAFile "+
+				"are only for type %s", name, StorageTypeS3)
+		}
+		storage := NewAWSStorage(name, os.Getenv(keyIdVar), os.Getenv(secretVar), region)
+		storage.noMd5ETags = config.NoMd5ETags
+		return storage, nil
+	case StorageTypeS3:
+		storage, err := NewS3CompatibleStorage(name, os.Getenv(keyIdVar), os.Getenv(secretVar),
+			region, config.Endpoint, config.PathStyle, config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		storage.noMd5ETags = config.NoMd5ETags
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("Storage provider %s has unknown type '%s'", name, config.Type)
+	}
+}
+
+// loadCertPool returns the system's certificate authorities,
+// plus those in the PEM file caFile.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read CA file: %v", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA file %s has no certificates", caFile)
+	}
+	return pool, nil
+}
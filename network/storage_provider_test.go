@@ -0,0 +1,194 @@
+package network_test
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fakeS3Storage(t *testing.T) (*network.FakeS3, network.StorageProvider) {
+	fake := network.NewFakeS3()
+	fake.CreateBucket("preservation")
+	provider, err := network.NewS3CompatibleStorage("minio", "key", "secret",
+		"us-east-1", fake.URL, true, "")
+	require.Nil(t, err)
+	return fake, provider
+}
+
+func TestS3CompatibleStorage(t *testing.T) {
+	fake, provider := fakeS3Storage(t)
+	defer fake.Close()
+	assert.Equal(t, "minio", provider.Name())
+	assert.Equal(t, "us-east-1", provider.Region())
+	ctx := context.Background()
+	data := "Preservation copy"
+
+	upload := provider.Put("preservation", "uuid-1", "text/plain")
+	upload.AddMetadata("institution", "test.edu")
+	upload.SendWithContext(ctx, strings.NewReader(data))
+	require.Empty(t, upload.ErrorMessage)
+	assert.Equal(t, fake.URL+"/preservation/uuid-1", upload.Response.Location)
+	obj := fake.Object("preservation", "uuid-1")
+	require.NotNil(t, obj)
+	assert.Equal(t, data, string(obj.Data))
+	assert.Equal(t, "text/plain", obj.ContentType)
+	assert.Equal(t, "test.edu", obj.Metadata["institution"])
+	fake.PutObject("preservation", "uuid-2", []byte("Another file"))
+
+	head := provider.Head("preservation")
+	head.HeadWithContext(ctx, "uuid-1")
+	require.Empty(t, head.ErrorMessage)
+	assert.EqualValues(t, len(data), *head.Response.ContentLength)
+	assert.Equal(t, "test.edu", *head.Response.Metadata["Institution"])
+
+	tempDir, err := ioutil.TempDir("", "storage_provider_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	localPath := filepath.Join(tempDir, "uuid-1")
+	download := provider.Get("preservation", "uuid-1", localPath, true, true)
+	download.FetchWithContext(ctx)
+	require.Empty(t, download.ErrorMessage)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte(data))), download.Md5Digest)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte(data))), download.Sha256Digest)
+	saved, err := ioutil.ReadFile(localPath)
+	require.Nil(t, err)
+	assert.Equal(t, data, string(saved))
+
+	download = provider.Get("preservation", "no-such-uuid", os.DevNull, false, true)
+	download.FetchWithContext(ctx)
+	assert.Contains(t, download.ErrorMessage, "NoSuchKey")
+
+	list := provider.List("preservation", 1)
+	list.GetListWithContext(ctx, "uuid")
+	require.Empty(t, list.ErrorMessage)
+	require.Equal(t, 1, len(list.Response.Contents))
+	assert.Equal(t, "uuid-1", *list.Response.Contents[0].Key)
+	assert.EqualValues(t, len(data), *list.Response.Contents[0].Size)
+	assert.True(t, *list.Response.IsTruncated)
+	list.GetListWithContext(ctx, "uuid")
+	require.Equal(t, 1, len(list.Response.Contents))
+	assert.Equal(t, "uuid-2", *list.Response.Contents[0].Key)
+
+	restore := provider.Restore("preservation", "uuid-1", "Bulk", 5)
+	restore.RestoreWithContext(ctx)
+	assert.True(t, restore.RequestAccepted())
+	assert.True(t, fake.Object("preservation", "uuid-1").RestoreRequested)
+
+	deleter := provider.Delete("preservation", []string{"uuid-1", "uuid-2"})
+	deleter.DeleteListWithContext(ctx)
+	require.Empty(t, deleter.ErrorMessage)
+	assert.Empty(t, fake.Keys("preservation"))
+
+	upload = provider.Put("no-such-bucket", "uuid-3", "")
+	upload.SendWithContext(ctx, strings.NewReader(data))
+	assert.Contains(t, upload.ErrorMessage, "NoSuchBucket")
+}
+
+func TestNewS3CompatibleStorage(t *testing.T) {
+	_, err := network.NewS3CompatibleStorage("wasabi", "key", "secret", "us-east-1", "", false, "")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "has no endpoint")
+	_, err = network.NewS3CompatibleStorage("wasabi", "key", "secret", "us-east-1", "s3.wasabisys.com", false, "")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "must start with http:// or https://")
+	_, err = network.NewS3CompatibleStorage("ceph", "key", "secret", "", "https://ceph.local", true, "/no/such/ca.pem")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Cannot read CA file")
+
+	caFile, err := ioutil.TempFile("", "storage_provider_ca")
+	require.Nil(t, err)
+	defer os.Remove(caFile.Name())
+	caFile.WriteString("not a certificate")
+	caFile.Close()
+	_, err = network.NewS3CompatibleStorage("ceph", "key", "secret", "", "https://ceph.local", true, caFile.Name())
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "has no certificates")
+}
+
+func TestStorageProviderFromConfig(t *testing.T) {
+	provider, err := network.StorageProviderFromConfig("aws", models.StorageProviderConfig{}, constants.AWSOregon)
+	require.Nil(t, err)
+	assert.IsType(t, &network.AWSStorage{}, provider)
+	assert.Equal(t, constants.AWSOregon, provider.Region())
+	assert.Equal(t, constants.AWSOregon, provider.Put("bucket", "key", "").AWSRegion)
+
+	os.Setenv("WASABI_KEY_ID", "wasabi-key")
+	os.Setenv("WASABI_SECRET", "wasabi-secret")
+	defer os.Unsetenv("WASABI_KEY_ID")
+	defer os.Unsetenv("WASABI_SECRET")
+	provider, err = network.StorageProviderFromConfig("wasabi", models.StorageProviderConfig{
+		Type:               "s3",
+		Endpoint:           "https://s3.wasabisys.com/",
+		Region:             "us-east-2",
+		AccessKeyIdVar:     "WASABI_KEY_ID",
+		SecretAccessKeyVar: "WASABI_SECRET",
+	}, constants.AWSVirginia)
+	require.Nil(t, err)
+	require.IsType(t, &network.S3CompatibleStorage{}, provider)
+	assert.Equal(t, "wasabi", provider.Name())
+	assert.Equal(t, "us-east-2", provider.Region())
+	s3Compatible := provider.(*network.S3CompatibleStorage)
+	assert.Equal(t, "https://s3.wasabisys.com", s3Compatible.Endpoint())
+	creds, err := s3Compatible.GetSession().Config.Credentials.Get()
+	require.Nil(t, err)
+	assert.Equal(t, "wasabi-key", creds.AccessKeyID)
+	assert.Equal(t, "wasabi-secret", creds.SecretAccessKey)
+
+	_, err = network.StorageProviderFromConfig("minio", models.StorageProviderConfig{Type: "s3"}, "")
+	require.NotNil(t, err)
+	_, err = network.StorageProviderFromConfig("aws", models.StorageProviderConfig{PathStyle: true}, "")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "only for type s3")
+	_, err = network.StorageProviderFromConfig("tape", models.StorageProviderConfig{Type: "tape"}, "")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unknown type 'tape'")
+}
+
+func TestStorageProviderFromConfig_NoMd5ETags(t *testing.T) {
+	fake := network.NewFakeS3()
+	defer fake.Close()
+	fake.CreateBucket("preservation")
+	os.Setenv("CEPH_KEY_ID", "ceph-key")
+	os.Setenv("CEPH_SECRET", "ceph-secret")
+	defer os.Unsetenv("CEPH_KEY_ID")
+	defer os.Unsetenv("CEPH_SECRET")
+	config := models.StorageProviderConfig{
+		Type:               "s3",
+		Endpoint:           fake.URL,
+		PathStyle:          true,
+		AccessKeyIdVar:     "CEPH_KEY_ID",
+		SecretAccessKeyVar: "CEPH_SECRET",
+		NoMd5ETags:         true,
+	}
+	provider, err := network.StorageProviderFromConfig("ceph", config, "us-east-1")
+	require.Nil(t, err)
+	data := "Preservation copy"
+
+	// Uploads still work, but they can't tell us what ETag
+	// the object should have.
+	upload := provider.Put("preservation", "small", "text/plain")
+	upload.SendWithSizeWithContext(context.Background(), strings.NewReader(data), int64(len(data)))
+	require.Empty(t, upload.ErrorMessage)
+	assert.NotEmpty(t, upload.Md5Digest)
+	assert.Empty(t, upload.ETag)
+	assert.NotNil(t, fake.Object("preservation", "small"))
+
+	config.NoMd5ETags = false
+	provider, err = network.StorageProviderFromConfig("ceph", config, "us-east-1")
+	require.Nil(t, err)
+	upload = provider.Put("preservation", "small", "text/plain")
+	upload.SendWithSizeWithContext(context.Background(), strings.NewReader(data), int64(len(data)))
+	require.Empty(t, upload.ErrorMessage)
+	assert.Equal(t, upload.Md5Digest, upload.ETag)
+}
@@ -12,7 +12,7 @@ import (
 )
 
 func main() {
-	pathToConfigFile, pathToOutFile, preserveAttrs := parseCommandLine()
+	pathToConfigFile, pathToOutFile, preserveAttrs, workers, format := parseCommandLine()
 	configAbsPath, err := filepath.Abs(pathToConfigFile)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -33,6 +33,9 @@ func main() {
 		fmt.Fprintln(os.Stderr, "Error creating validator: ", err.Error())
 		os.Exit(common.EXIT_RUNTIME_ERR)
 	}
+	if workers > 0 {
+		validator.HashWorkers = workers
+	}
 	summary, err := validator.Validate()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "The validator encountered an error: ", err.Error())
@@ -41,19 +44,50 @@ func main() {
 	exitCode := common.EXIT_OK
 	if summary.HasErrors() {
 		cleanup(validator.DBName())
-		fmt.Println("Bag is not valid")
-		fmt.Println(summary.AllErrorsAsString())
 		exitCode = common.EXIT_BAG_INVALID
-	} else {
-		fmt.Println("Bag is valid")
+	}
+	err = printReport(validator, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error formatting validation report: ", err.Error())
+		os.Exit(common.EXIT_RUNTIME_ERR)
 	}
 	if pathToOutFile != "" {
 		printOutput(validator, pathToOutFile)
 	}
 	cleanup(validator.DBName())
+	cleanupFetchDir(validator)
 	os.Exit(exitCode)
 }
 
+// printReport prints the validation results to stdout, as plain text,
+// JSON or JUnit XML.
+func printReport(validator *validation.Validator, format string) error {
+	var data []byte
+	var err error
+	switch format {
+	case "json":
+		data, err = validator.Report().ToJson()
+	case "junit":
+		data, err = validator.Report().ToJUnitXml()
+	default:
+		report := validator.Report()
+		if report.Valid {
+			fmt.Println("Bag is valid")
+		} else {
+			fmt.Println("Bag is not valid")
+			for _, finding := range report.Errors() {
+				fmt.Println(finding.Message)
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
 func printOutput(validator *validation.Validator, pathToOutFile string) {
 	file, err := os.Create(pathToOutFile)
 	if err != nil {
@@ -77,12 +111,24 @@ func cleanup(filePath string) {
 	}
 }
 
-func parseCommandLine() (pathToConfigFile, pathToOutFile string, preserveAttrs bool) {
+// cleanupFetchDir deletes files the validator downloaded from
+// the URLs in fetch.txt.
+func cleanupFetchDir(validator *validation.Validator) {
+	fetchDir := validator.FetchDir()
+	if validator.FetchResolver != nil && fileutil.FileExists(fetchDir) &&
+		fileutil.LooksSafeToDelete(fetchDir, 12, 3) {
+		os.RemoveAll(fetchDir)
+	}
+}
+
+func parseCommandLine() (pathToConfigFile, pathToOutFile string, preserveAttrs bool, workers int, format string) {
 	var help bool
 	var version bool
 	flag.StringVar(&pathToConfigFile, "config", "", "Path to bag validation config file")
 	flag.StringVar(&pathToOutFile, "outfile", "", "Path to file for dumping JSON output")
 	flag.BoolVar(&preserveAttrs, "attrs", false, "Preserve attributes")
+	flag.IntVar(&workers, "workers", 0, "Number of goroutines for calculating checksums")
+	flag.StringVar(&format, "format", "text", "Output format: text, json or junit")
 	flag.BoolVar(&help, "help", false, "Show help")
 	flag.BoolVar(&version, "version", false, "Show version")
 
@@ -92,11 +138,16 @@ func parseCommandLine() (pathToConfigFile, pathToOutFile string, preserveAttrs b
 		fmt.Println(common.GetVersion())
 		os.Exit(common.EXIT_NO_OP)
 	}
+	if format != "text" && format != "json" && format != "junit" {
+		fmt.Fprintf(os.Stderr, "Invalid format '%s'. Use text, json or junit.\n", format)
+		printUsage()
+		os.Exit(common.EXIT_USER_ERR)
+	}
 	if help || pathToConfigFile == "" || flag.Arg(0) == "" {
 		printUsage()
 		os.Exit(common.EXIT_USER_ERR)
 	}
-	return pathToConfigFile, pathToOutFile, preserveAttrs
+	return pathToConfigFile, pathToOutFile, preserveAttrs, workers, format
 }
 
 // Tell the user about the program.
@@ -108,7 +159,9 @@ Usage:
 
 apt_validate --config=<config_file> \
              [--attrs=<true|false>] \
+             [--format=<text|json|junit>] \
              [--outfile=<path_to_output_file>] \
+             [--workers=<n>] \
              path_to_bag
 
 apt_validate --help
@@ -126,7 +179,17 @@ the validator.
 --config is required and should be the path to a bag validation
 config file that describes the validation rules. An example can be found at
 https://github.com/APTrust/exchange/blob/master/config/aptrust_bag_validation_config.json
-but the config file must exist on the local drive.
+but the config file must exist on the local drive. This may also be
+a standard BagIt-Profile, as described in version 1.3 of the spec at
+https://bagit-profiles.github.io/bagit-profiles-specification/
+
+--format option is not required. It sets the format of the validation
+results printed to stdout. The default, text, prints "Bag is valid" or
+"Bag is not valid" followed by a list of errors. json prints a report
+with a structured list of findings, including the file, manifest, line
+number and expected and actual digests where they apply. junit prints
+the same findings as JUnit XML, which most CI systems can display.
+Exit codes are the same for all formats.
 
 --help prints this help message and exits.
 
@@ -137,6 +200,11 @@ to debug your bagging process.
 
 --version prints version info and exits.
 
+--workers option is not required. It sets the number of files the
+validator will checksum at once when validating an untarred bag.
+The default is the number of CPUs. Tarred bags are always read one
+file at a time.
+
 Arguments
 
 The path_to_bag parameter is required. It should be the absolute path
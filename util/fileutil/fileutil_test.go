@@ -182,6 +182,14 @@ func TestGetChecksum(t *testing.T) {
 	require.Nil(t, err)
 	assert.Equal(t, "24f4ea194115efa3e8a9bd229cbfa7ac23ded35917af6bd2ec24ffcb1a067f55", sha256)
 
+	sha1, err := fileutil.CalculateChecksum(filePath, constants.AlgSha1)
+	require.Nil(t, err)
+	assert.Equal(t, "d82021489462a99ec18b7c5ca0a7c4ce14760238", sha1)
+
+	sha512, err := fileutil.CalculateChecksum(filePath, constants.AlgSha512)
+	require.Nil(t, err)
+	assert.Equal(t, "28c929a4f101199028f97640fb7c44fb7d111650e496db0bf2166e579d0984cda38d169d3b1da65b461e0cdb6408800574ec08aa504ac0c5d6f32b0994c21e9e", sha512)
+
 	_, err = fileutil.CalculateChecksum(filePath, "fake_algorithm")
 	require.NotNil(t, err)
 
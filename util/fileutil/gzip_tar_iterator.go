@@ -0,0 +1,52 @@
+package fileutil
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+)
+
+// GzipTarIterator lets us read gzipped tar files (.tar.gz or .tgz)
+// without having to unzip or untar them. It works just like the
+// TarFileIterator, and has the same limitation: it's forward-only.
+//
+// Unlike a plain tar file, a gzipped tar file can't skip over the
+// files it doesn't return. Find and Next decompress every byte that
+// comes before the file you want, so using a new iterator to Find
+// each of n files in a bag reads the archive n times. To read many
+// files, walk the archive once with Next(), or call Find on the same
+// iterator for files in the order they appear in the archive.
+type GzipTarIterator struct {
+	*TarFileIterator
+	gzipReader *gzip.Reader
+}
+
+// NewGzipTarIterator returns a new GzipTarIterator. Param pathToFile
+// should be an absolute path to the .tar.gz or .tgz file.
+func NewGzipTarIterator(pathToFile string) (*GzipTarIterator, error) {
+	file, err := os.Open(pathToFile)
+	if err != nil {
+		return nil, err
+	}
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &GzipTarIterator{
+		TarFileIterator: &TarFileIterator{
+			tarReader:        tar.NewReader(gzipReader),
+			file:             file,
+			topLevelDirNames: make([]string, 0),
+		},
+		gzipReader: gzipReader,
+	}, nil
+}
+
+// Close closes the gzip reader and the underlying file.
+func (iter *GzipTarIterator) Close() {
+	if iter.gzipReader != nil {
+		iter.gzipReader.Close()
+	}
+	iter.TarFileIterator.Close()
+}
@@ -0,0 +1,108 @@
+package fileutil_test
+
+import (
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func unitTestBagPath(bagName string) string {
+	_, filename, _, _ := runtime.Caller(0)
+	absPath, _ := filepath.Abs(path.Join(filepath.Dir(filename),
+		"..", "..", "testdata", "unit_test_bags", bagName))
+	return absPath
+}
+
+// readAll reads every file from the iterator, and returns a map
+// of relative paths to file contents for the regular files.
+func readAll(t *testing.T, iter fileutil.ReadIterator) map[string]string {
+	files := make(map[string]string)
+	for {
+		reader, fileSummary, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		require.NotNil(t, fileSummary)
+		if fileSummary.IsRegularFile {
+			data, err := ioutil.ReadAll(reader)
+			require.Nil(t, err)
+			assert.EqualValues(t, len(data), fileSummary.Size, fileSummary.RelPath)
+			assert.False(t, fileSummary.ModTime.IsZero())
+			files[fileSummary.RelPath] = string(data)
+		}
+		if reader != nil {
+			reader.Close()
+		}
+	}
+	return files
+}
+
+func TestGzipTarIterator(t *testing.T) {
+	tfi, err := fileutil.NewTarFileIterator(unitTestBagPath("example.edu.tagsample_good.tar"))
+	require.Nil(t, err)
+	defer tfi.Close()
+	expected := readAll(t, tfi)
+
+	for _, bagName := range []string{"example.edu.tagsample_good.tar.gz", "example.edu.tagsample_good.tgz"} {
+		gti, err := fileutil.NewGzipTarIterator(unitTestBagPath(bagName))
+		require.Nil(t, err, bagName)
+		assert.Equal(t, expected, readAll(t, gti), bagName)
+		assert.Equal(t, []string{"example.edu.tagsample_good"}, gti.GetTopLevelDirNames())
+		assert.NotPanics(t, gti.Close)
+		assert.NotPanics(t, gti.Close)
+	}
+
+	// Plain tar file is not gzipped.
+	_, err = fileutil.NewGzipTarIterator(unitTestBagPath("example.edu.tagsample_good.tar"))
+	assert.NotNil(t, err)
+}
+
+func TestGzipTarIteratorFind(t *testing.T) {
+	gti, err := fileutil.NewGzipTarIterator(unitTestBagPath("example.edu.tagsample_good.tar.gz"))
+	require.Nil(t, err)
+	defer gti.Close()
+	readCloser, err := gti.Find("example.edu.tagsample_good/tagmanifest-sha256.txt")
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(readCloser)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, data)
+	readCloser.Close()
+
+	_, err = gti.Find("this-file-does-not-exist")
+	assert.NotNil(t, err)
+}
+
+func TestGzipTarIteratorFindForward(t *testing.T) {
+	gti, err := fileutil.NewGzipTarIterator(unitTestBagPath("example.edu.tagsample_good.tar.gz"))
+	require.Nil(t, err)
+	defer gti.Close()
+
+	// Files that come later in the archive can be found with
+	// the same iterator.
+	for _, name := range []string{"bag-info.txt", "manifest-md5.txt", "data/datastream-MARC"} {
+		readCloser, err := gti.Find("example.edu.tagsample_good/" + name)
+		require.Nil(t, err, name)
+		data, err := ioutil.ReadAll(readCloser)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, data, name)
+		readCloser.Close()
+	}
+
+	// Files we've already passed can't.
+	_, err = gti.Find("example.edu.tagsample_good/bagit.txt")
+	assert.NotNil(t, err)
+}
+
+func TestIsGzippedTar(t *testing.T) {
+	assert.True(t, fileutil.IsGzippedTar("/mnt/bags/bag.tar.gz"))
+	assert.True(t, fileutil.IsGzippedTar("/mnt/bags/bag.tgz"))
+	assert.False(t, fileutil.IsGzippedTar("/mnt/bags/bag.tar"))
+	assert.False(t, fileutil.IsGzippedTar("/mnt/bags/bag.zip"))
+}
@@ -1,12 +1,55 @@
 package fileutil
 
 import (
+	"fmt"
 	"io"
+	"strings"
 )
 
-// ReadIterator is an interface that allows TarFileIterator and
-// FileSystemIterator to be used interchangeably.
+// ReadIterator is an interface that allows TarFileIterator,
+// GzipTarIterator, ZipFileIterator and FileSystemIterator to be
+// used interchangeably.
 type ReadIterator interface {
 	Next() (io.ReadCloser, *FileSummary, error)
 	GetTopLevelDirNames() []string
 }
+
+// ArchiveIterator is a ReadIterator for serialized bags. It can find
+// a single file in the archive, and it must be closed when you're done
+// with it.
+type ArchiveIterator interface {
+	ReadIterator
+	Find(originalPathWithBagName string) (io.ReadCloser, error)
+	Close()
+}
+
+// NewArchiveIterator returns a TarFileIterator, GzipTarIterator or
+// ZipFileIterator, depending on the extension of pathToArchive.
+// Supported extensions are .tar, .tar.gz, .tgz and .zip.
+func NewArchiveIterator(pathToArchive string) (ArchiveIterator, error) {
+	// Check errors here, so we don't return a nil pointer
+	// wrapped in a non-nil interface.
+	var iterator ArchiveIterator
+	var err error
+	switch {
+	case strings.HasSuffix(pathToArchive, ".tar"):
+		iterator, err = NewTarFileIterator(pathToArchive)
+	case IsGzippedTar(pathToArchive):
+		iterator, err = NewGzipTarIterator(pathToArchive)
+	case strings.HasSuffix(pathToArchive, ".zip"):
+		iterator, err = NewZipFileIterator(pathToArchive)
+	default:
+		err = fmt.Errorf("Unsupported archive format: %s", pathToArchive)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return iterator, nil
+}
+
+// IsGzippedTar returns true if pathToArchive has a .tar.gz or .tgz
+// extension. See GzipTarIterator for what it costs to find files in
+// these archives.
+func IsGzippedTar(pathToArchive string) bool {
+	return strings.HasSuffix(pathToArchive, ".tar.gz") || strings.HasSuffix(pathToArchive, ".tgz")
+}
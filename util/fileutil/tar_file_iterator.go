@@ -8,12 +8,20 @@ import (
 	"strings"
 )
 
+// Tar files are written in blocks of this size.
+const tarBlockSize = 512
+
 // TarFileIterator lets us read tarred bags (or any other tarred files)
 // without having to untar them.
 type TarFileIterator struct {
 	tarReader        *tar.Reader
 	file             *os.File
 	topLevelDirNames []string
+	// seekable is true if tarReader reads directly from file,
+	// so that offsets in the file match offsets in the archive.
+	// It's false for gzipped tar files.
+	seekable         bool
+	nextHeaderOffset int64
 }
 
 // NewTarFileIterator returns a new TarFileIterator. Param pathToTarFile
@@ -27,6 +35,7 @@ func NewTarFileIterator(pathToTarFile string) (*TarFileIterator, error) {
 		tarReader:        tar.NewReader(file),
 		file:             file,
 		topLevelDirNames: make([]string, 0),
+		seekable:         true,
 	}, nil
 }
 
@@ -40,6 +49,15 @@ func (iter *TarFileIterator) Next() (io.ReadCloser, *FileSummary, error) {
 		return nil, nil, err
 	}
 	iter.setTopLevelDirName(header.Name)
+	if iter.seekable {
+		// The tar reader has just read the header, so the file
+		// is positioned at the start of this entry's data. Data
+		// is padded out to a full block.
+		dataOffset, err := iter.file.Seek(0, io.SeekCurrent)
+		if err == nil {
+			iter.nextHeaderOffset = dataOffset + (header.Size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+		}
+	}
 	finfo := header.FileInfo()
 	// Path to file, minus the top-level directory name,
 	// which is the name of the bag.
@@ -67,10 +85,13 @@ func (iter *TarFileIterator) Next() (io.ReadCloser, *FileSummary, error) {
 
 // Find returns an open reader for the file with the specified name,
 // or nil if that file cannot be found. Caller is responsible
-// for closing the reader. Note that the iterator is forward-only,
-// which makes it unsuitable for re-use. Create a new iterator each
-// time you want to call Find, and user genericFile.OriginalPathWithBagName()
+// for closing the reader. Use genericFile.OriginalPathWithBagName()
 // to get the originalPath param.
+//
+// Find searches forward from the iterator's current position, so
+// you can call it again on the same iterator to find a file that
+// comes later in the archive. To find a file that comes earlier,
+// create a new iterator.
 func (iter *TarFileIterator) Find(originalPathWithBagName string) (io.ReadCloser, error) {
 	for {
 		header, err := iter.tarReader.Next()
@@ -88,6 +109,36 @@ func (iter *TarFileIterator) Find(originalPathWithBagName string) (io.ReadCloser
 	}
 }
 
+// Offset returns the offset in the tar file of the header that follows
+// the entry most recently returned by Next(). Pass this to SkipTo()
+// on a new iterator to pick up where this one left off. Returns zero
+// before the first call to Next(), and -1 for gzipped tar files,
+// which don't support seeking.
+func (iter *TarFileIterator) Offset() int64 {
+	if !iter.seekable {
+		return -1
+	}
+	return iter.nextHeaderOffset
+}
+
+// SkipTo moves the iterator to the tar header at offset, which should
+// be a value returned by Offset(). The next call to Next() returns the
+// entry at that offset, without reading any of the entries before it.
+// Note that GetTopLevelDirNames() will not include the names of
+// directories in the entries we skipped.
+func (iter *TarFileIterator) SkipTo(offset int64) error {
+	if !iter.seekable {
+		return fmt.Errorf("Cannot skip to offset %d: tar file is not seekable", offset)
+	}
+	_, err := iter.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	iter.tarReader = tar.NewReader(iter.file)
+	iter.nextHeaderOffset = offset
+	return nil
+}
+
 // Keep track of any top-level directory names we encounter.
 // The BagIt spec says a tar file SHOULD untar to a directory with the
 // same name as the tar file, minus the .tar extension. The APTrust
@@ -140,3 +140,37 @@ func TestTFIFind(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Nil(t, readCloser)
 }
+
+func TestTFIOffsetAndSkipTo(t *testing.T) {
+	tarFilePath := unitTestBagPath("example.edu.tagsample_good.tar")
+	tfi, err := fileutil.NewTarFileIterator(tarFilePath)
+	require.Nil(t, err)
+	defer tfi.Close()
+	assert.EqualValues(t, 0, tfi.Offset())
+
+	// Read a few entries, and note where the rest begin.
+	for i := 0; i < 5; i++ {
+		_, _, err = tfi.Next()
+		require.Nil(t, err)
+	}
+	offset := tfi.Offset()
+	assert.True(t, offset > 0)
+	assert.EqualValues(t, 0, offset%512)
+	expected := readAll(t, tfi)
+	require.NotEmpty(t, expected)
+
+	// A new iterator that skips to offset should return the same files.
+	tfi2, err := fileutil.NewTarFileIterator(tarFilePath)
+	require.Nil(t, err)
+	defer tfi2.Close()
+	require.Nil(t, tfi2.SkipTo(offset))
+	assert.Equal(t, offset, tfi2.Offset())
+	assert.Equal(t, expected, readAll(t, tfi2))
+
+	// Gzipped tar files can't seek.
+	gti, err := fileutil.NewGzipTarIterator(unitTestBagPath("example.edu.tagsample_good.tar.gz"))
+	require.Nil(t, err)
+	defer gti.Close()
+	assert.EqualValues(t, -1, gti.Offset())
+	assert.NotNil(t, gti.SkipTo(offset))
+}
@@ -0,0 +1,105 @@
+package fileutil
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ZipFileIterator lets us read zipped bags without having to
+// unzip them.
+type ZipFileIterator struct {
+	zipReader        *zip.ReadCloser
+	index            int
+	topLevelDirNames []string
+}
+
+// NewZipFileIterator returns a new ZipFileIterator. Param pathToZipFile
+// should be an absolute path to the zip file.
+func NewZipFileIterator(pathToZipFile string) (*ZipFileIterator, error) {
+	zipReader, err := zip.OpenReader(pathToZipFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ZipFileIterator{
+		zipReader:        zipReader,
+		topLevelDirNames: make([]string, 0),
+	}, nil
+}
+
+// Next returns an open reader for the next file, along with a FileSummary.
+// Returns io.EOF when it reaches the last file. The caller is responsible
+// for closing the reader.
+func (iter *ZipFileIterator) Next() (io.ReadCloser, *FileSummary, error) {
+	if iter.zipReader == nil || iter.index >= len(iter.zipReader.File) {
+		return nil, nil, io.EOF
+	}
+	zipFile := iter.zipReader.File[iter.index]
+	iter.index += 1
+	iter.setTopLevelDirName(zipFile.Name)
+	finfo := zipFile.FileInfo()
+	// Path to file, minus the top-level directory name,
+	// which is the name of the bag.
+	relPathInArchive := strings.Join(strings.Split(zipFile.Name, "/")[1:], "/")
+	fs := &FileSummary{
+		RelPath:       strings.TrimSuffix(relPathInArchive, "/"),
+		AbsPath:       "",
+		Mode:          finfo.Mode(),
+		Size:          int64(zipFile.UncompressedSize64),
+		ModTime:       zipFile.Modified,
+		IsDir:         finfo.IsDir(),
+		IsRegularFile: finfo.Mode().IsRegular(),
+	}
+	reader, err := zipFile.Open()
+	if err != nil {
+		return nil, fs, err
+	}
+	return reader, fs, nil
+}
+
+// Find returns an open reader for the file with the specified name,
+// or an error if that file cannot be found. Param originalPathWithBagName
+// should include the bag name. E.g. "my_bag/data/photo.jpg". The caller
+// is responsible for closing the reader.
+func (iter *ZipFileIterator) Find(originalPathWithBagName string) (io.ReadCloser, error) {
+	if iter.zipReader != nil {
+		for _, zipFile := range iter.zipReader.File {
+			if zipFile.Name == originalPathWithBagName {
+				return zipFile.Open()
+			}
+		}
+	}
+	return nil, fmt.Errorf("File '%s' not found in archive", originalPathWithBagName)
+}
+
+// Keep track of any top-level directory names we encounter.
+// See the comments on TarFileIterator.setTopLevelDirName.
+func (iter *ZipFileIterator) setTopLevelDirName(name string) {
+	topLevelDir := strings.Split(name, "/")[0]
+	for i := range iter.topLevelDirNames {
+		if iter.topLevelDirNames[i] == topLevelDir {
+			return
+		}
+	}
+	iter.topLevelDirNames = append(iter.topLevelDirNames, topLevelDir)
+}
+
+// GetTopLevelDirNames returns the names of the top level directories to
+// which the zip file expands. As with tar files, we expect one directory
+// whose name matches that of the zip file, minus the .zip extension.
+//
+// Note that you should read the entire zip file before calling
+// this; otherwise, you may not get all the top-level dir names.
+func (iter *ZipFileIterator) GetTopLevelDirNames() []string {
+	return iter.topLevelDirNames
+}
+
+// Close closes the underlying zip file. It's safe to call this
+// more than once.
+func (iter *ZipFileIterator) Close() {
+	if iter.zipReader != nil {
+		iter.zipReader.Close()
+		iter.zipReader = nil
+	}
+}
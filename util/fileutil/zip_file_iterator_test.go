@@ -0,0 +1,58 @@
+package fileutil_test
+
+import (
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"testing"
+)
+
+func TestZipFileIterator(t *testing.T) {
+	tfi, err := fileutil.NewTarFileIterator(unitTestBagPath("example.edu.tagsample_good.tar"))
+	require.Nil(t, err)
+	defer tfi.Close()
+	expected := readAll(t, tfi)
+
+	zfi, err := fileutil.NewZipFileIterator(unitTestBagPath("example.edu.tagsample_good.zip"))
+	require.Nil(t, err)
+	assert.Equal(t, expected, readAll(t, zfi))
+	assert.Equal(t, []string{"example.edu.tagsample_good"}, zfi.GetTopLevelDirNames())
+	assert.NotPanics(t, zfi.Close)
+	assert.NotPanics(t, zfi.Close)
+
+	_, err = fileutil.NewZipFileIterator(unitTestBagPath("example.edu.tagsample_good.tar"))
+	assert.NotNil(t, err)
+}
+
+func TestZipFileIteratorFind(t *testing.T) {
+	zfi, err := fileutil.NewZipFileIterator(unitTestBagPath("example.edu.tagsample_good.zip"))
+	require.Nil(t, err)
+	defer zfi.Close()
+	readCloser, err := zfi.Find("example.edu.tagsample_good/tagmanifest-sha256.txt")
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(readCloser)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, data)
+	readCloser.Close()
+
+	_, err = zfi.Find("this-file-does-not-exist")
+	assert.NotNil(t, err)
+}
+
+func TestNewArchiveIterator(t *testing.T) {
+	for _, bagName := range []string{
+		"example.edu.tagsample_good.tar",
+		"example.edu.tagsample_good.tar.gz",
+		"example.edu.tagsample_good.tgz",
+		"example.edu.tagsample_good.zip",
+	} {
+		iter, err := fileutil.NewArchiveIterator(unitTestBagPath(bagName))
+		require.Nil(t, err, bagName)
+		require.NotNil(t, iter, bagName)
+		iter.Close()
+	}
+	iter, err := fileutil.NewArchiveIterator("/tmp/bag.rar")
+	assert.NotNil(t, err)
+	assert.Nil(t, iter)
+}
@@ -15,6 +15,11 @@ import (
 const FILE_BUCKET = "files"
 const OBJ_BUCKET = "objects"
 
+// META_BUCKET holds bookkeeping data that is neither an
+// IntellectualObject nor a GenericFile, such as the validator's
+// progress through a bag.
+const META_BUCKET = "meta"
+
 // BoltDB represents a bolt database, which is a single-file key-value
 // store. Our validator uses this to track information about the files
 // inside a bag that we're validating. At a minimum, the validator
@@ -58,6 +63,10 @@ func (boltDB *BoltDB) initBuckets() error {
 		if err != nil {
 			return fmt.Errorf("Error creating object bucket: %s", err)
 		}
+		_, err = tx.CreateBucketIfNotExists([]byte(META_BUCKET))
+		if err != nil {
+			return fmt.Errorf("Error creating meta bucket: %s", err)
+		}
 		return nil
 	})
 	return err
@@ -152,6 +161,58 @@ func (boltDB *BoltDB) GetGenericFile(key string) (*models.GenericFile, error) {
 	return gf, err
 }
 
+// SaveMetadata saves a value to the meta bucket. Unlike Save, this
+// never puts anything in the file or object buckets, so metadata does
+// not show up in FileIdentifiers(), FileCount() or DumpJson().
+func (boltDB *BoltDB) SaveMetadata(key string, value interface{}) error {
+	var byteSlice []byte
+	buf := bytes.NewBuffer(byteSlice)
+	encoder := gob.NewEncoder(buf)
+	err := encoder.Encode(value)
+	if err == nil {
+		err = boltDB.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(META_BUCKET))
+			return bucket.Put([]byte(key), buf.Bytes())
+		})
+	}
+	return err
+}
+
+// GetMetadata decodes the metadata with the specified key into
+// value, which should be a pointer. Returns false if key is not found.
+func (boltDB *BoltDB) GetMetadata(key string, value interface{}) (bool, error) {
+	found := false
+	err := boltDB.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(META_BUCKET))
+		data := bucket.Get([]byte(key))
+		if len(data) == 0 {
+			return nil
+		}
+		found = true
+		return gob.NewDecoder(bytes.NewBuffer(data)).Decode(value)
+	})
+	return found, err
+}
+
+// DeleteMetadata deletes the metadata with the specified key.
+func (boltDB *BoltDB) DeleteMetadata(key string) error {
+	return boltDB.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(META_BUCKET)).Delete([]byte(key))
+	})
+}
+
+// DeleteFiles deletes all of the GenericFiles in the database.
+// The IntellectualObject and metadata are not affected.
+func (boltDB *BoltDB) DeleteFiles() error {
+	return boltDB.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(FILE_BUCKET)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket([]byte(FILE_BUCKET))
+		return err
+	})
+}
+
 // ForEach calls the specified function for each key in the database's
 // file bucket.
 func (boltDB *BoltDB) ForEach(fn func(k, v []byte) error) error {
@@ -63,6 +63,50 @@ func TestBoltDB(t *testing.T) {
 	assert.Equal(t, 10, bolt.FileCount())
 
 	assert.Equal(t, "Test Object", bolt.ObjectIdentifier())
+
+	// Deleting the files leaves the object.
+	require.Nil(t, bolt.DeleteFiles())
+	assert.Equal(t, 0, bolt.FileCount())
+	assert.Equal(t, "Test Object", bolt.ObjectIdentifier())
+	require.Nil(t, bolt.Save(gfIdentifier, restoredFile))
+	assert.Equal(t, 1, bolt.FileCount())
+}
+
+func TestBoltDB_Metadata(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "boltdb_test")
+	require.Nil(t, err)
+	defer tempFile.Close()
+	defer os.Remove(tempFile.Name())
+
+	bolt, err := storage.NewBoltDB(tempFile.Name())
+	require.Nil(t, err)
+	defer bolt.Close()
+
+	type progress struct {
+		Offset int64
+		Dirs   []string
+	}
+	saved := progress{Offset: 1024, Dirs: []string{"bag"}}
+	require.Nil(t, bolt.SaveMetadata("progress", saved))
+
+	restored := progress{}
+	found, err := bolt.GetMetadata("progress", &restored)
+	require.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, saved, restored)
+
+	// Metadata is not a file.
+	assert.Equal(t, 0, bolt.FileCount())
+	assert.Empty(t, bolt.FileIdentifiers())
+
+	found, err = bolt.GetMetadata("no such key", &restored)
+	require.Nil(t, err)
+	assert.False(t, found)
+
+	require.Nil(t, bolt.DeleteMetadata("progress"))
+	found, err = bolt.GetMetadata("progress", &restored)
+	require.Nil(t, err)
+	assert.False(t, found)
 }
 
 func TestBoltDB_FileIdentifierBatch(t *testing.T) {
@@ -11,35 +11,27 @@ import (
 	"unicode"
 )
 
-// This is part of a temporary patch to read bucket names from Pharos.
-// This will be properly fixed in the forthcoming preservation-services
-// code, which will replace Exchange. In the following two maps, the
-// key is the bucket name and the value is the institition identifier.
-// For example: "aptrust.receiving.test.edu" = "test.edu"
-var OwnerOfReceivingBucket = make(map[string]string)
-var OwnerOfRestoreBucket = make(map[string]string)
-
-// This map uses institution identifier as key, restoration bucket name
-// as value.
-var RestoreBucketFor = make(map[string]string)
+// BucketOwners tells us which institution owns a bucket. Workers use
+// their context's InstitutionRegistry, which knows the bucket names
+// in Pharos. Functions that take a BucketOwners use the bucket naming
+// rules in OwnerOf if it's nil.
+type BucketOwners interface {
+	// OwnerOf returns the identifier of the institution that owns
+	// the specified bucket.
+	OwnerOf(bucketName string) string
+}
 
 var reManifest *regexp.Regexp = regexp.MustCompile("^manifest-[A-Za-z0-9]+\\.txt$")
 var reTagManifest *regexp.Regexp = regexp.MustCompile("^tagmanifest-[A-Za-z0-9]+\\.txt$")
 var reLegal *regexp.Regexp = regexp.MustCompile("^[A-Za-z0-9\\-_\\.]+$")
 
 // OwnerOf returns the domain name of the institution that owns the
-// specified bucket. For example, if bucketName is 'aptrust.receiving.unc.edu'
-// the return value will be 'unc.edu'.
+// specified bucket, based on the bucket naming rules. For example, if
+// bucketName is 'aptrust.receiving.unc.edu' the return value will be
+// 'unc.edu'. Buckets that don't follow the rules return an empty string.
+// Workers should ask their context's InstitutionRegistry instead, which
+// also knows the bucket names in Pharos.
 func OwnerOf(bucketName string) (institution string) {
-	// If we've loaded authoritative bucket names from
-	// Pharos, use those.
-	if inst, ok := OwnerOfReceivingBucket[bucketName]; ok {
-		return inst
-	}
-	if inst, ok := OwnerOfRestoreBucket[bucketName]; ok {
-		return inst
-	}
-	// Otherwise, fall back to the old method that uses naming patterns.
 	if bucketName == constants.ReceiveTestBucketPrefix+"edu" {
 		// Actual test.edu receiving bucket for production.
 		// Didn't anticipate this case back in 2014. Oops.
@@ -70,12 +62,6 @@ func RestorationBucketFor(institution string, restoreToTestBuckets bool) (bucket
 	if restoreToTestBuckets {
 		return constants.RestoreBucketPrefix + "test." + institution
 	}
-	// If we've loaded authoritative bucket names from
-	// Pharos, use those.
-	if bucket, ok := RestoreBucketFor[institution]; ok {
-		return bucket
-	}
-	// Otherwise, fall back to old pattern-based naming.
 	return constants.RestoreBucketPrefix + institution
 }
 
@@ -88,13 +74,11 @@ func BagNameFromTarFileName(pathToTarFile string) string {
 }
 
 // CleanBagName returns the clean bag name. That's the tar file name minus
-// the tar extension and any ".bagN.ofN" suffix.
+// the serialization extension (.tar, .tar.gz, .tgz or .zip) and any
+// ".bagN.ofN" suffix.
 func CleanBagName(bagName string) string {
-	// Strip the .tar suffix
-	nameWithoutTar := bagName
-	if strings.HasSuffix(bagName, ".tar") {
-		nameWithoutTar = bagName[0 : len(bagName)-4]
-	}
+	// Strip the .tar, .tar.gz, .tgz or .zip suffix
+	nameWithoutTar := constants.SerializedBagSuffix.ReplaceAllString(bagName, "")
 	// Now get rid of the .b001.of200 suffix if this is a multi-part bag.
 	cleanName := constants.MultipartSuffix.ReplaceAll([]byte(nameWithoutTar), []byte(""))
 	return string(cleanName)
@@ -49,6 +49,13 @@ func TestCleanBagName(t *testing.T) {
 		t.Errorf("CleanBagName should have returned '%s', but returned '%s'",
 			expected, actual)
 	}
+	for _, name := range []string{"some.file.tar.gz", "some.file.tgz", "some.file.zip"} {
+		actual = util.CleanBagName(name)
+		if actual != expected {
+			t.Errorf("CleanBagName should have returned '%s', but returned '%s'",
+				expected, actual)
+		}
+	}
 }
 
 func TestMin(t *testing.T) {
@@ -20,6 +20,17 @@ const (
 
 var presenceValues = []string{REQUIRED, OPTIONAL, FORBIDDEN}
 
+// Levels for the optional file name checks. IGNORE turns a check off.
+// WARN adds a warning to the ValidationReport, and ERROR makes the
+// bag invalid.
+const (
+	IGNORE = "ignore"
+	WARN   = "warn"
+	ERROR  = "error"
+)
+
+var checkLevels = []string{IGNORE, WARN, ERROR}
+
 // FileSpec defines whether files at a specified path within
 // the bag are required, optional, or forbidden.
 type FileSpec struct {
@@ -48,6 +59,8 @@ type TagSpec struct {
 	EmptyOK bool
 	// Describes which values are allowed (case-insensitive).
 	AllowedValues []string
+	// NonRepeatable indicates that the tag may appear only once.
+	NonRepeatable bool
 }
 
 // Valid tells you whether this TagSpec is valid.
@@ -90,9 +103,20 @@ type BagValidationConfig struct {
 	// must untar to a directory whose name matches the tar file
 	// name. E.g. Must my_bag.tar untar to a directory called my_tar?
 	TopLevelDirMustMatchBagName bool
+	// VerifyBagSize describes whether we should check the Bag-Size tag
+	// in bag-info.txt against the actual size of the bag. Because
+	// Bag-Size is approximate (e.g. "260 MB"), this check allows
+	// a margin of error. Note that we always check Payload-Oxum,
+	// if it's present.
+	VerifyBagSize bool
 	// Which fixity algorithms should we calculate on tag and
 	// payload files?
 	FixityAlgorithms []string
+	// RequireTagManifest describes whether a valid bag must include
+	// at least one tag manifest, and whether every tag file and payload
+	// manifest must appear in a tag manifest. Whether or not this is set,
+	// we verify the digests of all tag files listed in tag manifests.
+	RequireTagManifest bool
 	// Regex to describe valid file and directory names.
 	// This can also be set to APTRUST to use the standard APTrust
 	// filename pattern defined in constants.APTrustFileNamePattern,
@@ -100,6 +124,44 @@ type BagValidationConfig struct {
 	FileNamePattern string
 	// Regex compiled internally from FileNamePattern.
 	FileNameRegex *regexp.Regexp
+	// ManifestsAllowed lists the digest algorithms of the payload
+	// manifests a bag may contain. E.g. ["md5", "sha256"] means
+	// the bag may not contain manifest-sha1.txt. If this is empty,
+	// all payload manifests are allowed.
+	ManifestsAllowed []string
+	// TagManifestsAllowed is like ManifestsAllowed, for tag manifests.
+	TagManifestsAllowed []string
+	// TagFilesAllowed is a list of glob patterns describing which
+	// tag files a bag may contain. Manifests, tag manifests, bagit.txt,
+	// bag-info.txt and fetch.txt are always allowed. If this is empty,
+	// all tag files are allowed.
+	TagFilesAllowed []string
+	// DataEmpty describes whether the payload must be empty. An empty
+	// payload may contain a single zero-length file.
+	DataEmpty bool
+	// Serialization describes whether a bag must be tarred (REQUIRED),
+	// must not be tarred (FORBIDDEN) or may be either (OPTIONAL).
+	// Empty means OPTIONAL.
+	Serialization string
+	// AcceptSerialization lists the mime types of acceptable
+	// serialized bags, such as "application/x-tar". If this is empty,
+	// all serialization formats are acceptable.
+	AcceptSerialization []string
+	// UnicodeNormalization describes what to do when a manifest
+	// lists a file whose name matches a file in the bag only after
+	// Unicode normalization. E.g. the manifest uses the decomposed
+	// (NFD) form of "café" and the tar file uses the composed (NFC)
+	// form. This can be IGNORE, WARN or ERROR. Empty means IGNORE,
+	// in which case the file is reported as missing from the bag.
+	// With WARN or ERROR, the manifest entry applies to the file
+	// in the bag, so we still verify its checksum.
+	UnicodeNormalization string
+	// CaseCollisions describes what to do when two paths in the bag
+	// differ only in case or Unicode normalization, such as
+	// "Data/A.txt" and "data/a.txt". Those files overwrite one another
+	// when restored to macOS or Windows. This can be IGNORE, WARN or
+	// ERROR. Empty means IGNORE.
+	CaseCollisions string
 }
 
 func NewBagValidationConfig() *BagValidationConfig {
@@ -122,6 +184,27 @@ func (config *BagValidationConfig) ValidateConfig() []error {
 				tagSpec.FilePath))
 		}
 	}
+	for _, alg := range config.FixityAlgorithms {
+		if !util.StringListContains(constants.ChecksumAlgorithms, alg) {
+			errors = append(errors, fmt.Errorf(
+				"FixityAlgorithms includes unsupported algorithm '%s'.", alg))
+		}
+	}
+	if config.Serialization != "" && !ValidPresenceValue(config.Serialization) {
+		errors = append(errors, fmt.Errorf(
+			"Serialization must be one of required, optional or forbidden, not '%s'.",
+			config.Serialization))
+	}
+	if config.UnicodeNormalization != "" && !util.StringListContains(checkLevels, config.UnicodeNormalization) {
+		errors = append(errors, fmt.Errorf(
+			"UnicodeNormalization must be one of ignore, warn or error, not '%s'.",
+			config.UnicodeNormalization))
+	}
+	if config.CaseCollisions != "" && !util.StringListContains(checkLevels, config.CaseCollisions) {
+		errors = append(errors, fmt.Errorf(
+			"CaseCollisions must be one of ignore, warn or error, not '%s'.",
+			config.CaseCollisions))
+	}
 	return errors
 }
 
@@ -148,6 +231,10 @@ func (config *BagValidationConfig) CompileFileNameRegex() error {
 	return err
 }
 
+// LoadBagValidationConfig loads a BagValidationConfig from the JSON file
+// at pathToConfigFile. The file may be one of our own BagValidationConfig
+// documents, or a standard BagIt-Profile, which this translates into
+// a BagValidationConfig.
 func LoadBagValidationConfig(pathToConfigFile string) (*BagValidationConfig, []error) {
 	errors := make([]error, 0)
 	var file []byte
@@ -166,6 +253,9 @@ func LoadBagValidationConfig(pathToConfigFile string) (*BagValidationConfig, []e
 		errors = append(errors, detailedError)
 		return nil, errors
 	}
+	if LooksLikeBagItProfile(file) {
+		return loadBagItProfile(pathToConfigFile, file)
+	}
 	bagValidationConfig := NewBagValidationConfig()
 	err = json.Unmarshal(file, bagValidationConfig)
 	if err != nil {
@@ -175,10 +265,36 @@ func LoadBagValidationConfig(pathToConfigFile string) (*BagValidationConfig, []e
 		errors = append(errors, detailedError)
 		return nil, errors
 	}
+	return bagValidationConfig, compileAndValidate(bagValidationConfig)
+}
+
+// loadBagItProfile parses a BagIt-Profile and translates it into
+// a BagValidationConfig.
+func loadBagItProfile(pathToConfigFile string, data []byte) (*BagValidationConfig, []error) {
+	errors := make([]error, 0)
+	profile, err := BagItProfileFromJson(data)
+	if err != nil {
+		detailedError := fmt.Errorf(
+			"Error parsing JSON from BagIt profile '%s': %v",
+			pathToConfigFile, err)
+		errors = append(errors, detailedError)
+		return nil, errors
+	}
+	errors = profile.Validate()
+	if len(errors) > 0 {
+		return nil, errors
+	}
+	bagValidationConfig := profile.ToBagValidationConfig()
+	return bagValidationConfig, compileAndValidate(bagValidationConfig)
+}
+
+// compileAndValidate validates the config and compiles its
+// file name regex, returning any errors.
+func compileAndValidate(bagValidationConfig *BagValidationConfig) []error {
 	configErrors := bagValidationConfig.ValidateConfig()
 	regexErr := bagValidationConfig.CompileFileNameRegex()
 	if regexErr != nil {
 		configErrors = append(configErrors, regexErr)
 	}
-	return bagValidationConfig, configErrors
+	return configErrors
 }
@@ -0,0 +1,262 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/util"
+	"github.com/APTrust/exchange/util/fileutil"
+	"path"
+	"strings"
+)
+
+// BagItProfileInfo describes the publisher of a BagIt-Profile.
+// See https://bagit-profiles.github.io/bagit-profiles-specification/
+type BagItProfileInfo struct {
+	BagItProfileIdentifier string `json:"BagIt-Profile-Identifier"`
+	BagItProfileVersion    string `json:"BagIt-Profile-Version,omitempty"`
+	ContactEmail           string `json:"Contact-Email,omitempty"`
+	ContactName            string `json:"Contact-Name,omitempty"`
+	ExternalDescription    string `json:"External-Description,omitempty"`
+	SourceOrganization     string `json:"Source-Organization,omitempty"`
+	Version                string `json:"Version,omitempty"`
+}
+
+// BagInfoTagDef describes a single tag in the Bag-Info section
+// of a BagIt-Profile.
+type BagInfoTagDef struct {
+	// Required indicates whether the tag must be present
+	// in bag-info.txt.
+	Required bool `json:"required"`
+	// Values, if not empty, lists the allowed values for
+	// this tag.
+	Values []string `json:"values,omitempty"`
+	// Repeatable indicates whether the tag may appear more
+	// than once. The spec says this defaults to true, so
+	// nil means repeatable.
+	Repeatable *bool `json:"repeatable,omitempty"`
+	// Description is a human-readable description of the tag.
+	Description string `json:"description,omitempty"`
+}
+
+// BagItProfile is a standard BagIt-Profile document, as described
+// in version 1.3 of the BagIt-Profiles spec at
+// https://bagit-profiles.github.io/bagit-profiles-specification/
+//
+// The validator does not work with profiles directly. Call
+// ToBagValidationConfig to translate the profile into a
+// BagValidationConfig.
+type BagItProfile struct {
+	BagItProfileInfo     BagItProfileInfo         `json:"BagIt-Profile-Info"`
+	BagInfo              map[string]BagInfoTagDef `json:"Bag-Info,omitempty"`
+	ManifestsRequired    []string                 `json:"Manifests-Required,omitempty"`
+	ManifestsAllowed     []string                 `json:"Manifests-Allowed,omitempty"`
+	AllowFetchTxt        *bool                    `json:"Allow-Fetch.txt,omitempty"`
+	FetchTxtRequired     bool                     `json:"Fetch.txt-Required,omitempty"`
+	DataEmpty            bool                     `json:"Data-Empty,omitempty"`
+	Serialization        string                   `json:"Serialization,omitempty"`
+	AcceptSerialization  []string                 `json:"Accept-Serialization,omitempty"`
+	AcceptBagItVersion   []string                 `json:"Accept-BagIt-Version"`
+	TagManifestsRequired []string                 `json:"Tag-Manifests-Required,omitempty"`
+	TagManifestsAllowed  []string                 `json:"Tag-Manifests-Allowed,omitempty"`
+	TagFilesRequired     []string                 `json:"Tag-Files-Required,omitempty"`
+	TagFilesAllowed      []string                 `json:"Tag-Files-Allowed,omitempty"`
+}
+
+// BagItProfileFromJson parses a BagIt-Profile from JSON.
+func BagItProfileFromJson(data []byte) (*BagItProfile, error) {
+	profile := &BagItProfile{}
+	err := json.Unmarshal(data, profile)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// LooksLikeBagItProfile returns true if data appears to be a
+// BagIt-Profile document rather than one of our own BagValidationConfig
+// documents. Every BagIt-Profile must have a BagIt-Profile-Info section,
+// and no BagValidationConfig has one.
+func LooksLikeBagItProfile(data []byte) bool {
+	sections := make(map[string]json.RawMessage)
+	err := json.Unmarshal(data, &sections)
+	if err != nil {
+		return false
+	}
+	_, hasProfileInfo := sections["BagIt-Profile-Info"]
+	return hasProfileInfo
+}
+
+// Validate returns a list of problems with the profile itself,
+// as opposed to problems with the bags it describes.
+func (profile *BagItProfile) Validate() []error {
+	errors := make([]error, 0)
+	if profile.BagItProfileInfo.BagItProfileIdentifier == "" {
+		errors = append(errors, fmt.Errorf(
+			"BagIt-Profile-Info is missing BagIt-Profile-Identifier."))
+	}
+	if len(profile.AcceptBagItVersion) == 0 {
+		errors = append(errors, fmt.Errorf(
+			"Profile must list at least one Accept-BagIt-Version."))
+	}
+	if profile.Serialization != "" && !ValidPresenceValue(profile.Serialization) {
+		errors = append(errors, fmt.Errorf(
+			"Serialization must be one of required, optional or forbidden, not '%s'.",
+			profile.Serialization))
+	}
+	if profile.AllowFetchTxt != nil && *profile.AllowFetchTxt == false && profile.FetchTxtRequired {
+		errors = append(errors, fmt.Errorf(
+			"Profile cannot require fetch.txt and also forbid it."))
+	}
+	errors = append(errors, requiredNotAllowed("Manifests", profile.ManifestsRequired, profile.ManifestsAllowed)...)
+	errors = append(errors, requiredNotAllowed("Tag-Manifests", profile.TagManifestsRequired, profile.TagManifestsAllowed)...)
+	for _, tagFile := range profile.TagFilesRequired {
+		if len(profile.TagFilesAllowed) > 0 && !TagFileAllowed(tagFile, profile.TagFilesAllowed) {
+			errors = append(errors, fmt.Errorf(
+				"Tag file '%s' is in Tag-Files-Required but not in Tag-Files-Allowed.", tagFile))
+		}
+	}
+	return errors
+}
+
+// requiredNotAllowed returns an error for each item in required that
+// does not appear in allowed. An empty allowed list means everything
+// is allowed.
+func requiredNotAllowed(section string, required, allowed []string) []error {
+	errors := make([]error, 0)
+	if len(allowed) == 0 {
+		return errors
+	}
+	for _, item := range required {
+		if !util.StringListContains(allowed, item) {
+			errors = append(errors, fmt.Errorf(
+				"'%s' is in %s-Required but not in %s-Allowed.", item, section, section))
+		}
+	}
+	return errors
+}
+
+// ToBagValidationConfig translates the BagIt-Profile into a
+// BagValidationConfig that the Validator can work with.
+func (profile *BagItProfile) ToBagValidationConfig() *BagValidationConfig {
+	config := NewBagValidationConfig()
+	config.AllowMiscTopLevelFiles = true
+	config.AllowMiscDirectories = true
+	config.TopLevelDirMustMatchBagName = true
+
+	// Spec says fetch.txt is allowed unless the profile says otherwise.
+	config.AllowFetchTxt = profile.AllowFetchTxt == nil || *profile.AllowFetchTxt
+	if profile.FetchTxtRequired {
+		config.FileSpecs["fetch.txt"] = FileSpec{Presence: REQUIRED}
+	}
+
+	// Always calculate our own standard digests, plus whatever
+	// the profile requires, so long as we know how to calculate it.
+	config.FixityAlgorithms = append(config.FixityAlgorithms, constants.AlgMd5, constants.AlgSha256)
+	for _, alg := range profile.ManifestsRequired {
+		config.FileSpecs[fmt.Sprintf("manifest-%s.txt", alg)] = FileSpec{Presence: REQUIRED}
+		config.addFixityAlgorithm(alg)
+	}
+	for _, alg := range profile.TagManifestsRequired {
+		config.FileSpecs[fmt.Sprintf("tagmanifest-%s.txt", alg)] = FileSpec{Presence: REQUIRED}
+		config.addFixityAlgorithm(alg)
+	}
+	config.RequireTagManifest = len(profile.TagManifestsRequired) > 0
+	config.ManifestsAllowed = profile.ManifestsAllowed
+	config.TagManifestsAllowed = profile.TagManifestsAllowed
+
+	for _, tagFile := range profile.TagFilesRequired {
+		config.FileSpecs[tagFile] = FileSpec{Presence: REQUIRED}
+	}
+	config.TagFilesAllowed = profile.TagFilesAllowed
+
+	// Every bag must have a bagit.txt, and we have to parse it
+	// to check BagIt-Version.
+	config.FileSpecs["bagit.txt"] = FileSpec{Presence: REQUIRED, ParseAsTagFile: true}
+	config.TagSpecs["BagIt-Version"] = TagSpec{
+		FilePath:      "bagit.txt",
+		Presence:      REQUIRED,
+		AllowedValues: profile.AcceptBagItVersion,
+	}
+
+	bagInfoPresence := OPTIONAL
+	for tagName, tagDef := range profile.BagInfo {
+		presence := OPTIONAL
+		if tagDef.Required {
+			presence = REQUIRED
+			bagInfoPresence = REQUIRED
+		}
+		config.TagSpecs[tagName] = TagSpec{
+			FilePath:      "bag-info.txt",
+			Presence:      presence,
+			EmptyOK:       !tagDef.Required,
+			AllowedValues: tagDef.Values,
+			NonRepeatable: tagDef.Repeatable != nil && *tagDef.Repeatable == false,
+		}
+	}
+	config.FileSpecs["bag-info.txt"] = FileSpec{Presence: bagInfoPresence, ParseAsTagFile: true}
+
+	config.DataEmpty = profile.DataEmpty
+	config.Serialization = strings.ToLower(profile.Serialization)
+	config.AcceptSerialization = profile.AcceptSerialization
+	return config
+}
+
+// addFixityAlgorithm adds alg to the config's FixityAlgorithms if
+// it's not already there and it's one we can calculate.
+func (config *BagValidationConfig) addFixityAlgorithm(alg string) {
+	if util.StringListContains(constants.ChecksumAlgorithms, alg) &&
+		!util.StringListContains(config.FixityAlgorithms, alg) {
+		config.FixityAlgorithms = append(config.FixityAlgorithms, alg)
+	}
+}
+
+// TagFileAllowed returns true if the tag file at relPath matches
+// one of the glob patterns in allowed. A pattern of "*" matches
+// all tag files, including those in subdirectories.
+func TagFileAllowed(relPath string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if pattern == "*" {
+			return true
+		}
+		if matched, _ := path.Match(pattern, relPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Some profiles use mime types for serialization formats that differ
+// from the ones in fileutil.MimeTypes. This maps those to ours.
+var serializationAliases = map[string]string{
+	"application/tar":     "application/x-tar",
+	"application/x-gzip":  "application/gzip",
+	"application/x-zip":   "application/zip",
+	"multipart/x-gzip":    "application/gzip",
+	"multipart/x-tar":     "application/x-tar",
+	"application/x-ustar": "application/x-tar",
+}
+
+// normalizeSerialization returns the canonical mime type for a
+// serialization format listed in Accept-Serialization.
+func normalizeSerialization(mimeType string) string {
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+	if canonical, ok := serializationAliases[mimeType]; ok {
+		return canonical
+	}
+	return mimeType
+}
+
+// serializationMimeType returns the mime type of a serialized bag,
+// based on its file extension.
+func serializationMimeType(pathToBag string) string {
+	lowerPath := strings.ToLower(pathToBag)
+	if strings.HasSuffix(lowerPath, ".tar.gz") || strings.HasSuffix(lowerPath, ".tgz") {
+		return "application/gzip"
+	}
+	ext := strings.TrimPrefix(path.Ext(lowerPath), ".")
+	if mimeType, ok := fileutil.MimeTypes[ext]; ok {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,157 @@
+package validation_test
+
+import (
+	"github.com/APTrust/exchange/util"
+	"github.com/APTrust/exchange/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path"
+	"testing"
+)
+
+func getBagItProfileConfig(t *testing.T) *validation.BagValidationConfig {
+	configFilePath := path.Join("testdata", "json_objects", "bagit_profile.json")
+	conf, errors := validation.LoadBagValidationConfig(configFilePath)
+	require.Empty(t, errors)
+	require.NotNil(t, conf)
+	return conf
+}
+
+func TestLooksLikeBagItProfile(t *testing.T) {
+	assert.True(t, validation.LooksLikeBagItProfile([]byte(`{"BagIt-Profile-Info": {}}`)))
+	assert.False(t, validation.LooksLikeBagItProfile([]byte(`{"FileSpecs": {}}`)))
+	assert.False(t, validation.LooksLikeBagItProfile([]byte(`this is not json`)))
+}
+
+func TestBagItProfileValidate(t *testing.T) {
+	profile, err := validation.BagItProfileFromJson([]byte(`{
+        "BagIt-Profile-Info": {},
+        "Serialization": "sometimes",
+        "Allow-Fetch.txt": false,
+        "Fetch.txt-Required": true,
+        "Manifests-Required": ["sha512"],
+        "Manifests-Allowed": ["md5"],
+        "Tag-Files-Required": ["custom/tags.txt"],
+        "Tag-Files-Allowed": ["other/*"]
+    }`))
+	require.Nil(t, err)
+	errors := profile.Validate()
+	assert.Equal(t, 6, len(errors))
+}
+
+func TestLoadBagValidationConfig_BagItProfile(t *testing.T) {
+	conf := getBagItProfileConfig(t)
+	assert.False(t, conf.AllowFetchTxt)
+	assert.Equal(t, validation.OPTIONAL, conf.Serialization)
+	assert.Equal(t, []string{"application/tar"}, conf.AcceptSerialization)
+	assert.Equal(t, []string{"md5", "sha256"}, conf.ManifestsAllowed)
+	assert.Equal(t, []string{"md5", "sha256"}, conf.TagManifestsAllowed)
+	assert.Equal(t, 4, len(conf.TagFilesAllowed))
+	assert.True(t, util.StringListContains(conf.FixityAlgorithms, "md5"))
+	assert.True(t, util.StringListContains(conf.FixityAlgorithms, "sha256"))
+
+	assert.Equal(t, validation.REQUIRED, conf.FileSpecs["manifest-md5.txt"].Presence)
+	assert.Equal(t, validation.REQUIRED, conf.FileSpecs["tagmanifest-md5.txt"].Presence)
+	assert.True(t, conf.RequireTagManifest)
+	assert.Equal(t, validation.REQUIRED, conf.FileSpecs["aptrust-info.txt"].Presence)
+	assert.Equal(t, validation.REQUIRED, conf.FileSpecs["bagit.txt"].Presence)
+	assert.True(t, conf.FileSpecs["bagit.txt"].ParseAsTagFile)
+	assert.Equal(t, validation.REQUIRED, conf.FileSpecs["bag-info.txt"].Presence)
+	assert.True(t, conf.FileSpecs["bag-info.txt"].ParseAsTagFile)
+
+	bagItVersion := conf.TagSpecs["BagIt-Version"]
+	assert.Equal(t, "bagit.txt", bagItVersion.FilePath)
+	assert.Equal(t, []string{"0.97", "1.0"}, bagItVersion.AllowedValues)
+
+	sourceOrg := conf.TagSpecs["Source-Organization"]
+	assert.Equal(t, "bag-info.txt", sourceOrg.FilePath)
+	assert.Equal(t, validation.REQUIRED, sourceOrg.Presence)
+	assert.False(t, sourceOrg.EmptyOK)
+	assert.True(t, sourceOrg.NonRepeatable)
+
+	groupId := conf.TagSpecs["Bag-Group-Identifier"]
+	assert.Equal(t, validation.OPTIONAL, groupId.Presence)
+	assert.True(t, groupId.EmptyOK)
+	assert.False(t, groupId.NonRepeatable)
+}
+
+func TestTagFileAllowed(t *testing.T) {
+	allowed := []string{"aptrust-info.txt", "custom_tags/*"}
+	assert.True(t, validation.TagFileAllowed("aptrust-info.txt", allowed))
+	assert.True(t, validation.TagFileAllowed("custom_tags/tracked_tag_file.txt", allowed))
+	assert.False(t, validation.TagFileAllowed("junk_file.txt", allowed))
+	assert.False(t, validation.TagFileAllowed("custom_tags/nested/file.txt", allowed))
+	assert.True(t, validation.TagFileAllowed("custom_tags/nested/file.txt", []string{"*"}))
+}
+
+// untrackedTagFileErrors are the errors for the tag files in
+// example.edu.tagsample_good that aren't in its tag manifests.
+// The profile requires a tag manifest, so every tag file must be
+// listed in one.
+var untrackedTagFileErrors = []string{
+	"Tag file 'custom_tags/untracked_tag_file.txt' does not appear in any tag manifest",
+	"Tag file 'junk_file.txt' does not appear in any tag manifest",
+}
+
+func TestValidator_BagItProfile_BagValid(t *testing.T) {
+	conf := getBagItProfileConfig(t)
+	pathToBag := getBagPath(t, "example.edu.tagsample_good.tar")
+	validator, err := validation.NewValidator(pathToBag, conf, false)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.ElementsMatch(t, untrackedTagFileErrors, summary.Errors)
+}
+
+func TestValidator_BagItProfile_AcceptSerialization(t *testing.T) {
+	conf := getBagItProfileConfig(t)
+	conf.AcceptSerialization = []string{"application/x-gzip", "application/zip"}
+	for _, bagName := range []string{"example.edu.tagsample_good.tgz", "example.edu.tagsample_good.zip"} {
+		validator, err := validation.NewValidator(getBagPath(t, bagName), conf, false)
+		require.Nil(t, err)
+		summary, err := validator.Validate()
+		deleteFile(validator.DBName())
+		require.Nil(t, err)
+		assert.ElementsMatch(t, untrackedTagFileErrors, summary.Errors, bagName)
+	}
+}
+
+func TestValidator_BagItProfile_BagInvalid(t *testing.T) {
+	conf := getBagItProfileConfig(t)
+	conf.Serialization = validation.FORBIDDEN
+	conf.AcceptSerialization = []string{"application/zip"}
+	conf.ManifestsAllowed = []string{"md5"}
+	conf.TagFilesAllowed = []string{"aptrust-info.txt"}
+	conf.DataEmpty = true
+	conf.TagSpecs["BagIt-Version"] = validation.TagSpec{
+		FilePath:      "bagit.txt",
+		Presence:      validation.REQUIRED,
+		AllowedValues: []string{"1.0"},
+	}
+	pathToBag := getBagPath(t, "example.edu.tagsample_good.tar")
+	validator, err := validation.NewValidator(pathToBag, conf, false)
+	require.Nil(t, err)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	require.True(t, summary.HasErrors())
+
+	expected := []string{
+		"Bag must not be serialized, but it's a file.",
+		"Bag serialization 'application/x-tar' is not one of the accepted formats: application/zip.",
+		"Payload manifest 'manifest-sha256.txt' is not allowed. Allowed algorithms: md5.",
+		"Tag 'BagIt-Version' has illegal value '0.97'.",
+		"Payload must be empty, but it contains 4 files totalling 13821 bytes.",
+		"Tag file 'custom_tag_file.txt' is not in the list of allowed tag files.",
+		"Tag file 'junk_file.txt' is not in the list of allowed tag files.",
+		"Tag file 'custom_tags/tracked_file_custom.xml' is not in the list of allowed tag files.",
+		"Tag file 'custom_tags/tracked_tag_file.txt' is not in the list of allowed tag files.",
+		"Tag file 'custom_tags/untracked_tag_file.txt' is not in the list of allowed tag files.",
+	}
+	expected = append(expected, untrackedTagFileErrors...)
+	for _, msg := range expected {
+		assert.True(t, util.StringListContains(summary.Errors, msg), msg)
+	}
+	assert.Equal(t, len(expected), len(summary.Errors), summary.AllErrorsAsString())
+}
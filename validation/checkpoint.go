@@ -0,0 +1,253 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/util/fileutil"
+	"os"
+	"time"
+)
+
+// The validator saves a checkpoint after hashing this many
+// files from a tarred bag.
+const checkpointInterval = 100
+
+// Key of the checkpoint in the validation db's meta bucket.
+const checkpointKey = "hash_checkpoint"
+
+// hashCheckpoint records how far the validator got through a tarred
+// bag. If the validator dies partway through a large bag, the next
+// run can seek directly to Offset, instead of reading through all of
+// the files it has already hashed.
+//
+// We only keep checkpoints when PreserveExtendedAttributes is true,
+// because that's the only time the GenericFile records in the db
+// include file sizes and modification times, which we need to
+// resume safely.
+type hashCheckpoint struct {
+	// BagSize, BagModTime and BagETag describe the tar file when we
+	// saved this checkpoint. If they've changed, we start over.
+	// We ignore BagModTime when we know the bag's ETag, because
+	// the fetcher may have downloaded the same bag again.
+	BagSize    int64
+	BagModTime time.Time
+	BagETag    string
+	// Offset is the offset in the tar file of the first header
+	// after the last file we hashed.
+	Offset int64
+	// TopLevelDirNames are the top-level directories we found in
+	// the part of the tar file before Offset.
+	TopLevelDirNames []string
+}
+
+// initResume figures out whether we can reuse the work of an earlier
+// run that left records in the validation db. Files already hashed on
+// an earlier run won't be hashed again, as long as the bag matches the
+// earlier run's checkpoint, and the files' size and modification time
+// haven't changed. If we can't resume, we clear the old file records,
+// so none of them end up in this run's results.
+func (validator *Validator) initResume() {
+	validator.resumedFiles = make(map[string]bool)
+	validator.checkpoint = nil
+	validator.canResume = false
+	if validator.db.FileCount() > 0 {
+		validator.checkpoint = validator.matchingCheckpoint()
+		validator.canResume = validator.checkpoint != nil
+		if !validator.canResume {
+			validator.db.DeleteMetadata(checkpointKey)
+			if err := validator.db.DeleteFiles(); err != nil {
+				validator.log(fmt.Sprintf("Can't clear old file records for %s: %v",
+					validator.PathToBag, err))
+			}
+		}
+	}
+	// Files on disk are checked one at a time in previouslyHashed,
+	// so the checkpoint for a directory only needs to say which
+	// bag the records belong to.
+	if !validator.isSerialized() {
+		validator.saveCheckpoint(0, nil)
+	}
+}
+
+// matchingCheckpoint returns the checkpoint an earlier run saved,
+// or nil if there isn't one, or if it was saved for a different
+// version of the bag.
+func (validator *Validator) matchingCheckpoint() *hashCheckpoint {
+	if !validator.PreserveExtendedAttributes {
+		return nil
+	}
+	checkpoint := &hashCheckpoint{}
+	found, err := validator.db.GetMetadata(checkpointKey, checkpoint)
+	if err != nil || !found {
+		return nil
+	}
+	stat, err := os.Stat(validator.PathToBag)
+	if err != nil || !checkpoint.describes(stat, validator.BagETag) {
+		// The bag changed since the last run, so we can't
+		// trust any of the checksums we recorded.
+		validator.log(fmt.Sprintf("%s changed since last validation. Starting over.", validator.PathToBag))
+		return nil
+	}
+	return checkpoint
+}
+
+// describes returns true if the checkpoint was saved for the bag
+// with the specified stats and ETag.
+func (checkpoint *hashCheckpoint) describes(stat os.FileInfo, etag string) bool {
+	if stat.Size() != checkpoint.BagSize {
+		return false
+	}
+	if etag != "" && checkpoint.BagETag != "" {
+		return etag == checkpoint.BagETag
+	}
+	return stat.ModTime().Equal(checkpoint.BagModTime)
+}
+
+// resumeFromCheckpoint moves a tar file iterator past the files we
+// hashed on an earlier run, and updates the validator's counts and
+// lists of manifests, etc. to include those files.
+//
+// This does nothing unless every file recorded in the db was hashed
+// with all of the algorithms in the BagValidationConfig. Otherwise,
+// we'd skip files that still need to be hashed.
+func (validator *Validator) resumeFromCheckpoint(iterator fileutil.ReadIterator) {
+	tarIterator, isTar := iterator.(*fileutil.TarFileIterator)
+	if !validator.canResume || validator.checkpoint == nil || !isTar {
+		return
+	}
+	// Read through the db twice, instead of keeping all of
+	// the records in memory. There may be hundreds of thousands.
+	identifiers := validator.db.FileIdentifiers()
+	for _, identifier := range identifiers {
+		gf, err := validator.db.GetGenericFile(identifier)
+		if err != nil || gf == nil || !validator.hasAllDigests(gf) {
+			return
+		}
+	}
+	err := tarIterator.SkipTo(validator.checkpoint.Offset)
+	if err != nil {
+		validator.log(fmt.Sprintf("Can't resume %s at offset %d: %v",
+			validator.PathToBag, validator.checkpoint.Offset, err))
+		return
+	}
+	for _, identifier := range identifiers {
+		gf, err := validator.db.GetGenericFile(identifier)
+		if err != nil || gf == nil || validator.reuseGenericFile(gf) != nil {
+			continue
+		}
+		validator.trackFile(gf, gf.Size)
+		validator.resumedFiles[identifier] = true
+	}
+	validator.log(fmt.Sprintf("Resuming %s at offset %d. %d files were hashed on an earlier run.",
+		validator.PathToBag, validator.checkpoint.Offset, len(identifiers)))
+}
+
+// saveCheckpoint records offset, the iterator's position in a tar file,
+// so a later run can skip the files we've already hashed. Every file
+// before offset must already be saved in the db. Param dirNames holds
+// the top-level directories before offset.
+func (validator *Validator) saveCheckpoint(offset int64, dirNames []string) {
+	if !validator.PreserveExtendedAttributes {
+		return
+	}
+	stat, err := os.Stat(validator.PathToBag)
+	if err != nil {
+		return
+	}
+	checkpoint := &hashCheckpoint{
+		BagSize:          stat.Size(),
+		BagModTime:       stat.ModTime(),
+		BagETag:          validator.BagETag,
+		Offset:           offset,
+		TopLevelDirNames: dirNames,
+	}
+	err = validator.db.SaveMetadata(checkpointKey, checkpoint)
+	if err != nil {
+		validator.log(fmt.Sprintf("Can't save checkpoint for %s: %v", validator.PathToBag, err))
+	}
+}
+
+// topLevelDirNames returns the top-level directory names from the
+// iterator, plus those from the part of the bag we skipped on resume.
+func (validator *Validator) topLevelDirNames(iterator fileutil.ReadIterator) []string {
+	dirNames := iterator.GetTopLevelDirNames()
+	if validator.checkpoint == nil || len(validator.resumedFiles) == 0 {
+		return dirNames
+	}
+	merged := append([]string{}, validator.checkpoint.TopLevelDirNames...)
+	for _, dirName := range dirNames {
+		found := false
+		for _, existing := range merged {
+			if existing == dirName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, dirName)
+		}
+	}
+	return merged
+}
+
+// previouslyHashed returns the GenericFile record for a file hashed
+// on an earlier run, or nil if the file needs to be hashed.
+func (validator *Validator) previouslyHashed(identifier string, fileSummary *fileutil.FileSummary) *models.GenericFile {
+	if !validator.canResume {
+		return nil
+	}
+	gf, err := validator.db.GetGenericFile(identifier)
+	if err != nil || gf == nil {
+		return nil
+	}
+	if gf.Size != fileSummary.Size || !gf.FileModified.Equal(fileSummary.ModTime) ||
+		!validator.hasAllDigests(gf) {
+		return nil
+	}
+	if validator.reuseGenericFile(gf) != nil {
+		return nil
+	}
+	return gf
+}
+
+// reuseGenericFile clears the data an earlier run recorded after
+// hashing gf, such as manifest digests and verification timestamps,
+// so this run starts from the same place it would if it had hashed
+// the file itself. It also clears digests for algorithms that are
+// no longer in the BagValidationConfig. Then it saves gf.
+func (validator *Validator) reuseGenericFile(gf *models.GenericFile) error {
+	gf.IngestManifestMd5 = ""
+	gf.IngestManifestSha1 = ""
+	gf.IngestManifestSha256 = ""
+	gf.IngestManifestSha512 = ""
+	gf.IngestMd5VerifiedAt = time.Time{}
+	gf.IngestSha1VerifiedAt = time.Time{}
+	gf.IngestSha256VerifiedAt = time.Time{}
+	gf.IngestSha512VerifiedAt = time.Time{}
+	if !validator.calculateMd5 {
+		gf.IngestMd5 = ""
+		gf.IngestMd5GeneratedAt = time.Time{}
+	}
+	if !validator.calculateSha1 {
+		gf.IngestSha1 = ""
+		gf.IngestSha1GeneratedAt = time.Time{}
+	}
+	if !validator.calculateSha256 {
+		gf.IngestSha256 = ""
+		gf.IngestSha256GeneratedAt = time.Time{}
+	}
+	if !validator.calculateSha512 {
+		gf.IngestSha512 = ""
+		gf.IngestSha512GeneratedAt = time.Time{}
+	}
+	return validator.db.Save(gf.Identifier, gf)
+}
+
+// hasAllDigests returns true if gf has a digest for each
+// of the algorithms in the BagValidationConfig.
+func (validator *Validator) hasAllDigests(gf *models.GenericFile) bool {
+	return (!validator.calculateMd5 || gf.IngestMd5 != "") &&
+		(!validator.calculateSha1 || gf.IngestSha1 != "") &&
+		(!validator.calculateSha256 || gf.IngestSha256 != "") &&
+		(!validator.calculateSha512 || gf.IngestSha512 != "")
+}
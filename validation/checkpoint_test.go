@@ -0,0 +1,270 @@
+package validation_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/network"
+	"github.com/APTrust/exchange/testhelper"
+	"github.com/APTrust/exchange/util/fileutil"
+	"github.com/APTrust/exchange/util/storage"
+	"github.com/op/go-logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validateAndLoad validates the bag at bagPath, keeping the validation
+// db, and returns the summary and the GenericFile records from the db.
+func validateAndLoad(t *testing.T, bagPath string) (*models.WorkSummary, map[string]*models.GenericFile) {
+	validator := getValidator(t, bagPath, true)
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	db, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	defer db.Close()
+	files := make(map[string]*models.GenericFile)
+	for _, identifier := range db.FileIdentifiers() {
+		gf, err := db.GetGenericFile(identifier)
+		require.Nil(t, err)
+		files[identifier] = gf
+	}
+	return summary, files
+}
+
+// copyTestBag copies a tarred test bag into a temp dir, so tests
+// can modify it. Returns the temp dir and the path to the copy.
+func copyTestBag(t *testing.T, bagName string) (string, string) {
+	tempDir, err := ioutil.TempDir("", "checkpoint_test")
+	require.Nil(t, err)
+	data, err := ioutil.ReadFile(getBagPath(t, bagName))
+	require.Nil(t, err)
+	bagPath := filepath.Join(tempDir, bagName)
+	require.Nil(t, ioutil.WriteFile(bagPath, data, 0644))
+	return tempDir, bagPath
+}
+
+// corruptTarEntry changes the first byte of the file in the tar
+// archive whose name ends with suffix, without changing the size
+// of the tar file.
+func corruptTarEntry(t *testing.T, tarPath, suffix string) {
+	file, err := os.OpenFile(tarPath, os.O_RDWR, 0644)
+	require.Nil(t, err)
+	defer file.Close()
+	tarReader := tar.NewReader(file)
+	for {
+		header, err := tarReader.Next()
+		require.Nil(t, err, "%s not found in %s", suffix, tarPath)
+		if strings.HasSuffix(header.Name, suffix) {
+			offset, err := file.Seek(0, io.SeekCurrent)
+			require.Nil(t, err)
+			b := make([]byte, 1)
+			_, err = file.ReadAt(b, offset)
+			require.Nil(t, err)
+			b[0] ^= 0xff
+			_, err = file.WriteAt(b, offset)
+			require.Nil(t, err)
+			return
+		}
+	}
+}
+
+func TestValidator_ResumeDirectory(t *testing.T) {
+	tempDir, bagPath, err := testhelper.UntarTestBag("example.edu.tagsample_good.tar")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	summary, firstRun := validateAndLoad(t, bagPath)
+	require.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	// Second run should reuse the records from the first,
+	// without hashing the files again.
+	summary, secondRun := validateAndLoad(t, bagPath)
+	require.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+	require.Equal(t, len(firstRun), len(secondRun))
+	for identifier, gf := range firstRun {
+		assert.Equal(t, gf.IngestUUID, secondRun[identifier].IngestUUID, identifier)
+		assert.True(t, gf.IngestMd5GeneratedAt.Equal(secondRun[identifier].IngestMd5GeneratedAt), identifier)
+		assert.Equal(t, gf.IngestManifestMd5, secondRun[identifier].IngestManifestMd5, identifier)
+	}
+
+	// If a file changes, we hash it again.
+	changedFile := filepath.Join(bagPath, "data", "datastream-DC")
+	require.Nil(t, ioutil.WriteFile(changedFile, []byte("Changed"), 0644))
+	summary, thirdRun := validateAndLoad(t, bagPath)
+	assert.True(t, summary.HasErrors())
+	assert.Contains(t, summary.AllErrorsAsString(), "Bad md5 digest for 'data/datastream-DC'")
+	changed := thirdRun["example.edu.tagsample_good/data/datastream-DC"]
+	require.NotNil(t, changed)
+	assert.NotEqual(t, firstRun[changed.Identifier].IngestUUID, changed.IngestUUID)
+}
+
+func TestValidator_ResumeTarFile(t *testing.T) {
+	tempDir, bagPath := copyTestBag(t, "example.edu.tagsample_good.tar")
+	defer os.RemoveAll(tempDir)
+
+	summary, firstRun := validateAndLoad(t, bagPath)
+	require.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	// Change a payload file in a way that doesn't change the size or
+	// modification time of the tar file. The resumed run seeks past all
+	// of the files it hashed on the first run, so it won't notice.
+	stat, err := os.Stat(bagPath)
+	require.Nil(t, err)
+	corruptTarEntry(t, bagPath, "data/datastream-DC")
+	require.Nil(t, os.Chtimes(bagPath, stat.ModTime(), stat.ModTime()))
+
+	summary, secondRun := validateAndLoad(t, bagPath)
+	require.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+	require.Equal(t, len(firstRun), len(secondRun))
+	for identifier, gf := range firstRun {
+		assert.Equal(t, gf.IngestUUID, secondRun[identifier].IngestUUID, identifier)
+		assert.Equal(t, gf.IngestMd5, secondRun[identifier].IngestMd5, identifier)
+	}
+
+	// Once the tar file's modification time changes, we start over
+	// and find the problem.
+	later := stat.ModTime().Add(time.Minute)
+	require.Nil(t, os.Chtimes(bagPath, later, later))
+	summary, _ = validateAndLoad(t, bagPath)
+	assert.True(t, summary.HasErrors())
+	assert.Contains(t, summary.AllErrorsAsString(), "Bad md5 digest for 'data/datastream-DC'")
+}
+
+func TestValidator_NoResumeWithoutExtendedAttributes(t *testing.T) {
+	tempDir, bagPath := copyTestBag(t, "example.edu.tagsample_good.tar")
+	defer os.RemoveAll(tempDir)
+
+	validator := getValidator(t, bagPath, false)
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	require.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	// Without extended attributes, the db doesn't have file sizes
+	// or modification times, so we can't tell whether files changed.
+	// We should hash everything again.
+	stat, err := os.Stat(bagPath)
+	require.Nil(t, err)
+	corruptTarEntry(t, bagPath, "data/datastream-DC")
+	require.Nil(t, os.Chtimes(bagPath, stat.ModTime(), stat.ModTime()))
+	validator = getValidator(t, bagPath, false)
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	assert.Contains(t, summary.AllErrorsAsString(), "Bad md5 digest for 'data/datastream-DC'")
+	assert.True(t, fileutil.FileExists(validator.DBName()))
+}
+
+// crashingLog is a log backend that panics when it sees a message
+// containing crashAt, so tests can stop the validator partway
+// through its work, as if the process died.
+type crashingLog struct {
+	bytes.Buffer
+	crashAt string
+}
+
+func (log *crashingLog) Write(p []byte) (int, error) {
+	if log.crashAt != "" && bytes.Contains(p, []byte(log.crashAt)) {
+		panic("crash")
+	}
+	return log.Buffer.Write(p)
+}
+
+func TestValidator_ResumeAfterRefetch(t *testing.T) {
+	data, err := ioutil.ReadFile(getBagPath(t, "example.edu.tagsample_good.tar"))
+	require.Nil(t, err)
+	fake := network.NewFakeS3()
+	defer fake.Close()
+	etag := strings.Trim(fake.PutObject("receiving", "example.edu.tagsample_good.tar", data).ETag, "\"")
+	provider, err := network.NewS3CompatibleStorage("minio", "key", "secret",
+		"us-east-1", fake.URL, true, "")
+	require.Nil(t, err)
+	tempDir, err := ioutil.TempDir("", "checkpoint_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+	bagPath := filepath.Join(tempDir, "example.edu.tagsample_good.tar")
+	fetch := func() {
+		download := provider.Get("receiving", "example.edu.tagsample_good.tar", bagPath, true, false)
+		download.FetchWithContext(context.Background())
+		require.Empty(t, download.ErrorMessage)
+	}
+	dbPath := ""
+	ingestUUIDs := func() map[string]string {
+		db, err := storage.NewBoltDB(dbPath)
+		require.Nil(t, err)
+		defer db.Close()
+		uuids := make(map[string]string)
+		for _, identifier := range db.FileIdentifiers() {
+			gf, err := db.GetGenericFile(identifier)
+			require.Nil(t, err)
+			uuids[identifier] = gf.IngestUUID
+		}
+		return uuids
+	}
+	validate := func(log *crashingLog) *models.WorkSummary {
+		validator := getValidator(t, bagPath, true)
+		dbPath = validator.DBName()
+		validator.BagETag = etag
+		validator.Logger = logging.MustGetLogger("checkpoint_test")
+		validator.Logger.SetBackend(logging.AddModuleLevel(logging.NewLogBackend(log, "", 0)))
+		summary, err := validator.Validate()
+		require.Nil(t, err)
+		return summary
+	}
+
+	// Fetch the bag, and crash after hashing its files.
+	fetch()
+	earlier := time.Now().Add(-1 * time.Hour)
+	require.Nil(t, os.Chtimes(bagPath, earlier, earlier))
+	assert.Panics(t, func() { validate(&crashingLog{crashAt: "Parsing tag files"}) })
+	firstRun := ingestUUIDs()
+	require.NotEmpty(t, firstRun)
+
+	// After the restart, the fetcher downloads the bag again, which
+	// changes its modification time. The validator should still
+	// pick up where it left off.
+	fetch()
+	stat, err := os.Stat(bagPath)
+	require.Nil(t, err)
+	require.False(t, stat.ModTime().Equal(earlier))
+	log := &crashingLog{}
+	summary := validate(log)
+	require.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+	assert.Contains(t, log.String(), "Resuming "+bagPath)
+	assert.NotContains(t, log.String(), "Starting over")
+	assert.Equal(t, firstRun, ingestUUIDs())
+}
+
+func TestValidator_NoResumeWithoutCheckpoint(t *testing.T) {
+	tempDir, bagPath, err := testhelper.UntarTestBag("example.edu.tagsample_good.tar")
+	require.Nil(t, err)
+	defer os.RemoveAll(tempDir)
+
+	summary, firstRun := validateAndLoad(t, bagPath)
+	require.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	// Without a checkpoint, we can't tell whether the records in
+	// the db came from this bag, so we clear them and start over.
+	validator := getValidator(t, bagPath, true)
+	db, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	require.Nil(t, db.DeleteMetadata("hash_checkpoint"))
+	stale := &models.GenericFile{Identifier: "example.edu.tagsample_good/data/stale.txt"}
+	require.Nil(t, db.Save(stale.Identifier, stale))
+	db.Close()
+
+	summary, secondRun := validateAndLoad(t, bagPath)
+	require.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+	assert.Nil(t, secondRun[stale.Identifier])
+	require.Equal(t, len(firstRun), len(secondRun))
+	for identifier, gf := range firstRun {
+		require.NotNil(t, secondRun[identifier], identifier)
+		assert.NotEqual(t, gf.IngestUUID, secondRun[identifier].IngestUUID, identifier)
+	}
+}
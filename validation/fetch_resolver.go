@@ -0,0 +1,345 @@
+package validation
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/APTrust/exchange/constants"
+	"github.com/APTrust/exchange/network"
+	"github.com/aws/aws-sdk-go/aws"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxUnknownLength is the largest file a FetchResolver will
+// download when fetch.txt doesn't say how long the file is.
+const DefaultMaxUnknownLength = int64(5 * 1024 * 1024 * 1024)
+
+// FetchItem describes a single line of a bag's fetch.txt file.
+type FetchItem struct {
+	// URL is the location of the remote file.
+	URL string
+	// Length is the expected size of the file, in bytes.
+	// This is -1 if fetch.txt says "-", meaning the length
+	// is unknown.
+	Length int64
+	// Path is the path, relative to the bag's root directory,
+	// at which the file belongs. E.g. data/images/photo.jpg.
+	Path string
+}
+
+// ParseFetchTxt parses the contents of a fetch.txt file. Each line
+// should have a URL, a length (or "-") and a relative file path,
+// separated by whitespace. The file path may contain spaces.
+func ParseFetchTxt(reader io.Reader) ([]*FetchItem, error) {
+	items := make([]*FetchItem, 0)
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Unable to parse line %d of fetch.txt: %s", lineNum, line)
+		}
+		var length int64 = -1
+		if fields[1] != "-" {
+			var err error
+			length, err = strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || length < 0 {
+				return nil, fmt.Errorf("Invalid length '%s' on line %d of fetch.txt", fields[1], lineNum)
+			}
+		}
+		// Path is everything after the length, and may contain spaces.
+		afterUrl := strings.TrimSpace(line[len(fields[0]):])
+		filePath := strings.TrimSpace(afterUrl[len(fields[1]):])
+		items = append(items, &FetchItem{
+			URL:    fields[0],
+			Length: length,
+			Path:   filePath,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// FetchResolver downloads the files listed in a bag's fetch.txt.
+// Files are written only inside WorkDir, at the relative path
+// given in fetch.txt, and only if that path is inside the bag's
+// data directory. The resolver supports http, https and s3 URLs.
+//
+// The resolver won't fetch http or https URLs from hosts on loopback,
+// link-local or private networks, such as the EC2 metadata service at
+// 169.254.169.254, unless they're in AllowedHosts. It checks each
+// address it connects to, including after redirects.
+//
+// The resolver does not verify checksums. The Validator adds the
+// downloaded files to the bag and checks them against the manifests,
+// just like files that came in the bag itself.
+type FetchResolver struct {
+	// WorkDir is the directory into which we download remote files.
+	WorkDir string
+	// HttpClient is the client used to fetch http and https URLs.
+	// The default client refuses to connect to private addresses.
+	// A client you substitute won't, unless you make it.
+	HttpClient *http.Client
+	// AllowedHosts are host names or IP addresses we may fetch from,
+	// even though they are on a loopback, link-local or private
+	// network. Names must match the host in the URL exactly.
+	AllowedHosts []string
+	// AWSRegion is the region used to fetch s3 URLs.
+	AWSRegion string
+	// AccessKeyId and SecretAccessKey are the credentials used to
+	// fetch s3 URLs. If these are empty, the AWS library will look
+	// for credentials in the environment.
+	AccessKeyId     string
+	SecretAccessKey string
+	// MaxUnknownLength is the largest file we'll download when
+	// fetch.txt gives "-" as its length. Without a limit, a remote
+	// server could fill up the disk.
+	MaxUnknownLength int64
+}
+
+// NewFetchResolver returns a FetchResolver that downloads files
+// into workDir.
+func NewFetchResolver(workDir string) *FetchResolver {
+	resolver := &FetchResolver{
+		WorkDir:          workDir,
+		AWSRegion:        constants.AWSVirginia,
+		MaxUnknownLength: DefaultMaxUnknownLength,
+	}
+	// No proxy, because we have to check the address of the
+	// server we're fetching from, not the address of the proxy.
+	transport := &http.Transport{
+		DialContext:         resolver.dialPublic,
+		TLSHandshakeTimeout: 30 * time.Second,
+	}
+	resolver.HttpClient = &http.Client{Transport: transport, Timeout: 30 * time.Minute}
+	return resolver
+}
+
+// Resolve downloads all of the items in the list, and returns
+// one error for each item that could not be fetched.
+func (resolver *FetchResolver) Resolve(items []*FetchItem) []error {
+	errors := make([]error, 0)
+	for _, item := range items {
+		err := resolver.Fetch(item)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("Cannot fetch '%s' from %s: %v",
+				item.Path, item.URL, err))
+		}
+	}
+	return errors
+}
+
+// Fetch downloads a single item. The file is written to a temp
+// file first, and moved into place only if the download succeeds
+// and the length matches what fetch.txt says it should be.
+func (resolver *FetchResolver) Fetch(item *FetchItem) error {
+	localPath, err := resolver.LocalPath(item)
+	if err != nil {
+		return err
+	}
+	fetchUrl, err := url.Parse(item.URL)
+	if err != nil {
+		return fmt.Errorf("Invalid URL: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		return err
+	}
+	tempPath := localPath + ".partial"
+	defer os.Remove(tempPath)
+	var bytesWritten int64
+	switch fetchUrl.Scheme {
+	case "http", "https":
+		bytesWritten, err = resolver.fetchHttp(item, tempPath)
+	case "s3":
+		bytesWritten, err = resolver.fetchS3(item, fetchUrl, tempPath)
+	default:
+		return fmt.Errorf("Unsupported URL scheme '%s'", fetchUrl.Scheme)
+	}
+	if err != nil {
+		return err
+	}
+	if item.Length >= 0 && bytesWritten != item.Length {
+		return fmt.Errorf("fetch.txt says length is %d bytes, but we got %d",
+			item.Length, bytesWritten)
+	}
+	if item.Length < 0 && bytesWritten > resolver.MaxUnknownLength {
+		return resolver.tooLong()
+	}
+	return os.Rename(tempPath, localPath)
+}
+
+// LocalPath returns the absolute path to which item should be
+// downloaded. It returns an error if the item's path is absolute,
+// is outside the data directory, or would escape WorkDir.
+func (resolver *FetchResolver) LocalPath(item *FetchItem) (string, error) {
+	cleanPath := path.Clean(item.Path)
+	if path.IsAbs(item.Path) || cleanPath != item.Path || strings.Contains(item.Path, "\\") {
+		return "", fmt.Errorf("Illegal file path '%s'", item.Path)
+	}
+	if !strings.HasPrefix(cleanPath, "data/") {
+		return "", fmt.Errorf("File path '%s' is not in the data directory", item.Path)
+	}
+	workDir, err := filepath.Abs(resolver.WorkDir)
+	if err != nil {
+		return "", err
+	}
+	localPath := filepath.Join(workDir, filepath.FromSlash(cleanPath))
+	if !strings.HasPrefix(localPath, workDir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Illegal file path '%s'", item.Path)
+	}
+	return localPath, nil
+}
+
+// tooLong returns the error for a file of unknown length that is
+// larger than MaxUnknownLength.
+func (resolver *FetchResolver) tooLong() error {
+	return fmt.Errorf("fetch.txt does not give the length of this file, "+
+		"and it's larger than the limit of %d bytes", resolver.MaxUnknownLength)
+}
+
+// privateNetworks are the address ranges dialPublic refuses,
+// in addition to loopback, link-local and multicast addresses.
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, networks[i], _ = net.ParseCIDR(cidr)
+	}
+	return networks
+}
+
+// isPrivateAddress returns true if ip is on a loopback, link-local,
+// or private network, or is not a unicast address.
+func isPrivateAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, ipNet := range privateNetworks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialPublic connects to addr, as long as the host is in AllowedHosts
+// or all of its addresses are public. It connects to the address it
+// checked, so a DNS server can't give us a public address for the
+// check and a private one for the connection. The default HttpClient
+// calls this for every connection, including those for redirects.
+func (resolver *FetchResolver) dialPublic(ctx context.Context, netType, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	for _, allowed := range resolver.AllowedHosts {
+		if host == allowed {
+			return dialer.DialContext(ctx, netType, addr)
+		}
+	}
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ipAddr := range ipAddrs {
+		if isPrivateAddress(ipAddr.IP) {
+			return nil, fmt.Errorf("Host %s is on a private or local network (%s)", host, ipAddr.IP)
+		}
+	}
+	for _, ipAddr := range ipAddrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, netType, net.JoinHostPort(ipAddr.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// fetchHttp downloads an http or https URL to localPath. It stops
+// reading one byte past the expected length, or past MaxUnknownLength
+// if the length is unknown, so a server that sends too much data
+// can't fill up the disk.
+func (resolver *FetchResolver) fetchHttp(item *FetchItem, localPath string) (int64, error) {
+	resp, err := resolver.HttpClient.Get(item.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Server returned status %d", resp.StatusCode)
+	}
+	limit := item.Length
+	if limit < 0 {
+		if resp.ContentLength > resolver.MaxUnknownLength {
+			return 0, resolver.tooLong()
+		}
+		limit = resolver.MaxUnknownLength
+	}
+	body := io.LimitReader(resp.Body, limit+1)
+	outputFile, err := os.Create(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer outputFile.Close()
+	return io.Copy(outputFile, body)
+}
+
+// fetchS3 downloads an s3 URL, in the form s3://bucket/key,
+// to localPath. If fetch.txt doesn't give the length, we ask S3 for
+// it first, so we don't download files larger than MaxUnknownLength.
+// Like fetchHttp, it stops reading one byte past the expected length.
+func (resolver *FetchResolver) fetchS3(item *FetchItem, fetchUrl *url.URL, localPath string) (int64, error) {
+	key := strings.TrimPrefix(fetchUrl.Path, "/")
+	if fetchUrl.Host == "" || key == "" {
+		return 0, fmt.Errorf("S3 URL must be in the form s3://bucket/key")
+	}
+	limit := item.Length
+	if item.Length < 0 {
+		limit = resolver.MaxUnknownLength
+		head := network.NewS3Head(resolver.AccessKeyId, resolver.SecretAccessKey,
+			resolver.AWSRegion, fetchUrl.Host)
+		head.Head(key)
+		if head.ErrorMessage != "" {
+			return 0, fmt.Errorf("%s", head.ErrorMessage)
+		}
+		if aws.Int64Value(head.Response.ContentLength) > resolver.MaxUnknownLength {
+			return 0, resolver.tooLong()
+		}
+	}
+	download := network.NewS3Download(resolver.AccessKeyId, resolver.SecretAccessKey,
+		resolver.AWSRegion, fetchUrl.Host, key, localPath, false, false)
+	download.MaxBytes = limit + 1
+	download.Fetch()
+	if download.ErrorMessage != "" {
+		return 0, fmt.Errorf("%s", download.ErrorMessage)
+	}
+	return download.BytesCopied, nil
+}
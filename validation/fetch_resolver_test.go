@@ -0,0 +1,257 @@
+package validation_test
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const fetchedContent = "This file came from a remote server.\n"
+
+func fetchTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file.txt" {
+			fmt.Fprint(w, fetchedContent)
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestParseFetchTxt(t *testing.T) {
+	fetchTxt := "http://example.com/1.txt 1234 data/file one.txt\n\n" +
+		"s3://bucket/key - data/two.txt\n"
+	items, err := validation.ParseFetchTxt(strings.NewReader(fetchTxt))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(items))
+	assert.Equal(t, "http://example.com/1.txt", items[0].URL)
+	assert.EqualValues(t, 1234, items[0].Length)
+	assert.Equal(t, "data/file one.txt", items[0].Path)
+	assert.Equal(t, "s3://bucket/key", items[1].URL)
+	assert.EqualValues(t, -1, items[1].Length)
+	assert.Equal(t, "data/two.txt", items[1].Path)
+
+	_, err = validation.ParseFetchTxt(strings.NewReader("http://example.com/1.txt data/x.txt"))
+	assert.NotNil(t, err)
+	_, err = validation.ParseFetchTxt(strings.NewReader("http://example.com/1.txt abc data/x.txt"))
+	assert.NotNil(t, err)
+}
+
+func TestFetchResolver_LocalPath(t *testing.T) {
+	resolver := validation.NewFetchResolver("/tmp/bag.fetch")
+	localPath, err := resolver.LocalPath(&validation.FetchItem{Path: "data/dir/file.txt"})
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join("/tmp/bag.fetch", "data", "dir", "file.txt"), localPath)
+
+	badPaths := []string{
+		"/etc/passwd",
+		"data/../../etc/passwd",
+		"../data/file.txt",
+		"bag-info.txt",
+		"data//file.txt",
+		"data\\..\\file.txt",
+	}
+	for _, badPath := range badPaths {
+		_, err = resolver.LocalPath(&validation.FetchItem{Path: badPath})
+		assert.NotNil(t, err, badPath)
+	}
+}
+
+func TestFetchResolver_Resolve(t *testing.T) {
+	server := fetchTestServer()
+	defer server.Close()
+	workDir, err := ioutil.TempDir("", "fetch_resolver_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	resolver := validation.NewFetchResolver(workDir)
+	resolver.AllowedHosts = []string{"127.0.0.1"}
+	items := []*validation.FetchItem{
+		{URL: server.URL + "/file.txt", Length: int64(len(fetchedContent)), Path: "data/good.txt"},
+		{URL: server.URL + "/file.txt", Length: -1, Path: "data/unknown_length.txt"},
+		{URL: server.URL + "/file.txt", Length: 10, Path: "data/too_long.txt"},
+		{URL: server.URL + "/file.txt", Length: 1000, Path: "data/too_short.txt"},
+		{URL: server.URL + "/missing.txt", Length: -1, Path: "data/missing.txt"},
+		{URL: "file:///etc/passwd", Length: -1, Path: "data/passwd"},
+		{URL: server.URL + "/file.txt", Length: -1, Path: "data/../../escape.txt"},
+	}
+	errors := resolver.Resolve(items)
+	require.Equal(t, 5, len(errors))
+	assert.Contains(t, errors[0].Error(), "data/too_long.txt")
+	assert.Contains(t, errors[0].Error(), "fetch.txt says length is 10 bytes, but we got 11")
+	assert.Contains(t, errors[1].Error(), "fetch.txt says length is 1000 bytes")
+	assert.Contains(t, errors[2].Error(), "Server returned status 404")
+	assert.Contains(t, errors[3].Error(), "Unsupported URL scheme 'file'")
+	assert.Contains(t, errors[4].Error(), "Illegal file path 'data/../../escape.txt'")
+
+	data, err := ioutil.ReadFile(filepath.Join(workDir, "data", "good.txt"))
+	require.Nil(t, err)
+	assert.Equal(t, fetchedContent, string(data))
+	assert.FileExists(t, filepath.Join(workDir, "data", "unknown_length.txt"))
+
+	// Failed downloads should leave nothing behind.
+	_, err = os.Stat(filepath.Join(workDir, "data", "too_long.txt"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(workDir, "data", "too_long.txt.partial"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFetchResolver_MaxUnknownLength(t *testing.T) {
+	server := fetchTestServer()
+	defer server.Close()
+	workDir, err := ioutil.TempDir("", "fetch_resolver_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	resolver := validation.NewFetchResolver(workDir)
+	resolver.AllowedHosts = []string{"127.0.0.1"}
+	assert.Equal(t, validation.DefaultMaxUnknownLength, resolver.MaxUnknownLength)
+	resolver.MaxUnknownLength = 5
+	err = resolver.Fetch(&validation.FetchItem{URL: server.URL + "/file.txt", Length: -1, Path: "data/big.txt"})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "larger than the limit of 5 bytes")
+	_, err = os.Stat(filepath.Join(workDir, "data", "big.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The limit doesn't apply when fetch.txt gives the length.
+	err = resolver.Fetch(&validation.FetchItem{URL: server.URL + "/file.txt",
+		Length: int64(len(fetchedContent)), Path: "data/big.txt"})
+	assert.Nil(t, err)
+}
+
+func TestFetchResolver_PrivateHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://"+r.URL.Query().Get("to")+"/file.txt", http.StatusFound)
+		} else {
+			fmt.Fprint(w, fetchedContent)
+		}
+	}))
+	defer server.Close()
+	workDir, err := ioutil.TempDir("", "fetch_resolver_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(workDir)
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+
+	// The resolver won't fetch from loopback, link-local
+	// or private addresses unless we say it can.
+	resolver := validation.NewFetchResolver(workDir)
+	badUrls := []string{
+		server.URL + "/file.txt",
+		"http://localhost:" + port + "/file.txt",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.1.2.3/file.txt",
+		"http://[::1]:" + port + "/file.txt",
+	}
+	for _, badUrl := range badUrls {
+		err = resolver.Fetch(&validation.FetchItem{URL: badUrl, Length: -1, Path: "data/file.txt"})
+		require.NotNil(t, err, badUrl)
+		assert.Contains(t, err.Error(), "is on a private or local network", badUrl)
+	}
+
+	resolver.AllowedHosts = []string{"localhost"}
+	item := &validation.FetchItem{URL: "http://localhost:" + port + "/file.txt", Length: -1, Path: "data/file.txt"}
+	require.Nil(t, resolver.Fetch(item))
+
+	// An allowed host can't redirect us to one that isn't.
+	item.URL = "http://localhost:" + port + "/redirect?to=127.0.0.1:" + port
+	err = resolver.Fetch(item)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Host 127.0.0.1 is on a private or local network")
+	item.URL = "http://localhost:" + port + "/redirect?to=localhost:" + port
+	assert.Nil(t, resolver.Fetch(item))
+}
+
+// makeHoleyBag creates an untarred bag in a temp directory, with one
+// payload file present and one listed in fetch.txt. Param remoteMd5
+// is the md5 digest the manifest should list for the remote file.
+// Returns the path to the bag. The caller should delete the bag's
+// parent directory.
+func makeHoleyBag(t *testing.T, serverUrl, remoteMd5 string) string {
+	parentDir, err := ioutil.TempDir("", "holey_bag_test")
+	require.Nil(t, err)
+	bagDir := filepath.Join(parentDir, "holey_bag")
+	require.Nil(t, os.MkdirAll(filepath.Join(bagDir, "data"), 0755))
+	files := map[string]string{
+		"bagit.txt":      "BagIt-Version: 0.97\nTag-File-Character-Encoding: UTF-8\n",
+		"data/local.txt": "Local file\n",
+		"manifest-md5.txt": "454ae3ef375d78a2c4e2d4d83c762511 data/local.txt\n" +
+			remoteMd5 + " data/remote.txt\n",
+		"fetch.txt": fmt.Sprintf("%s/file.txt %d data/remote.txt\n",
+			serverUrl, len(fetchedContent)),
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(bagDir, name), []byte(content), 0644)
+		require.Nil(t, err)
+	}
+	return bagDir
+}
+
+func holeyBagConfig() *validation.BagValidationConfig {
+	config := validation.NewBagValidationConfig()
+	config.AllowFetchTxt = true
+	config.AllowMiscTopLevelFiles = true
+	config.FixityAlgorithms = []string{"md5"}
+	return config
+}
+
+func TestValidator_HoleyBag(t *testing.T) {
+	server := fetchTestServer()
+	defer server.Close()
+
+	// Manifest digests match the local and remote files.
+	bagDir := makeHoleyBag(t, server.URL, "6ba8075689a6fe96f67bcd30552255a7")
+	defer os.RemoveAll(filepath.Dir(bagDir))
+	validator, err := validation.NewValidator(bagDir, holeyBagConfig(), false)
+	require.Nil(t, err)
+	validator.FetchResolver.AllowedHosts = []string{"127.0.0.1"}
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+	assert.FileExists(t, filepath.Join(validator.FetchDir(), "data", "remote.txt"))
+}
+
+func TestValidator_HoleyBag_BadChecksum(t *testing.T) {
+	server := fetchTestServer()
+	defer server.Close()
+
+	// Fetched file must match the manifest, like any other payload file.
+	bagDir := makeHoleyBag(t, server.URL, "00000000000000000000000000000000")
+	defer os.RemoveAll(filepath.Dir(bagDir))
+	validator, err := validation.NewValidator(bagDir, holeyBagConfig(), false)
+	require.Nil(t, err)
+	validator.FetchResolver.AllowedHosts = []string{"127.0.0.1"}
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.Equal(t, []string{
+		"Bad md5 digest for 'data/remote.txt': manifest says '00000000000000000000000000000000', " +
+			"file digest is '6ba8075689a6fe96f67bcd30552255a7'",
+	}, summary.Errors)
+}
+
+func TestValidator_HoleyBag_FetchFails(t *testing.T) {
+	server := fetchTestServer()
+	// Close the server so fetch fails.
+	server.Close()
+
+	bagDir := makeHoleyBag(t, server.URL, "6ba8075689a6fe96f67bcd30552255a7")
+	defer os.RemoveAll(filepath.Dir(bagDir))
+	validator, err := validation.NewValidator(bagDir, holeyBagConfig(), false)
+	require.Nil(t, err)
+	validator.FetchResolver.AllowedHosts = []string{"127.0.0.1"}
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(summary.Errors))
+	assert.True(t, strings.HasPrefix(summary.Errors[0],
+		fmt.Sprintf("Cannot fetch 'data/remote.txt' from %s/file.txt", server.URL)))
+	assert.Equal(t, "File 'data/remote.txt' in manifest 'manifest-md5.txt' is missing from bag",
+		summary.Errors[1])
+}
@@ -0,0 +1,107 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+)
+
+// trackFileName records the path of a file in the bag, so we can find
+// Unicode normalization mismatches and case collisions. This is called
+// once for each file, in the order the iterator returns them, and is not
+// safe to call from more than one goroutine.
+//
+// A case collision can be in any part of the path, so we check each of
+// the file's parent directories as well as the file itself. E.g.
+// data/Images/1.jpg and data/images/2.jpg will end up in the same
+// directory on a case-insensitive file system.
+func (validator *Validator) trackFileName(relPath string) {
+	normalized := norm.NFC.String(relPath)
+	if _, exists := validator.normalizedPaths[normalized]; !exists {
+		validator.normalizedPaths[normalized] = relPath
+	}
+	if validator.checkLevel(validator.BagValidationConfig.CaseCollisions) == IGNORE {
+		return
+	}
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		if validator.trackedDirs[dir] {
+			continue
+		}
+		validator.trackedDirs[dir] = true
+		validator.checkCaseCollision(dir, "Paths")
+	}
+	validator.checkCaseCollision(relPath, "File names")
+}
+
+// checkCaseCollision adds a finding if relPath matches a path we've
+// already seen after case folding and Unicode normalization. Param
+// kind says what the paths are, for the message.
+func (validator *Validator) checkCaseCollision(relPath, kind string) {
+	// Case folding can undo normalization, so we normalize again.
+	folded := norm.NFC.String(cases.Fold().String(norm.NFC.String(relPath)))
+	if otherPath, exists := validator.foldedPaths[folded]; exists {
+		validator.addCheckFinding(validator.BagValidationConfig.CaseCollisions, &Finding{
+			Code: FindingCaseCollision,
+			Message: fmt.Sprintf("%s '%s' and '%s' differ only in case or "+
+				"Unicode normalization, and will collide on case-insensitive file systems.",
+				kind, otherPath, relPath),
+			FilePath: relPath,
+		})
+		return
+	}
+	validator.foldedPaths[folded] = relPath
+}
+
+// findNormalizedMatch returns the GenericFile whose path matches
+// manifestPath after Unicode normalization, along with its identifier.
+// It returns nil if there is no such file, or if the UnicodeNormalization
+// check is off. Params manifest and lineNum describe where manifestPath
+// came from, for the ValidationReport.
+func (validator *Validator) findNormalizedMatch(manifestPath, manifest string, lineNum int) (*models.GenericFile, string) {
+	level := validator.checkLevel(validator.BagValidationConfig.UnicodeNormalization)
+	if level == IGNORE {
+		return nil, ""
+	}
+	actualPath, exists := validator.normalizedPaths[norm.NFC.String(manifestPath)]
+	if !exists || actualPath == manifestPath {
+		return nil, ""
+	}
+	gfIdentifier := fmt.Sprintf("%s/%s", validator.ObjIdentifier, actualPath)
+	genericFile, err := validator.db.GetGenericFile(gfIdentifier)
+	if err != nil || genericFile == nil {
+		return nil, ""
+	}
+	validator.addCheckFinding(level, &Finding{
+		Code: FindingUnicodeNormalization,
+		Message: fmt.Sprintf("File '%s' in manifest '%s' matches '%s' in the bag "+
+			"only after Unicode normalization.", manifestPath, manifest, actualPath),
+		FilePath:   actualPath,
+		Manifest:   manifest,
+		LineNumber: lineNum,
+	})
+	return genericFile, gfIdentifier
+}
+
+// checkLevel returns the effective level of a file name check.
+// Empty means IGNORE.
+func (validator *Validator) checkLevel(level string) string {
+	if level == "" {
+		return IGNORE
+	}
+	return level
+}
+
+// addCheckFinding adds a finding as a warning or an error, depending
+// on level, which should be WARN or ERROR.
+func (validator *Validator) addCheckFinding(level string, finding *Finding) {
+	if level == WARN {
+		finding.Severity = SeverityWarning
+	} else {
+		finding.Severity = SeverityError
+	}
+	validator.addFinding(finding)
+}
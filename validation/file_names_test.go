@@ -0,0 +1,146 @@
+package validation_test
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/APTrust/exchange/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// "café" with a precomposed é (NFC) and with e plus a combining
+// acute accent (NFD).
+const cafeNFC = "caf\u00e9.txt"
+const cafeNFD = "cafe\u0301.txt"
+
+// makeFileNameBag creates an untarred bag containing the payload
+// files in fileNames. The manifest lists each file under the name
+// in manifestNames, at the same index. Returns the path to the bag.
+// The caller should delete the bag's parent directory.
+func makeFileNameBag(t *testing.T, fileNames, manifestNames []string) string {
+	parentDir, err := ioutil.TempDir("", "file_name_test")
+	require.Nil(t, err)
+	bagDir := filepath.Join(parentDir, "file_name_bag")
+	manifest := ""
+	for i, fileName := range fileNames {
+		content := []byte(fmt.Sprintf("File %d\n", i))
+		absPath := filepath.Join(bagDir, filepath.FromSlash(fileName))
+		require.Nil(t, os.MkdirAll(filepath.Dir(absPath), 0755))
+		require.Nil(t, ioutil.WriteFile(absPath, content, 0644))
+		manifest += fmt.Sprintf("%x %s\n", md5.Sum(content), manifestNames[i])
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagDir, "manifest-md5.txt"), []byte(manifest), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagDir, "bagit.txt"),
+		[]byte("BagIt-Version: 0.97\nTag-File-Character-Encoding: UTF-8\n"), 0644))
+	return bagDir
+}
+
+func validateFileNameBag(t *testing.T, bagDir string, config *validation.BagValidationConfig) *validation.ValidationReport {
+	validator, err := validation.NewValidator(bagDir, config, false)
+	require.Nil(t, err)
+	defer os.Remove(validator.DBName())
+	_, err = validator.Validate()
+	require.Nil(t, err)
+	return validator.Report()
+}
+
+func fileNameConfig() *validation.BagValidationConfig {
+	config := validation.NewBagValidationConfig()
+	config.AllowMiscTopLevelFiles = true
+	config.AllowMiscDirectories = true
+	config.FixityAlgorithms = []string{"md5"}
+	return config
+}
+
+func TestValidator_UnicodeNormalization(t *testing.T) {
+	bagDir := makeFileNameBag(t, []string{"data/" + cafeNFC}, []string{"data/" + cafeNFD})
+	defer os.RemoveAll(filepath.Dir(bagDir))
+
+	// Default is to ignore normalization, so the file is missing
+	// from the bag and not in the manifest.
+	config := fileNameConfig()
+	report := validateFileNameBag(t, bagDir, config)
+	assert.False(t, report.Valid)
+	require.Equal(t, 2, len(report.Errors()))
+	assert.Equal(t, validation.FindingFileMissing, report.Errors()[0].Code)
+	assert.Equal(t, validation.FindingNotInManifest, report.Errors()[1].Code)
+
+	// WARN matches the manifest entry to the file, and warns.
+	config.UnicodeNormalization = validation.WARN
+	report = validateFileNameBag(t, bagDir, config)
+	assert.True(t, report.Valid)
+	require.Equal(t, 1, len(report.Warnings()))
+	finding := report.Warnings()[0]
+	assert.Equal(t, validation.FindingUnicodeNormalization, finding.Code)
+	assert.Equal(t, "data/"+cafeNFC, finding.FilePath)
+	assert.Equal(t, "manifest-md5.txt", finding.Manifest)
+	assert.Equal(t, 1, finding.LineNumber)
+
+	// ERROR makes the bag invalid, but still verifies the checksum.
+	config.UnicodeNormalization = validation.ERROR
+	report = validateFileNameBag(t, bagDir, config)
+	assert.False(t, report.Valid)
+	require.Equal(t, 1, len(report.Errors()))
+	assert.Equal(t, validation.FindingUnicodeNormalization, report.Errors()[0].Code)
+}
+
+func TestValidator_CaseCollisions(t *testing.T) {
+	fileNames := []string{"data/a.txt", "data/A.txt", "Data/b.txt", "data/" + cafeNFC, "data/" + cafeNFD}
+	bagDir := makeFileNameBag(t, fileNames, fileNames)
+	defer os.RemoveAll(filepath.Dir(bagDir))
+
+	config := fileNameConfig()
+	report := validateFileNameBag(t, bagDir, config)
+	assert.True(t, report.Valid)
+	assert.Empty(t, report.Findings)
+
+	config.CaseCollisions = validation.WARN
+	report = validateFileNameBag(t, bagDir, config)
+	assert.True(t, report.Valid)
+	collisions := report.Warnings()
+	require.Equal(t, 3, len(collisions))
+	messages := make([]string, len(collisions))
+	for i, finding := range collisions {
+		assert.Equal(t, validation.FindingCaseCollision, finding.Code)
+		messages[i] = finding.Message
+	}
+	// Data/b.txt doesn't collide with a file, but its
+	// directory collides with data.
+	assert.Contains(t, messages[0], "Paths 'Data' and 'data'")
+	assert.Contains(t, messages[1], "File names 'data/A.txt' and 'data/a.txt'")
+
+	config.CaseCollisions = validation.ERROR
+	report = validateFileNameBag(t, bagDir, config)
+	assert.False(t, report.Valid)
+	assert.Equal(t, 3, len(report.Errors()))
+}
+
+func TestValidator_CaseCollisions_Folding(t *testing.T) {
+	// Final sigma and sigma are the same letter after case folding,
+	// but not after strings.ToLower.
+	fileNames := []string{"data/σ/a.txt", "data/ς/b.txt"}
+	bagDir := makeFileNameBag(t, fileNames, fileNames)
+	defer os.RemoveAll(filepath.Dir(bagDir))
+
+	config := fileNameConfig()
+	config.CaseCollisions = validation.ERROR
+	report := validateFileNameBag(t, bagDir, config)
+	assert.False(t, report.Valid)
+	require.Equal(t, 1, len(report.Errors()))
+	assert.Equal(t, validation.FindingCaseCollision, report.Errors()[0].Code)
+	assert.Contains(t, report.Errors()[0].Message, "Paths ")
+}
+
+func TestBagValidationConfig_CheckLevels(t *testing.T) {
+	config := fileNameConfig()
+	config.UnicodeNormalization = "sometimes"
+	config.CaseCollisions = "loudly"
+	errors := config.ValidateConfig()
+	require.Equal(t, 2, len(errors))
+	assert.Contains(t, errors[0].Error(), "UnicodeNormalization")
+	assert.Contains(t, errors[1].Error(), "CaseCollisions")
+}
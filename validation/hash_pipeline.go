@@ -0,0 +1,93 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/util/fileutil"
+	"io"
+	"sort"
+	"sync"
+)
+
+// hashJob is a file waiting for one of the hash workers.
+type hashJob struct {
+	reader io.ReadCloser
+	gf     *models.GenericFile
+}
+
+// addFilesConcurrently reads files from the iterator in order, creating
+// a GenericFile record for each, and passes them to a pool of
+// HashWorkers goroutines that calculate checksums and save the records
+// to the validation database.
+//
+// Everything that depends on the order of files (lists of manifests,
+// required files, payload counts, etc.) happens here in the calling
+// goroutine, so results are the same as when we hash files one at a
+// time. The job channel is buffered to the number of workers, which
+// limits the number of files we have open at once.
+//
+// As in the single-threaded path, we stop reading files after the
+// first error. Errors are sorted before we add them to the
+// WorkSummary, so they don't depend on which worker finished first.
+func (validator *Validator) addFilesConcurrently(iterator fileutil.ReadIterator) {
+	jobs := make(chan *hashJob, validator.HashWorkers)
+	errors := make([]string, 0)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < validator.HashWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				err := validator.hashAndSave(job.reader, job.gf)
+				job.reader.Close()
+				if err != nil {
+					mutex.Lock()
+					errors = append(errors, fmt.Sprintf("Error reading bag: %s", err.Error()))
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for {
+		mutex.Lock()
+		workerFailed := len(errors) > 0
+		mutex.Unlock()
+		if workerFailed {
+			break
+		}
+		reader, fileSummary, err := iterator.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			mutex.Lock()
+			errors = append(errors, fmt.Sprintf("Error reading bag: %s", err.Error()))
+			mutex.Unlock()
+			break
+		}
+		if !fileSummary.IsRegularFile {
+			if reader != nil {
+				reader.Close()
+			}
+			continue
+		}
+		if validator.isFetchTxt(fileSummary) {
+			reader = validator.readFetchTxt(reader)
+		}
+		gf, alreadyHashed := validator.newGenericFile(fileSummary)
+		if alreadyHashed {
+			reader.Close()
+			continue
+		}
+		jobs <- &hashJob{reader: reader, gf: gf}
+	}
+	close(jobs)
+	wg.Wait()
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		for _, msg := range errors {
+			validator.addError(FindingBagReadError, "%s", msg)
+		}
+		validator.summary.ErrorIsFatal = true
+	}
+}
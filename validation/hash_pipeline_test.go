@@ -0,0 +1,105 @@
+package validation_test
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/APTrust/exchange/models"
+	"github.com/APTrust/exchange/testhelper"
+	"github.com/APTrust/exchange/util/storage"
+	"github.com/APTrust/exchange/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// validateDirectoryBag validates an untarred bag with the specified
+// number of hash workers, and returns the summary along with all of
+// the GenericFiles in the validation db.
+func validateDirectoryBag(t *testing.T, bagPath string, workers int) (*models.WorkSummary, map[string]*models.GenericFile) {
+	validator := getValidator(t, bagPath, false)
+	validator.HashWorkers = workers
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	db, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	defer db.Close()
+	files := make(map[string]*models.GenericFile)
+	for _, identifier := range db.FileIdentifiers() {
+		gf, err := db.GetGenericFile(identifier)
+		require.Nil(t, err)
+		files[identifier] = gf
+	}
+	return summary, files
+}
+
+func TestValidator_ConcurrentHashing(t *testing.T) {
+	for _, bagName := range []string{"example.edu.tagsample_good.tar", "example.edu.tagsample_bad.tar"} {
+		tempDir, bagPath, err := testhelper.UntarTestBag(bagName)
+		require.Nil(t, err)
+		defer os.RemoveAll(tempDir)
+
+		singleSummary, singleFiles := validateDirectoryBag(t, bagPath, 1)
+		for _, workers := range []int{2, 8} {
+			summary, files := validateDirectoryBag(t, bagPath, workers)
+			// Tag spec errors come out in map order, so don't compare order.
+			assert.ElementsMatch(t, singleSummary.Errors, summary.Errors, bagName)
+			require.Equal(t, len(singleFiles), len(files), bagName)
+			for identifier, gf := range singleFiles {
+				require.NotNil(t, files[identifier], identifier)
+				assert.Equal(t, gf.IngestFileType, files[identifier].IngestFileType, identifier)
+				assert.Equal(t, gf.IngestMd5, files[identifier].IngestMd5, identifier)
+				assert.Equal(t, gf.IngestSha256, files[identifier].IngestSha256, identifier)
+				assert.Equal(t, gf.IngestManifestMd5, files[identifier].IngestManifestMd5, identifier)
+			}
+		}
+	}
+}
+
+// makeBenchmarkBag creates an untarred bag with numFiles random
+// payload files of fileSize bytes each.
+func makeBenchmarkBag(b *testing.B, numFiles, fileSize int) (string, string) {
+	tempDir, err := ioutil.TempDir("", "validator_bench")
+	require.Nil(b, err)
+	bagPath := filepath.Join(tempDir, "bench_bag")
+	require.Nil(b, os.MkdirAll(filepath.Join(bagPath, "data"), 0755))
+	manifest := ""
+	data := make([]byte, fileSize)
+	for i := 0; i < numFiles; i++ {
+		rand.Read(data)
+		fileName := fmt.Sprintf("data/file_%05d.bin", i)
+		require.Nil(b, ioutil.WriteFile(filepath.Join(bagPath, fileName), data, 0644))
+		manifest += fmt.Sprintf("%x %s\n", md5.Sum(data), fileName)
+	}
+	require.Nil(b, ioutil.WriteFile(filepath.Join(bagPath, "manifest-md5.txt"), []byte(manifest), 0644))
+	require.Nil(b, ioutil.WriteFile(filepath.Join(bagPath, "bagit.txt"),
+		[]byte("BagIt-Version: 0.97\nTag-File-Character-Encoding: UTF-8\n"), 0644))
+	return tempDir, bagPath
+}
+
+func benchmarkValidator(b *testing.B, workers int) {
+	tempDir, bagPath := makeBenchmarkBag(b, 200, 256*1024)
+	defer os.RemoveAll(tempDir)
+	config := validation.NewBagValidationConfig()
+	config.AllowMiscTopLevelFiles = true
+	config.FixityAlgorithms = []string{"md5", "sha256"}
+	b.SetBytes(200 * 256 * 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		validator, err := validation.NewValidator(bagPath, config, false)
+		require.Nil(b, err)
+		validator.HashWorkers = workers
+		summary, err := validator.Validate()
+		require.Nil(b, err)
+		require.False(b, summary.HasErrors(), summary.AllErrorsAsString())
+		os.Remove(validator.DBName())
+	}
+}
+
+func BenchmarkValidator_SingleThreaded(b *testing.B) { benchmarkValidator(b, 1) }
+func BenchmarkValidator_FourWorkers(b *testing.B)    { benchmarkValidator(b, 4) }
+func BenchmarkValidator_EightWorkers(b *testing.B)   { benchmarkValidator(b, 8) }
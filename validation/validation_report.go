@@ -0,0 +1,229 @@
+package validation
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// Severity levels for validation findings. Errors make a bag invalid.
+// Warnings describe things the validator noticed but did not check,
+// such as a manifest for an algorithm that isn't in FixityAlgorithms.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Codes describing the kinds of problems the validator finds.
+// These are stable, so scripts can key on them.
+const (
+	FindingInternalError        = "internal_error"
+	FindingBagReadError         = "bag_read_error"
+	FindingFetchError           = "fetch_error"
+	FindingFetchTxtNotAllowed   = "fetch_txt_not_allowed"
+	FindingManifestParseError   = "manifest_parse_error"
+	FindingManifestMissing      = "manifest_missing"
+	FindingManifestNotAllowed   = "manifest_not_allowed"
+	FindingManifestNotVerified  = "manifest_not_verified"
+	FindingTagManifestMissing   = "tag_manifest_missing"
+	FindingFileMissing          = "file_missing"
+	FindingBadDigest            = "bad_digest"
+	FindingNotInManifest        = "not_in_manifest"
+	FindingNotInTagManifest     = "not_in_tag_manifest"
+	FindingPayloadOxum          = "payload_oxum"
+	FindingBagSize              = "bag_size"
+	FindingSerialization        = "serialization"
+	FindingDataNotEmpty         = "data_not_empty"
+	FindingWrongTopLevelDir     = "wrong_top_level_dir"
+	FindingRequiredFileMissing  = "required_file_missing"
+	FindingForbiddenFile        = "forbidden_file"
+	FindingTagFileNotAllowed    = "tag_file_not_allowed"
+	FindingTagParseError        = "tag_parse_error"
+	FindingRequiredTagMissing   = "required_tag_missing"
+	FindingForbiddenTag         = "forbidden_tag"
+	FindingTagRepeated          = "tag_repeated"
+	FindingTagValueMissing      = "tag_value_missing"
+	FindingIllegalTagValue      = "illegal_tag_value"
+	FindingIllegalFileName      = "illegal_file_name"
+	FindingUnicodeNormalization = "unicode_normalization"
+	FindingCaseCollision        = "case_collision"
+)
+
+// Finding describes a single problem the validator found in a bag.
+// Message is the same human-readable text that appears in the
+// WorkSummary. The other fields are filled in when they apply.
+type Finding struct {
+	Code       string `json:"code"`
+	Severity   string `json:"severity"`
+	Message    string `json:"message"`
+	FilePath   string `json:"file_path,omitempty"`
+	Manifest   string `json:"manifest,omitempty"`
+	LineNumber int    `json:"line_number,omitempty"`
+	Algorithm  string `json:"algorithm,omitempty"`
+	Expected   string `json:"expected,omitempty"`
+	Actual     string `json:"actual,omitempty"`
+}
+
+// ValidationReport is a structured description of the results of
+// validating a bag. Unlike the WorkSummary, which has only a list
+// of error strings, the report has typed findings that can be
+// grouped and filtered, and it can be serialized to JSON or
+// JUnit-style XML.
+type ValidationReport struct {
+	BagPath       string     `json:"bag_path"`
+	ObjIdentifier string     `json:"obj_identifier"`
+	Valid         bool       `json:"valid"`
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    time.Time  `json:"finished_at"`
+	Findings      []*Finding `json:"findings"`
+}
+
+// NewValidationReport creates a new, empty ValidationReport.
+func NewValidationReport(bagPath, objIdentifier string) *ValidationReport {
+	return &ValidationReport{
+		BagPath:       bagPath,
+		ObjIdentifier: objIdentifier,
+		Valid:         true,
+		Findings:      make([]*Finding, 0),
+	}
+}
+
+// AddFinding adds a finding to the report. Any finding with
+// SeverityError makes the bag invalid.
+func (report *ValidationReport) AddFinding(finding *Finding) {
+	if finding.Severity == "" {
+		finding.Severity = SeverityError
+	}
+	if finding.Severity == SeverityError {
+		report.Valid = false
+	}
+	report.Findings = append(report.Findings, finding)
+}
+
+// Errors returns the findings with SeverityError.
+func (report *ValidationReport) Errors() []*Finding {
+	return report.findingsWithSeverity(SeverityError)
+}
+
+// Warnings returns the findings with SeverityWarning.
+func (report *ValidationReport) Warnings() []*Finding {
+	return report.findingsWithSeverity(SeverityWarning)
+}
+
+func (report *ValidationReport) findingsWithSeverity(severity string) []*Finding {
+	findings := make([]*Finding, 0)
+	for _, finding := range report.Findings {
+		if finding.Severity == severity {
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+// ToJson returns the report as pretty-printed JSON.
+func (report *ValidationReport) ToJson() ([]byte, error) {
+	return json.MarshalIndent(report, "", "  ")
+}
+
+// JUnit XML structures. See https://llg.cubic.org/docs/junit/
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Type    string `xml:"type,attr,omitempty"`
+	Message string `xml:"message,attr"`
+	Details string `xml:",chardata"`
+}
+
+// ToJUnitXml returns the report as JUnit-style XML, so CI systems
+// and other tools that understand JUnit can display it. The bag is
+// the test suite, and each finding is a test case. Errors are
+// failures, and warnings are skipped tests. A valid bag with no
+// findings has a single passing test case.
+func (report *ValidationReport) ToJUnitXml() ([]byte, error) {
+	suite := junitTestSuite{
+		Name:      report.ObjIdentifier,
+		Time:      fmt.Sprintf("%.3f", report.FinishedAt.Sub(report.StartedAt).Seconds()),
+		TestCases: make([]junitTestCase, 0),
+	}
+	if !report.StartedAt.IsZero() {
+		suite.Timestamp = report.StartedAt.Format(time.RFC3339)
+	}
+	for _, finding := range report.Findings {
+		name := finding.FilePath
+		if name == "" {
+			name = finding.Code
+		}
+		message := &junitMessage{
+			Type:    finding.Code,
+			Message: finding.Message,
+			Details: finding.details(),
+		}
+		testCase := junitTestCase{ClassName: finding.Code, Name: name}
+		if finding.Severity == SeverityError {
+			testCase.Failure = message
+			suite.Failures += 1
+		} else {
+			testCase.Skipped = message
+			suite.Skipped += 1
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	if len(suite.TestCases) == 0 {
+		suite.TestCases = append(suite.TestCases, junitTestCase{
+			ClassName: "bag",
+			Name:      "valid",
+		})
+	}
+	suite.Tests = len(suite.TestCases)
+	data, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// details returns the finding's optional fields as text,
+// one per line.
+func (finding *Finding) details() string {
+	details := ""
+	if finding.FilePath != "" {
+		details += fmt.Sprintf("File: %s\n", finding.FilePath)
+	}
+	if finding.Manifest != "" {
+		details += fmt.Sprintf("Manifest: %s\n", finding.Manifest)
+	}
+	if finding.LineNumber > 0 {
+		details += fmt.Sprintf("Line: %d\n", finding.LineNumber)
+	}
+	if finding.Algorithm != "" {
+		details += fmt.Sprintf("Algorithm: %s\n", finding.Algorithm)
+	}
+	if finding.Expected != "" {
+		details += fmt.Sprintf("Expected: %s\n", finding.Expected)
+	}
+	if finding.Actual != "" {
+		details += fmt.Sprintf("Actual: %s\n", finding.Actual)
+	}
+	return details
+}
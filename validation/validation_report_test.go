@@ -0,0 +1,165 @@
+package validation_test
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/APTrust/exchange/validation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func findingFor(report *validation.ValidationReport, code, filePath string) *validation.Finding {
+	for _, finding := range report.Findings {
+		if finding.Code == code && finding.FilePath == filePath {
+			return finding
+		}
+	}
+	return nil
+}
+
+func TestValidationReport_AddFinding(t *testing.T) {
+	report := validation.NewValidationReport("/tmp/bag.tar", "bag")
+	assert.True(t, report.Valid)
+	report.AddFinding(&validation.Finding{
+		Code:     validation.FindingManifestNotVerified,
+		Severity: validation.SeverityWarning,
+		Message:  "Not verifying",
+	})
+	assert.True(t, report.Valid)
+	report.AddFinding(&validation.Finding{
+		Code:    validation.FindingRequiredTagMissing,
+		Message: "Required tag 'Title' is missing.",
+	})
+	assert.False(t, report.Valid)
+	assert.Equal(t, validation.SeverityError, report.Findings[1].Severity)
+	assert.Equal(t, 1, len(report.Errors()))
+	assert.Equal(t, 1, len(report.Warnings()))
+}
+
+func TestValidator_Report(t *testing.T) {
+	validator := getValidator(t, "example.edu.tagsample_bad.tar", true)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+
+	report := validator.Report()
+	assert.False(t, report.Valid)
+	assert.Equal(t, "example.edu.tagsample_bad", report.ObjIdentifier)
+	assert.False(t, report.StartedAt.IsZero())
+	assert.False(t, report.FinishedAt.IsZero())
+
+	// The report should have the same errors as the summary.
+	messages := make([]string, 0)
+	for _, finding := range report.Errors() {
+		messages = append(messages, finding.Message)
+	}
+	assert.ElementsMatch(t, summary.Errors, messages)
+
+	badDigest := findingFor(report, validation.FindingBadDigest, "data/datastream-descMetadata")
+	require.NotNil(t, badDigest)
+	assert.Equal(t, "sha256", badDigest.Algorithm)
+	assert.Equal(t, "manifest-sha256.txt", badDigest.Manifest)
+	assert.Equal(t, 4, badDigest.LineNumber)
+	assert.Equal(t, "This-checksum-is-bad-on-purpose.-The-validator-should-catch-it!!", badDigest.Expected)
+	assert.Equal(t, "cf9cbce80062932e10ee9cd70ec05ebc24019deddfea4e54b8788decd28b4bc7", badDigest.Actual)
+
+	badTagDigest := findingFor(report, validation.FindingBadDigest, "custom_tags/tracked_tag_file.txt")
+	require.NotNil(t, badTagDigest)
+	assert.True(t, strings.HasPrefix(badTagDigest.Manifest, "tagmanifest-"))
+	assert.Equal(t, 2, badTagDigest.LineNumber)
+
+	missing := findingFor(report, validation.FindingFileMissing, "data/file-not-in-bag")
+	require.NotNil(t, missing)
+	assert.Equal(t, "manifest-sha256.txt", missing.Manifest)
+	assert.True(t, missing.LineNumber > 0)
+}
+
+func TestValidationReport_ToJson(t *testing.T) {
+	report := validation.NewValidationReport("/tmp/bag.tar", "bag")
+	report.AddFinding(&validation.Finding{
+		Code:       validation.FindingFileMissing,
+		Message:    "File 'data/x' in manifest 'manifest-md5.txt' is missing from bag",
+		FilePath:   "data/x",
+		Manifest:   "manifest-md5.txt",
+		LineNumber: 3,
+	})
+	data, err := report.ToJson()
+	require.Nil(t, err)
+
+	hash := make(map[string]interface{})
+	require.Nil(t, json.Unmarshal(data, &hash))
+	assert.Equal(t, false, hash["valid"])
+	assert.Equal(t, "bag", hash["obj_identifier"])
+	findings := hash["findings"].([]interface{})
+	require.Equal(t, 1, len(findings))
+	finding := findings[0].(map[string]interface{})
+	assert.Equal(t, "file_missing", finding["code"])
+	assert.Equal(t, "error", finding["severity"])
+	assert.Equal(t, "data/x", finding["file_path"])
+	assert.EqualValues(t, 3, finding["line_number"])
+	_, hasExpected := finding["expected"]
+	assert.False(t, hasExpected)
+}
+
+func TestValidationReport_ToJUnitXml(t *testing.T) {
+	report := validation.NewValidationReport("/tmp/bag.tar", "bag")
+	report.StartedAt = time.Now().UTC()
+	report.FinishedAt = report.StartedAt.Add(1500 * time.Millisecond)
+
+	// Valid bag has a single passing test case.
+	data, err := report.ToJUnitXml()
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "<?xml"))
+	assert.Contains(t, string(data), `tests="1" failures="0" skipped="0" time="1.500"`)
+	assert.Contains(t, string(data), `<testcase classname="bag" name="valid"></testcase>`)
+
+	report.AddFinding(&validation.Finding{
+		Code:      validation.FindingBadDigest,
+		Message:   "Bad md5 digest for 'data/x'",
+		FilePath:  "data/x",
+		Algorithm: "md5",
+		Expected:  "1234",
+		Actual:    "5678",
+	})
+	report.AddFinding(&validation.Finding{
+		Code:     validation.FindingManifestNotVerified,
+		Severity: validation.SeverityWarning,
+		Message:  "Not verifying checksums in manifest-sha1.txt",
+	})
+	data, err = report.ToJUnitXml()
+	require.Nil(t, err)
+
+	// Make sure it parses, and that errors are failures
+	// and warnings are skipped.
+	var parsed struct {
+		Suites []struct {
+			Tests     int `xml:"tests,attr"`
+			Failures  int `xml:"failures,attr"`
+			Skipped   int `xml:"skipped,attr"`
+			TestCases []struct {
+				Name    string `xml:"name,attr"`
+				Failure *struct {
+					Message string `xml:"message,attr"`
+					Details string `xml:",chardata"`
+				} `xml:"failure"`
+				Skipped *struct{} `xml:"skipped"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+	require.Nil(t, xml.Unmarshal(data, &parsed))
+	require.Equal(t, 1, len(parsed.Suites))
+	suite := parsed.Suites[0]
+	assert.Equal(t, 2, suite.Tests)
+	assert.Equal(t, 1, suite.Failures)
+	assert.Equal(t, 1, suite.Skipped)
+	require.Equal(t, 2, len(suite.TestCases))
+	assert.Equal(t, "data/x", suite.TestCases[0].Name)
+	require.NotNil(t, suite.TestCases[0].Failure)
+	assert.Equal(t, "Bad md5 digest for 'data/x'", suite.TestCases[0].Failure.Message)
+	assert.Contains(t, suite.TestCases[0].Failure.Details, "Expected: 1234")
+	assert.Contains(t, suite.TestCases[0].Failure.Details, "Actual: 5678")
+	assert.NotNil(t, suite.TestCases[1].Skipped)
+}
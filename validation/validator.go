@@ -2,8 +2,11 @@ package validation
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/models"
@@ -12,19 +15,40 @@ import (
 	"github.com/APTrust/exchange/util/storage"
 	"github.com/op/go-logging"
 	"github.com/satori/go.uuid"
+	"golang.org/x/text/unicode/norm"
 	"hash"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const VALIDATION_DB_SUFFIX = ".valdb"
 
-var TAR_SUFFIX = regexp.MustCompile("\\.tar$")
+// FETCH_DIR_SUFFIX is the suffix of the directory into which
+// the validator downloads the files listed in a bag's fetch.txt.
+const FETCH_DIR_SUFFIX = ".fetch"
+
+// Key of the items parsed from fetch.txt in the validation db's
+// meta bucket.
+const fetchItemsKey = "fetch_items"
+
+// manifestEntry identifies a file's entry in a manifest, so we can
+// report the manifest line number when the file's digest is wrong.
+type manifestEntry struct {
+	manifest     string
+	gfIdentifier string
+}
+
+// Tag files every bag may contain, regardless of
+// BagValidationConfig.TagFilesAllowed.
+var alwaysAllowedTagFiles = []string{"bagit.txt", "bag-info.txt", "fetch.txt"}
 
 // Validator validates a BagIt bag using a BagValidationConfig
 // object, which describes the bag's requirements.
@@ -34,6 +58,7 @@ type Validator struct {
 	PreserveExtendedAttributes bool
 	ObjIdentifier              string
 	summary                    *models.WorkSummary
+	report                     *ValidationReport
 	intelObj                   *models.IntellectualObject
 	tagFilesToParse            []string
 	manifests                  []string
@@ -41,7 +66,40 @@ type Validator struct {
 	requiredFiles              []string
 	forbiddenFiles             []string
 	calculateMd5               bool
+	calculateSha1              bool
 	calculateSha256            bool
+	calculateSha512            bool
+	payloadFileCount           int64
+	payloadByteCount           int64
+	totalByteCount             int64
+	fetchItems                 []*FetchItem
+	fetchedFileCount           int
+	sizesVerified              bool
+	normalizedPaths            map[string]string
+	foldedPaths                map[string]string
+	trackedDirs                map[string]bool
+	manifestLines              map[manifestEntry]int
+	canResume                  bool
+	checkpoint                 *hashCheckpoint
+	resumedFiles               map[string]bool
+
+	// HashWorkers is the number of goroutines that calculate checksums
+	// when validating an untarred bag. NewValidator sets this to the
+	// number of CPUs. Set it to 1 to hash files one at a time.
+	HashWorkers int
+
+	// FetchResolver downloads the files listed in fetch.txt.
+	// NewValidator sets this if the BagValidationConfig allows
+	// fetch.txt. Set it to nil to skip fetching, or replace it
+	// to change where and how files are fetched.
+	FetchResolver *FetchResolver
+
+	// BagETag is the S3 ETag of the serialized bag, if we downloaded
+	// it from S3. When this is set, the checkpoints that let us resume
+	// an interrupted validation are tied to the bag's ETag instead of
+	// its modification time, so they still apply after the bag is
+	// downloaded again. Leave this empty unless the download succeeded.
+	BagETag string
 
 	// Note that we can have only one open reference to the BoltDB
 	// at a time. If some other piece of code has this DB open,
@@ -57,8 +115,8 @@ type Validator struct {
 }
 
 // NewValidator creates a new Validator. Param pathToBag
-// should be an absolute path to either the tarred bag (.tar file)
-// or to the untarred bag (a directory). Param bagValidationConfig
+// should be an absolute path to either the serialized bag (.tar,
+// .tar.gz, .tgz or .zip file) or to the untarred bag (a directory). Param bagValidationConfig
 // defines what we need to validate, in addition to the checksums in the
 // manifests. If param preserveExtendedAttributes is true, the validator
 // will preserve special data attributes used by the APTrust ingest
@@ -72,7 +130,9 @@ func NewValidator(pathToBag string, bagValidationConfig *BagValidationConfig, pr
 		return nil, err
 	}
 	calculateMd5 := util.StringListContains(bagValidationConfig.FixityAlgorithms, constants.AlgMd5)
+	calculateSha1 := util.StringListContains(bagValidationConfig.FixityAlgorithms, constants.AlgSha1)
 	calculateSha256 := util.StringListContains(bagValidationConfig.FixityAlgorithms, constants.AlgSha256)
+	calculateSha512 := util.StringListContains(bagValidationConfig.FixityAlgorithms, constants.AlgSha512)
 	tagFilesToParse := make([]string, 0)
 	for pathToFile, filespec := range bagValidationConfig.FileSpecs {
 		if filespec.ParseAsTagFile {
@@ -91,7 +151,18 @@ func NewValidator(pathToBag string, bagValidationConfig *BagValidationConfig, pr
 		requiredFiles:              make([]string, 0),
 		forbiddenFiles:             make([]string, 0),
 		calculateMd5:               calculateMd5,
+		calculateSha1:              calculateSha1,
 		calculateSha256:            calculateSha256,
+		calculateSha512:            calculateSha512,
+		normalizedPaths:            make(map[string]string),
+		foldedPaths:                make(map[string]string),
+		trackedDirs:                make(map[string]bool),
+		manifestLines:              make(map[manifestEntry]int),
+	}
+	validator.report = NewValidationReport(pathToBag, validator.ObjIdentifier)
+	validator.HashWorkers = runtime.NumCPU()
+	if bagValidationConfig.AllowFetchTxt {
+		validator.FetchResolver = NewFetchResolver(validator.FetchDir())
 	}
 	return validator, nil
 }
@@ -123,26 +194,45 @@ func validateParams(pathToBag string, bagValidationConfig *BagValidationConfig)
 // DBName returns the name of the BoltDB file where the validator keeps
 // track of validation data.
 func (validator *Validator) DBName() string {
-	bagPath := validator.PathToBag
-	if strings.HasSuffix(bagPath, ".tar") {
-		bagPath = bagPath[0 : len(bagPath)-4]
-	}
+	bagPath := constants.SerializedBagSuffix.ReplaceAllString(validator.PathToBag, "")
 	if strings.HasSuffix(bagPath, string(os.PathSeparator)) {
 		bagPath = bagPath[0 : len(bagPath)-1]
 	}
 	return fmt.Sprintf("%s%s", bagPath, VALIDATION_DB_SUFFIX)
 }
 
-// getIterator returns either a tar file iterator or a filesystem
-// iterator, depending on whether we're reading a tarred bag or
-// an untarred one.
+// FetchDir returns the path to the directory into which the validator
+// downloads the files listed in the bag's fetch.txt. Files fetched
+// from remote URLs stay in this directory, under the same relative path
+// they would have inside the bag. E.g. data/images/photo.jpg.
+func (validator *Validator) FetchDir() string {
+	return strings.TrimSuffix(validator.DBName(), VALIDATION_DB_SUFFIX) + FETCH_DIR_SUFFIX
+}
+
+// getIterator returns an archive iterator (for .tar, .tar.gz, .tgz
+// or .zip files) or a filesystem iterator, depending on whether
+// we're reading a serialized bag or an untarred one.
 func (validator *Validator) getIterator() (fileutil.ReadIterator, error) {
-	if strings.HasSuffix(validator.PathToBag, ".tar") {
-		return fileutil.NewTarFileIterator(validator.PathToBag)
+	if validator.isSerialized() {
+		return fileutil.NewArchiveIterator(validator.PathToBag)
 	}
 	return fileutil.NewFileSystemIterator(validator.PathToBag)
 }
 
+// closeIterator closes the underlying file of an archive iterator.
+// Filesystem iterators don't need to be closed.
+func closeIterator(iterator fileutil.ReadIterator) {
+	if archiveIterator, ok := iterator.(fileutil.ArchiveIterator); ok {
+		archiveIterator.Close()
+	}
+}
+
+// isSerialized returns true if PathToBag has the extension of a
+// serialized bag that we know how to read.
+func (validator *Validator) isSerialized() bool {
+	return constants.SerializedBagSuffix.MatchString(validator.PathToBag)
+}
+
 // Validate reads and validates the bag, and returns a ValidationResult with
 // the IntellectualObject and any errors encountered during validation.
 func (validator *Validator) Validate() (*models.WorkSummary, error) {
@@ -155,16 +245,72 @@ func (validator *Validator) Validate() (*models.WorkSummary, error) {
 	validator.summary.Start()
 	validator.summary.Attempted = true
 	validator.summary.AttemptNumber += 1
-	validator.readBag()
+	// A truncated or padded bag fails here, before we spend
+	// time hashing it. We still run the checks that don't need
+	// checksums, so the depositor can fix everything at once.
+	sizesOk := validator.verifySizesBeforeHashing()
+	if sizesOk {
+		validator.readBag()
+		if !validator.sizesVerified {
+			validator.verifyPayloadOxum(validator.bagInfoTagValue("Payload-Oxum"),
+				validator.payloadByteCount, validator.payloadFileCount)
+			validator.verifyBagSize(validator.bagInfoTagValue("Bag-Size"), validator.totalByteCount)
+		}
+	} else {
+		validator.readBagWithoutHashing()
+	}
+	validator.verifySerialization()
 	validator.verifyManifestPresent()
+	validator.verifyTagManifestPresent()
+	validator.verifyManifestsAllowed()
 	validator.verifyTopLevelFolder()
 	validator.verifyFileSpecs()
 	validator.verifyTagSpecs()
-	validator.verifyGenericFiles()
+	validator.verifyDataEmpty()
+	if sizesOk {
+		validator.verifyGenericFiles()
+	}
 	validator.summary.Finish()
+	validator.report.StartedAt = validator.summary.StartedAt
+	validator.report.FinishedAt = validator.summary.FinishedAt
 	return validator.summary, nil
 }
 
+// Report returns a structured report of the problems found during
+// validation. The report has the same errors as the WorkSummary
+// returned by Validate(), plus any warnings.
+func (validator *Validator) Report() *ValidationReport {
+	return validator.report
+}
+
+// addError records a validation error in both the WorkSummary
+// and the ValidationReport.
+func (validator *Validator) addError(code, format string, a ...interface{}) {
+	validator.addFinding(&Finding{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// addFileError records a validation error that applies to the file
+// at filePath, which is relative to the bag's root directory.
+func (validator *Validator) addFileError(code, filePath, format string, a ...interface{}) {
+	validator.addFinding(&Finding{
+		Code:     code,
+		Message:  fmt.Sprintf(format, a...),
+		FilePath: filePath,
+	})
+}
+
+// addFinding adds a finding to the ValidationReport. Errors also
+// go into the WorkSummary. Warnings do not.
+func (validator *Validator) addFinding(finding *Finding) {
+	validator.report.AddFinding(finding)
+	if finding.Severity == SeverityError {
+		validator.summary.AddError("%s", finding.Message)
+	}
+}
+
 // readBag reads through the contents of the bag and creates a list of
 // GenericFiles. This function creates a lightweight record of the
 // IntellectualObject in the db, and a for each file in the bag
@@ -176,7 +322,7 @@ func (validator *Validator) readBag() {
 	// In refactor, don't call anything for side effects!
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Could not init object: %v", err)
+		validator.addError(FindingInternalError, "Could not init object: %v", err)
 		return
 	}
 	validator.intelObj = obj
@@ -192,11 +338,56 @@ func (validator *Validator) readBag() {
 
 	err = validator.db.Save(obj.Identifier, obj)
 	if err != nil {
-		validator.summary.AddError("Could not save intelObj metadata: %v", err)
+		validator.addError(FindingInternalError, "Could not save intelObj metadata: %v", err)
 	}
 	validator.log(fmt.Sprintf("Finished reading %s", validator.PathToBag))
 }
 
+// readBagWithoutHashing lists the files in the bag and parses its tag
+// files, without hashing anything. We use this instead of readBag when
+// the bag's sizes are wrong, so we can still report problems with its
+// files and tags. Nothing goes into the validation db, because a bag
+// with the wrong sizes has to be fixed and sent again anyway.
+func (validator *Validator) readBagWithoutHashing() {
+	validator.log(fmt.Sprintf("Listing files in %s without hashing", validator.PathToBag))
+	obj := validator.newIntellectualObject()
+	validator.intelObj = obj
+	iterator, err := validator.getIterator()
+	if err != nil {
+		validator.addError(FindingBagReadError, "Error getting file iterator: %v", err)
+		return
+	}
+	defer closeIterator(iterator)
+	for {
+		reader, fileSummary, err := iterator.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if reader != nil {
+				reader.Close()
+			}
+			validator.addError(FindingBagReadError, "Error reading bag: %s", err.Error())
+			return
+		}
+		if fileSummary.IsRegularFile {
+			gf := models.NewGenericFile()
+			gf.Identifier = fmt.Sprintf("%s/%s", validator.ObjIdentifier, fileSummary.RelPath)
+			gf.IntellectualObjectIdentifier = validator.ObjIdentifier
+			validator.setFileType(gf, fileSummary)
+			validator.trackFile(gf, fileSummary.Size)
+			if reader != nil && util.StringListContains(validator.tagFilesToParse, fileSummary.RelPath) {
+				validator.readTags(obj, reader, fileSummary.RelPath)
+			}
+		}
+		if reader != nil {
+			reader.Close()
+		}
+	}
+	obj.IngestTopLevelDirNames = iterator.GetTopLevelDirNames()
+	obj.IngestManifests = validator.manifests
+	obj.IngestTagManifests = validator.tagManifests
+}
+
 // getIntellectualObject returns a lightweight representation of the
 // IntellectualObject that this bag represents. The IntellectualObject
 // will not include PremisEvents or GenericFiles. GenericFiles are
@@ -217,38 +408,144 @@ func (validator *Validator) getIntellectualObject() (*models.IntellectualObject,
 
 // initIntellectualObject creates a barebones IntellectualObject.
 func (validator *Validator) initIntellectualObject() (*models.IntellectualObject, error) {
+	obj := validator.newIntellectualObject()
+	err := validator.db.Save(obj.Identifier, obj)
+	return obj, err
+}
+
+// newIntellectualObject returns a barebones IntellectualObject
+// without saving it.
+func (validator *Validator) newIntellectualObject() *models.IntellectualObject {
 	obj := models.NewIntellectualObject()
 	obj.Identifier = validator.ObjIdentifier
-	if strings.HasSuffix(validator.PathToBag, ".tar") {
+	if validator.isSerialized() {
 		obj.IngestTarFilePath = validator.PathToBag
 	} else {
 		obj.IngestUntarredPath = validator.PathToBag
 	}
-	err := validator.db.Save(obj.Identifier, obj)
-	return obj, err
+	return obj
 }
 
 // addFiles adds a record for each file to our validation database.
 func (validator *Validator) addFiles() {
 	validator.log(fmt.Sprintf("Creating file records for %s", validator.PathToBag))
+	validator.initResume()
 	iterator, err := validator.getIterator()
 	if err != nil {
-		validator.summary.AddError("Error getting file iterator: %v", err)
+		validator.addError(FindingBagReadError, "Error getting file iterator: %v", err)
+		return
+	}
+	validator.resumeFromCheckpoint(iterator)
+	validator.addFilesFrom(iterator)
+	closeIterator(iterator)
+	validator.intelObj.IngestTopLevelDirNames = validator.topLevelDirNames(iterator)
+	validator.intelObj.IngestManifests = validator.manifests
+	validator.intelObj.IngestTagManifests = validator.tagManifests
+
+	// Add files we download from the URLs in fetch.txt.
+	validator.resolveFetchTxt()
+}
+
+// addFilesFrom adds a record for each file in the iterator to
+// our validation database. Files on disk are hashed in parallel,
+// using HashWorkers goroutines. Files in a tar archive must be
+// read in order, so we hash those one at a time, saving a checkpoint
+// every so often so we can resume if we're interrupted.
+func (validator *Validator) addFilesFrom(iterator fileutil.ReadIterator) {
+	_, isFileSystem := iterator.(*fileutil.FileSystemIterator)
+	if isFileSystem && validator.HashWorkers > 1 {
+		validator.addFilesConcurrently(iterator)
 		return
 	}
+	tarIterator, isTar := iterator.(*fileutil.TarFileIterator)
+	filesRead := 0
 	for {
 		err := validator.addFile(iterator)
+		if err == nil {
+			filesRead += 1
+			if isTar && filesRead%checkpointInterval == 0 {
+				validator.saveCheckpoint(tarIterator.Offset(), validator.topLevelDirNames(tarIterator))
+			}
+		}
 		if err != nil && (err == io.EOF || err.Error() == "EOF") {
+			if isTar {
+				validator.saveCheckpoint(tarIterator.Offset(), validator.topLevelDirNames(tarIterator))
+			}
 			break // readIterator hit the end of the list
 		} else if err != nil {
-			validator.summary.AddError("Error reading bag: %s", err.Error())
+			validator.addError(FindingBagReadError, "Error reading bag: %s", err.Error())
 			validator.summary.ErrorIsFatal = true
 			break // PT #146289839: Stop on error, or memory usage explodes.
 		}
 	}
-	validator.intelObj.IngestTopLevelDirNames = iterator.GetTopLevelDirNames()
-	validator.intelObj.IngestManifests = validator.manifests
-	validator.intelObj.IngestTagManifests = validator.tagManifests
+}
+
+// readFetchTxt parses fetch.txt while we're reading the bag to hash
+// its files, so we don't need another pass through the bag to find it.
+// It returns a reader with the contents of fetch.txt, to be hashed in
+// place of param reader, which it closes. The items are also saved in
+// the validation db, in case a later run resumes past fetch.txt.
+func (validator *Validator) readFetchTxt(reader io.ReadCloser) io.ReadCloser {
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		validator.addError(FindingBagReadError, "Error reading fetch.txt: %v", err)
+		return ioutil.NopCloser(bytes.NewReader(data))
+	}
+	items, err := ParseFetchTxt(bytes.NewReader(data))
+	if err != nil {
+		validator.addError(FindingFetchError, "%s", err.Error())
+		return ioutil.NopCloser(bytes.NewReader(data))
+	}
+	validator.fetchItems = items
+	err = validator.db.SaveMetadata(fetchItemsKey, items)
+	if err != nil {
+		validator.log(fmt.Sprintf("Can't save fetch.txt items for %s: %v", validator.PathToBag, err))
+	}
+	return ioutil.NopCloser(bytes.NewReader(data))
+}
+
+// isFetchTxt returns true if the file is a fetch.txt we should resolve.
+func (validator *Validator) isFetchTxt(fileSummary *fileutil.FileSummary) bool {
+	return fileSummary.RelPath == "fetch.txt" && validator.FetchResolver != nil &&
+		validator.BagValidationConfig.AllowFetchTxt
+}
+
+// resolveFetchTxt downloads the files listed in the bag's fetch.txt,
+// which we parsed while adding the bag's files, and adds them to the
+// validation database. Files that are already in the bag are not
+// downloaded. Each file we can't fetch gets its own error in the
+// WorkSummary.
+func (validator *Validator) resolveFetchTxt() {
+	if validator.fetchItems == nil && validator.resumedFiles[validator.ObjIdentifier+"/fetch.txt"] {
+		// We skipped fetch.txt because an earlier run hashed it.
+		validator.db.GetMetadata(fetchItemsKey, &validator.fetchItems)
+	}
+	missingItems := make([]*FetchItem, 0)
+	for _, item := range validator.fetchItems {
+		if _, inBag := validator.normalizedPaths[norm.NFC.String(item.Path)]; !inBag {
+			missingItems = append(missingItems, item)
+		}
+	}
+	if len(missingItems) == 0 {
+		return
+	}
+	validator.log(fmt.Sprintf("Fetching %d files listed in fetch.txt for %s",
+		len(missingItems), validator.PathToBag))
+	fetchErrors := validator.FetchResolver.Resolve(missingItems)
+	for _, err := range fetchErrors {
+		validator.addError(FindingFetchError, "%s", err.Error())
+	}
+	validator.fetchedFileCount = len(missingItems) - len(fetchErrors)
+	if validator.fetchedFileCount == 0 {
+		return
+	}
+	fetchIterator, err := fileutil.NewFileSystemIterator(validator.FetchResolver.WorkDir)
+	if err != nil {
+		validator.addError(FindingFetchError, "Error getting iterator for fetched files: %v", err)
+		return
+	}
+	validator.addFilesFrom(fetchIterator)
 }
 
 // addFile adds a record for a single file to our validation database.
@@ -257,12 +554,42 @@ func (validator *Validator) addFile(readIterator fileutil.ReadIterator) error {
 	if err != nil {
 		return err
 	}
+	if reader != nil {
+		defer reader.Close()
+	}
 	if !fileSummary.IsRegularFile {
 		return nil
 	}
+	if reader != nil && validator.isFetchTxt(fileSummary) {
+		reader = validator.readFetchTxt(reader)
+	}
+	gf, alreadyHashed := validator.newGenericFile(fileSummary)
+	if alreadyHashed {
+		return nil
+	}
+	return validator.hashAndSave(reader, gf)
+}
+
+// newGenericFile creates the GenericFile record for a file in the bag,
+// and updates the validator's counts and lists of manifests, required
+// files, etc. This is not safe to call from multiple goroutines.
+//
+// If we're resuming an earlier run, and that run already hashed this
+// file, this returns the existing record and true, meaning the file
+// does not need to be hashed again.
+func (validator *Validator) newGenericFile(fileSummary *fileutil.FileSummary) (*models.GenericFile, bool) {
+	identifier := fmt.Sprintf("%s/%s", validator.ObjIdentifier, fileSummary.RelPath)
+	if validator.resumedFiles[identifier] {
+		// Skipped and accounted for in resumeFromCheckpoint.
+		return nil, true
+	}
+	if gf := validator.previouslyHashed(identifier, fileSummary); gf != nil {
+		validator.trackFile(gf, fileSummary.Size)
+		return gf, true
+	}
 
 	gf := models.NewGenericFile()
-	gf.Identifier = fmt.Sprintf("%s/%s", validator.ObjIdentifier, fileSummary.RelPath)
+	gf.Identifier = identifier
 
 	// Unfortunately, we need this to compute gf.OriginalPath()
 	gf.IntellectualObjectIdentifier = validator.ObjIdentifier
@@ -270,6 +597,7 @@ func (validator *Validator) addFile(readIterator fileutil.ReadIterator) error {
 	// Figure out whether this is a manifest, payload file, etc.
 	// This is not the same as setting the file's mime type.
 	validator.setFileType(gf, fileSummary)
+	validator.trackFile(gf, fileSummary.Size)
 
 	// The following info is used by the APTrust ingest process,
 	// but is not relevant to anyone doing validation outside
@@ -286,17 +614,40 @@ func (validator *Validator) addFile(readIterator fileutil.ReadIterator) error {
 		gf.IngestFileGid = fileSummary.Gid
 		validator.setMimeType(gf)
 	}
+	return gf, false
+}
+
+// trackFile updates the validator's counts and lists of manifests,
+// required files, etc. to include gf, which is size bytes long.
+func (validator *Validator) trackFile(gf *models.GenericFile, size int64) {
+	relPath := gf.OriginalPath()
+	switch gf.IngestFileType {
+	case constants.TAG_MANIFEST:
+		validator.tagManifests = append(validator.tagManifests, relPath)
+	case constants.PAYLOAD_MANIFEST:
+		validator.manifests = append(validator.manifests, relPath)
+	case constants.PAYLOAD_FILE:
+		validator.payloadFileCount += 1
+		validator.payloadByteCount += size
+	}
+	validator.totalByteCount += size
+	validator.trackFileName(relPath)
 
 	// Keep track of which required/forbidden files we encounter.
-	fileSpec, isInSpec := validator.BagValidationConfig.FileSpecs[gf.OriginalPath()]
+	fileSpec, isInSpec := validator.BagValidationConfig.FileSpecs[relPath]
 	if isInSpec {
 		if fileSpec.Presence == REQUIRED {
-			validator.requiredFiles = append(validator.requiredFiles, gf.OriginalPath())
+			validator.requiredFiles = append(validator.requiredFiles, relPath)
 		} else if fileSpec.Presence == FORBIDDEN {
-			validator.forbiddenFiles = append(validator.forbiddenFiles, gf.OriginalPath())
+			validator.forbiddenFiles = append(validator.forbiddenFiles, relPath)
 		}
 	}
+}
 
+// hashAndSave calculates the file's checksums and saves the GenericFile
+// to the validation database. This is safe to call from multiple
+// goroutines.
+func (validator *Validator) hashAndSave(reader io.Reader, gf *models.GenericFile) error {
 	// We calculate checksums in all contexts, because that's part of
 	// basic bag validation. Even if checksum calculation fails (which
 	// has not yet happened), we still want to keep a record of the
@@ -315,15 +666,25 @@ func (validator *Validator) addFile(readIterator fileutil.ReadIterator) error {
 func (validator *Validator) calculateChecksums(reader io.Reader, gf *models.GenericFile) error {
 	hashes := make([]io.Writer, 0)
 	var md5Hash hash.Hash
+	var sha1Hash hash.Hash
 	var sha256Hash hash.Hash
+	var sha512Hash hash.Hash
 	if validator.calculateMd5 {
 		md5Hash = md5.New()
 		hashes = append(hashes, md5Hash)
 	}
+	if validator.calculateSha1 {
+		sha1Hash = sha1.New()
+		hashes = append(hashes, sha1Hash)
+	}
 	if validator.calculateSha256 {
 		sha256Hash = sha256.New()
 		hashes = append(hashes, sha256Hash)
 	}
+	if validator.calculateSha512 {
+		sha512Hash = sha512.New()
+		hashes = append(hashes, sha512Hash)
+	}
 	if len(hashes) > 0 {
 		multiWriter := io.MultiWriter(hashes...)
 		io.Copy(multiWriter, reader)
@@ -334,29 +695,39 @@ func (validator *Validator) calculateChecksums(reader io.Reader, gf *models.Gene
 				gf.IngestMd5GeneratedAt = utcNow
 			}
 		}
+		if sha1Hash != nil {
+			gf.IngestSha1 = fmt.Sprintf("%x", sha1Hash.Sum(nil))
+			if validator.PreserveExtendedAttributes {
+				gf.IngestSha1GeneratedAt = utcNow
+			}
+		}
 		if sha256Hash != nil {
 			gf.IngestSha256 = fmt.Sprintf("%x", sha256Hash.Sum(nil))
 			if validator.PreserveExtendedAttributes {
 				gf.IngestSha256GeneratedAt = utcNow
 			}
 		}
+		if sha512Hash != nil {
+			gf.IngestSha512 = fmt.Sprintf("%x", sha512Hash.Sum(nil))
+			if validator.PreserveExtendedAttributes {
+				gf.IngestSha512GeneratedAt = utcNow
+			}
+		}
 	}
 	return nil
 }
 
 // setFileType figures whether a file is a manifest, tag manifest,
-// tag file or payload file. If the file is a manifest that we'll
-// need to parse during the second phase of validation, this will
-// add it to the list of Manifests or TagManifests.
+// tag file or payload file. See trackFile for the lists of Manifests
+// and TagManifests that we'll need to parse during the second phase
+// of validation.
 func (validator *Validator) setFileType(gf *models.GenericFile, fileSummary *fileutil.FileSummary) {
 	if strings.HasPrefix(fileSummary.RelPath, "tagmanifest-") {
 		gf.IngestFileType = constants.TAG_MANIFEST
 		gf.FileFormat = "text/plain"
-		validator.tagManifests = append(validator.tagManifests, fileSummary.RelPath)
 	} else if strings.HasPrefix(fileSummary.RelPath, "manifest-") {
 		gf.IngestFileType = constants.PAYLOAD_MANIFEST
 		gf.FileFormat = "text/plain"
-		validator.manifests = append(validator.manifests, fileSummary.RelPath)
 	} else if strings.HasPrefix(fileSummary.RelPath, "data/") {
 		gf.IngestFileType = constants.PAYLOAD_FILE
 	} else {
@@ -373,9 +744,10 @@ func (validator *Validator) parseFiles() {
 	// forward-only. We can't rewind it.
 	readIterator, err := validator.getIterator()
 	if err != nil {
-		validator.summary.AddError("Error getting file iterator: %v", err)
+		validator.addError(FindingBagReadError, "Error getting file iterator: %v", err)
 		return
 	}
+	defer closeIterator(readIterator)
 	for {
 		// Don't use "defer reader.Close()" because the readers
 		// won't be closed until we exit the enclosing funcion,
@@ -404,7 +776,7 @@ func (validator *Validator) parseFiles() {
 			} else {
 				msg = err.Error()
 			}
-			validator.summary.AddError(msg)
+			validator.addError(FindingBagReadError, "%s", msg)
 			if len(validator.summary.Errors) > 100 {
 				if reader != nil {
 					reader.Close()
@@ -427,14 +799,14 @@ func (validator *Validator) parseFiles() {
 		gfIdentifier := fmt.Sprintf("%s/%s", validator.ObjIdentifier, fileSummary.RelPath)
 		gf, err := validator.db.GetGenericFile(gfIdentifier)
 		if err != nil {
-			validator.summary.AddError("Error finding '%s' in validation db: %v", gfIdentifier, err)
+			validator.addError(FindingInternalError, "Error finding '%s' in validation db: %v", gfIdentifier, err)
 			if reader != nil {
 				reader.Close()
 			}
 			continue
 		}
 		if gf == nil {
-			validator.summary.AddError("Cannot find '%s' in validation db", gfIdentifier)
+			validator.addError(FindingInternalError, "Cannot find '%s' in validation db", gfIdentifier)
 			if reader != nil {
 				reader.Close()
 			}
@@ -451,7 +823,7 @@ func (validator *Validator) setStorageOption() {
 	validator.log(fmt.Sprintf("Setting storage option for %s", validator.PathToBag))
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Error getting IntelObj from validation db: %v", err)
+		validator.addError(FindingInternalError, "Error getting IntelObj from validation db: %v", err)
 		return
 	}
 	obj.StorageOption = constants.StorageStandard
@@ -463,20 +835,20 @@ func (validator *Validator) setStorageOption() {
 	// Save obj with new StorageOption
 	err = validator.db.Save(obj.Identifier, obj)
 	if err != nil {
-		validator.summary.AddError("Error saving IntelObj '%s' to db: %v", obj.Identifier, err)
+		validator.addError(FindingInternalError, "Error saving IntelObj '%s' to db: %v", obj.Identifier, err)
 	}
 
 	gfIdentifiers := validator.db.FileIdentifiers()
 	for _, gfIdentifier := range gfIdentifiers {
 		gf, err := validator.db.GetGenericFile(gfIdentifier)
 		if err != nil {
-			validator.summary.AddError("Error getting file %s from validation db: %v", gfIdentifier, err)
+			validator.addError(FindingInternalError, "Error getting file %s from validation db: %v", gfIdentifier, err)
 			return
 		}
 		gf.StorageOption = obj.StorageOption
 		err = validator.db.Save(gfIdentifier, gf)
 		if err != nil {
-			validator.summary.AddError("Error saving generic file '%s' to db: %v", gfIdentifier, err)
+			validator.addError(FindingInternalError, "Error saving generic file '%s' to db: %v", gfIdentifier, err)
 		}
 	}
 }
@@ -505,13 +877,23 @@ func (validator *Validator) parseFile(reader io.ReadCloser, gf *models.GenericFi
 func (validator *Validator) parseTags(reader io.Reader, relFilePath string) {
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Error getting IntelObj from validation db: %v", err)
+		validator.addError(FindingInternalError, "Error getting IntelObj from validation db: %v", err)
 		return
 	}
 	if obj == nil {
-		validator.summary.AddError("IntelObj '%s' is missing from validation db", validator.ObjIdentifier)
+		validator.addError(FindingInternalError, "IntelObj '%s' is missing from validation db", validator.ObjIdentifier)
 		return
 	}
+	validator.readTags(obj, reader, relFilePath)
+	err = validator.db.Save(validator.ObjIdentifier, obj)
+	if err != nil {
+		validator.addError(FindingInternalError, "Could not save IntelObj after parsing tags: %v", err)
+	}
+}
+
+// readTags adds the tags in a bagit-format tag file to obj, without
+// saving obj.
+func (validator *Validator) readTags(obj *models.IntellectualObject, reader io.Reader, relFilePath string) {
 	re := regexp.MustCompile(`^(\S*\:)?(\s*.*)?$`)
 	scanner := bufio.NewScanner(reader)
 	var tag *models.Tag
@@ -538,20 +920,16 @@ func (validator *Validator) parseTags(reader io.Reader, relFilePath string) {
 				validator.SetIntelObjTagValue(obj, tag)
 			}
 		} else {
-			validator.summary.AddError("Unable to parse tag data from line: '%s'", line)
+			validator.addError(FindingTagParseError, "Unable to parse tag data from line: '%s'", line)
 		}
 	}
 	if tag != nil && tag.Label != "" {
 		obj.IngestTags = append(obj.IngestTags, tag)
 	}
 	if scanner.Err() != nil {
-		validator.summary.AddError("Error reading tag file '%s': %v",
+		validator.addError(FindingTagParseError, "Error reading tag file '%s': %v",
 			relFilePath, scanner.Err().Error())
 	}
-	err = validator.db.Save(validator.ObjIdentifier, obj)
-	if err != nil {
-		validator.summary.AddError("Could not save IntelObj after parsing tags: %v", err)
-	}
 }
 
 // Copy certain values from the aptrust-info.txt file into
@@ -598,21 +976,34 @@ func (validator *Validator) SetIntelObjTagValue(obj *models.IntellectualObject,
 //
 // TODO: Move this into a separate file and make it more generic.
 func (validator *Validator) parseManifest(reader io.Reader, fileSummary *fileutil.FileSummary) {
-	alg := ""
-	if strings.Contains(fileSummary.RelPath, constants.AlgSha256) {
-		alg = constants.AlgSha256
-	} else if strings.Contains(fileSummary.RelPath, constants.AlgMd5) {
-		alg = constants.AlgMd5
-	} else {
-		fmt.Fprintln(os.Stderr, "Not verifying checksums in", fileSummary.RelPath,
-			"- unsupported algorithm. Will still verify any md5 or sha256 checksums. "+
-				"Bag ", validator.PathToBag)
+	alg := manifestAlgorithm(fileSummary.RelPath)
+	if !util.StringListContains(constants.ChecksumAlgorithms, alg) {
+		validator.addFinding(&Finding{
+			Code:     FindingManifestNotVerified,
+			Severity: SeverityWarning,
+			Message: fmt.Sprintf("Can't verify checksums in %s: unsupported algorithm '%s'. "+
+				"Supported algorithms are %s.", fileSummary.RelPath, alg,
+				algorithmList(constants.ChecksumAlgorithms)),
+			Manifest:  fileSummary.RelPath,
+			Algorithm: alg,
+		})
+		return
+	}
+	if !util.StringListContains(validator.BagValidationConfig.FixityAlgorithms, alg) {
+		validator.addFinding(&Finding{
+			Code:      FindingManifestNotVerified,
+			Severity:  SeverityWarning,
+			Message:   fmt.Sprintf("Not verifying checksums in %s: algorithm is not in FixityAlgorithms.", fileSummary.RelPath),
+			Manifest:  fileSummary.RelPath,
+			Algorithm: alg,
+		})
 		return
 	}
 	re := regexp.MustCompile(`^(\S*)\s*(.*)`)
 	scanner := bufio.NewScanner(reader)
-	lineNum := 1
+	lineNum := 0
 	for scanner.Scan() {
+		lineNum += 1
 		updateGenericFile := false
 		line := scanner.Text()
 		if strings.TrimSpace(line) == "" {
@@ -626,47 +1017,372 @@ func (validator *Validator) parseManifest(reader io.Reader, fileSummary *fileuti
 			gfIdentifier := fmt.Sprintf("%s/%s", validator.ObjIdentifier, filePath)
 			genericFile, err := validator.db.GetGenericFile(gfIdentifier)
 			if err != nil {
-				validator.summary.AddError("Error finding generic file '%s' in db: %v", gfIdentifier, err)
+				validator.addError(FindingInternalError, "Error finding generic file '%s' in db: %v", gfIdentifier, err)
 			}
 			if genericFile == nil {
-				validator.summary.AddError(
-					"File '%s' in manifest '%s' is missing from bag",
-					filePath, fileSummary.RelPath)
+				genericFile, gfIdentifier = validator.findNormalizedMatch(filePath, fileSummary.RelPath, lineNum)
+			}
+			if genericFile == nil {
+				validator.addFinding(&Finding{
+					Code: FindingFileMissing,
+					Message: fmt.Sprintf("File '%s' in manifest '%s' is missing from bag",
+						filePath, fileSummary.RelPath),
+					FilePath:   filePath,
+					Manifest:   fileSummary.RelPath,
+					LineNumber: lineNum,
+				})
 				continue
 			}
 
 			// If we got a digest from this line of the manifest,
 			// set it on the GenericFile and save the record back
 			// to the database.
-			if alg == constants.AlgMd5 {
+			validator.manifestLines[manifestEntry{fileSummary.RelPath, gfIdentifier}] = lineNum
+			switch alg {
+			case constants.AlgMd5:
 				genericFile.IngestManifestMd5 = digest
 				updateGenericFile = true
-			} else if alg == constants.AlgSha256 {
+			case constants.AlgSha1:
+				genericFile.IngestManifestSha1 = digest
+				updateGenericFile = true
+			case constants.AlgSha256:
 				genericFile.IngestManifestSha256 = digest
 				updateGenericFile = true
+			case constants.AlgSha512:
+				genericFile.IngestManifestSha512 = digest
+				updateGenericFile = true
 			}
 			if updateGenericFile {
 				err = validator.db.Save(gfIdentifier, genericFile)
 				if err != nil {
-					validator.summary.AddError("Error saving generic file '%s' to db: %v", gfIdentifier, err)
+					validator.addError(FindingInternalError, "Error saving generic file '%s' to db: %v", gfIdentifier, err)
 				}
 			}
 		} else {
-			validator.summary.AddError(fmt.Sprintf(
-				"Unable to parse data from line %d of manifest %s: %s",
-				lineNum, fileSummary.RelPath, line))
+			validator.addFinding(&Finding{
+				Code: FindingManifestParseError,
+				Message: fmt.Sprintf("Unable to parse data from line %d of manifest %s: %s",
+					lineNum, fileSummary.RelPath, line),
+				Manifest:   fileSummary.RelPath,
+				LineNumber: lineNum,
+			})
 		}
-		lineNum += 1
 	}
 }
 
+// verifySizesBeforeHashing checks Payload-Oxum and Bag-Size before
+// we read any file contents. For a tarred bag, the sizes come from the
+// tar headers, which the tar reader can skip between without reading
+// the data. For an untarred bag, they come from the file system.
+// It returns false if the sizes don't match what bag-info.txt says.
+//
+// Gzipped and zipped bags would have to be decompressed to find their
+// sizes, and so would holey bags, whose payload isn't all there until
+// we fetch it. Those are checked after they're read.
+func (validator *Validator) verifySizesBeforeHashing() bool {
+	iterator, err := validator.getIterator()
+	if err != nil {
+		// readBag will report this.
+		return true
+	}
+	defer closeIterator(iterator)
+	switch iterator.(type) {
+	case *fileutil.TarFileIterator, *fileutil.FileSystemIterator:
+	default:
+		return true
+	}
+	var payloadBytes, payloadFiles, totalBytes int64
+	var bagInfo map[string]string
+	for {
+		reader, fileSummary, err := iterator.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// So will this.
+			if reader != nil {
+				reader.Close()
+			}
+			return true
+		}
+		if fileSummary.IsRegularFile {
+			totalBytes += fileSummary.Size
+			if strings.HasPrefix(fileSummary.RelPath, "data/") {
+				payloadBytes += fileSummary.Size
+				payloadFiles += 1
+			}
+			if fileSummary.RelPath == "bag-info.txt" && reader != nil {
+				bagInfo = readTagValues(reader)
+			}
+		}
+		if reader != nil {
+			reader.Close()
+		}
+		if fileSummary.IsRegularFile && validator.isFetchTxt(fileSummary) {
+			return true
+		}
+	}
+	validator.sizesVerified = true
+	errorCount := len(validator.summary.Errors)
+	validator.verifyPayloadOxum(bagInfo["Payload-Oxum"], payloadBytes, payloadFiles)
+	validator.verifyBagSize(bagInfo["Bag-Size"], totalBytes)
+	return len(validator.summary.Errors) == errorCount
+}
+
+// verifyPayloadOxum compares the Payload-Oxum tag in bag-info.txt,
+// if there is one, to the number of payload files and bytes we found
+// in the bag. A mismatch usually means the bag was truncated or padded
+// in transit.
+func (validator *Validator) verifyPayloadOxum(oxum string, payloadBytes, payloadFiles int64) {
+	if oxum == "" {
+		return
+	}
+	parts := strings.Split(oxum, ".")
+	if len(parts) != 2 {
+		validator.addError(FindingPayloadOxum,
+			"Payload-Oxum '%s' is not valid. It should be <bytes>.<file count>.", oxum)
+		return
+	}
+	expectedBytes, bytesErr := strconv.ParseInt(parts[0], 10, 64)
+	expectedFiles, filesErr := strconv.ParseInt(parts[1], 10, 64)
+	if bytesErr != nil || filesErr != nil {
+		validator.addError(FindingPayloadOxum,
+			"Payload-Oxum '%s' is not valid. It should be <bytes>.<file count>.", oxum)
+		return
+	}
+	if expectedBytes != payloadBytes || expectedFiles != payloadFiles {
+		validator.addError(FindingPayloadOxum,
+			"Payload-Oxum mismatch: expected %d bytes/%d files, found %d bytes/%d files",
+			expectedBytes, expectedFiles, payloadBytes, payloadFiles)
+	}
+}
+
+// verifyBagSize compares the Bag-Size tag in bag-info.txt to the
+// total size of all files in the bag, if the BagValidationConfig
+// says to. Bag-Size is human-readable and approximate, and the
+// spec doesn't say whether a kilobyte is 1000 or 1024 bytes, so
+// we accept any value within 10% of the actual size in either
+// interpretation.
+func (validator *Validator) verifyBagSize(bagSize string, totalBytes int64) {
+	if !validator.BagValidationConfig.VerifyBagSize || bagSize == "" {
+		return
+	}
+	decimalSize, binarySize, err := parseBagSize(bagSize)
+	if err != nil {
+		validator.addError(FindingBagSize, "Bag-Size '%s' is not valid: %v", bagSize, err)
+		return
+	}
+	actual := float64(totalBytes)
+	if math.Abs(decimalSize-actual) > actual*0.1 && math.Abs(binarySize-actual) > actual*0.1 {
+		validator.addError(FindingBagSize,
+			"Bag-Size mismatch: bag-info.txt says '%s', but bag contains %d bytes",
+			bagSize, totalBytes)
+	}
+}
+
+// readTagValues returns the value of the first tag with each label
+// in a bagit-format tag file. Unlike parseTags, this doesn't save
+// anything, and it ignores lines it can't parse.
+func readTagValues(reader io.Reader) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		colon := strings.Index(line, ":")
+		if colon < 1 || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		label := strings.TrimSpace(line[:colon])
+		if _, exists := values[label]; !exists {
+			values[label] = strings.TrimSpace(line[colon+1:])
+		}
+	}
+	return values
+}
+
+// bagInfoTagValue returns the trimmed value of the first tag in
+// bag-info.txt with the specified name, or an empty string.
+func (validator *Validator) bagInfoTagValue(tagName string) string {
+	obj, err := validator.getIntellectualObject()
+	if err != nil {
+		validator.addError(FindingInternalError, "Cannot get object metadata from db: %v", err)
+		return ""
+	}
+	for _, tag := range obj.FindTag(tagName) {
+		if tag.SourceFile == "bag-info.txt" {
+			return strings.TrimSpace(tag.Value)
+		}
+	}
+	return ""
+}
+
+// bagSizeUnits maps the units that may appear in a Bag-Size tag
+// to their exponents.
+var bagSizeUnits = map[string]float64{
+	"":      0,
+	"B":     0,
+	"BYTE":  0,
+	"BYTES": 0,
+	"K":     1,
+	"KB":    1,
+	"KIB":   1,
+	"M":     2,
+	"MB":    2,
+	"MIB":   2,
+	"G":     3,
+	"GB":    3,
+	"GIB":   3,
+	"T":     4,
+	"TB":    4,
+	"TIB":   4,
+}
+
+var bagSizeRegex = regexp.MustCompile(`^([0-9]*\.?[0-9]+)\s*([A-Za-z]*)$`)
+
+// parseBagSize parses a human-readable Bag-Size value, such as
+// "260 MB", and returns the number of bytes it describes, assuming
+// first that a kilobyte is 1000 bytes, and then that it's 1024 bytes.
+func parseBagSize(bagSize string) (decimalSize, binarySize float64, err error) {
+	match := bagSizeRegex.FindStringSubmatch(strings.TrimSpace(bagSize))
+	if match == nil {
+		return 0, 0, fmt.Errorf("expected a number followed by an optional unit")
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	exponent, ok := bagSizeUnits[strings.ToUpper(match[2])]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown unit '%s'", match[2])
+	}
+	return number * math.Pow(1000, exponent), number * math.Pow(1024, exponent), nil
+}
+
 // verifyManifestPresent checks to see if at least one payload manifest
 // is present in the bag. If not, it adds an error message to the
 // WorkSummary.
 func (validator *Validator) verifyManifestPresent() {
 	validator.log(fmt.Sprintf("Verifying manifests present for %s", validator.PathToBag))
 	if len(validator.manifests) == 0 {
-		validator.summary.AddError("Bag contains no payload manifest.")
+		validator.addError(FindingManifestMissing, "Bag contains no payload manifest.")
+	}
+}
+
+// verifyTagManifestPresent checks to see if at least one tag manifest
+// is present in the bag, if the BagValidationConfig requires one. If
+// none of the tag manifests use an algorithm in FixityAlgorithms, we
+// can't verify them, and we say so once here, instead of reporting
+// every tag file as missing from the tag manifest.
+func (validator *Validator) verifyTagManifestPresent() {
+	if !validator.BagValidationConfig.RequireTagManifest {
+		return
+	}
+	if len(validator.tagManifests) == 0 {
+		validator.addError(FindingTagManifestMissing, "Bag contains no tag manifest.")
+	} else if !validator.canVerifyTagManifest() {
+		validator.addFinding(&Finding{
+			Code: FindingManifestNotVerified,
+			Message: fmt.Sprintf("Can't verify tag files: no tag manifest uses %s. Tag manifests: %s.",
+				algorithmList(validator.BagValidationConfig.FixityAlgorithms),
+				strings.Join(validator.tagManifests, ", ")),
+		})
+	}
+}
+
+// canVerifyTagManifest returns true if at least one of the bag's tag
+// manifests uses an algorithm in FixityAlgorithms.
+func (validator *Validator) canVerifyTagManifest() bool {
+	for _, tagManifest := range validator.tagManifests {
+		if util.StringListContains(validator.BagValidationConfig.FixityAlgorithms,
+			manifestAlgorithm(tagManifest)) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyManifestsAllowed ensures the bag contains no payload manifests
+// or tag manifests for algorithms the BagValidationConfig does not allow.
+func (validator *Validator) verifyManifestsAllowed() {
+	config := validator.BagValidationConfig
+	if len(config.ManifestsAllowed) > 0 {
+		for _, manifest := range validator.manifests {
+			alg := manifestAlgorithm(manifest)
+			if !util.StringListContains(config.ManifestsAllowed, alg) {
+				validator.addError(FindingManifestNotAllowed,
+					"Payload manifest '%s' is not allowed. Allowed algorithms: %s.",
+					manifest, strings.Join(config.ManifestsAllowed, ", "))
+			}
+		}
+	}
+	if len(config.TagManifestsAllowed) > 0 {
+		for _, manifest := range validator.tagManifests {
+			alg := manifestAlgorithm(manifest)
+			if !util.StringListContains(config.TagManifestsAllowed, alg) {
+				validator.addError(FindingManifestNotAllowed,
+					"Tag manifest '%s' is not allowed. Allowed algorithms: %s.",
+					manifest, strings.Join(config.TagManifestsAllowed, ", "))
+			}
+		}
+	}
+}
+
+// manifestAlgorithm returns the digest algorithm of a manifest or
+// tag manifest, based on its name. E.g. "tagmanifest-sha256.txt"
+// returns "sha256".
+func manifestAlgorithm(relPath string) string {
+	alg := strings.TrimSuffix(relPath, ".txt")
+	return alg[strings.Index(alg, "-")+1:]
+}
+
+// algorithmList returns a list of algorithms for error messages,
+// like "md5, sha1 or sha256".
+func algorithmList(algs []string) string {
+	if len(algs) < 2 {
+		return strings.Join(algs, "")
+	}
+	return strings.Join(algs[:len(algs)-1], ", ") + " or " + algs[len(algs)-1]
+}
+
+// verifySerialization ensures the bag is tarred if the BagValidationConfig
+// requires serialization, and untarred if serialization is forbidden.
+// If the bag is tarred, the tar file's mime type must be one of the
+// accepted serialization formats.
+func (validator *Validator) verifySerialization() {
+	config := validator.BagValidationConfig
+	stat, err := os.Stat(validator.PathToBag)
+	if err != nil {
+		validator.addError(FindingBagReadError, "Cannot stat bag: %v", err)
+		return
+	}
+	isSerialized := !stat.IsDir()
+	if config.Serialization == REQUIRED && !isSerialized {
+		validator.addError(FindingSerialization, "Bag must be serialized, but it's a directory.")
+	} else if config.Serialization == FORBIDDEN && isSerialized {
+		validator.addError(FindingSerialization, "Bag must not be serialized, but it's a file.")
+	}
+	if !isSerialized || len(config.AcceptSerialization) == 0 {
+		return
+	}
+	mimeType := serializationMimeType(validator.PathToBag)
+	for _, accepted := range config.AcceptSerialization {
+		if normalizeSerialization(accepted) == mimeType {
+			return
+		}
+	}
+	validator.addError(FindingSerialization, "Bag serialization '%s' is not one of the accepted formats: %s.",
+		mimeType, strings.Join(config.AcceptSerialization, ", "))
+}
+
+// verifyDataEmpty ensures the payload is empty, if the BagValidationConfig
+// says it must be. An empty payload may contain one zero-length file.
+func (validator *Validator) verifyDataEmpty() {
+	if !validator.BagValidationConfig.DataEmpty {
+		return
+	}
+	if validator.payloadFileCount > 1 || validator.payloadByteCount > 0 {
+		validator.addError(FindingDataNotEmpty,
+			"Payload must be empty, but it contains %d files totalling %d bytes.",
+			validator.payloadFileCount, validator.payloadByteCount)
 	}
 }
 
@@ -677,7 +1393,7 @@ func (validator *Validator) verifyTopLevelFolder() {
 	validator.log(fmt.Sprintf("Verifying top-level folder for %s", validator.PathToBag))
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Can't get object: %v", err)
+		validator.addError(FindingInternalError, "Can't get object: %v", err)
 		return
 	}
 	if obj.IngestTarFilePath == "" {
@@ -691,12 +1407,12 @@ func (validator *Validator) verifyTopLevelFolder() {
 		parts := strings.Split(obj.IngestTarFilePath, "\\")
 		baseName = parts[len(parts)-1]
 	}
-	expectedDirName := TAR_SUFFIX.ReplaceAllString(baseName, "")
+	expectedDirName := constants.SerializedBagSuffix.ReplaceAllString(baseName, "")
 	dirNames := obj.IngestTopLevelDirNames
 	if dirNames != nil {
 		for _, dirName := range dirNames {
 			if dirName != expectedDirName {
-				validator.summary.AddError(
+				validator.addError(FindingWrongTopLevelDir,
 					"Tarred bag should untar to directory '%s', not '%s'",
 					expectedDirName, dirName)
 			}
@@ -710,9 +1426,9 @@ func (validator *Validator) verifyFileSpecs() {
 	validator.log(fmt.Sprintf("Checking required/forbidden files for %s", validator.PathToBag))
 	for gfPath, fileSpec := range validator.BagValidationConfig.FileSpecs {
 		if fileSpec.Presence == REQUIRED && !util.StringListContains(validator.requiredFiles, gfPath) {
-			validator.summary.AddError("Required file '%s' is missing.", gfPath)
+			validator.addFileError(FindingRequiredFileMissing, gfPath, "Required file '%s' is missing.", gfPath)
 		} else if fileSpec.Presence == FORBIDDEN && util.StringListContains(validator.forbiddenFiles, gfPath) {
-			validator.summary.AddError("Bag contains forbidden file '%s'.", gfPath)
+			validator.addFileError(FindingForbiddenFile, gfPath, "Bag contains forbidden file '%s'.", gfPath)
 		}
 
 	}
@@ -723,19 +1439,25 @@ func (validator *Validator) verifyTagSpecs() {
 	validator.log(fmt.Sprintf("Verifying tags for %s", validator.PathToBag))
 	obj, err := validator.getIntellectualObject()
 	if err != nil {
-		validator.summary.AddError("Cannot get object metadata from db: %v", err)
+		validator.addError(FindingInternalError, "Cannot get object metadata from db: %v", err)
 		return
 	}
 	for tagName, tagSpec := range validator.BagValidationConfig.TagSpecs {
 		tags := obj.FindTag(tagName)
 		if tagSpec.Presence == FORBIDDEN {
-			validator.summary.AddError("Forbidden tag '%s' found in file '%s'.",
-				tagName, tags[0].SourceFile)
+			if len(tags) > 0 {
+				validator.addError(FindingForbiddenTag, "Forbidden tag '%s' found in file '%s'.",
+					tagName, tags[0].SourceFile)
+			}
 			continue
 		}
 		if tagSpec.Presence == REQUIRED {
 			validator.checkRequiredTag(tagName, tags, tagSpec)
 		}
+		if tagSpec.NonRepeatable && len(tags) > 1 {
+			validator.addError(FindingTagRepeated, "Tag '%s' appears %d times, but it may appear only once.",
+				tagName, len(tags))
+		}
 		if tags != nil && tagSpec.AllowedValues != nil && len(tagSpec.AllowedValues) > 0 {
 			validator.checkAllowedTagValue(tagName, tags, tagSpec)
 		}
@@ -746,7 +1468,7 @@ func (validator *Validator) verifyTagSpecs() {
 // It adds and error to the WorkSummary if not.
 func (validator *Validator) checkRequiredTag(tagName string, tags []*models.Tag, tagSpec TagSpec) {
 	if tags == nil {
-		validator.summary.AddError("Required tag '%s' is missing.", tagName)
+		validator.addError(FindingRequiredTagMissing, "Required tag '%s' is missing.", tagName)
 		return
 	}
 	if !tagSpec.EmptyOK {
@@ -758,7 +1480,7 @@ func (validator *Validator) checkRequiredTag(tagName string, tags []*models.Tag,
 			}
 		}
 		if !tagHasValue {
-			validator.summary.AddError("Value for tag '%s' is missing.", tagName)
+			validator.addError(FindingTagValueMissing, "Value for tag '%s' is missing.", tagName)
 		}
 	}
 }
@@ -780,7 +1502,7 @@ func (validator *Validator) checkAllowedTagValue(tagName string, tags []*models.
 		}
 	}
 	if !valueOk {
-		validator.summary.AddError("Tag '%s' has illegal value '%s'.", tagName, lastValue)
+		validator.addError(FindingIllegalTagValue, "Tag '%s' has illegal value '%s'.", tagName, lastValue)
 	}
 }
 
@@ -792,52 +1514,68 @@ func (validator *Validator) verifyGenericFiles() {
 	detail := validator.fileValidationDetail()
 	gfIdentifiers := validator.db.FileIdentifiers()
 	validator.log(fmt.Sprintf("Housekeeping DB %d has files for %s", len(gfIdentifiers), validator.PathToBag))
+	// If we can't verify any tag manifest, verifyTagManifestPresent
+	// has already said so.
+	checkTagManifestEntries := validator.BagValidationConfig.RequireTagManifest &&
+		validator.canVerifyTagManifest()
 	count := 0
 	for _, gfIdentifier := range gfIdentifiers {
 		gf, err := validator.db.GetGenericFile(gfIdentifier)
 		if err != nil {
-			validator.summary.AddError("Cannot get GenericFile %s from BoltDB: %v", gfIdentifier, err)
+			validator.addError(FindingInternalError, "Cannot get GenericFile %s from BoltDB: %v", gfIdentifier, err)
 			validator.summary.ErrorIsFatal = true
 			return
 		}
 		// Flag illegal fetch.txt
 		if gf.OriginalPath() == "fetch.txt" && validator.BagValidationConfig.AllowFetchTxt == false {
-			validator.summary.AddError("Bag contains a fetch.txt file, but the profile does not allow it.")
+			validator.addError(FindingFetchTxtNotAllowed, "Bag contains a fetch.txt file, but the profile does not allow it.")
 		}
 
-		// Md5 digests
-		if gf.IngestManifestMd5 != "" && gf.IngestManifestMd5 != gf.IngestMd5 {
-			validator.summary.AddError(
-				"Bad md5 digest for '%s': manifest says '%s', file digest is '%s'",
-				gf.OriginalPath(), gf.IngestManifestMd5, gf.IngestMd5)
-		} else {
+		// Compare digests from the manifests and tag manifests
+		// to the digests we calculated.
+		if validator.digestMatches(gf, constants.AlgMd5, gf.IngestManifestMd5, gf.IngestMd5) {
 			gf.IngestMd5VerifiedAt = time.Now().UTC()
 		}
-		// Sha256 digests
-		if gf.IngestManifestSha256 != "" && gf.IngestManifestSha256 != gf.IngestSha256 {
-			validator.summary.AddError(
-				"Bad sha256 digest for '%s': manifest says '%s', file digest is '%s'",
-				gf.OriginalPath(), gf.IngestManifestSha256, gf.IngestSha256)
-		} else {
+		if validator.digestMatches(gf, constants.AlgSha1, gf.IngestManifestSha1, gf.IngestSha1) &&
+			gf.IngestManifestSha1 != "" {
+			gf.IngestSha1VerifiedAt = time.Now().UTC()
+		}
+		if validator.digestMatches(gf, constants.AlgSha256, gf.IngestManifestSha256, gf.IngestSha256) {
 			gf.IngestSha256VerifiedAt = time.Now().UTC()
 		}
-		// No manifest entry?
-		if gf.IngestFileType == constants.PAYLOAD_FILE &&
-			gf.IngestManifestMd5 == "" && gf.IngestManifestSha256 == "" {
-			validator.summary.AddError(
-				"File '%s' does not appear in any payload manifest (md5 or sha256)",
+		if validator.digestMatches(gf, constants.AlgSha512, gf.IngestManifestSha512, gf.IngestSha512) &&
+			gf.IngestManifestSha512 != "" {
+			gf.IngestSha512VerifiedAt = time.Now().UTC()
+		}
+		// Tag file not on the allowed list?
+		if gf.IngestFileType == constants.TAG_FILE && !validator.tagFileAllowed(gf.OriginalPath()) {
+			validator.addFileError(FindingTagFileNotAllowed, gf.OriginalPath(), "Tag file '%s' is not in the list of allowed tag files.",
 				gf.OriginalPath())
 		}
+		// No manifest entry?
+		hasManifestEntry := gf.IngestManifestMd5 != "" || gf.IngestManifestSha1 != "" ||
+			gf.IngestManifestSha256 != "" || gf.IngestManifestSha512 != ""
+		if gf.IngestFileType == constants.PAYLOAD_FILE && !hasManifestEntry {
+			validator.addFileError(FindingNotInManifest, gf.OriginalPath(),
+				"File '%s' does not appear in any payload manifest (%s)",
+				gf.OriginalPath(), algorithmList(validator.BagValidationConfig.FixityAlgorithms))
+		}
+		// No tag manifest entry, when one is required?
+		if checkTagManifestEntries && !hasManifestEntry &&
+			(gf.IngestFileType == constants.TAG_FILE || gf.IngestFileType == constants.PAYLOAD_MANIFEST) {
+			validator.addFileError(FindingNotInTagManifest, gf.OriginalPath(),
+				"Tag file '%s' does not appear in any tag manifest", gf.OriginalPath())
+		}
 		// Make sure name is valid
 		if util.ContainsControlCharacter(gf.OriginalPath()) ||
 			util.LooksLikeEscapedControl(gf.OriginalPath()) {
-			validator.summary.AddError(
+			validator.addFileError(FindingIllegalFileName, gf.OriginalPath(),
 				"File name '%s' contains an illegal unicode control character",
 				gf.OriginalPath())
 		} else if validator.BagValidationConfig.FileNameRegex != nil {
 			for _, pathComponent := range strings.Split(gf.OriginalPath(), "/") {
 				if !validator.BagValidationConfig.FileNameRegex.MatchString(pathComponent) {
-					validator.summary.AddError(
+					validator.addFileError(FindingIllegalFileName, gf.OriginalPath(),
 						"Filename '%s' is not valid according to %s",
 						gf.OriginalPath(), detail)
 				}
@@ -845,7 +1583,7 @@ func (validator *Validator) verifyGenericFiles() {
 		}
 		err = validator.db.Save(gf.Identifier, gf)
 		if err != nil {
-			validator.summary.AddError("Cannot save GenericFile %s to db after comparing checksums",
+			validator.addError(FindingInternalError, "Cannot save GenericFile %s to db after comparing checksums",
 				gf.Identifier)
 		}
 		count += 1
@@ -855,6 +1593,43 @@ func (validator *Validator) verifyGenericFiles() {
 	}
 }
 
+// digestMatches returns true if the manifest digest for the specified
+// algorithm is empty or matches the digest we calculated. If the digests
+// don't match, this adds an error to the WorkSummary. Digests for tag
+// files and payload manifests come from the tag manifests, so the
+// finding names the tag manifest.
+func (validator *Validator) digestMatches(gf *models.GenericFile, algorithm, manifestDigest, fileDigest string) bool {
+	if manifestDigest == "" || manifestDigest == fileDigest {
+		return true
+	}
+	manifest := fmt.Sprintf("manifest-%s.txt", algorithm)
+	if gf.IngestFileType == constants.TAG_FILE || gf.IngestFileType == constants.PAYLOAD_MANIFEST {
+		manifest = fmt.Sprintf("tagmanifest-%s.txt", algorithm)
+	}
+	validator.addFinding(&Finding{
+		Code: FindingBadDigest,
+		Message: fmt.Sprintf("Bad %s digest for '%s': manifest says '%s', file digest is '%s'",
+			algorithm, gf.OriginalPath(), manifestDigest, fileDigest),
+		FilePath:   gf.OriginalPath(),
+		Manifest:   manifest,
+		LineNumber: validator.manifestLines[manifestEntry{manifest, gf.Identifier}],
+		Algorithm:  algorithm,
+		Expected:   manifestDigest,
+		Actual:     fileDigest,
+	})
+	return false
+}
+
+// tagFileAllowed returns true if the BagValidationConfig permits
+// the tag file at relPath.
+func (validator *Validator) tagFileAllowed(relPath string) bool {
+	allowed := validator.BagValidationConfig.TagFilesAllowed
+	if len(allowed) == 0 || util.StringListContains(alwaysAllowedTagFiles, relPath) {
+		return true
+	}
+	return TagFileAllowed(relPath, allowed)
+}
+
 // fileValidationDetail returns a specific description of the file name
 // validation rules in effect.
 func (validator *Validator) fileValidationDetail() string {
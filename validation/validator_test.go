@@ -10,6 +10,7 @@ import (
 	"github.com/APTrust/exchange/validation"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -202,6 +203,35 @@ func TestValidator_FromTarFile_BagInvalid(t *testing.T) {
 	assert.True(t, util.StringListContains(summary.Errors, err_8))
 }
 
+// Read valid bags from gzipped tar files and zip files.
+func TestValidator_CompressedBagValid(t *testing.T) {
+	for _, bagName := range []string{
+		"example.edu.tagsample_good.tar.gz",
+		"example.edu.tagsample_good.tgz",
+		"example.edu.tagsample_good.zip",
+	} {
+		validator := getValidator(t, bagName, true)
+		assert.Equal(t, "example.edu.tagsample_good", validator.ObjIdentifier)
+		summary, err := validator.Validate()
+		deleteFile(validator.DBName())
+		assert.Nil(t, err, bagName)
+		assert.False(t, summary.HasErrors(), "%s: %s", bagName, summary.AllErrorsAsString())
+	}
+}
+
+// Read an invalid bag from a zip file. We should get the same
+// errors we get from the tar file.
+func TestValidator_ZipFile_BagInvalid(t *testing.T) {
+	validator := getValidator(t, "example.edu.tagsample_bad.zip", true)
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	assert.Nil(t, err)
+	assert.True(t, summary.HasErrors())
+	for _, expected := range []string{err_1, err_2, err_3, err_4, err_5, err_6, err_7, err_8} {
+		assert.True(t, util.StringListContains(summary.Errors, expected), expected)
+	}
+}
+
 // Read a valid bag from a directory
 func TestValidator_FromDirectory_BagValid(t *testing.T) {
 	tempDir, bagPath, err := testhelper.UntarTestBag("example.edu.tagsample_good.tar")
@@ -382,6 +412,76 @@ func TestValidator_BadChecksums(t *testing.T) {
 	assert.True(t, util.StringListContains(summary.Errors, "Bad md5 digest for 'data/datastream-descMetadata': manifest says '4bd0ad5f85c00ce84a45BlahBlahBlah', file digest is '4bd0ad5f85c00ce84a455466b24c8960'"))
 }
 
+func validatorWithSha1AndSha512(t *testing.T, bagName string) *validation.Validator {
+	bagValidationConfig, err := getValidationConfig()
+	require.Nil(t, err)
+	bagValidationConfig.FileSpecs["tagmanifest-md5.txt"] = validation.FileSpec{Presence: "OPTIONAL"}
+	bagValidationConfig.FileSpecs["manifest-sha1.txt"] = validation.FileSpec{Presence: "OPTIONAL"}
+	bagValidationConfig.FixityAlgorithms = append(bagValidationConfig.FixityAlgorithms,
+		constants.AlgSha1, constants.AlgSha512)
+	validator, err := validation.NewValidator(getBagPath(t, bagName), bagValidationConfig, true)
+	require.Nil(t, err)
+	return validator
+}
+
+func TestValidator_Sha1AndSha512Manifests(t *testing.T) {
+	validator := validatorWithSha1AndSha512(t, "example.edu.sample_sha512.tar")
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	require.NotNil(t, summary)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	boltDB, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	defer boltDB.Close()
+	gf, err := boltDB.GetGenericFile("example.edu.sample_sha512/data/datastream-DC")
+	require.Nil(t, err)
+	require.NotNil(t, gf)
+	assert.Equal(t, "a315e2d13c512a985821ce74f1183c1cd4ff3c51", gf.IngestSha1)
+	assert.Equal(t, gf.IngestSha1, gf.IngestManifestSha1)
+	assert.False(t, gf.IngestSha1VerifiedAt.IsZero())
+	assert.Len(t, gf.IngestSha512, 128)
+	assert.Equal(t, gf.IngestSha512, gf.IngestManifestSha512)
+	assert.False(t, gf.IngestSha512GeneratedAt.IsZero())
+	assert.False(t, gf.IngestSha512VerifiedAt.IsZero())
+}
+
+func TestValidator_BadSha512Checksum(t *testing.T) {
+	validator := validatorWithSha1AndSha512(t, "example.edu.sample_bad_sha512.tar")
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	require.NotNil(t, summary)
+	require.Equal(t, 1, len(summary.Errors))
+	assert.True(t, strings.HasPrefix(summary.Errors[0], "Bad sha512 digest for 'data/datastream-DC'"))
+
+	// If the config doesn't ask for sha512, we don't check it.
+	validator = validatorWithOptionalSpec(t, "example.edu.sample_bad_sha512.tar")
+	validator.BagValidationConfig.FileSpecs["manifest-sha1.txt"] = validation.FileSpec{Presence: "OPTIONAL"}
+	defer deleteFile(validator.DBName())
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+}
+
+func TestValidator_UnsupportedManifest(t *testing.T) {
+	bagDir := makeFileNameBag(t, []string{"data/file.txt"}, []string{"data/file.txt"})
+	defer os.RemoveAll(filepath.Dir(bagDir))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagDir, "manifest-sha384.txt"),
+		[]byte("0000 data/file.txt\n"), 0644))
+	// BagIt allows other algorithms. We just can't check them.
+	report := validateFileNameBag(t, bagDir, fileNameConfig())
+	assert.True(t, report.Valid)
+	assert.Empty(t, report.Errors())
+	require.Equal(t, 1, len(report.Warnings()))
+	finding := report.Warnings()[0]
+	assert.Equal(t, validation.FindingManifestNotVerified, finding.Code)
+	assert.Equal(t, "manifest-sha384.txt", finding.Manifest)
+	assert.Equal(t, "Can't verify checksums in manifest-sha384.txt: unsupported algorithm 'sha384'. "+
+		"Supported algorithms are md5, sha1, sha256 or sha512.", finding.Message)
+}
+
 func TestValidator_BadFileNames(t *testing.T) {
 	validator := validatorWithOptionalSpec(t, "example.edu.sample_bad_file_names.tar")
 	defer deleteFile(validator.DBName())
@@ -684,10 +784,20 @@ func TestNewValidator_LegalFetchTxt(t *testing.T) {
 	pathToBag := getBagPath(t, "example.edu.fetchtxt.tar")
 	validator, err := validation.NewValidator(pathToBag, bagValidationConfig, true)
 	require.Nil(t, err)
+	require.NotNil(t, validator.FetchResolver)
 	defer deleteFile(validator.DBName())
 	summary, err := validator.Validate()
 	assert.Nil(t, err)
 	assert.NotNil(t, summary)
+	// fetch.txt is allowed, but the one in this bag has no URLs.
+	assert.Equal(t, []string{"Invalid length 'file' on line 1 of fetch.txt"}, summary.Errors)
+
+	// The bag is valid if we don't try to fetch anything.
+	validator, err = validation.NewValidator(pathToBag, bagValidationConfig, true)
+	require.Nil(t, err)
+	validator.FetchResolver = nil
+	summary, err = validator.Validate()
+	assert.Nil(t, err)
 	assert.False(t, summary.HasErrors())
 }
 
@@ -753,3 +863,119 @@ func TestNewValidator_SetIntelObjTagValue(t *testing.T) {
 	validator.SetIntelObjTagValue(obj, internalSenderDescription)
 	assert.Equal(t, description.Value, obj.Description)
 }
+
+func TestValidator_RequireTagManifest(t *testing.T) {
+	// Bag has no tag manifest
+	validator := validatorWithOptionalSpec(t, "example.edu.sample_good.tar")
+	validator.BagValidationConfig.RequireTagManifest = true
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.True(t, util.StringListContains(summary.Errors, "Bag contains no tag manifest."))
+
+	// Bag has tag manifests, but some tag files are not listed in them.
+	validator = getValidator(t, "example.edu.tagsample_good.tar", false)
+	validator.BagValidationConfig.RequireTagManifest = true
+	defer deleteFile(validator.DBName())
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		"Tag file 'custom_tags/untracked_tag_file.txt' does not appear in any tag manifest",
+		"Tag file 'junk_file.txt' does not appear in any tag manifest",
+	}, summary.Errors)
+
+	// Same bag passes when tag manifests are not required.
+	validator = getValidator(t, "example.edu.tagsample_good.tar", false)
+	defer deleteFile(validator.DBName())
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+}
+
+func TestValidator_RequireTagManifest_Unverifiable(t *testing.T) {
+	// The only tag manifest uses an algorithm we don't calculate,
+	// so we can't tell which tag files it lists.
+	bagDir := makeFileNameBag(t, []string{"data/file.txt"}, []string{"data/file.txt"})
+	defer os.RemoveAll(filepath.Dir(bagDir))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagDir, "tagmanifest-sha384.txt"),
+		[]byte("0000 bagit.txt\n0000 manifest-md5.txt\n"), 0644))
+	config := fileNameConfig()
+	config.RequireTagManifest = true
+	report := validateFileNameBag(t, bagDir, config)
+	assert.False(t, report.Valid)
+	require.Equal(t, 1, len(report.Errors()), report.Errors())
+	assert.Equal(t, validation.FindingManifestNotVerified, report.Errors()[0].Code)
+	assert.Equal(t, "Can't verify tag files: no tag manifest uses md5. "+
+		"Tag manifests: tagmanifest-sha384.txt.", report.Errors()[0].Message)
+}
+
+func TestValidator_PayloadOxumAndBagSize(t *testing.T) {
+	validator := validatorWithOptionalSpec(t, "example.edu.sample_oxum.tar")
+	validator.BagValidationConfig.VerifyBagSize = true
+	defer deleteFile(validator.DBName())
+	summary, err := validator.Validate()
+	require.Nil(t, err)
+	assert.False(t, summary.HasErrors(), summary.AllErrorsAsString())
+
+	validator = validatorWithOptionalSpec(t, "example.edu.sample_bad_oxum.tar")
+	validator.BagValidationConfig.VerifyBagSize = true
+	defer deleteFile(validator.DBName())
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(summary.Errors))
+	assert.Equal(t, "Payload-Oxum mismatch: expected 20000 bytes/5 files, found 13821 bytes/4 files", summary.Errors[0])
+	assert.True(t, strings.HasPrefix(summary.Errors[1], "Bag-Size mismatch: bag-info.txt says '2 MB'"))
+
+	// We found the problem in the tar headers, so we didn't
+	// hash anything.
+	db, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	assert.Equal(t, 0, db.FileCount())
+	db.Close()
+
+	// Bag-Size is not checked unless the config says so.
+	validator = validatorWithOptionalSpec(t, "example.edu.sample_bad_oxum.tar")
+	defer deleteFile(validator.DBName())
+	summary, err = validator.Validate()
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(summary.Errors))
+}
+
+func TestValidator_PayloadOxumWithOtherErrors(t *testing.T) {
+	// The file that's not in the manifest needs hashing to find,
+	// so we don't report it. The others don't.
+	bagDir := makeFileNameBag(t, []string{"data/file.txt"}, []string{"data/file.txt"})
+	defer os.RemoveAll(filepath.Dir(bagDir))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagDir, "data", "extra.txt"), []byte("extra\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(bagDir, "bag-info.txt"),
+		[]byte("Payload-Oxum: 999.3\nSource-Organization: example.edu\n"), 0644))
+	config := fileNameConfig()
+	config.FileSpecs["bag-info.txt"] = validation.FileSpec{Presence: validation.REQUIRED, ParseAsTagFile: true}
+	config.FileSpecs["aptrust-info.txt"] = validation.FileSpec{Presence: validation.REQUIRED}
+	config.TagSpecs["Source-Organization"] = validation.TagSpec{
+		FilePath: "bag-info.txt", Presence: validation.REQUIRED, AllowedValues: []string{"other.edu"}}
+	config.TagSpecs["Bag-Group-Identifier"] = validation.TagSpec{
+		FilePath: "bag-info.txt", Presence: validation.REQUIRED}
+
+	validator, err := validation.NewValidator(bagDir, config, false)
+	require.Nil(t, err)
+	defer os.Remove(validator.DBName())
+	_, err = validator.Validate()
+	require.Nil(t, err)
+	codes := make([]string, 0)
+	for _, finding := range validator.Report().Errors() {
+		codes = append(codes, finding.Code)
+	}
+	assert.ElementsMatch(t, []string{
+		validation.FindingPayloadOxum,
+		validation.FindingRequiredFileMissing,
+		validation.FindingIllegalTagValue,
+		validation.FindingRequiredTagMissing,
+	}, codes)
+
+	// Nothing was hashed.
+	db, err := storage.NewBoltDB(validator.DBName())
+	require.Nil(t, err)
+	assert.Equal(t, 0, db.FileCount())
+	db.Close()
+}
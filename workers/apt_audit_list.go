@@ -78,11 +78,9 @@ func NewAPTAuditList(context *context.Context, region, bucket, keyPrefix, format
 	}
 	recordType := STORED_FILE
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	context.Institutions.Start()
 
 	return &APTAuditList{
 		context:      context,
@@ -112,7 +110,9 @@ func (list *APTAuditList) Run() (int, error) {
 	list.initClients()
 	for {
 		listAttempts += 1
-		list.listClient.GetList(list.keyPrefix)
+		ctx, cancel := list.context.NetworkContext(nil)
+		list.listClient.GetListWithContext(ctx, list.keyPrefix)
+		cancel()
 		if list.listClient.ErrorMessage != "" {
 			fmt.Fprintln(os.Stderr, list.listClient.ErrorMessage)
 			list.flagError()
@@ -176,7 +176,9 @@ func (list *APTAuditList) fetchBatch(objects []*s3.Object, startIndex int) int {
 // fetchOne fetches a HEAD record for a single key in AWS,
 // then adds the record to the list of results.
 func (list *APTAuditList) fetchOne(client *network.S3Head, key string) {
-	client.Head(key)
+	ctx, cancel := list.context.NetworkContext(nil)
+	defer cancel()
+	client.HeadWithContext(ctx, key)
 	if client.ErrorMessage != "" {
 		fmt.Fprintln(os.Stderr, client.ErrorMessage)
 		list.flagError()
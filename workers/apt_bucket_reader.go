@@ -7,7 +7,6 @@ import (
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/stats"
-	"github.com/APTrust/exchange/util"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"net/url"
 	"os"
@@ -49,11 +48,9 @@ func NewAPTBucketReader(context *context.Context, enableStats bool) *APTBucketRe
 		statsEnabled:      enableStats,
 	}
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	context.Institutions.Start()
 
 	if enableStats {
 		reader.stats = stats.NewAPTBucketReaderStats()
@@ -174,7 +171,9 @@ func (reader *APTBucketReader) processBucket(bucketName string) {
 		bucketName, MAX_KEYS)
 	keepFetching := true
 	for keepFetching {
-		s3ObjList.GetList("")
+		ctx, cancel := reader.Context.NetworkContext(nil)
+		s3ObjList.GetListWithContext(ctx, "")
+		cancel()
 		if s3ObjList.ErrorMessage != "" {
 			if reader.stats != nil {
 				reader.stats.AddError(s3ObjList.ErrorMessage)
@@ -194,9 +193,9 @@ func (reader *APTBucketReader) processBucket(bucketName string) {
 				}
 				continue
 			}
-			// Skip non-tar files
-			if !strings.HasSuffix(*s3Object.Key, ".tar") {
-				msg := fmt.Sprintf("Ignoring non-tar file %s", *s3Object.Key)
+			// Skip files that aren't serialized bags (.tar, .tar.gz, .tgz or .zip)
+			if !constants.SerializedBagSuffix.MatchString(*s3Object.Key) {
+				msg := fmt.Sprintf("Ignoring non-bag file %s", *s3Object.Key)
 				reader.Context.MessageLog.Info(msg)
 				if reader.stats != nil {
 					reader.stats.AddWarning(msg)
@@ -299,10 +298,10 @@ func (reader *APTBucketReader) findWorkItem(key, etag string) (*models.WorkItem,
 
 func (reader *APTBucketReader) createWorkItem(bucket string, s3Object *s3.Object) *models.WorkItem {
 	// Create a WorkItem in Pharos
-	institution := reader.Institutions[util.OwnerOf(bucket)]
+	institution := reader.Institutions[reader.Context.Institutions.OwnerOf(bucket)]
 	if institution == nil {
 		errMsg := fmt.Sprintf("Cannot find institution record for item %s/%s. "+
-			"Owner computes to '%s'", bucket, *s3Object.Key, util.OwnerOf(bucket))
+			"Owner computes to '%s'", bucket, *s3Object.Key, reader.Context.Institutions.OwnerOf(bucket))
 		reader.Context.MessageLog.Error(errMsg)
 		if reader.stats != nil {
 			reader.stats.AddError(errMsg)
@@ -353,7 +352,9 @@ func (reader *APTBucketReader) createWorkItem(bucket string, s3Object *s3.Object
 
 func (reader *APTBucketReader) addToNSQ(workItem *models.WorkItem) {
 	client := network.NewNSQClient(reader.Context.Config.NsqdHttpAddress)
-	err := client.Enqueue(reader.Context.Config.FetchWorker.NsqTopic, workItem.Id)
+	ctx, cancel := reader.Context.NetworkContext(nil)
+	defer cancel()
+	err := client.EnqueueWithContext(ctx, reader.Context.Config.FetchWorker.NsqTopic, workItem.Id)
 	if err != nil {
 		msg := fmt.Sprintf("Error sending WorkItem %d to NSQ: %v", workItem.Id, err)
 		if reader.stats != nil {
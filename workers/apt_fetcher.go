@@ -32,11 +32,9 @@ func NewAPTFetcher(_context *context.Context) *APTFetcher {
 		Context: _context,
 	}
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	// Load the config settings that describe how to validate
 	// APTrust bags. We'll exit here if the config can't be
@@ -94,7 +92,7 @@ func (fetcher *APTFetcher) HandleMessage(message *nsq.Message) error {
 	// requeue this request with a delay of several hours.
 	// See https://trello.com/c/GLURkoKW
 	if fetcher.StillIngestingOlderVersion(ingestState) {
-		err = MarkWorkItemRequeued(ingestState, fetcher.Context)
+		err = MarkWorkItemRequeued(nil, ingestState, fetcher.Context)
 		if err != nil {
 			fetcher.Context.MessageLog.Error(
 				"Error telling Pharos this item is being requeued: %v",
@@ -131,7 +129,7 @@ func (fetcher *APTFetcher) HandleMessage(message *nsq.Message) error {
 	ingestState.IngestManifest.ClearAllErrors()
 
 	// Tell Pharos that we've started to fetch this item.
-	err = MarkWorkItemStarted(ingestState, fetcher.Context, constants.StageFetch,
+	err = MarkWorkItemStarted(nil, ingestState, fetcher.Context, constants.StageFetch,
 		"Fetching bag from receiving bucket.")
 	if err != nil {
 		fetcher.Context.MessageLog.Error(err.Error())
@@ -150,7 +148,7 @@ func (fetcher *APTFetcher) HandleMessage(message *nsq.Message) error {
 	// Reserve disk space to download this item, or requeue it
 	// if we can't get the disk space.
 	if fetcher.Context.Config.UseVolumeService && !fetcher.reserveSpaceForDownload(ingestState) {
-		err = MarkWorkItemRequeued(ingestState, fetcher.Context)
+		err = MarkWorkItemRequeued(nil, ingestState, fetcher.Context)
 		if err != nil {
 			fetcher.Context.MessageLog.Error(
 				"Error telling Pharos this item is being requeued: %v",
@@ -217,11 +215,11 @@ func (fetcher *APTFetcher) validate() {
 		// Let's NOT quit if there's an error here. In that case, Pharos
 		// might not know that we're validating, but we can still proceed.
 		// Restarting the whole fetch process would be expensive.
-		MarkWorkItemStarted(ingestState, fetcher.Context, constants.StageValidate,
+		MarkWorkItemStarted(nil, ingestState, fetcher.Context, constants.StageValidate,
 			"Validating bag.")
 
 		// Validate the bag.
-		objIdentifier, _ := ingestState.IngestManifest.ObjectIdentifier()
+		objIdentifier, _ := ingestState.IngestManifest.ObjectIdentifier(fetcher.Context.Institutions)
 		validator, err := validation.NewValidator(
 			ingestState.IngestManifest.BagPath,
 			fetcher.BagValidationConfig,
@@ -236,6 +234,14 @@ func (fetcher *APTFetcher) validate() {
 			// to the validator constructor when we refactor.
 			validator.Logger = fetcher.Context.MessageLog
 
+			// If we crashed while validating a large bag, the validator
+			// can pick up where it left off, as long as the bag on disk
+			// is the one it was working on. The ETag tells it that,
+			// even if we had to download the bag again.
+			if !ingestState.IngestManifest.FetchResult.HasErrors() {
+				validator.BagETag = ingestState.WorkItem.ETag
+			}
+
 			// Here's where bag validation actually happens. There's a lot
 			// going on in this call, which can take anywhere from 2 seconds
 			// to several hours to complete, depending on the size of the bag.
@@ -321,23 +327,23 @@ func (fetcher *APTFetcher) record() {
 
 		if ingestState.WorkItem.Status == constants.StatusCancelled {
 			ingestState.FinishNSQ()
-			MarkWorkItemCancelled(ingestState, fetcher.Context)
+			MarkWorkItemCancelled(nil, ingestState, fetcher.Context)
 		} else if itsTimeToGiveUp {
 			ingestState.FinishNSQ()
-			MarkWorkItemFailed(ingestState, fetcher.Context)
+			MarkWorkItemFailed(nil, ingestState, fetcher.Context)
 		} else if ingestState.IngestManifest.HasErrors() {
 			ingestState.RequeueNSQ(30000)
-			MarkWorkItemRequeued(ingestState, fetcher.Context)
+			MarkWorkItemRequeued(nil, ingestState, fetcher.Context)
 		} else {
 			ingestState.FinishNSQ()
-			MarkWorkItemSucceeded(ingestState, fetcher.Context, constants.StageStore)
+			MarkWorkItemSucceeded(nil, ingestState, fetcher.Context, constants.StageStore)
 			PushToQueue(ingestState, fetcher.Context, fetcher.Context.Config.StoreWorker.NsqTopic)
 		}
 
 		// Record WorkItemState and dump out a JSON record
 		// of this item to the local JSON log.
 		LogJson(ingestState, fetcher.Context.JsonLog)
-		RecordWorkItemState(ingestState, fetcher.Context, ingestState.IngestManifest.FetchResult)
+		RecordWorkItemState(nil, ingestState, fetcher.Context, ingestState.IngestManifest.FetchResult)
 	}
 }
 
@@ -387,7 +393,9 @@ func (fetcher *APTFetcher) assertETagMatch(ingestState *models.IngestState) {
 		os.Getenv("AWS_SECRET_ACCESS_KEY"),
 		constants.AWSVirginia,
 		ingestState.WorkItem.Bucket)
-	s3Client.Head(ingestState.WorkItem.Name)
+	ctx, cancel := fetcher.Context.NetworkContext(&fetcher.Context.Config.FetchWorker)
+	defer cancel()
+	s3Client.HeadWithContext(ctx, ingestState.WorkItem.Name)
 
 	if s3Client.Response != nil && s3Client.Response.ETag != nil {
 		etag := strings.Replace(util.PointerToString(s3Client.Response.ETag), "\"", "", -1)
@@ -447,7 +455,9 @@ func (fetcher *APTFetcher) tryDownload(downloader *network.S3Download, ingestSta
 	succeeded := false
 	errorIsFatal := false
 	downloader.ErrorMessage = "" // clear before each attempt
-	downloader.Fetch()
+	ctx, cancel := fetcher.Context.NetworkContext(&fetcher.Context.Config.FetchWorker)
+	defer cancel()
+	downloader.FetchWithContext(ctx)
 	if downloader.ErrorMessage == "" {
 		fetcher.Context.MessageLog.Info("Fetched %s/%s after %d attempts",
 			ingestState.WorkItem.Bucket,
@@ -474,7 +484,7 @@ func (fetcher *APTFetcher) tryDownload(downloader *network.S3Download, ingestSta
 
 func (fetcher *APTFetcher) buildObject(downloader *network.S3Download, ingestState *models.IngestState) *models.IntellectualObject {
 	obj := &models.IntellectualObject{}
-	instIdentifier := util.OwnerOf(ingestState.WorkItem.Bucket)
+	instIdentifier := fetcher.Context.Institutions.OwnerOf(ingestState.WorkItem.Bucket)
 	obj.BagName = util.CleanBagName(ingestState.WorkItem.Name)
 	obj.Institution = instIdentifier
 	obj.Identifier = fmt.Sprintf("%s/%s", instIdentifier, obj.BagName)
@@ -8,7 +8,6 @@ import (
 	"github.com/APTrust/exchange/network"
 	"github.com/nsqio/go-nsq"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 )
@@ -45,11 +44,9 @@ func NewAPTFileDeleter(_context *context.Context) *APTFileDeleter {
 		RecentlyDeleted: models.NewRingList(20),
 	}
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	// Set up buffered channels
 	workerBufferSize := _context.Config.FileDeleteWorker.Workers * 10
@@ -100,9 +97,7 @@ func (deleter *APTFileDeleter) HandleMessage(message *nsq.Message) error {
 	return nil
 }
 
-// Technical debt is piling up here since the addition of new storage options.
-// This needs to be rewritten as we add new storage providers.
-// A simple delete operation should not require this much ugly logic.
+// delete deletes each file from the places it was stored at ingest.
 func (deleter *APTFileDeleter) delete() {
 	for deleteState := range deleter.DeleteChannel {
 		deleteState.DeleteSummary.Attempted = true
@@ -113,43 +108,69 @@ func (deleter *APTFileDeleter) delete() {
 		if err != nil {
 			deleteState.DeleteSummary.AddError(err.Error())
 		} else {
-			storageOption := deleteState.GenericFile.StorageOption
-			// Standard storage requires two deletions from two separate buckets.
-			if storageOption == constants.StorageStandard {
-				deleter.deleteFromStandardStorage(deleteState, fileUUID)
-			} else {
-				if deleteState.DeletedFromPrimaryAt.IsZero() {
-					deleter.deleteFromStorage(deleteState, storageOption)
-				} else {
-					deleter.Context.MessageLog.Info("File %s (%s) was previously "+
-						"deleted from %s storage",
-						deleteState.GenericFile.Identifier, fileUUID, storageOption)
-				}
-			}
+			deleter.deleteAllCopies(deleteState, fileUUID)
 		}
 		deleteState.DeleteSummary.Finish()
 		deleter.PostProcessChannel <- deleteState
 	}
 }
 
-// Delete from Standard storage, which includes an S3 copy and a Glacier copy.
-func (deleter *APTFileDeleter) deleteFromStandardStorage(deleteState *models.DeleteState, fileUUID string) {
+// Delete every copy of the file. The primary copy is at the file's URI,
+// and the others are at the URLs in its replication events. We don't
+// use the buckets of the file's storage option, because they may have
+// changed since the file was stored, except for older files whose
+// replication URLs Pharos doesn't have.
+func (deleter *APTFileDeleter) deleteAllCopies(deleteState *models.DeleteState, fileUUID string) {
+	gf := deleteState.GenericFile
 	// In some cases, we may have deleted the file on a
 	// previous run, then failed to record the deletion
 	// event.
 	if deleteState.DeletedFromPrimaryAt.IsZero() {
-		deleter.deleteFromStorage(deleteState, "s3")
+		if deleter.deleteFromStorage(deleteState, "primary", gf.URI) {
+			deleteState.DeletedFromPrimaryAt = time.Now().UTC()
+		}
 	} else {
 		deleter.Context.MessageLog.Info("File %s (%s) was previously "+
 			"deleted from primary storage",
-			deleteState.GenericFile.Identifier, fileUUID)
+			gf.Identifier, fileUUID)
 	}
-	if deleteState.DeletedFromSecondaryAt.IsZero() {
-		deleter.deleteFromStorage(deleteState, "glacier")
-	} else {
+	if !deleteState.DeletedFromSecondaryAt.IsZero() {
 		deleter.Context.MessageLog.Info("File %s (%s) was previously "+
 			"deleted from secondary storage",
-			deleteState.GenericFile.Identifier, fileUUID)
+			gf.Identifier, fileUUID)
+		return
+	}
+	replicationURLs := gf.ReplicationURLs()
+	if len(replicationURLs) == 0 {
+		// Files ingested before we recorded replication URLs are in
+		// the storage option's replication bucket, under the same
+		// key as the primary copy.
+		option, err := deleter.Context.Config.StorageOption(gf.StorageOption)
+		if err != nil {
+			deleteState.DeleteSummary.AddError("Cannot tell whether %s has a copy "+
+				"in secondary storage: %v", gf.Identifier, err)
+			deleteState.DeleteSummary.ErrorIsFatal = true
+			return
+		}
+		for _, target := range option.ReplicationTargets {
+			deleter.Context.MessageLog.Info("Pharos has no replication URL for %s (%s). "+
+				"Deleting it from replication bucket %s.",
+				gf.Identifier, fileUUID, target.Bucket)
+			replicationURLs = append(replicationURLs,
+				fmt.Sprintf("%s%s/%s", constants.S3UriPrefix, target.Bucket, fileUUID))
+		}
+		if len(replicationURLs) == 0 {
+			return
+		}
+	}
+	deletedAll := true
+	for _, replicationURL := range replicationURLs {
+		if !deleter.deleteFromStorage(deleteState, "secondary", replicationURL) {
+			deletedAll = false
+		}
+	}
+	if deletedAll {
+		deleteState.DeletedFromSecondaryAt = time.Now().UTC()
 	}
 }
 
@@ -172,63 +193,48 @@ func (deleter *APTFileDeleter) postProcess() {
 	}
 }
 
-func (deleter *APTFileDeleter) deleteFromStorage(deleteState *models.DeleteState, fromWhere string) {
-	// Find the key we'll need to delete.
-	key, err := deleteState.GenericFile.PreservationStorageFileName()
+// deleteFromStorage deletes the copy of the file at storageURL, and
+// returns true if it succeeds. fromWhere is "primary" or "secondary".
+func (deleter *APTFileDeleter) deleteFromStorage(deleteState *models.DeleteState, fromWhere, storageURL string) bool {
+	// Find the bucket and key we'll need to delete.
+	bucket, key, err := models.BucketAndKeyFromURL(storageURL)
 	if err != nil {
 		deleteState.DeleteSummary.AddError("For file %s: %v", deleteState.GenericFile.Identifier, err)
 		deleteState.DeleteSummary.ErrorIsFatal = true
-		return
+		return false
 	}
 	keys := make([]string, 1)
 	keys[0] = key
-	deleter.Context.MessageLog.Info("Deleting %s (key %s) from %s",
-		deleteState.GenericFile.Identifier, key, fromWhere)
+	deleter.Context.MessageLog.Info("Deleting %s (key %s) from %s storage in %s",
+		deleteState.GenericFile.Identifier, key, fromWhere, bucket)
 
 	// Set up the proper S3 or Glacier client
-	var region string
-	var bucket string
-	if fromWhere == "s3" {
-		region = deleter.Context.Config.APTrustS3Region
-		bucket = deleter.Context.Config.PreservationBucket
-	} else if fromWhere == "glacier" {
-		region = deleter.Context.Config.APTrustGlacierRegion
-		bucket = deleter.Context.Config.ReplicationBucket
-	} else {
-		region, bucket, err = deleter.Context.Config.StorageRegionAndBucketFor(fromWhere)
+	target, err := deleter.Context.Config.StorageTargetForBucket(bucket)
+	var provider network.StorageProvider
+	if err == nil {
+		provider, err = deleter.Context.StorageProviderFor(*target)
 	}
-	if region == "" || bucket == "" {
-		deleteState.DeleteSummary.AddError("Cannot delete %s from %s because "+
-			"deleter doesn't know where %s is.",
-			deleteState.GenericFile.Identifier, fromWhere, fromWhere)
-		if err != nil {
-			deleteState.DeleteSummary.AddError(err.Error())
-		}
+	if err != nil {
+		deleteState.DeleteSummary.AddError("Cannot delete %s from %s storage because "+
+			"deleter doesn't know where %s storage is: %v",
+			deleteState.GenericFile.Identifier, fromWhere, fromWhere, err)
 		deleteState.DeleteSummary.ErrorIsFatal = true
-		return
+		return false
 	}
-	client := network.NewS3ObjectDelete(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		region, bucket, keys)
-	client.DeleteList()
+	client := provider.Delete(bucket, keys)
+	ctx, cancel := deleter.Context.NetworkContext(&deleter.Context.Config.FileDeleteWorker)
+	defer cancel()
+	client.DeleteListWithContext(ctx)
 	if client.ErrorMessage != "" {
-		msg := fmt.Sprintf("Error deleting %s from %s: %v",
+		msg := fmt.Sprintf("Error deleting %s from %s storage: %v",
 			deleteState.GenericFile.Identifier,
 			fromWhere, client.ErrorMessage)
 		deleteState.DeleteSummary.AddError(msg)
-	} else {
-		if fromWhere == "s3" {
-			deleteState.DeletedFromPrimaryAt = time.Now().UTC()
-		} else if fromWhere == "glacier" {
-			deleteState.DeletedFromSecondaryAt = time.Now().UTC()
-		} else {
-			// Glacier-only
-			deleteState.DeletedFromPrimaryAt = time.Now().UTC()
-		}
-		deleter.Context.MessageLog.Info("Deleted %s (key %s) from %s",
-			deleteState.GenericFile.Identifier, key, fromWhere)
+		return false
 	}
+	deleter.Context.MessageLog.Info("Deleted %s (key %s) from %s storage",
+		deleteState.GenericFile.Identifier, key, fromWhere)
+	return true
 }
 
 func (deleter *APTFileDeleter) buildState(message *nsq.Message) (*models.DeleteState, error) {
@@ -242,7 +248,8 @@ func (deleter *APTFileDeleter) buildState(message *nsq.Message) (*models.DeleteS
 		return nil, fmt.Errorf("WorkItem %d is missing generic file identifier",
 			workItem.Id)
 	}
-	resp := deleter.Context.PharosClient.GenericFileGet(workItem.GenericFileIdentifier, false)
+	// Get the file's events too. They say where its replication copies are.
+	resp := deleter.Context.PharosClient.GenericFileGet(workItem.GenericFileIdentifier, true)
 	if resp.Error != nil {
 		return nil, fmt.Errorf("Error getting generic file '%s': %v",
 			workItem.GenericFileIdentifier, resp.Error)
@@ -300,12 +307,17 @@ func (deleter *APTFileDeleter) finishWithSuccess(deleteState *models.DeleteState
 		deleteState.DeleteSummary.AddError(err.Error())
 		return
 	}
+	// Files with no secondary copy have only the primary deletion time.
+	deletedAt := deleteState.DeletedFromSecondaryAt
+	if deletedAt.IsZero() {
+		deletedAt = deleteState.DeletedFromPrimaryAt
+	}
 	deleteState.WorkItem.Date = time.Now().UTC()
 	deleteState.WorkItem.Note = fmt.Sprintf(
 		"File %s (%s) deleted at %s by request of %s",
 		deleteState.GenericFile.Identifier,
 		fileUUID,
-		deleteState.DeletedFromSecondaryAt.Format(time.RFC3339),
+		deletedAt.Format(time.RFC3339),
 		deleteState.WorkItem.User)
 	deleteState.WorkItem.Node = ""
 	deleteState.WorkItem.Pid = 0
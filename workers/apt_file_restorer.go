@@ -7,7 +7,6 @@ import (
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
-	"github.com/APTrust/exchange/util"
 	"github.com/nsqio/go-nsq"
 	"os"
 	"time"
@@ -32,11 +31,9 @@ func NewAPTFileRestorer(_context *context.Context) *APTFileRestorer {
 		Context: _context,
 	}
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	// Set up buffered channels
 	workerBufferSize := _context.Config.FileRestoreWorker.Workers * 10
@@ -77,7 +74,7 @@ func (restorer *APTFileRestorer) restore() {
 		restoreState.RestoreSummary.Start()
 
 		if restorer.alreadyRestored(restoreState) {
-			restorationBucket := util.RestorationBucketFor(restoreState.IntellectualObject.Institution,
+			restorationBucket := restorer.Context.Institutions.RestorationBucketFor(restoreState.IntellectualObject.Institution,
 				restorer.Context.Config.RestoreToTestBuckets)
 			restorer.Context.MessageLog.Info("File %s has already been restored to %s",
 				restoreState.GenericFile.Identifier, restorationBucket)
@@ -103,12 +100,29 @@ func (restorer *APTFileRestorer) postProcess() {
 }
 
 func (restorer *APTFileRestorer) copyToRestorationBucket(restoreState *models.FileRestoreState) {
-	sourceRegion, sourceBucket, err := restorer.Context.Config.StorageRegionAndBucketFor(restoreState.GenericFile.StorageOption)
+	storageOption := restoreState.GenericFile.StorageOption
+	option, err := restorer.Context.Config.StorageOption(storageOption)
 	if err != nil {
 		restoreState.RestoreSummary.AddError(err.Error())
 		return
 	}
-	restorationBucket := util.RestorationBucketFor(restoreState.IntellectualObject.Institution,
+	sourceRegion := option.Region
+	sourceBucket := option.Bucket
+	// We restore files with a copy inside AWS, which can't
+	// read from other storage providers.
+	provider, err := restorer.Context.StorageProviderFor(option.StorageTarget)
+	if err != nil {
+		restoreState.RestoreSummary.AddError(err.Error())
+		return
+	}
+	if _, isAWS := provider.(*network.AWSStorage); !isAWS {
+		restoreState.RestoreSummary.AddError("Cannot restore %s, because copying files "+
+			"from storage provider %s to the restoration bucket is not supported",
+			restoreState.GenericFile.Identifier, provider.Name())
+		restoreState.RestoreSummary.ErrorIsFatal = true
+		return
+	}
+	restorationBucket := restorer.Context.Institutions.RestorationBucketFor(restoreState.IntellectualObject.Institution,
 		restorer.Context.Config.RestoreToTestBuckets)
 	// PT #159115778: Get a client for the S3 restoration region, since
 	// this is the region we're writing to.
@@ -128,7 +142,9 @@ func (restorer *APTFileRestorer) copyToRestorationBucket(restoreState *models.Fi
 		fileUUID,
 		restorationBucket,
 		restoreState.GenericFile.Identifier)
-	copier.Copy()
+	ctx, cancel := restorer.Context.NetworkContext(&restorer.Context.Config.FileRestoreWorker)
+	defer cancel()
+	copier.CopyWithContext(ctx)
 	if copier.ErrorMessage != "" {
 		restoreState.RestoreSummary.AddError("Error copying to restoration bucket: %s",
 			copier.ErrorMessage)
@@ -139,14 +155,16 @@ func (restorer *APTFileRestorer) copyToRestorationBucket(restoreState *models.Fi
 }
 
 func (restorer *APTFileRestorer) alreadyRestored(restoreState *models.FileRestoreState) bool {
-	restorationBucket := util.RestorationBucketFor(restoreState.IntellectualObject.Institution,
+	restorationBucket := restorer.Context.Institutions.RestorationBucketFor(restoreState.IntellectualObject.Institution,
 		restorer.Context.Config.RestoreToTestBuckets)
 	client := network.NewS3Head(
 		os.Getenv("AWS_ACCESS_KEY_ID"),
 		os.Getenv("AWS_SECRET_ACCESS_KEY"),
 		restorer.Context.Config.APTrustS3Region,
 		restorationBucket)
-	client.Head(restoreState.GenericFile.Identifier)
+	ctx, cancel := restorer.Context.NetworkContext(&restorer.Context.Config.FileRestoreWorker)
+	defer cancel()
+	client.HeadWithContext(ctx, restoreState.GenericFile.Identifier)
 	if client.Response != nil && client.ErrorMessage == "" {
 		sizeInS3 := int64(-1)
 		if client.Response.ContentLength != nil {
@@ -5,9 +5,7 @@ import (
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
-	"github.com/APTrust/exchange/network"
 	"github.com/nsqio/go-nsq"
-	"os"
 	"strings"
 	"time"
 )
@@ -37,11 +35,9 @@ func NewAPTFixityChecker(_context *context.Context) *APTFixityChecker {
 		ItemsInProcess: models.NewSynchronizedMap(),
 	}
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	workerBufferSize := _context.Config.FixityWorker.Workers * 10
 	checker.FixityChannel = make(chan *models.FixityResult, workerBufferSize)
@@ -68,7 +64,9 @@ func (checker *APTFixityChecker) HandleMessage(message *nsq.Message) error {
 		return nil // Should we return an error to NSQ?
 	}
 
-	if fixityResult.GenericFile.StorageOption != constants.StorageStandard {
+	// We can't stream files in Glacier to check them.
+	option, err := checker.Context.Config.StorageOption(fixityResult.GenericFile.StorageOption)
+	if err != nil || option.RetrievalTier != "" {
 		checker.Context.MessageLog.Info("Skipping %s because StorageOption is %s.",
 			fixityResult.GenericFile.Identifier,
 			fixityResult.GenericFile.StorageOption)
@@ -119,10 +117,35 @@ func (checker *APTFixityChecker) checkFixity() {
 	}
 }
 
-// record records a PremisEvent in Pharos saying when this fixity check
-// was performed and whether it succeeded.
+// record records PremisEvents in Pharos saying when fixity checks
+// were performed and whether they succeeded. When several checks finish
+// at once, their events go to Pharos in one batch request.
 func (checker *APTFixityChecker) record() {
 	for fixityResult := range checker.RecordChannel {
+		results := []*models.FixityResult{fixityResult}
+		batchSize := checker.Context.PharosClient.BatchSize()
+	drain:
+		for len(results) < batchSize {
+			select {
+			case next, ok := <-checker.RecordChannel:
+				if !ok {
+					break drain
+				}
+				results = append(results, next)
+			default:
+				break drain
+			}
+		}
+		checker.recordBatch(results)
+	}
+}
+
+// recordBatch saves the fixity check events for results in one batch
+// and passes each result on to the PostProcessChannel.
+func (checker *APTFixityChecker) recordBatch(results []*models.FixityResult) {
+	events := make([]*models.PremisEvent, 0, len(results))
+	eventResults := make([]*models.FixityResult, 0, len(results))
+	for _, fixityResult := range results {
 		// Create PREMIS event saying whether fixity event
 		// succeeded or failed.
 		event, err := models.NewEventGenericFileFixityCheck(
@@ -133,22 +156,32 @@ func (checker *APTFixityChecker) record() {
 		if err != nil {
 			fixityResult.Error = fmt.Errorf("Could not create Premis Event for %s: %v",
 				fixityResult.GenericFile.Identifier, err)
-		} else {
-			event.IntellectualObjectId = fixityResult.GenericFile.IntellectualObjectId
-			event.IntellectualObjectIdentifier = fixityResult.GenericFile.IntellectualObjectIdentifier
-			event.GenericFileId = fixityResult.GenericFile.Id
-			event.GenericFileIdentifier = fixityResult.GenericFile.Identifier
-			resp := checker.Context.PharosClient.PremisEventSave(event)
-			if resp.Error != nil {
-				fixityResult.Error = fmt.Errorf("After completing fixity check for %s, "+
-					"could not save PremisEvent to Pharos: %v. Event data: %v",
-					fixityResult.GenericFile.Identifier, resp.Error, event)
-			} else {
+			continue
+		}
+		event.IntellectualObjectId = fixityResult.GenericFile.IntellectualObjectId
+		event.IntellectualObjectIdentifier = fixityResult.GenericFile.IntellectualObjectIdentifier
+		event.GenericFileId = fixityResult.GenericFile.Id
+		event.GenericFileIdentifier = fixityResult.GenericFile.Identifier
+		events = append(events, event)
+		eventResults = append(eventResults, fixityResult)
+	}
+	if len(events) > 0 {
+		resp := checker.Context.PharosClient.PremisEventSaveBatch(events)
+		for _, itemErr := range resp.ItemErrors {
+			fixityResult := eventResults[itemErr.Index]
+			fixityResult.Error = fmt.Errorf("After completing fixity check for %s, "+
+				"could not save PremisEvent to Pharos: %v. Event data: %v",
+				fixityResult.GenericFile.Identifier, itemErr.Err, events[itemErr.Index])
+		}
+		for i, savedEvent := range resp.PremisEvents() {
+			if savedEvent != nil {
 				checker.Context.MessageLog.Info("Completing fixity check for %s, "+
 					"and saved PremisEvent %s to Pharos",
-					fixityResult.GenericFile.Identifier, event.Identifier)
+					eventResults[i].GenericFile.Identifier, savedEvent.Identifier)
 			}
 		}
+	}
+	for _, fixityResult := range results {
 		checker.PostProcessChannel <- fixityResult
 	}
 }
@@ -197,16 +230,31 @@ func (checker *APTFixityChecker) getFixityValueOfS3File(fixityResult *models.Fix
 		fixityResult.ErrorIsFatal = true
 		return
 	}
-	downloader := network.NewS3Download(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		constants.AWSVirginia,
+	option, err := checker.Context.Config.StorageOption(fixityResult.GenericFile.StorageOption)
+	if err != nil {
+		fixityResult.Error = fmt.Errorf("Can't get storage option for %s: %v",
+			fixityResult.GenericFile.Identifier, err)
+		fixityResult.ErrorIsFatal = true
+		return
+	}
+	provider, err := checker.Context.StorageProviderFor(option.StorageTarget)
+	if err != nil {
+		fixityResult.Error = fmt.Errorf("Can't get storage provider for %s: %v",
+			fixityResult.GenericFile.Identifier, err)
+		fixityResult.ErrorIsFatal = true
+		return
+	}
+	downloader := provider.Get(
 		bucket,      // should be S3 preservation bucket
 		key,         // s3 key to fetch
 		"/dev/null", // local path at which to save the s3 file
 		false,       // don't calculate md5 digest
 		true)        // do calculate sha256 digest
-	downloader.Fetch()
+	downloader.Concurrency = checker.Context.Config.FixityWorker.DownloadConcurrency
+	downloader.PartSize = checker.Context.Config.FixityWorker.DownloadPartSize
+	ctx, cancel := checker.Context.NetworkContext(&checker.Context.Config.FixityWorker)
+	defer cancel()
+	downloader.FetchWithContext(ctx)
 	if downloader.ErrorMessage != "" {
 		fixityResult.Error = fmt.Errorf("Error fetching file %s (%s/%s) from S3: %s",
 			fixityResult.GenericFile.Identifier, bucket, key,
@@ -16,12 +16,11 @@ import (
 
 // TODO: Move constants to config file?
 
-// Standard retrieval is 3-5 hours for Glacier and
-// 12 hours for Glacier Deep Archive. We may want
-// to consider adding "Bulk" as a retrieval option
-// for Glacier Deep Archive, because it's 8x cheaper.
-// See the Glacier sections of https://aws.amazon.com/s3/pricing/
-const RETRIEVAL_OPTION = "Standard"
+// The retrieval tier comes from the RetrievalTier setting of each
+// storage option. Standard retrieval is 3-5 hours for Glacier and
+// 12 hours for Glacier Deep Archive. "Bulk" is 8x cheaper for
+// Glacier Deep Archive. See the Glacier sections of
+// https://aws.amazon.com/s3/pricing/
 
 // Keep the files in S3 up to 5 days, in case we're
 // having system problems and we need to attempt the
@@ -62,11 +61,9 @@ func NewGlacierRestore(_context *context.Context) *APTGlacierRestoreInit {
 		Context: _context,
 	}
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	// Set up buffered channels
 	restorerBufferSize := _context.Config.GlacierRestoreWorker.NetworkConnections * 4
@@ -179,7 +176,9 @@ func (restorer *APTGlacierRestoreInit) RestoreRequestNeeded(state *models.Glacie
 	if err != nil {
 		return needsRestoreRequest, err
 	}
-	s3Client.Head(fileUUID)
+	ctx, cancel := restorer.Context.NetworkContext(&restorer.Context.Config.GlacierRestoreWorker)
+	defer cancel()
+	s3Client.HeadWithContext(ctx, fileUUID)
 
 	// Status 409: Conflict is an expected response.
 	// It means a restore request has already been initiated.
@@ -233,15 +232,15 @@ func (restorer *APTGlacierRestoreInit) RestoreRequestNeeded(state *models.Glacie
 }
 
 func (restorer *APTGlacierRestoreInit) GetS3HeadClient(storageOption string) (*network.S3Head, error) {
-	region, bucket, err := restorer.Context.Config.StorageRegionAndBucketFor(storageOption)
+	option, err := restorer.Context.Config.StorageOption(storageOption)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := restorer.Context.StorageProviderFor(option.StorageTarget)
 	if err != nil {
 		return nil, err
 	}
-	client := network.NewS3Head(
-		restorer.Context.Config.GetAWSAccessKeyId(),
-		restorer.Context.Config.GetAWSSecretAccessKey(),
-		region,
-		bucket)
+	client := provider.Head(option.Bucket)
 	// Hack for testing: Tell the client to talk to our own
 	// local S3 test server, and clear the bucket name,
 	// because that gets prepended to the URL.
@@ -440,7 +439,7 @@ func (restorer *APTGlacierRestoreInit) RequeueToCheckState(state *models.Glacier
 			state.WorkItem.Id)
 	}
 	recheckInterval := GLACIER_RECHECK_INTERVAL
-	if util.IsGlacierDeepArchive(storageOption) {
+	if restorer.isDeepArchive(storageOption) {
 		recheckInterval = GLACIER_DEEP_RECHECK_INTERVAL
 		restorer.Context.MessageLog.Error("Setting longer polling interval because "+
 			"WorkItem %d is in Glacier Deep Archive.", state.WorkItem.Id)
@@ -448,6 +447,20 @@ func (restorer *APTGlacierRestoreInit) RequeueToCheckState(state *models.Glacier
 	state.NSQMessage.RequeueWithoutBackoff(recheckInterval)
 }
 
+// isDeepArchive returns true if we restore files with the specified
+// storage option from Glacier Deep Archive. Configs without a
+// StorageOptions table don't set StorageClass, so we go by the
+// name of the storage option for those.
+func (restorer *APTGlacierRestoreInit) isDeepArchive(storageOption string) bool {
+	option, err := restorer.Context.Config.StorageOption(storageOption)
+	if err == nil {
+		if target := option.GlacierTarget(); target != nil && target.StorageClass == "DEEP_ARCHIVE" {
+			return true
+		}
+	}
+	return util.IsGlacierDeepArchive(storageOption)
+}
+
 // createRestoreWorkItem: We call this to create a normal WorkItem
 // with action='Restore 'when we know all files have been restored
 // from Glacier to S3. Once all files are in S3, the apt_restore
@@ -556,21 +569,23 @@ func (restorer *APTGlacierRestoreInit) GetRequestDetails(gf *models.GenericFile)
 		return nil, fmt.Errorf("File %s: %v. URI is %s", gf.Identifier, err, gf.URI)
 	}
 	details["fileUUID"] = fileUUID
-	if gf.StorageOption == constants.StorageStandard {
-		// Items in standard starage are in S3 Virginia and Glacier Oregon,
-		// but the Glacier Oregon bucket is aptrust.preservation.oregon.
-		// Normally, we only restore standard items from S3, but this is
-		// here in case we ever need to restore a standard item from Glacier.
-		details["region"] = restorer.Context.Config.APTrustGlacierRegion
-		details["bucket"] = restorer.Context.Config.ReplicationBucket
-	} else {
-		details["region"], details["bucket"], err =
-			restorer.Context.Config.StorageRegionAndBucketFor(gf.StorageOption)
-	}
-
+	// Items in standard storage are in S3 Virginia and Glacier Oregon,
+	// and we restore them from the Oregon replication bucket. Normally,
+	// we only restore standard items from S3, but this is here in case
+	// we ever need to restore a standard item from Glacier.
+	option, err := restorer.Context.Config.StorageOption(gf.StorageOption)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot restore file %s because StorageOption is %s", gf.Identifier, gf.StorageOption)
 	}
+	target := option.GlacierTarget()
+	if target == nil {
+		return nil, fmt.Errorf("Cannot restore file %s from Glacier because StorageOption %s "+
+			"keeps no copies in Glacier", gf.Identifier, gf.StorageOption)
+	}
+	details["provider"] = target.Provider
+	details["region"] = target.Region
+	details["bucket"] = target.Bucket
+	details["tier"] = target.RetrievalTier
 	return details, nil
 }
 
@@ -595,13 +610,18 @@ func (restorer *APTGlacierRestoreInit) InitializeRetrieval(state *models.Glacier
 	restorer.Context.MessageLog.Info("Requesting Glacier retrieval of %s at %s (%s)",
 		gf.Identifier, gf.URI, gf.StorageOption)
 
-	restoreClient := network.NewS3Restore(
-		restorer.Context.Config.GetAWSAccessKeyId(),
-		restorer.Context.Config.GetAWSSecretAccessKey(),
-		details["region"],
+	provider, err := restorer.Context.StorageProviderFor(models.StorageTarget{
+		Provider: details["provider"],
+		Region:   details["region"],
+	})
+	if err != nil {
+		state.WorkSummary.AddError("Cannot request Glacier retrieval of %s: %v", gf.Identifier, err)
+		return
+	}
+	restoreClient := provider.Restore(
 		details["bucket"],
 		details["fileUUID"],
-		RETRIEVAL_OPTION,
+		details["tier"],
 		DAYS_TO_KEEP_IN_S3)
 	if restorer.S3Url != "" {
 		restorer.Context.MessageLog.Warning("Setting S3 URL to %s. This should happen only in testing!",
@@ -611,7 +631,9 @@ func (restorer *APTGlacierRestoreInit) InitializeRetrieval(state *models.Glacier
 	}
 	now := time.Now().UTC()
 	estimatedDeletionFromS3 := now.AddDate(0, 0, DAYS_TO_KEEP_IN_S3)
-	restoreClient.Restore()
+	ctx, cancel := restorer.Context.NetworkContext(&restorer.Context.Config.GlacierRestoreWorker)
+	defer cancel()
+	restoreClient.RestoreWithContext(ctx)
 	if restoreClient.ErrorMessage != "" {
 		state.WorkSummary.AddError("Glacier retrieval request returned an error for %s at %s: %v",
 			gf.Identifier, gf.URI, restoreClient.ErrorMessage)
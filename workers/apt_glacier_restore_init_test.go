@@ -512,6 +512,7 @@ func TestGetRequestDetails(t *testing.T) {
 	assert.Equal(t, fileUUID, details["fileUUID"])
 	assert.Equal(t, worker.Context.Config.GlacierRegionOH, details["region"])
 	assert.Equal(t, worker.Context.Config.GlacierBucketOH, details["bucket"])
+	assert.Equal(t, "Standard", details["tier"])
 
 	// Glacier Oregon
 	gf.StorageOption = constants.StorageGlacierOR
@@ -545,6 +546,35 @@ func TestGetRequestDetails(t *testing.T) {
 	details, err = worker.GetRequestDetails(gf)
 	require.NotNil(t, err)
 	require.Nil(t, details)
+
+	// Storage options with no copies in Glacier can't be restored from it.
+	worker.Context.Config.StorageOptions = []models.StorageOptionConfig{
+		{
+			Name:          "Wasabi",
+			StorageTarget: models.StorageTarget{Provider: "wasabi", Bucket: "wasabi"},
+		},
+		{
+			Name: "Wasabi-Deep",
+			StorageTarget: models.StorageTarget{
+				Provider:      "wasabi",
+				Region:        "us-east-2",
+				Bucket:        "wasabi-deep",
+				RetrievalTier: "Bulk",
+			},
+		},
+	}
+	defer func() { worker.Context.Config.StorageOptions = nil }()
+	gf.StorageOption = "Wasabi"
+	_, err = worker.GetRequestDetails(gf)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "keeps no copies in Glacier")
+	gf.StorageOption = "Wasabi-Deep"
+	details, err = worker.GetRequestDetails(gf)
+	require.Nil(t, err)
+	assert.Equal(t, "wasabi", details["provider"])
+	assert.Equal(t, "us-east-2", details["region"])
+	assert.Equal(t, "wasabi-deep", details["bucket"])
+	assert.Equal(t, "Bulk", details["tier"])
 }
 
 func TestGetRequestRecord(t *testing.T) {
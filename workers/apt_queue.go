@@ -7,6 +7,7 @@ import (
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/stats"
+	"io"
 	"net/url"
 	"time"
 )
@@ -32,11 +33,9 @@ type APTQueue struct {
 func NewAPTQueue(_context *context.Context, topic string, enableStats, dryRun bool) *APTQueue {
 	_context.MessageLog.Info("NSQ address: %s", _context.Config.NsqdHttpAddress)
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	nsqClient := network.NewNSQClient(_context.Config.NsqdHttpAddress)
 	aptQueue := &APTQueue{
@@ -63,23 +62,26 @@ func (aptQueue *APTQueue) Run() {
 	params.Set("node_empty", "true")
 	params.Set("page", "1")
 	params.Set("per_page", "100")
+	// No prefetch here, because markAsQueued changes which
+	// items match the query.
+	options := network.PagingOptions{
+		OnPage: func(resp *network.PharosResponse) {
+			aptQueue.Context.MessageLog.Info("GET %s", resp.Request.URL)
+		},
+	}
+	iterator := aptQueue.Context.PharosClient.WorkItemIterator(params, options)
 	for {
-		resp := aptQueue.Context.PharosClient.WorkItemList(params)
-		aptQueue.Context.MessageLog.Info("GET %s", resp.Request.URL)
-		if resp.Error != nil {
+		item, err := iterator.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
 			aptQueue.recordError(
-				"Error getting WorkItem list from Pharos: %s",
-				resp.Error)
-		}
-		for _, item := range resp.WorkItems() {
-			if aptQueue.addToNSQ(item) {
-				aptQueue.markAsQueued(item)
-			}
-		}
-		if resp.HasNextPage() == false {
+				"Error getting WorkItem list from Pharos: %s", err)
 			break
 		}
-		params = resp.ParamsForNextPage()
+		if aptQueue.addToNSQ(item) {
+			aptQueue.markAsQueued(item)
+		}
 	}
 }
 
@@ -113,7 +115,9 @@ func (aptQueue *APTQueue) addToNSQ(workItem *models.WorkItem) bool {
 			workItem.Stage, workItem.Status, topic)
 		return false
 	}
-	err := aptQueue.NSQClient.Enqueue(topic, workItem.Id)
+	ctx, cancel := aptQueue.Context.NetworkContext(nil)
+	defer cancel()
+	err := aptQueue.NSQClient.EnqueueWithContext(ctx, topic, workItem.Id)
 	if err != nil {
 		aptQueue.recordError("Error sending WorkItem %d %s (%s/%s/%s) - to %s: %v",
 			workItem.Id, identifier, workItem.Action,
@@ -1,12 +1,12 @@
 package workers
 
 import (
-	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util"
+	"io"
 	"net/url"
 	"strconv"
 	"time"
@@ -29,11 +29,9 @@ func NewAPTQueueFixity(_context *context.Context, identifierLike string, maxFile
 	_context.MessageLog.Info("NSQ address: %s", _context.Config.NsqdHttpAddress)
 	nsqClient := network.NewNSQClient(_context.Config.NsqdHttpAddress)
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	aptQueue := &APTQueueFixity{
 		Context:        _context,
@@ -75,23 +73,25 @@ func (aptQueue *APTQueueFixity) Run() {
 			"Queuing only files whose identifier contains %s",
 			aptQueue.identifierLike)
 	}
-	for {
-		resp := aptQueue.Context.PharosClient.GenericFileList(params)
-		aptQueue.Context.MessageLog.Info("GET %s", resp.Request.URL)
-		if resp.Error != nil {
+	options := network.PagingOptions{
+		Prefetch: true,
+		OnPage: func(resp *network.PharosResponse) {
+			aptQueue.Context.MessageLog.Info("GET %s", resp.Request.URL)
+		},
+	}
+	iterator := aptQueue.Context.PharosClient.GenericFileIterator(params, options)
+	for itemsAdded < aptQueue.maxFiles {
+		gf, err := iterator.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
 			aptQueue.Context.MessageLog.Error(
-				"Error getting GenericFile list from Pharos: %s",
-				resp.Error)
-		}
-		for _, gf := range resp.GenericFiles() {
-			if aptQueue.addToNSQ(gf) {
-				itemsAdded += 1
-			}
-		}
-		if resp.HasNextPage() == false || itemsAdded >= aptQueue.maxFiles {
+				"Error getting GenericFile list from Pharos: %s", err)
 			break
 		}
-		params = resp.ParamsForNextPage()
+		if aptQueue.addToNSQ(gf) {
+			itemsAdded += 1
+		}
 	}
 }
 
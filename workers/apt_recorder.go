@@ -1,6 +1,7 @@
 package workers
 
 import (
+	stdcontext "context"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
@@ -23,8 +24,21 @@ const (
 // Records ingest data (objects, files and events) in Pharos
 type APTRecorder struct {
 	Context        *context.Context
-	RecordChannel  chan *models.IngestState
-	CleanupChannel chan *models.IngestState
+	RecordChannel  chan *recordItem
+	CleanupChannel chan *recordItem
+
+	// Done, if it's not nil, receives each IngestState the recorder
+	// is finished with, whether it recorded the item or skipped it.
+	// apt_record -replay uses this to know when to stop.
+	Done chan *models.IngestState
+}
+
+// recordItem is an IngestState on its way through the recorder's
+// channels, with the context for its Pharos and S3 requests. The
+// context carries the item's cassette if recording is on.
+type recordItem struct {
+	ctx         stdcontext.Context
+	ingestState *models.IngestState
 }
 
 func NewAPTRecorder(_context *context.Context) *APTRecorder {
@@ -32,16 +46,14 @@ func NewAPTRecorder(_context *context.Context) *APTRecorder {
 		Context: _context,
 	}
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	// Set up buffered channels
 	workerBufferSize := _context.Config.RecordWorker.Workers * 10
-	recorder.RecordChannel = make(chan *models.IngestState, workerBufferSize)
-	recorder.CleanupChannel = make(chan *models.IngestState, workerBufferSize)
+	recorder.RecordChannel = make(chan *recordItem, workerBufferSize)
+	recorder.CleanupChannel = make(chan *recordItem, workerBufferSize)
 	// Set up a limited number of go routines
 	for i := 0; i < _context.Config.RecordWorker.Workers; i++ {
 		go recorder.record()
@@ -53,9 +65,20 @@ func NewAPTRecorder(_context *context.Context) *APTRecorder {
 // This is the callback that NSQ workers use to handle messages from NSQ.
 func (recorder *APTRecorder) HandleMessage(message *nsq.Message) error {
 	log := recorder.Context.MessageLog
-	ingestState, err := GetIngestState(message, recorder.Context, false)
+	// If recording is on, this records the Pharos and S3 requests
+	// for this item, so we can replay them with apt_record -replay.
+	ctx := recorder.Context.StartCassette("workitem_" + strings.TrimSpace(string(message.Body)))
+	if recorder.Context.Recording() {
+		// Put the institutions in the cassette too, so a replay
+		// can load them when it starts.
+		if err := recorder.Context.Institutions.LoadWithContext(ctx); err != nil {
+			log.Warning("Cannot load institutions for cassette: %v", err)
+		}
+	}
+	ingestState, err := GetIngestStateWithContext(ctx, message, recorder.Context, false)
 	if err != nil {
 		recorder.Context.MessageLog.Error(err.Error())
+		recorder.Context.SaveCassette(ctx)
 		return err
 	}
 
@@ -63,6 +86,9 @@ func (recorder *APTRecorder) HandleMessage(message *nsq.Message) error {
 	if ingestState.WorkItem.IsInProgress() {
 		log.Info(ingestState.WorkItem.MsgSkippingInProgress())
 		message.Finish()
+		if recorder.Done != nil {
+			recorder.Done <- ingestState
+		}
 		return nil
 	}
 
@@ -75,17 +101,18 @@ func (recorder *APTRecorder) HandleMessage(message *nsq.Message) error {
 	ingestState.IngestManifest.RecordResult.ClearErrors()
 
 	// Tell Pharos that we've started to record this item.
-	err = MarkWorkItemStarted(ingestState, recorder.Context,
+	err = MarkWorkItemStarted(ctx, ingestState, recorder.Context,
 		constants.StageRecord, "Recording object, file and event metadata in Pharos.")
 	if err != nil {
 		recorder.Context.MessageLog.Error(err.Error())
+		recorder.Context.SaveCassette(ctx)
 		return err
 	}
 
 	recorder.Context.MessageLog.Info("Putting %s/%s into record channel",
 		ingestState.IngestManifest.S3Bucket, ingestState.IngestManifest.S3Key)
 
-	recorder.RecordChannel <- ingestState
+	recorder.RecordChannel <- &recordItem{ctx: ctx, ingestState: ingestState}
 
 	// Return no error, so NSQ knows we're OK.
 	return nil
@@ -93,18 +120,20 @@ func (recorder *APTRecorder) HandleMessage(message *nsq.Message) error {
 
 // Step 1: Record data in Pharos
 func (recorder *APTRecorder) record() {
-	for ingestState := range recorder.RecordChannel {
+	for item := range recorder.RecordChannel {
+		ingestState := item.ingestState
 		ingestState.IngestManifest.RecordResult.Start()
 		ingestState.IngestManifest.RecordResult.Attempted = true
 		ingestState.IngestManifest.RecordResult.AttemptNumber += 1
-		recorder.saveAllPharosData(ingestState)
-		recorder.CleanupChannel <- ingestState
+		recorder.saveAllPharosData(item.ctx, ingestState)
+		recorder.CleanupChannel <- item
 	}
 }
 
 // Step 2: Delete tar file from staging area and from receiving bucket.
 func (recorder *APTRecorder) cleanup() {
-	for ingestState := range recorder.CleanupChannel {
+	for item := range recorder.CleanupChannel {
+		ctx, ingestState := item.ctx, item.ingestState
 		// See if we have fatal errors, or too many recurring transient errors
 		attemptNumber := ingestState.IngestManifest.RecordResult.AttemptNumber
 		maxAttempts := recorder.Context.Config.RecordWorker.MaxAttempts
@@ -114,19 +143,19 @@ func (recorder *APTRecorder) cleanup() {
 		if itsTimeToGiveUp {
 			recorder.logFailure(ingestState)
 			ingestState.FinishNSQ()
-			MarkWorkItemFailed(ingestState, recorder.Context)
+			MarkWorkItemFailed(ctx, ingestState, recorder.Context)
 		} else if ingestState.IngestManifest.RecordResult.HasErrors() {
 			recorder.logRequeue(ingestState)
 			ingestState.RequeueNSQ(1000)
-			MarkWorkItemRequeued(ingestState, recorder.Context)
+			MarkWorkItemRequeued(ctx, ingestState, recorder.Context)
 		} else {
-			MarkWorkItemStarted(ingestState, recorder.Context, constants.StageCleanup,
+			MarkWorkItemStarted(ctx, ingestState, recorder.Context, constants.StageCleanup,
 				"Bag has been stored and recorded. Deleting files from receiving bucket "+
 					"and staging area.")
 
 			// Call this before calling DeleteFileFromStaging on the valdb file,
 			// because this writes to valdb.
-			recorder.deleteBagFromReceivingBucket(ingestState)
+			recorder.deleteBagFromReceivingBucket(ctx, ingestState)
 
 			// Remove both the bag and the validation DB (unless we're running integration tests)
 			DeleteFileFromStaging(ingestState.IngestManifest.BagPath, recorder.Context)
@@ -134,17 +163,34 @@ func (recorder *APTRecorder) cleanup() {
 				DeleteFileFromStaging(ingestState.IngestManifest.DBPath, recorder.Context)
 			}
 
-			MarkWorkItemSucceeded(ingestState, recorder.Context, constants.StageCleanup)
+			MarkWorkItemSucceeded(ctx, ingestState, recorder.Context, constants.StageCleanup)
 			ingestState.FinishNSQ()
 		}
 
 		// Save our WorkItemState
 		ingestState.IngestManifest.RecordResult.Finish()
 		LogJson(ingestState, recorder.Context.JsonLog)
-		RecordWorkItemState(ingestState, recorder.Context, ingestState.IngestManifest.RecordResult)
+		RecordWorkItemState(ctx, ingestState, recorder.Context, ingestState.IngestManifest.RecordResult)
+		recorder.Context.SaveCassette(ctx)
+		if recorder.Done != nil {
+			recorder.Done <- ingestState
+		}
 	}
 }
 
+// pharosClient returns the PharosClient to use for an item's requests,
+// given the item's ctx. It records the requests if recording is on.
+func (recorder *APTRecorder) pharosClient(ctx stdcontext.Context) *network.PharosClient {
+	return recorder.Context.PharosClientFor(ctx)
+}
+
+// networkContext returns the context for an item's S3 requests, with
+// the cassette from the item's ctx attached if recording is on.
+func (recorder *APTRecorder) networkContext(ctx stdcontext.Context) (stdcontext.Context, stdcontext.CancelFunc) {
+	networkCtx, cancel := recorder.Context.NetworkContext(&recorder.Context.Config.RecordWorker)
+	return network.WithCassette(networkCtx, network.CassetteFrom(ctx)), cancel
+}
+
 // Make sure the IntellectualObject and its component files have
 // all of the checksums and PREMIS events we'll need to save.
 // We build these now so that the PREMIS events will have UUIDs,
@@ -153,7 +199,7 @@ func (recorder *APTRecorder) cleanup() {
 // in Pharos and which were not. This was a problem in the old
 // system, where record failured were common, and PREMIS events
 // often wound up being recorded twice.
-func (recorder *APTRecorder) saveAllPharosData(ingestState *models.IngestState) {
+func (recorder *APTRecorder) saveAllPharosData(ctx stdcontext.Context, ingestState *models.IngestState) {
 	db, err := storage.NewBoltDB(ingestState.IngestManifest.DBPath)
 	if db == nil {
 		// Happens when a prior worker process is killed,
@@ -187,7 +233,7 @@ func (recorder *APTRecorder) saveAllPharosData(ingestState *models.IngestState)
 
 	// Save the IntellectualObject
 	if ingestState.IngestManifest.Object.Id == 0 {
-		recorder.saveIntellectualObject(ingestState, obj)
+		recorder.saveIntellectualObject(ctx, ingestState, obj)
 		if ingestState.IngestManifest.RecordResult.HasErrors() {
 			recorder.logSaveError(ingestState)
 			return
@@ -205,10 +251,10 @@ func (recorder *APTRecorder) saveAllPharosData(ingestState *models.IngestState)
 		return
 	}
 
-	recorder.saveFiles(ingestState, obj, db)
+	recorder.saveFiles(ctx, ingestState, obj, db)
 }
 
-func (recorder *APTRecorder) saveFiles(ingestState *models.IngestState, obj *models.IntellectualObject, db *storage.BoltDB) {
+func (recorder *APTRecorder) saveFiles(ctx stdcontext.Context, ingestState *models.IngestState, obj *models.IntellectualObject, db *storage.BoltDB) {
 	offset := 0
 	for {
 		batch := db.FileIdentifierBatch(offset, GENERIC_FILE_BATCH_SIZE)
@@ -246,8 +292,8 @@ func (recorder *APTRecorder) saveFiles(ingestState *models.IngestState, obj *mod
 		}
 
 		// Save this batch of files in Pharos
-		recorder.createGenericFiles(ingestState, newFiles)
-		recorder.updateGenericFiles(ingestState, existingFiles)
+		recorder.createGenericFiles(ctx, ingestState, newFiles)
+		recorder.updateGenericFiles(ctx, ingestState, existingFiles)
 
 		// Update the GenericFile records in BoltDB
 		recorder.saveGenericFilesInBoltDB(ingestState, db, newFiles)
@@ -261,12 +307,12 @@ func (recorder *APTRecorder) saveFiles(ingestState *models.IngestState, obj *mod
 
 }
 
-func (recorder *APTRecorder) saveIntellectualObject(ingestState *models.IngestState, obj *models.IntellectualObject) {
+func (recorder *APTRecorder) saveIntellectualObject(ctx stdcontext.Context, ingestState *models.IngestState, obj *models.IntellectualObject) {
 	// If we're ingesting a new version of a previously ingested bag,
 	// we'll want to update the old record. Otherwise, we'll create a
 	// new one. 99.99% of the time, Pharos will return a 404 here, because
 	// it's a new ingest.
-	resp := recorder.Context.PharosClient.IntellectualObjectGet(obj.Identifier, false, false)
+	resp := recorder.pharosClient(ctx).IntellectualObjectGet(obj.Identifier, false, false)
 	existingObject := resp.IntellectualObject()
 	if existingObject != nil {
 		// PharosClient will know to update, rather than create,
@@ -279,7 +325,7 @@ func (recorder *APTRecorder) saveIntellectualObject(ingestState *models.IngestSt
 	// Pharos with State = "D", and now we're re-ingesting a new version of it.
 	obj.State = "A"
 
-	resp = recorder.Context.PharosClient.IntellectualObjectSave(obj)
+	resp = recorder.pharosClient(ctx).IntellectualObjectSave(obj)
 	if resp.Error != nil {
 		ingestState.IngestManifest.RecordResult.AddError(resp.Error.Error())
 		return
@@ -300,11 +346,11 @@ func (recorder *APTRecorder) saveIntellectualObject(ingestState *models.IngestSt
 	ingestState.IngestManifest.Object.CreatedAt = savedObject.CreatedAt
 	ingestState.IngestManifest.Object.UpdatedAt = savedObject.UpdatedAt
 
-	recorder.savePremisEventsForObject(ingestState, obj)
+	recorder.savePremisEventsForObject(ctx, ingestState, obj)
 }
 
 // createGenericFiles creates new GenericFile records in Pharos
-func (recorder *APTRecorder) createGenericFiles(ingestState *models.IngestState, files []*models.GenericFile) {
+func (recorder *APTRecorder) createGenericFiles(ctx stdcontext.Context, ingestState *models.IngestState, files []*models.GenericFile) {
 	if len(files) == 0 {
 		return
 	}
@@ -314,7 +360,7 @@ func (recorder *APTRecorder) createGenericFiles(ingestState *models.IngestState,
 		fileMap[gf.Identifier] = gf
 		identifiers[i] = gf.Identifier
 	}
-	resp := recorder.Context.PharosClient.GenericFileSaveBatch(files)
+	resp := recorder.pharosClient(ctx).GenericFileSaveBatch(files)
 	if resp.Error != nil {
 		body, _ := resp.RawResponseData()
 		recorder.Context.MessageLog.Error(
@@ -351,57 +397,101 @@ func (recorder *APTRecorder) createGenericFiles(ingestState *models.IngestState,
 	}
 }
 
-// updateGenericFiles updates existing GenericFile records in Pharos
-func (recorder *APTRecorder) updateGenericFiles(ingestState *models.IngestState, files []*models.GenericFile) {
+// updateGenericFiles updates existing GenericFile records in Pharos.
+// Re-ingested files come with new checksums and events. Those are
+// created with the batch endpoints after all of the files are updated,
+// rather than one file at a time.
+func (recorder *APTRecorder) updateGenericFiles(ctx stdcontext.Context, ingestState *models.IngestState, files []*models.GenericFile) {
 	if len(files) == 0 {
 		return
 	}
+	unsavedChecksums := make([]*models.Checksum, 0)
+	checksumFiles := make([]string, 0)
+	unsavedEvents := make([]*models.PremisEvent, 0)
 	for _, gf := range files {
-		clonedGenericFile := CloneWithoutSavedChildren(gf)
-		resp := recorder.Context.PharosClient.GenericFileSave(clonedGenericFile)
+		clonedGenericFile := gf.Clone()
+		clonedGenericFile.Checksums = nil
+		clonedGenericFile.PremisEvents = nil
+		resp := recorder.pharosClient(ctx).GenericFileSave(clonedGenericFile)
 		if resp.Error != nil {
 			ingestState.IngestManifest.RecordResult.AddError(
 				"Error updating '%s': %v", gf.Identifier, resp.Error)
 			continue
 		}
-		// Pick up updated timestamps in response from Pharos.
-		gf = resp.GenericFile()
-		// Shouldn't need to call this. Should already have Id?
 		gf.PropagateIdsToChildren()
+		for _, cs := range gf.Checksums {
+			if cs.Id == 0 {
+				unsavedChecksums = append(unsavedChecksums, cs)
+				checksumFiles = append(checksumFiles, gf.Identifier)
+			}
+		}
+		for _, event := range gf.PremisEvents {
+			if event.Id == 0 {
+				unsavedEvents = append(unsavedEvents, event)
+			}
+		}
+	}
+	if len(unsavedChecksums) > 0 {
+		resp := recorder.pharosClient(ctx).ChecksumSaveBatch(unsavedChecksums, checksumFiles)
+		for i, savedChecksum := range resp.Checksums() {
+			if savedChecksum != nil {
+				unsavedChecksums[i].MergeAttributes(savedChecksum)
+			}
+		}
+		for _, itemErr := range resp.ItemErrors {
+			ingestState.IngestManifest.RecordResult.AddError(
+				"Error adding checksum to updated file: %v", itemErr)
+		}
+	}
+	if len(unsavedEvents) > 0 {
+		resp := recorder.pharosClient(ctx).PremisEventSaveBatch(unsavedEvents)
+		for i, savedEvent := range resp.PremisEvents() {
+			if savedEvent != nil {
+				unsavedEvents[i].MergeAttributes(savedEvent)
+			}
+		}
+		for _, itemErr := range resp.ItemErrors {
+			event := unsavedEvents[itemErr.Index]
+			ingestState.IngestManifest.RecordResult.AddError(
+				"Error adding PremisEvent '%s' to '%s': %v",
+				event.EventType, event.GenericFileIdentifier, itemErr.Err)
+		}
 	}
 }
 
 // savePremisEventsForObject saves the object-level Premis events.
-func (recorder *APTRecorder) savePremisEventsForObject(ingestState *models.IngestState, obj *models.IntellectualObject) {
-	for i, event := range obj.PremisEvents {
+// Bags with many files can have thousands of these, so we save them
+// in batches.
+func (recorder *APTRecorder) savePremisEventsForObject(ctx stdcontext.Context, ingestState *models.IngestState, obj *models.IntellectualObject) {
+	unsavedEvents := make([]*models.PremisEvent, 0)
+	for _, event := range obj.PremisEvents {
 		if event.Id > 0 {
 			recorder.Context.MessageLog.Info("PremisEvent %d has already been saved", event.Id)
 			continue
 		}
 		event.IntellectualObjectId = obj.Id
-		resp := recorder.Context.PharosClient.PremisEventSave(event)
-		if resp.Error != nil {
-			method := "??"
-			url := "??"
-			if resp.Request != nil {
-				method = resp.Request.Method
-				if resp.Request.URL != nil {
-					url = resp.Request.URL.String()
-				}
-			}
-			ingestState.IngestManifest.RecordResult.AddError(
-				"While saving events for '%s', error adding PremisEvent '%s'."+
-					"Method: %s, URL: %s, Error: %v",
-				obj.Identifier, event.EventType, method, url, resp.Error)
-		} else {
-			obj.PremisEvents[i].MergeAttributes(resp.PremisEvent())
+		unsavedEvents = append(unsavedEvents, event)
+	}
+	if len(unsavedEvents) == 0 {
+		return
+	}
+	resp := recorder.pharosClient(ctx).PremisEventSaveBatch(unsavedEvents)
+	for i, savedEvent := range resp.PremisEvents() {
+		if savedEvent != nil {
+			unsavedEvents[i].MergeAttributes(savedEvent)
 		}
 	}
+	for _, itemErr := range resp.ItemErrors {
+		event := unsavedEvents[itemErr.Index]
+		ingestState.IngestManifest.RecordResult.AddError(
+			"While saving events for '%s', error adding PremisEvent '%s' (%s): %v",
+			obj.Identifier, event.EventType, event.Identifier, itemErr.Err)
+	}
 }
 
 // deleteBagFromReceivingBucket deletes the original tar file from the
 // depositor's receiving bucket.
-func (recorder *APTRecorder) deleteBagFromReceivingBucket(ingestState *models.IngestState) {
+func (recorder *APTRecorder) deleteBagFromReceivingBucket(ctx stdcontext.Context, ingestState *models.IngestState) {
 	var obj *models.IntellectualObject
 	db, err := storage.NewBoltDB(ingestState.IngestManifest.DBPath)
 	if err != nil {
@@ -423,7 +513,7 @@ func (recorder *APTRecorder) deleteBagFromReceivingBucket(ingestState *models.In
 	ingestState.IngestManifest.CleanupResult.AttemptNumber += 1
 
 	// Remove the bag from the receiving bucket, if ingest succeeded
-	if !recorder.bucketVersionMatchesCurrentVersion(ingestState) {
+	if !recorder.bucketVersionMatchesCurrentVersion(ctx, ingestState) {
 		recorder.Context.MessageLog.Info(
 			"Skipping deletion of %s in WorkItem %d "+
 				"because the etag of the tar file in "+
@@ -455,7 +545,9 @@ func (recorder *APTRecorder) deleteBagFromReceivingBucket(ingestState *models.In
 		constants.AWSVirginia,
 		ingestState.IngestManifest.S3Bucket,
 		[]string{ingestState.IngestManifest.S3Key})
-	deleter.DeleteList()
+	networkCtx, cancel := recorder.networkContext(ctx)
+	defer cancel()
+	deleter.DeleteListWithContext(networkCtx)
 	if deleter.ErrorMessage != "" {
 		message := fmt.Sprintf("In cleanup, error deleting S3 item %s/%s: %s",
 			ingestState.IngestManifest.S3Bucket, ingestState.IngestManifest.S3Key,
@@ -517,7 +609,7 @@ func (recorder *APTRecorder) saveGenericFilesInBoltDB(ingestState *models.Ingest
 // we will probably start ingesting it soon.
 //
 // Part of https://trello.com/c/GLURkoKW
-func (recorder *APTRecorder) bucketVersionMatchesCurrentVersion(ingestState *models.IngestState) bool {
+func (recorder *APTRecorder) bucketVersionMatchesCurrentVersion(ctx stdcontext.Context, ingestState *models.IngestState) bool {
 	eTagMatches := false
 	s3ObjectList := network.NewS3ObjectList(
 		os.Getenv("AWS_ACCESS_KEY_ID"),
@@ -526,7 +618,9 @@ func (recorder *APTRecorder) bucketVersionMatchesCurrentVersion(ingestState *mod
 		ingestState.IngestManifest.S3Bucket,
 		int64(100),
 	)
-	s3ObjectList.GetList(ingestState.IngestManifest.S3Key)
+	networkCtx, cancel := recorder.networkContext(ctx)
+	defer cancel()
+	s3ObjectList.GetListWithContext(networkCtx, ingestState.IngestManifest.S3Key)
 
 	if s3ObjectList.ErrorMessage != "" {
 		recorder.Context.MessageLog.Warning(
@@ -8,7 +8,6 @@ import (
 	"github.com/APTrust/exchange/models"
 	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/tarfile"
-	"github.com/APTrust/exchange/util"
 	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/APTrust/exchange/validation"
 	"github.com/nsqio/go-nsq"
@@ -17,7 +16,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -54,11 +52,9 @@ func NewAPTRestorer(_context *context.Context) *APTRestorer {
 		Context: _context,
 	}
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	restorer.BagValidationConfig = LoadAPTrustBagValidationConfig(restorer.Context)
 
@@ -402,7 +398,7 @@ func (restorer *APTRestorer) deleteBagDir(restoreState *models.RestoreState) {
 
 func (restorer *APTRestorer) uploadBag(restoreState *models.RestoreState) {
 	// Each institution has its own restoration bucket.
-	restorationBucket := util.RestorationBucketFor(restoreState.IntellectualObject.Institution,
+	restorationBucket := restorer.Context.Institutions.RestorationBucketFor(restoreState.IntellectualObject.Institution,
 		restorer.Context.Config.RestoreToTestBuckets)
 	s3Key := fmt.Sprintf("%s.tar", restoreState.IntellectualObject.BagName)
 	restorer.Context.MessageLog.Info("Uploading %s to %s/%s",
@@ -427,7 +423,9 @@ func (restorer *APTRestorer) uploadBag(restoreState *models.RestoreState) {
 	}
 
 	// Send the tarred bag to the depositor's restoration bucket.
-	upload.Send(reader)
+	ctx, cancel := restorer.Context.NetworkContext(&restorer.Context.Config.RestoreWorker)
+	defer cancel()
+	upload.SendWithContext(ctx, reader)
 	if upload.ErrorMessage != "" {
 		restoreState.CopySummary.AddError("Error uploading tar file %s: %s",
 			restoreState.LocalTarFile, upload.ErrorMessage)
@@ -645,7 +643,7 @@ func (restorer *APTRestorer) writeAPTrustInfoFile(restoreState *models.RestoreSt
 			aptInfoPath, err)
 		return
 	}
-	if !util.StringListContains(constants.StorageOptions, restoreState.IntellectualObject.StorageOption) {
+	if _, err := restorer.Context.Config.StorageOption(restoreState.IntellectualObject.StorageOption); err != nil {
 		restorer.Context.MessageLog.Warning("Object %s has invalid StorageOption '%s'",
 			restoreState.IntellectualObject.Identifier,
 			restoreState.IntellectualObject.StorageOption)
@@ -858,22 +856,28 @@ func (restorer *APTRestorer) fetchAllFiles(restoreState *models.RestoreState) {
 		return
 	}
 
-	region, bucket, err := restorer.Context.Config.StorageRegionAndBucketFor(restoreState.IntellectualObject.StorageOption)
+	storageOption := restoreState.IntellectualObject.StorageOption
+	option, err := restorer.Context.Config.StorageOption(storageOption)
 	if err != nil {
 		restoreState.PackageSummary.AddError("Cannot get region and bucket info for file: %v", err)
 		return
 	}
+	bucket := option.Bucket
+	provider, err := restorer.Context.StorageProviderFor(option.StorageTarget)
+	if err != nil {
+		restoreState.PackageSummary.AddError("Cannot get storage provider for %s: %v", storageOption, err)
+		return
+	}
 
-	// Set up a downloader to fetch files from S3 long-term storage.
-	downloader := network.NewS3Download(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		region,
+	// Set up a downloader to fetch files from long-term storage.
+	downloader := provider.Get(
 		bucket,
 		"",   // s3 key to fetch - to be set below
 		"",   // local path at which to save the s3 file - set below
 		true, // calculate md5 for manifest
 		true) // calculate sha256 for manifest and fixity verification
+	downloader.Concurrency = restorer.Context.Config.RestoreWorker.DownloadConcurrency
+	downloader.PartSize = restorer.Context.Config.RestoreWorker.DownloadPartSize
 
 	// Fetch all of the files from S3 to our local bag dir.
 	restorer.Context.MessageLog.Info("Starting fetch. Object %s has %d saved (active) files",
@@ -937,7 +941,9 @@ func (restorer *APTRestorer) fetchAllFiles(restoreState *models.RestoreState) {
 		// point if we don't have the info above.
 		restorer.Context.MessageLog.Info("Downloading %s (%s) to %s", gf.Identifier,
 			s3KeyName, downloader.LocalPath)
-		downloader.Fetch()
+		ctx, cancel := restorer.Context.NetworkContext(&restorer.Context.Config.RestoreWorker)
+		downloader.FetchWithContext(ctx)
+		cancel()
 		if downloader.ErrorMessage != "" {
 			msg := fmt.Sprintf("Error fetching %s from S3: %s", gf.Identifier, downloader.ErrorMessage)
 			restorer.Context.MessageLog.Error(msg)
@@ -997,31 +1003,47 @@ func (restorer *APTRestorer) WritePremisEventFile(restoreState *models.RestoreSt
 	// Write the open JSON array bracket.
 	io.WriteString(jsonFile, "[")
 
-	var events []*models.PremisEvent
-	hasMoreResults := true
-	pageNumber := 1
+	params := url.Values{}
+	params.Set("object_identifier", restoreState.WorkItem.ObjectIdentifier)
+	params.Set("page", "1")
+	params.Set("per_page", "500")
+	pageNumber := 0
+	options := network.PagingOptions{
+		Prefetch: true,
+		OnPage: func(resp *network.PharosResponse) {
+			pageNumber++
+			if resp.Error != nil {
+				return
+			}
+			restorer.Context.MessageLog.Info("Page %d of Premis events for %s returned %d items",
+				pageNumber, restoreState.WorkItem.ObjectIdentifier, len(resp.PremisEvents()))
+			if !resp.HasNextPage() {
+				restorer.Context.MessageLog.Info("Page %d is the last page of Premis events for %s",
+					pageNumber, restoreState.WorkItem.ObjectIdentifier)
+			}
+		},
+	}
+	iterator := restorer.Context.PharosClient.PremisEventIterator(params, options)
 	eventNumber := 0
 
-	// Keep getting batches, as long as we have more results.
-	for hasMoreResults {
-		events, hasMoreResults, err = restorer.getBatchOfPremisEvents(restoreState, pageNumber)
-		if err != nil {
+	// Stream each event record into the file, fetching
+	// more from Pharos as needed.
+	for {
+		event, err := iterator.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
 			restoreState.PackageSummary.AddError(
 				"Error getting page %d of Premis Events for %s from Pharos: %v",
 				pageNumber, restoreState.WorkItem.ObjectIdentifier, err)
 			break
-		} else {
-			// Stream each event record into the file.
-			for _, event := range events {
-				eventJson, _ := json.MarshalIndent(event, "", "  ")
-				if eventNumber > 0 {
-					io.WriteString(jsonFile, ",\n")
-				}
-				io.WriteString(jsonFile, string(eventJson))
-				eventNumber++
-			}
 		}
-		pageNumber++
+		eventJson, _ := json.MarshalIndent(event, "", "  ")
+		if eventNumber > 0 {
+			io.WriteString(jsonFile, ",\n")
+		}
+		io.WriteString(jsonFile, string(eventJson))
+		eventNumber++
 	}
 
 	// Closing JSON array bracket.
@@ -1032,26 +1054,6 @@ func (restorer *APTRestorer) WritePremisEventFile(restoreState *models.RestoreSt
 	restorer.addPremisFileChecksums(restoreState)
 }
 
-func (restorer *APTRestorer) getBatchOfPremisEvents(restoreState *models.RestoreState, pageNumber int) ([]*models.PremisEvent, bool, error) {
-	params := url.Values{}
-	params.Set("object_identifier", restoreState.WorkItem.ObjectIdentifier)
-	params.Set("page", strconv.Itoa(pageNumber))
-	params.Set("per_page", "500")
-	resp := restorer.Context.PharosClient.PremisEventList(params)
-	if resp.Error != nil {
-		return nil, false, resp.Error
-	}
-	events := resp.PremisEvents()
-	hasMoreItems := resp.HasNextPage()
-	restorer.Context.MessageLog.Info("Page %d of Premis events for %s returned %d items",
-		pageNumber, restoreState.WorkItem.ObjectIdentifier, len(events))
-	if !hasMoreItems {
-		restorer.Context.MessageLog.Info("Page %d is the last page of Premis events for %s",
-			pageNumber, restoreState.WorkItem.ObjectIdentifier)
-	}
-	return events, hasMoreItems, nil
-}
-
 // addPremisFileChecksums adds the PremisEvents.json file and its checksums
 // to the in-memory version of the IntellectualObject.
 //
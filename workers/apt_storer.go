@@ -9,6 +9,7 @@ import (
 	"github.com/APTrust/exchange/util"
 	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/APTrust/exchange/util/storage"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/nsqio/go-nsq"
 	"io"
@@ -37,6 +38,11 @@ const HIGH_FILE_BAG_IN_PROGRESS = "HighFileBagInProgress"
 // Special to deal with huge Fedora and DSpace dumps.
 const SMALL_FILE_SIZE = int64(300000)
 
+// Each file goes to the primary bucket of its storage option and,
+// if the option has a replication target, to that bucket as well.
+const sendToPrimary = "primary"
+const sendToReplica = "replica"
+
 // Stores GenericFiles in long-term storage (S3 and Glacier).
 type APTStorer struct {
 	Context        *context.Context
@@ -52,11 +58,9 @@ func NewAPTStorer(_context *context.Context) *APTStorer {
 		SyncMap: models.NewSynchronizedMap(),
 	}
 
-	// Patch for https://trello.com/c/Ep4pKzZB
-	err := CacheBucketNames(_context)
-	if err != nil {
-		panic(fmt.Sprintf("Cannot cache bucket names from Pharos: %v", err))
-	}
+	// Load institutions and their bucket names from Pharos,
+	// and keep them up to date.
+	_context.Institutions.Start()
 
 	// Set up buffered channels
 	workerBufferSize := _context.Config.StoreWorker.Workers * 10
@@ -97,7 +101,7 @@ func (storer *APTStorer) HandleMessage(message *nsq.Message) error {
 	ingestState.IngestManifest.StoreResult.ClearErrors()
 
 	// Tell Pharos that we've started to store this item.
-	err = MarkWorkItemStarted(ingestState, storer.Context,
+	err = MarkWorkItemStarted(nil, ingestState, storer.Context,
 		constants.StageStore, "Files are being copied to long-term storage.")
 	if err != nil {
 		storer.Context.MessageLog.Error(err.Error())
@@ -160,7 +164,7 @@ func (storer *APTStorer) store() {
 			storer.CleanupChannel <- ingestState
 			continue
 		}
-		objIdentifier, err := ingestState.IngestManifest.ObjectIdentifier()
+		objIdentifier, err := ingestState.IngestManifest.ObjectIdentifier(storer.Context.Institutions)
 		if err != nil {
 			ingestState.IngestManifest.StoreResult.AddError(err.Error())
 			ingestState.IngestManifest.StoreResult.Finish()
@@ -213,6 +217,17 @@ func (storer *APTStorer) store() {
 			storer.Context.MessageLog.Info("Bag %s has many small files. Increasing batch size to %d", objIdentifier, limit)
 		}
 
+		// Files in a gzipped tar file can only be reached by
+		// decompressing everything before them, so we copy them
+		// all out in one pass, instead of searching the archive
+		// for each one. Files we couldn't copy are still found
+		// the slow way.
+		err = storer.extractGzippedFiles(db, objIdentifier,
+			int(ingestState.IngestManifest.StoreResult.AttemptNumber))
+		if err != nil {
+			storer.Context.MessageLog.Warning(err.Error())
+		}
+
 		for {
 			// Get a batch of files to save...
 			storageSummaries, hasMoreFiles, err := storer.getStorageSummaryBatch(db, objIdentifier, start, limit)
@@ -310,7 +325,7 @@ func (storer *APTStorer) record() {
 		// and to the JSON log.
 		ingestState.IngestManifest.StoreResult.Finish()
 
-		objIdentifier, _ := ingestState.IngestManifest.ObjectIdentifier()
+		objIdentifier, _ := ingestState.IngestManifest.ObjectIdentifier(storer.Context.Institutions)
 		if objIdentifier != "" {
 			storer.clearHighResourceBag(objIdentifier)
 		}
@@ -324,7 +339,7 @@ func (storer *APTStorer) record() {
 		if itsTimeToGiveUp {
 			storer.logFailedToStore(ingestState)
 			ingestState.FinishNSQ()
-			MarkWorkItemFailed(ingestState, storer.Context)
+			MarkWorkItemFailed(nil, ingestState, storer.Context)
 		} else if ingestState.IngestManifest.StoreResult.HasErrors() {
 			timeout := 30000 // thirty seconds
 			if strings.Contains(ingestState.IngestManifest.StoreResult.Errors[0], "[High Resource Bag]") {
@@ -333,16 +348,16 @@ func (storer *APTStorer) record() {
 			}
 			storer.logRequeued(ingestState)
 			ingestState.RequeueNSQ(timeout)
-			MarkWorkItemRequeued(ingestState, storer.Context)
+			MarkWorkItemRequeued(nil, ingestState, storer.Context)
 		} else {
 			storer.logFinishedStoring(ingestState)
 			ingestState.FinishNSQ()
-			MarkWorkItemSucceeded(ingestState, storer.Context, constants.StageRecord)
+			MarkWorkItemSucceeded(nil, ingestState, storer.Context, constants.StageRecord)
 			PushToQueue(ingestState, storer.Context, storer.Context.Config.RecordWorker.NsqTopic)
 		}
 
 		LogJson(ingestState, storer.Context.JsonLog)
-		RecordWorkItemState(ingestState, storer.Context, ingestState.IngestManifest.FetchResult)
+		RecordWorkItemState(nil, ingestState, storer.Context, ingestState.IngestManifest.FetchResult)
 	}
 }
 
@@ -409,22 +424,21 @@ func (storer *APTStorer) saveFile(db *storage.BoltDB, storageSummary *models.Sto
 	// Now copy to storage only if the file has changed.
 	if gf.IngestNeedsSave {
 		storer.Context.MessageLog.Info("File %s needs save", gf.Identifier)
-		if gf.StorageOption == constants.StorageStandard {
-			if gf.IngestStoredAt.IsZero() || gf.IngestStorageURL == "" {
-				storer.copyToLongTermStorage(storageSummary, "s3")
-			}
-			if gf.IngestReplicatedAt.IsZero() || gf.IngestReplicationURL == "" {
-				storer.copyToLongTermStorage(storageSummary, "glacier")
-			}
+		option, err := storer.Context.Config.StorageOption(gf.StorageOption)
+		if err != nil {
+			storageSummary.StoreResult.AddError("Cannot store %s: %v", gf.Identifier, err)
+			storageSummary.StoreResult.ErrorIsFatal = true
 		} else {
 			// A.D. 2020-06-10: Don't re-upload unnecessarily.
 			if gf.IngestStoredAt.IsZero() || gf.IngestStorageURL == "" {
-				storer.Context.MessageLog.Info("Skipping S3 because file %s is %s", gf.Identifier, gf.StorageOption)
-				// Send directly to Glacier VA, OH or OR.
-				storer.copyToLongTermStorage(storageSummary, gf.StorageOption)
+				storer.copyToLongTermStorage(db, storageSummary, sendToPrimary)
 			} else {
 				storer.Context.MessageLog.Info("Skipping upload of %s because it was stored at %s at %s", gf.Identifier, gf.IngestStorageURL, gf.IngestStoredAt.Format(time.RFC3339))
 			}
+			if len(option.ReplicationTargets) > 0 &&
+				(gf.IngestReplicatedAt.IsZero() || gf.IngestReplicationURL == "") {
+				storer.copyToLongTermStorage(db, storageSummary, sendToReplica)
+			}
 		}
 		// Don't do cleanup until both copies are saved.
 		defer storer.cleanupTempFile(gf)
@@ -434,6 +448,8 @@ func (storer *APTStorer) saveFile(db *storage.BoltDB, storageSummary *models.Sto
 		} else {
 			storer.Context.MessageLog.Info("Skipping %s: unchanged since previous save", gf.Identifier)
 		}
+		// We may have copied it out of a gzipped bag.
+		os.Remove(storer.getTempFilePath(gf))
 	}
 	err := db.Save(gf.Identifier, gf)
 	if err != nil {
@@ -593,7 +609,7 @@ func (storer *APTStorer) setStorageOption(db *storage.BoltDB, objIdentifier stri
 }
 
 // Copy the GenericFile to long-term storage in S3 or Glacier
-func (storer *APTStorer) copyToLongTermStorage(storageSummary *models.StorageSummary, sendWhere string) {
+func (storer *APTStorer) copyToLongTermStorage(db *storage.BoltDB, storageSummary *models.StorageSummary, sendWhere string) {
 	gf := storageSummary.GenericFile
 	if !storer.uuidPresent(storageSummary) {
 		msg := fmt.Sprintf("Cannot copy GenericFile %s to long-term storage because UUID is missing",
@@ -604,18 +620,17 @@ func (storer *APTStorer) copyToLongTermStorage(storageSummary *models.StorageSum
 	}
 	storer.Context.MessageLog.Info("Sending %s to %s", gf.Identifier, sendWhere)
 	for attemptNumber := 1; attemptNumber <= MAX_UPLOAD_ATTEMPTS; attemptNumber++ {
-		storer.doUpload(storageSummary, sendWhere, attemptNumber)
+		storer.doUpload(db, storageSummary, sendWhere, attemptNumber)
 		// Stop trying if storage succeeded
-		if sendWhere == "glacier" && gf.IngestReplicatedAt.IsZero() == false {
+		if sendWhere == sendToReplica && gf.IngestReplicatedAt.IsZero() == false {
 			break
-		} else if sendWhere != "glacier" && gf.IngestStoredAt.IsZero() == false {
-			// Covers "s3", "Glacier-VA", "Glacier-OH" and "Glacier-OR"
+		} else if sendWhere == sendToPrimary && gf.IngestStoredAt.IsZero() == false {
 			break
 		}
 	}
 }
 
-func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhere string, attemptNumber int) {
+func (storer *APTStorer) doUpload(db *storage.BoltDB, storageSummary *models.StorageSummary, sendWhere string, attemptNumber int) {
 	gf := storageSummary.GenericFile
 	uploader := storer.initUploader(storageSummary, sendWhere)
 	if uploader == nil {
@@ -627,10 +642,9 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 	if !storer.assertRequiredMetadata(storageSummary, uploader) {
 		return
 	}
-	tarFileIterator, readCloser := storer.getReadCloser(storageSummary)
-	if readCloser != nil && tarFileIterator != nil {
+	readCloser := storer.getReadCloser(storageSummary)
+	if readCloser != nil {
 		defer readCloser.Close()
-		defer tarFileIterator.Close()
 
 		// Handle large files. Amazon's moronic uploader will read the
 		// entire file into memory, unless we give it a reader that
@@ -639,9 +653,10 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 		// ReadAt(). So we have to copy the entire file to disk and then
 		// pass the uploader a File object, which does support those
 		// methods. Fun.
-		reader := readCloser
+		var file *os.File
 		if gf.Size > constants.S3LargeFileSize {
-			reader, err := storer.getFileReader(readCloser, gf, attemptNumber)
+			var err error
+			file, err = storer.getFileReader(readCloser, gf, attemptNumber)
 			if err != nil {
 				errMsg := fmt.Sprintf("Error copying '%s' from tarfile to "+
 					"filesystem at '%s' for large file upload: %v", gf.Identifier,
@@ -650,7 +665,7 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 				storageSummary.StoreResult.AddError(errMsg)
 				return
 			}
-			defer reader.Close()
+			defer file.Close()
 		} else {
 			storer.Context.MessageLog.Info("Upload file %s (size: %d) directly "+
 				"to %s from the tar file", gf.Identifier, gf.Size, sendWhere)
@@ -660,8 +675,27 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 			gf.Identifier, gf.Size, sendWhere)
 
 		// Now do the upload using the tar file reader for smaller files
-		// and the File reader for very large files.
-		uploader.SendWithSize(reader, gf.Size)
+		// and the File reader for very large files. Large files go up in
+		// parts, and we keep track of the parts in the bag's BoltDB, so
+		// if this worker dies or the upload fails, the next attempt only
+		// has to send the parts S3 doesn't have.
+		ctx, cancel := storer.Context.NetworkContext(&storer.Context.Config.StoreWorker)
+		if file != nil {
+			uploader.SendResumableWithContext(ctx, file, gf.Size, db,
+				uploadStateKey(gf, sendWhere))
+		} else {
+			uploader.SendWithSizeWithContext(ctx, readCloser, gf.Size)
+		}
+		cancel()
+
+		// If the temp file isn't what we ingested, copy it from
+		// the tar file again on the next attempt.
+		_, fromTempFile := readCloser.(*os.File)
+		if (file != nil || fromTempFile) && uploader.Md5Digest != "" && uploader.Md5Digest != gf.IngestMd5 {
+			storer.Context.MessageLog.Warning("Temp file for %s has md5 %s, "+
+				"should be %s. Deleting it.", gf.Identifier, uploader.Md5Digest, gf.IngestMd5)
+			os.Remove(storer.getTempFilePath(gf))
+		}
 
 		// For large files, give S3 some time to catch up.
 		// On a 50GB+ upload with thousands of parts, S3 seems to always
@@ -674,7 +708,7 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 		// PT #143660373: S3 zero-size file bug.
 		// S3 returns some very weird stuff here,
 		// sometimes zero, sometimes 10x the actual file size.
-		s3Obj := storer.getS3FileDetail(uploader.AWSRegion, *uploader.UploadInput.Bucket, gf.IngestUUID)
+		s3Obj := storer.getS3FileDetail(gf, sendWhere)
 		if s3Obj == nil {
 			errMsg := fmt.Sprintf("%s returned nothing for %s (%s).", sendWhere, gf.IngestUUID, gf.Identifier)
 			if attemptNumber == MAX_UPLOAD_ATTEMPTS {
@@ -691,7 +725,24 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 				storer.Context.MessageLog.Warning(errMsg + " Will retry.")
 			}
 		}
-		uploadSucceeded := (s3Obj != nil && *s3Obj.Size == gf.Size && uploader.ErrorMessage == "")
+
+		// Make sure S3 has the data we sent. The uploader already
+		// checked that the data we sent is the data we ingested.
+		// It has no ETag for us if the provider's ETags aren't
+		// md5 digests, so then we can only check the size.
+		etagMatches := s3Obj != nil && (uploader.ETag == "" ||
+			network.SameETag(aws.StringValue(s3Obj.ETag), uploader.ETag))
+		if s3Obj != nil && uploader.ErrorMessage == "" && !etagMatches {
+			errMsg := fmt.Sprintf("%s returned ETag %s for %s (%s), should be %s.",
+				sendWhere, aws.StringValue(s3Obj.ETag), gf.IngestUUID, gf.Identifier, uploader.ETag)
+			if attemptNumber == MAX_UPLOAD_ATTEMPTS {
+				storageSummary.StoreResult.AddError(errMsg)
+			} else {
+				storer.Context.MessageLog.Warning(errMsg + " Will retry.")
+			}
+		}
+		uploadSucceeded := (s3Obj != nil && *s3Obj.Size == gf.Size &&
+			uploader.ErrorMessage == "" && etagMatches)
 
 		if uploadSucceeded {
 			storer.Context.MessageLog.Info("Stored %s in %s after %d attempts",
@@ -710,6 +761,12 @@ func (storer *APTStorer) doUpload(storageSummary *models.StorageSummary, sendWhe
 	}
 }
 
+// uploadStateKey is the key under which we keep the state of the
+// multipart upload of gf to sendWhere in the bag's BoltDB.
+func uploadStateKey(gf *models.GenericFile, sendWhere string) string {
+	return fmt.Sprintf("upload:%s:%s", sendWhere, gf.Identifier)
+}
+
 // See the comment above, that begins "Handle large files."
 // We put temp files on the /mnt, not in /tmp, because they
 // may be too large for the root partition.
@@ -874,22 +931,30 @@ func (storer *APTStorer) uuidPresent(storageSummary *models.StorageSummary) bool
 	return true
 }
 
+// storageFor returns the storage provider and bucket for the primary
+// copy of gf, or for its replica if sendWhere is sendToReplica. Both
+// come from the settings for gf's storage option.
+func (storer *APTStorer) storageFor(gf *models.GenericFile, sendWhere string) (network.StorageProvider, *models.StorageTarget, error) {
+	option, err := storer.Context.Config.StorageOption(gf.StorageOption)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := &option.StorageTarget
+	if sendWhere == sendToReplica {
+		if len(option.ReplicationTargets) == 0 {
+			return nil, nil, fmt.Errorf("Storage option %s has no replication target", option.Name)
+		}
+		target = &option.ReplicationTargets[0]
+	}
+	provider, err := storer.Context.StorageProviderFor(*target)
+	return provider, target, err
+}
+
 // Initializes the uploader object with connection data and metadata
 // for this specific GenericFile.
 func (storer *APTStorer) initUploader(storageSummary *models.StorageSummary, sendWhere string) *network.S3Upload {
 	gf := storageSummary.GenericFile
-	var region string
-	var bucket string
-	var err error
-	if sendWhere == "s3" {
-		region = storer.Context.Config.APTrustS3Region
-		bucket = storer.Context.Config.PreservationBucket
-	} else if sendWhere == "glacier" {
-		region = storer.Context.Config.APTrustGlacierRegion
-		bucket = storer.Context.Config.ReplicationBucket
-	} else {
-		region, bucket, err = storer.Context.Config.StorageRegionAndBucketFor(sendWhere)
-	}
+	provider, target, err := storer.storageFor(gf, sendWhere)
 	if err != nil {
 		storageSummary.StoreResult.AddError(err.Error())
 		storageSummary.StoreResult.AddError("Cannot save %s to %s because "+
@@ -897,14 +962,10 @@ func (storer *APTStorer) initUploader(storageSummary *models.StorageSummary, sen
 		storageSummary.StoreResult.ErrorIsFatal = true
 		return nil
 	}
-	uploader := network.NewS3Upload(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		region,
-		bucket,
-		gf.IngestUUID,
-		gf.FileFormat,
-	)
+	uploader := provider.Put(target.Bucket, gf.IngestUUID, gf.FileFormat)
+	if target.StorageClass != "" {
+		uploader.UploadInput.StorageClass = aws.String(target.StorageClass)
+	}
 	instIdentifier, err := gf.InstitutionIdentifier()
 	if err != nil {
 		storageSummary.StoreResult.AddError("Error setting institution in S3 metadata: %v. "+
@@ -915,27 +976,36 @@ func (storer *APTStorer) initUploader(storageSummary *models.StorageSummary, sen
 	uploader.AddMetadata("bagpath", gf.OriginalPath())
 	uploader.AddMetadata("md5", gf.IngestMd5)
 	uploader.AddMetadata("sha256", gf.IngestSha256)
+	uploader.ExpectedMd5 = gf.IngestMd5
+	uploader.ExpectedSha256 = gf.IngestSha256
 	return uploader
 }
 
-// Returns a reader that can read the file from within the tar archive.
-// The S3 uploader uses this reader to stream data to S3 and Glacier.
-func (storer *APTStorer) getReadCloser(storageSummary *models.StorageSummary) (*fileutil.TarFileIterator, io.ReadCloser) {
+// Returns a reader that can read the file from within the tar, tar.gz
+// or zip archive. The S3 uploader uses this reader to stream data to
+// S3 and Glacier. If we already copied the file out of the archive,
+// this returns the temp file instead. Closing the reader closes the
+// archive.
+func (storer *APTStorer) getReadCloser(storageSummary *models.StorageSummary) io.ReadCloser {
 	gf := storageSummary.GenericFile
+	if tempFile := storer.openTempFile(gf); tempFile != nil {
+		return tempFile
+	}
 	tarFilePath := storageSummary.TarFilePath
-	tfi, err := fileutil.NewTarFileIterator(storageSummary.TarFilePath)
+	tfi, err := fileutil.NewArchiveIterator(storageSummary.TarFilePath)
 	if err != nil {
-		msg := fmt.Sprintf("Can't get TarFileIterator for %s: %v", tarFilePath, err)
+		msg := fmt.Sprintf("Can't get archive iterator for %s: %v", tarFilePath, err)
 		storer.Context.MessageLog.Error(msg)
 		storageSummary.StoreResult.AddError(msg)
-		return nil, nil
+		return nil
 	}
 	origPathWithBagName, err := gf.OriginalPathWithBagName()
 	if err != nil {
 		msg := fmt.Sprintf("Can't get original path for %s: %s", gf.Identifier, err.Error())
 		storer.Context.MessageLog.Error(msg)
 		storageSummary.StoreResult.AddError(msg)
-		return nil, nil
+		tfi.Close()
+		return nil
 	}
 	readCloser, err := tfi.Find(origPathWithBagName)
 	if err != nil {
@@ -945,9 +1015,98 @@ func (storer *APTStorer) getReadCloser(storageSummary *models.StorageSummary) (*
 		if readCloser != nil {
 			readCloser.Close()
 		}
-		return nil, nil
+		tfi.Close()
+		return nil
+	}
+	return archiveReadCloser{ReadCloser: readCloser, iterator: tfi}
+}
+
+// archiveReadCloser reads a file from an archive, and closes the
+// archive when it's closed.
+type archiveReadCloser struct {
+	io.ReadCloser
+	iterator fileutil.ArchiveIterator
+}
+
+// Close closes the reader and the archive.
+func (reader archiveReadCloser) Close() error {
+	err := reader.ReadCloser.Close()
+	reader.iterator.Close()
+	return err
+}
+
+// openTempFile returns the temp file for gf, if we copied gf out of
+// the archive and the copy is complete. Otherwise, it returns nil.
+func (storer *APTStorer) openTempFile(gf *models.GenericFile) *os.File {
+	if gf.Size == 0 || !util.LooksLikeUUID(gf.IngestUUID) {
+		return nil
+	}
+	tempFilePath := storer.getTempFilePath(gf)
+	stat, err := os.Stat(tempFilePath)
+	if err != nil || stat.Size() != gf.Size {
+		return nil
+	}
+	file, err := os.Open(tempFilePath)
+	if err != nil {
+		return nil
+	}
+	return file
+}
+
+// extractGzippedFiles copies the files in a .tar.gz or .tgz bag that
+// still need to be stored out to temp files, reading the archive once,
+// front to back. doUpload sends the temp files, and saveFile deletes
+// them. This needs as much free space as the files in the bag take up
+// uncompressed. Files that already have a complete temp file are
+// skipped, so a retry copies only the files that are missing. For
+// other kinds of bags, this is a no-op.
+func (storer *APTStorer) extractGzippedFiles(db *storage.BoltDB, objIdentifier string, attemptNumber int) error {
+	obj, err := db.GetIntellectualObject(objIdentifier)
+	if err != nil {
+		return fmt.Errorf("Can't get IntellectualObject from BoltDB: %v", err)
+	}
+	if obj == nil || !fileutil.IsGzippedTar(obj.IngestTarFilePath) {
+		return nil
+	}
+	iterator, err := fileutil.NewGzipTarIterator(obj.IngestTarFilePath)
+	if err != nil {
+		return fmt.Errorf("Can't get archive iterator for %s: %v", obj.IngestTarFilePath, err)
+	}
+	defer iterator.Close()
+	storer.Context.MessageLog.Info("Copying files out of gzipped bag %s", obj.IngestTarFilePath)
+	for {
+		reader, fileSummary, err := iterator.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Error reading %s: %v", obj.IngestTarFilePath, err)
+		}
+		if !fileSummary.IsRegularFile || fileSummary.Size == 0 {
+			continue
+		}
+		gf, err := db.GetGenericFile(objIdentifier + "/" + fileSummary.RelPath)
+		if err != nil {
+			return fmt.Errorf("Can't get GenericFile from BoltDB: %v", err)
+		}
+		if gf == nil || !gf.IngestNeedsSave || !util.LooksLikeUUID(gf.IngestUUID) {
+			continue
+		}
+		// Same test as cleanupTempFile.
+		fileIsStored := !gf.IngestStoredAt.IsZero()
+		fileIsReplicated := !gf.IngestReplicatedAt.IsZero() || strings.HasPrefix(gf.StorageOption, "Glacier")
+		if fileIsStored && fileIsReplicated {
+			continue
+		}
+		if tempFile := storer.openTempFile(gf); tempFile != nil {
+			tempFile.Close()
+			continue
+		}
+		err = storer.createTempFile(reader, gf, attemptNumber)
+		if err != nil {
+			os.Remove(storer.getTempFilePath(gf))
+			return fmt.Errorf("Error copying %s out of %s: %v", gf.Identifier, obj.IngestTarFilePath, err)
+		}
 	}
-	return tfi, readCloser
 }
 
 // Make sure we send data to S3/Glacier with all of the required metadata.
@@ -967,9 +1126,7 @@ func (storer *APTStorer) assertRequiredMetadata(storageSummary *models.StorageSu
 }
 
 func (storer *APTStorer) markFileAsStored(gf *models.GenericFile, sendWhere, storageUrl string) {
-	// For new Glacier-only storage, condition if sendWhere != "glacier"
-	// covers S3, Glacier-OH, Glacier-OR, and Glacier-VA
-	if sendWhere != "glacier" {
+	if sendWhere == sendToPrimary {
 		gf.IngestStoredAt = time.Now().UTC()
 		gf.IngestStorageURL = storageUrl
 		gf.URI = storageUrl
@@ -986,7 +1143,7 @@ func (storer *APTStorer) markFileAsStored(gf *models.GenericFile, sendWhere, sto
 		if event != nil {
 			event.DateTime = time.Now().UTC()
 		}
-	} else if sendWhere == "glacier" {
+	} else if sendWhere == sendToReplica {
 		gf.IngestReplicatedAt = time.Now().UTC()
 		gf.IngestReplicationURL = storageUrl
 		events := gf.FindEventsByType(constants.EventReplication)
@@ -997,12 +1154,16 @@ func (storer *APTStorer) markFileAsStored(gf *models.GenericFile, sendWhere, sto
 }
 
 // PT #143660373: S3 zero-size file bug.
-func (storer *APTStorer) getS3FileDetail(region, bucket, fileUUID string) *s3.Object {
-	s3Client := network.NewS3ObjectList(
-		os.Getenv("AWS_ACCESS_KEY_ID"),
-		os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		region, bucket, 1)
-	s3Client.GetList(fileUUID)
+func (storer *APTStorer) getS3FileDetail(gf *models.GenericFile, sendWhere string) *s3.Object {
+	provider, target, err := storer.storageFor(gf, sendWhere)
+	if err != nil {
+		storer.Context.MessageLog.Error("Cannot check %s in %s storage: %v", gf.IngestUUID, sendWhere, err)
+		return nil
+	}
+	s3Client := provider.List(target.Bucket, 1)
+	ctx, cancel := storer.Context.NetworkContext(&storer.Context.Config.StoreWorker)
+	defer cancel()
+	s3Client.GetListWithContext(ctx, gf.IngestUUID)
 	if len(s3Client.Response.Contents) > 0 {
 		return s3Client.Response.Contents[0]
 	}
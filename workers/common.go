@@ -1,46 +1,30 @@
 package workers
 
 import (
+	stdcontext "context"
 	"encoding/json"
 	"fmt"
 	"github.com/APTrust/exchange/constants"
 	"github.com/APTrust/exchange/context"
 	"github.com/APTrust/exchange/models"
-	"github.com/APTrust/exchange/util"
+	"github.com/APTrust/exchange/network"
 	"github.com/APTrust/exchange/util/fileutil"
 	"github.com/APTrust/exchange/validation"
 	"github.com/nsqio/go-nsq"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 var TAR_SUFFIX = regexp.MustCompile("\\.tar$")
 
-func CacheBucketNames(_context *context.Context) error {
-	params := url.Values{}
-	params.Add("page", "1")
-	params.Add("per_page", "100")
-	resp := _context.PharosClient.InstitutionList(params)
-	if resp.Error != nil {
-		return resp.Error
-	}
-	for _, inst := range resp.Institutions() {
-		util.OwnerOfReceivingBucket[inst.ReceivingBucket] = inst.Identifier
-		util.OwnerOfRestoreBucket[inst.RestoreBucket] = inst.Identifier
-		util.RestoreBucketFor[inst.Identifier] = inst.RestoreBucket
-	}
-	_context.MessageLog.Info(
-		"Loaded %d bucket names for institutions", len(resp.Institutions()))
-	return nil
-}
-
 // CreateNSQConsumer creates and returns an NSQ consumer for a worker process.
 func CreateNsqConsumer(config *models.Config, workerConfig *models.WorkerConfig) (*nsq.Consumer, error) {
 	nsqConfig := nsq.NewConfig()
@@ -54,6 +38,25 @@ func CreateNsqConsumer(config *models.Config, workerConfig *models.WorkerConfig)
 	return nsq.NewConsumer(workerConfig.NsqTopic, workerConfig.NsqChannel, nsqConfig)
 }
 
+// StopOnSignal shuts down the worker cleanly when the process receives
+// SIGINT or SIGTERM. It cancels network requests in progress, so the
+// worker can requeue the items it's working on, and then stops the
+// consumer. The consumer closes its StopChan when all in-flight
+// messages have been finished or requeued.
+func StopOnSignal(_context *context.Context, consumer *nsq.Consumer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		_context.MessageLog.Info("Received %v. Cancelling network requests "+
+			"and stopping the NSQ consumer.", sig)
+		_context.Shutdown()
+		consumer.Stop()
+		// A second signal exits without waiting.
+		signal.Stop(signals)
+	}()
+}
+
 // --------------------------------------------------------------------------------
 // TODO - Remove this
 // --------------------------------------------------------------------------------
@@ -63,14 +66,22 @@ func CreateNsqConsumer(config *models.Config, workerConfig *models.WorkerConfig)
 // in apt_fetcher, where we're often fetching new bags that Pharos has
 // never seen before. All other workers should pass in false for initIfEmpty.
 func GetIngestState(message *nsq.Message, _context *context.Context, initIfEmpty bool) (*models.IngestState, error) {
-	workItem, err := GetWorkItem(message, _context)
+	return GetIngestStateWithContext(nil, message, _context, initIfEmpty)
+}
+
+// GetIngestStateWithContext is like GetIngestState, but it sends its
+// Pharos requests with ctx. If ctx is nil, requests use the context's
+// PharosClient as it is.
+func GetIngestStateWithContext(ctx stdcontext.Context, message *nsq.Message, _context *context.Context, initIfEmpty bool) (*models.IngestState, error) {
+	pharosClient := _context.PharosClientFor(ctx)
+	workItem, err := getWorkItem(message, _context, pharosClient)
 	if err != nil {
 		return nil, err
 	}
 	_context.MessageLog.Info("Loaded WorkItem %d (%s/%s)",
 		workItem.Id, workItem.Bucket, workItem.Name)
 
-	workItemState, err := GetWorkItemState(workItem, _context, initIfEmpty)
+	workItemState, err := getWorkItemState(workItem, pharosClient, initIfEmpty)
 	if err != nil {
 		return nil, err
 	}
@@ -134,13 +145,17 @@ func GetIngestState(message *nsq.Message, _context *context.Context, initIfEmpty
 // GetWorkItem returns the WorkItem with the specified Id from Pharos,
 // or nil.
 func GetWorkItem(message *nsq.Message, _context *context.Context) (*models.WorkItem, error) {
+	return getWorkItem(message, _context, _context.PharosClient)
+}
+
+func getWorkItem(message *nsq.Message, _context *context.Context, pharosClient *network.PharosClient) (*models.WorkItem, error) {
 	msgBody := strings.TrimSpace(string(message.Body))
 	_context.MessageLog.Info("NSQ Message body: '%s'", msgBody)
 	workItemId, err := strconv.Atoi(string(msgBody))
 	if err != nil || workItemId == 0 {
 		return nil, fmt.Errorf("Could not get WorkItemId from NSQ message body: %v", err)
 	}
-	resp := _context.PharosClient.WorkItemGet(workItemId)
+	resp := pharosClient.WorkItemGet(workItemId)
 	if resp.Error != nil {
 		return nil, fmt.Errorf("Error getting WorkItem %d from Pharos: %v", workItemId, resp.Error)
 	}
@@ -156,13 +171,17 @@ func GetWorkItem(message *nsq.Message, _context *context.Context) (*models.WorkI
 // true ONLY when calling from apt_fetcher, which is working with objects
 // that are not yet in the system.
 func GetWorkItemState(workItem *models.WorkItem, _context *context.Context, initIfEmpty bool) (*models.WorkItemState, error) {
+	return getWorkItemState(workItem, _context.PharosClient, initIfEmpty)
+}
+
+func getWorkItemState(workItem *models.WorkItem, pharosClient *network.PharosClient, initIfEmpty bool) (*models.WorkItemState, error) {
 	var workItemState *models.WorkItemState
 	var err error
 	workItemStateId := 0
 	if workItem.WorkItemStateId != nil {
 		workItemStateId = *workItem.WorkItemStateId
 	}
-	resp := _context.PharosClient.WorkItemStateGet(workItemStateId)
+	resp := pharosClient.WorkItemStateGet(workItemStateId)
 	if resp.Response.StatusCode == http.StatusNotFound {
 		if initIfEmpty {
 			// Record has not been created yet, so build a new one now.
@@ -217,7 +236,11 @@ func InitWorkItemState(workItem *models.WorkItem) (*models.WorkItemState, error)
 // Param activeResult will change, depending on what stage of processing
 // we're in. It could be the IngestState.FetchResult, IngestState.RecordResult,
 // etc.
-func RecordWorkItemState(ingestState *models.IngestState, _context *context.Context, activeResult *models.WorkSummary) {
+//
+// Param ctx is the context for the Pharos request, which records it into
+// the item's cassette if the worker is recording. If ctx is nil, we use
+// the context's PharosClient as it is.
+func RecordWorkItemState(ctx stdcontext.Context, ingestState *models.IngestState, _context *context.Context, activeResult *models.WorkSummary) {
 	// Serialize the IngestManifest to JSON, and stuff it into the
 	// WorkItemState.State. Subsequent workers need this info to
 	// store the object's files in S3 and Glacier, and to record
@@ -236,7 +259,7 @@ func RecordWorkItemState(ingestState *models.IngestState, _context *context.Cont
 		// over to Pharos, so the next worker in the chain (the save worker)
 		// can access it.
 		// LogJson(ingestState, _context.JsonLog)
-		resp := _context.PharosClient.WorkItemStateSave(ingestState.WorkItemState)
+		resp := _context.PharosClientFor(ctx).WorkItemStateSave(ingestState.WorkItemState)
 		if resp.Error != nil {
 			// Could not send a copy of the WorkItemState to Pharos.
 			// That means subsequent workers won't have the info they
@@ -260,7 +283,8 @@ func RecordWorkItemState(ingestState *models.IngestState, _context *context.Cont
 
 // Loads the bag validation config file specified in the general config
 // options. This will die if the bag validation config cannot be loaded
-// or is invalid.
+// or is invalid. The allowed values of the Storage-Option tag are the
+// storage options in the general config.
 func LoadAPTrustBagValidationConfig(_context *context.Context) *validation.BagValidationConfig {
 	bagValidationConfig, errors := validation.LoadBagValidationConfig(
 		_context.Config.BagValidationConfigFile)
@@ -276,12 +300,17 @@ func LoadAPTrustBagValidationConfig(_context *context.Context) *validation.BagVa
 		_context.MessageLog.Info("Loaded bag validation config file %s",
 			_context.Config.BagValidationConfigFile)
 	}
+	if tagSpec, ok := bagValidationConfig.TagSpecs["Storage-Option"]; ok {
+		tagSpec.AllowedValues = _context.Config.StorageOptionNames()
+		bagValidationConfig.TagSpecs["Storage-Option"] = tagSpec
+	}
 	return bagValidationConfig
 }
 
 // MarkWorkItemFailed tells Pharos that this item failed processing
 // due to a fatal error or too many unsuccessful attempts.
-func MarkWorkItemFailed(ingestState *models.IngestState, _context *context.Context) error {
+// Param ctx is as for RecordWorkItemState.
+func MarkWorkItemFailed(ctx stdcontext.Context, ingestState *models.IngestState, _context *context.Context) error {
 	_context.MessageLog.Info("Telling Pharos processing failed for %s/%s",
 		ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
 	ingestState.WorkItem.Date = time.Now().UTC()
@@ -292,7 +321,7 @@ func MarkWorkItemFailed(ingestState *models.IngestState, _context *context.Conte
 	ingestState.WorkItem.NeedsAdminReview = true
 	ingestState.WorkItem.Status = constants.StatusFailed
 	ingestState.WorkItem.Note = "Processing failed. " + ingestState.IngestManifest.AllErrorsAsString()
-	resp := _context.PharosClient.WorkItemSave(ingestState.WorkItem)
+	resp := _context.PharosClientFor(ctx).WorkItemSave(ingestState.WorkItem)
 	if resp.Error != nil {
 		_context.MessageLog.Error("Could not mark WorkItem failed for %s/%s: %v",
 			ingestState.WorkItem.Bucket, ingestState.WorkItem.Name, resp.Error)
@@ -303,7 +332,8 @@ func MarkWorkItemFailed(ingestState *models.IngestState, _context *context.Conte
 }
 
 // MarkWorkItemCancelled tells Pharos that the work item has been cancelled.
-func MarkWorkItemCancelled(ingestState *models.IngestState, _context *context.Context) error {
+// Param ctx is as for RecordWorkItemState.
+func MarkWorkItemCancelled(ctx stdcontext.Context, ingestState *models.IngestState, _context *context.Context) error {
 	_context.MessageLog.Info("Telling Pharos processing cancelled for %s/%s",
 		ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
 	ingestState.WorkItem.Date = time.Now().UTC()
@@ -314,7 +344,7 @@ func MarkWorkItemCancelled(ingestState *models.IngestState, _context *context.Co
 	ingestState.WorkItem.NeedsAdminReview = false
 	ingestState.WorkItem.Status = constants.StatusCancelled
 	ingestState.WorkItem.Note = ingestState.IngestManifest.AllErrorsAsString()
-	resp := _context.PharosClient.WorkItemSave(ingestState.WorkItem)
+	resp := _context.PharosClientFor(ctx).WorkItemSave(ingestState.WorkItem)
 	if resp.Error != nil {
 		_context.MessageLog.Error("Could not mark WorkItem cancelled for %s/%s: %v",
 			ingestState.WorkItem.Bucket, ingestState.WorkItem.Name, resp.Error)
@@ -325,8 +355,8 @@ func MarkWorkItemCancelled(ingestState *models.IngestState, _context *context.Co
 }
 
 // MarkWorkItemRequeued tells Pharos that this item has been requeued
-// due to transient errors.
-func MarkWorkItemRequeued(ingestState *models.IngestState, _context *context.Context) error {
+// due to transient errors. Param ctx is as for RecordWorkItemState.
+func MarkWorkItemRequeued(ctx stdcontext.Context, ingestState *models.IngestState, _context *context.Context) error {
 	_context.MessageLog.Info("Telling Pharos we are requeueing %s/%s",
 		ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
 	ingestState.WorkItem.Date = time.Now().UTC()
@@ -338,7 +368,7 @@ func MarkWorkItemRequeued(ingestState *models.IngestState, _context *context.Con
 	ingestState.WorkItem.Status = constants.StatusStarted
 	ingestState.WorkItem.Note = "Item has been requeued due to transient errors. " +
 		ingestState.IngestManifest.AllErrorsAsString()
-	resp := _context.PharosClient.WorkItemSave(ingestState.WorkItem)
+	resp := _context.PharosClientFor(ctx).WorkItemSave(ingestState.WorkItem)
 	if resp.Error != nil {
 		_context.MessageLog.Error("Could not mark WorkItem requeued for %s/%s: %v",
 			ingestState.WorkItem.Bucket, ingestState.WorkItem.Name, resp.Error)
@@ -349,7 +379,8 @@ func MarkWorkItemRequeued(ingestState *models.IngestState, _context *context.Con
 }
 
 // MarkWorkItemStarted tells Pharos that we've started work on this item.
-func MarkWorkItemStarted(ingestState *models.IngestState, _context *context.Context, stage, message string) error {
+// Param ctx is as for RecordWorkItemState.
+func MarkWorkItemStarted(ctx stdcontext.Context, ingestState *models.IngestState, _context *context.Context, stage, message string) error {
 	_context.MessageLog.Info("Telling Pharos we're starting %s for %s/%s",
 		stage, ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
 	utcNow := time.Now().UTC()
@@ -359,19 +390,20 @@ func MarkWorkItemStarted(ingestState *models.IngestState, _context *context.Cont
 	ingestState.WorkItem.StageStartedAt = &utcNow
 	ingestState.WorkItem.Status = constants.StatusStarted
 	ingestState.WorkItem.Note = message
-	resp := _context.PharosClient.WorkItemSave(ingestState.WorkItem)
+	resp := _context.PharosClientFor(ctx).WorkItemSave(ingestState.WorkItem)
 	if resp.Error != nil {
 		_context.MessageLog.Error("Could not mark WorkItem started for %s for %s/%s: %v",
 			stage, ingestState.WorkItem.Bucket, ingestState.WorkItem.Name, resp.Error)
 		return resp.Error
 	}
 	ingestState.WorkItem = resp.WorkItem()
-	RecordWorkItemState(ingestState, _context, ingestState.IngestManifest.FetchResult)
+	RecordWorkItemState(ctx, ingestState, _context, ingestState.IngestManifest.FetchResult)
 	return nil
 }
 
 // MarkWorkItemSucceeded tells Pharos that this item was processed successfully.
-func MarkWorkItemSucceeded(ingestState *models.IngestState, _context *context.Context, nextStage string) error {
+// Param ctx is as for RecordWorkItemState.
+func MarkWorkItemSucceeded(ctx stdcontext.Context, ingestState *models.IngestState, _context *context.Context, nextStage string) error {
 	if nextStage == constants.StageCleanup {
 		_context.MessageLog.Info("Ingest complete for %s/%s",
 			ingestState.WorkItem.Bucket, ingestState.WorkItem.Name)
@@ -393,7 +425,7 @@ func MarkWorkItemSucceeded(ingestState *models.IngestState, _context *context.Co
 	} else {
 		ingestState.WorkItem.Status = constants.StatusPending
 	}
-	resp := _context.PharosClient.WorkItemSave(ingestState.WorkItem)
+	resp := _context.PharosClientFor(ctx).WorkItemSave(ingestState.WorkItem)
 	if resp.Error != nil {
 		_context.MessageLog.Error("Could not mark WorkItem ready for %s for %s/%s: %v",
 			nextStage, ingestState.WorkItem.Bucket, ingestState.WorkItem.Name, resp.Error)
@@ -406,7 +438,10 @@ func MarkWorkItemSucceeded(ingestState *models.IngestState, _context *context.Co
 // PushToQueue pushes the WorkItem in ingestState into the specified
 // NSQ topic.
 func PushToQueue(ingestState *models.IngestState, _context *context.Context, queueTopic string) {
-	err := _context.NSQClient.Enqueue(
+	ctx, cancel := _context.NetworkContext(nil)
+	defer cancel()
+	err := _context.NSQClient.EnqueueWithContext(
+		ctx,
 		queueTopic,
 		ingestState.WorkItem.Id)
 	if err != nil {
@@ -417,7 +452,7 @@ func PushToQueue(ingestState *models.IngestState, _context *context.Context, que
 		_context.MessageLog.Error(msg)
 		// Record work item state again, to capture the
 		// cannot-be-queued error.
-		RecordWorkItemState(ingestState, _context, ingestState.IngestManifest.FetchResult)
+		RecordWorkItemState(ctx, ingestState, _context, ingestState.IngestManifest.FetchResult)
 	}
 }
 
@@ -459,7 +494,7 @@ func DeleteFileFromStaging(pathToFile string, _context *context.Context) {
 		} else {
 			_context.MessageLog.Info("Deleted %s", pathToFile)
 		}
-		if _context.Config.UseVolumeService && strings.HasSuffix(pathToFile, ".tar") {
+		if _context.Config.UseVolumeService && constants.SerializedBagSuffix.MatchString(pathToFile) {
 			err = _context.VolumeClient.Release(pathToFile)
 			if err != nil {
 				_context.MessageLog.Warning(err.Error())
@@ -491,11 +526,11 @@ func SetupIngestState(message *nsq.Message, _context *context.Context) (*models.
 	//
 	// -----------------------------------
 
-	instIdentifier := util.OwnerOf(workItem.Bucket)
+	instIdentifier := _context.Institutions.OwnerOf(workItem.Bucket)
 
 	manifest.BagPath = filepath.Join(_context.Config.TarDirectory,
 		instIdentifier, workItem.Name)
-	manifest.DBPath = TAR_SUFFIX.ReplaceAllString(manifest.BagPath, ".valdb")
+	manifest.DBPath = constants.SerializedBagSuffix.ReplaceAllString(manifest.BagPath, ".valdb")
 
 	workItemState := models.NewWorkItemState(workItem.Id, workItem.Action, "")
 